@@ -0,0 +1,176 @@
+// bitmap.go
+package client
+
+import (
+	"image"
+
+	"github.com/tomatome/grdp/protocol/rfb"
+)
+
+/**
+ * BitmapFormat is the layout of the pixels of Bitmap.Data, the red,
+ * green and blue values of a pixel are (pixel >> shift) & max.
+ */
+type BitmapFormat struct {
+	// bytes per pixel, 1 to 4
+	Bpp       int  `json:"bpp"`
+	BigEndian bool `json:"bigEndian"`
+	// rows are bottom-up, as in uncompressed RDP bitmaps
+	BottomUp   bool   `json:"bottomUp"`
+	RedMax     uint32 `json:"redMax"`
+	GreenMax   uint32 `json:"greenMax"`
+	BlueMax    uint32 `json:"blueMax"`
+	RedShift   uint   `json:"redShift"`
+	GreenShift uint   `json:"greenShift"`
+	BlueShift  uint   `json:"blueShift"`
+}
+
+// bits per pixel of the RDP bitmaps of Bitmap.BitsPerPixel bytes per pixel
+var bitsPerPixel = map[int]int{1: 15, 2: 16, 3: 24, 4: 32}
+
+// rdpFormat returns the format of a RDP bitmap of bpp bits per pixel,
+// decompressed bitmaps are top-down with 16 bits pixels big endian
+func rdpFormat(bpp int, compressed bool) *BitmapFormat {
+	f := &BitmapFormat{Bpp: (bpp + 7) / 8, BigEndian: compressed && bpp <= 16, BottomUp: !compressed}
+	switch bpp {
+	case 15:
+		f.RedMax, f.GreenMax, f.BlueMax = 0x1f, 0x1f, 0x1f
+		f.RedShift, f.GreenShift = 10, 5
+	case 16:
+		f.RedMax, f.GreenMax, f.BlueMax = 0x1f, 0x3f, 0x1f
+		f.RedShift, f.GreenShift = 11, 5
+	default:
+		f.RedMax, f.GreenMax, f.BlueMax = 0xff, 0xff, 0xff
+		f.RedShift, f.GreenShift = 16, 8
+	}
+	return f
+}
+
+// rfbFormat returns the format of the true color pixels of a RFB server
+func rfbFormat(pf *rfb.PixelFormat) *BitmapFormat {
+	return &BitmapFormat{
+		Bpp:        int(pf.BitsPerPixel) / 8,
+		BigEndian:  pf.BigEndianFlag != 0,
+		RedMax:     uint32(pf.RedMax),
+		GreenMax:   uint32(pf.GreenMax),
+		BlueMax:    uint32(pf.BlueMax),
+		RedShift:   uint(pf.RedShift),
+		GreenShift: uint(pf.GreenShift),
+		BlueShift:  uint(pf.BlueShift),
+	}
+}
+
+// RGBA converts b to dst at off, the top left of b. A nil dst is a new
+// image of the size of b at off. The pixels out of dst are dropped and
+// a nil Format is the layout of uncompressed RDP bitmaps.
+func (b *Bitmap) RGBA(dst *image.RGBA, off image.Point) *image.RGBA {
+	if dst == nil {
+		dst = image.NewRGBA(image.Rect(0, 0, b.Width, b.Height).Add(off))
+	}
+	b.convert(dst.Pix, dst.Stride, dst.Rect, off)
+	return dst
+}
+
+// NRGBA is RGBA for image.NRGBA, the pixels of b are opaque
+// and the same in both
+func (b *Bitmap) NRGBA(dst *image.NRGBA, off image.Point) *image.NRGBA {
+	if dst == nil {
+		dst = image.NewNRGBA(image.Rect(0, 0, b.Width, b.Height).Add(off))
+	}
+	b.convert(dst.Pix, dst.Stride, dst.Rect, off)
+	return dst
+}
+
+// convert writes the R G B A pixels of b to the image of pix, stride and
+// bounds r, the rows missing from Data are left as they are
+func (b *Bitmap) convert(pix []byte, stride int, r image.Rectangle, off image.Point) {
+	f := b.Format
+	if f == nil {
+		f = rdpFormat(bitsPerPixel[b.BitsPerPixel], false)
+	}
+	if f.Bpp < 1 || f.Bpp > 4 || b.Width <= 0 || b.Height <= 0 {
+		return
+	}
+	// rows may be padded
+	srcStride := b.Width * f.Bpp
+	if n := len(b.Data) / b.Height; n > srcStride {
+		srcStride = n
+	}
+
+	clip := image.Rect(0, 0, b.Width, b.Height).Add(off).Intersect(r)
+	if clip.Empty() {
+		return
+	}
+	x0, x1 := clip.Min.X-off.X, clip.Max.X-off.X
+	red := newChannel(f.RedShift, f.RedMax)
+	green := newChannel(f.GreenShift, f.GreenMax)
+	blue := newChannel(f.BlueShift, f.BlueMax)
+	// B G R X, the pixels of most sessions
+	bgrx := f.Bpp == 4 && !f.BigEndian && f.RedShift == 16 && f.GreenShift == 8 && f.BlueShift == 0 &&
+		f.RedMax == 0xff && f.GreenMax == 0xff && f.BlueMax == 0xff
+	for y := clip.Min.Y; y < clip.Max.Y; y++ {
+		sy := y - off.Y
+		if f.BottomUp {
+			sy = b.Height - 1 - sy
+		}
+		if sy*srcStride+x1*f.Bpp > len(b.Data) {
+			continue
+		}
+		src := b.Data[sy*srcStride:]
+		i := (y-r.Min.Y)*stride + (clip.Min.X-r.Min.X)*4
+		row := pix[i : i+(x1-x0)*4]
+
+		if bgrx {
+			for x := x0; x < x1; x++ {
+				s, d := src[x*4:x*4+3:x*4+3], row[(x-x0)*4:(x-x0)*4+4:(x-x0)*4+4]
+				d[0], d[1], d[2], d[3] = s[2], s[1], s[0], 0xff
+			}
+			continue
+		}
+		for x := x0; x < x1; x++ {
+			v := pixel(src[x*f.Bpp:], f.Bpp, f.BigEndian)
+			d := row[(x-x0)*4 : (x-x0)*4+4 : (x-x0)*4+4]
+			d[0], d[1], d[2], d[3] = red.value(v), green.value(v), blue.value(v), 0xff
+		}
+	}
+}
+
+// pixel reads a pixel of Bpp bytes
+func pixel(p []byte, Bpp int, bigEndian bool) uint32 {
+	var v uint32
+	for i := 0; i < Bpp; i++ {
+		if bigEndian {
+			v = v<<8 | uint32(p[i])
+		} else {
+			v |= uint32(p[i]) << uint(8*i)
+		}
+	}
+	return v
+}
+
+// channel extracts a color channel from pixels and scales it to 8 bits
+type channel struct {
+	shift uint
+	max   uint32
+	// the 8 bits values of channels up to 8 bits
+	lut [256]uint8
+}
+
+func newChannel(shift uint, max uint32) *channel {
+	if max == 0 {
+		max = 0xff
+	}
+	c := &channel{shift: shift, max: max}
+	for i := uint32(0); i <= max && i < 256; i++ {
+		c.lut[i] = uint8((i*255 + max/2) / max)
+	}
+	return c
+}
+
+func (c *channel) value(v uint32) uint8 {
+	v = v >> c.shift & c.max
+	if c.max > 0xff {
+		return uint8(uint64(v) * 255 / uint64(c.max))
+	}
+	return c.lut[v]
+}
@@ -0,0 +1,74 @@
+// bitmap_test.go
+package client
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/tomatome/grdp/protocol/pdu"
+	"github.com/tomatome/grdp/protocol/rfb"
+)
+
+func TestBitmapRGBA(t *testing.T) {
+	red, blue := color.RGBA{0xff, 0, 0, 0xff}, color.RGBA{0, 0, 0xff, 0xff}
+	for _, c := range []struct {
+		name   string
+		bpp    int
+		format *BitmapFormat
+		// red then blue on the top row
+		data []byte
+	}{
+		// bottom-up, the top row last
+		{"uncompressed 15", 1, rdpFormat(15, false), []byte{0, 0, 0, 0, 0x00, 0x7c, 0x1f, 0x00}},
+		{"uncompressed 16", 2, rdpFormat(16, false), []byte{0, 0, 0, 0, 0x00, 0xf8, 0x1f, 0x00}},
+		// a color image of the black row then red and blue
+		{"compressed 15", 1, rdpFormat(15, true), bitmapDecompress(&pdu.BitmapData{Width: 2, Height: 2, BitsPerPixel: 15,
+			BitmapDataStream: []byte{0x84, 0, 0, 0, 0, 0x00, 0x7c, 0x1f, 0x00}})},
+		{"compressed 16", 2, rdpFormat(16, true), []byte{0xf8, 0x00, 0x00, 0x1f, 0, 0, 0, 0}},
+		{"compressed 24", 3, rdpFormat(24, true), []byte{0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"uncompressed 32", 4, rdpFormat(32, false), []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0, 0xff, 0, 0, 0}},
+		{"nil format", 4, nil, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0, 0xff, 0, 0, 0}},
+		{"rfb", 4, rfbFormat(&rfb.PixelFormat{BitsPerPixel: 32, BigEndianFlag: 1,
+			RedMax: 0xff, GreenMax: 0xff, BlueMax: 0xff, RedShift: 0, GreenShift: 8, BlueShift: 16}),
+			[]byte{0, 0, 0, 0xff, 0, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+	} {
+		b := &Bitmap{Width: 2, Height: 2, BitsPerPixel: c.bpp, Data: c.data, Format: c.format}
+		img := b.RGBA(nil, image.Pt(10, 20))
+		if img.Bounds() != image.Rect(10, 20, 12, 22) {
+			t.Fatalf("%s: bounds %v", c.name, img.Bounds())
+		}
+		if img.RGBAAt(10, 20) != red || img.RGBAAt(11, 20) != blue || img.RGBAAt(10, 21) != (color.RGBA{0, 0, 0, 0xff}) {
+			t.Errorf("%s: %v %v %v", c.name, img.RGBAAt(10, 20), img.RGBAAt(11, 20), img.RGBAAt(10, 21))
+		}
+		if n := b.NRGBA(nil, image.Point{}); n.NRGBAAt(1, 0) != (color.NRGBA{0, 0, 0xff, 0xff}) {
+			t.Errorf("%s: nrgba %v", c.name, n.NRGBAAt(1, 0))
+		}
+	}
+}
+
+func TestBitmapBlit(t *testing.T) {
+	// rows of 1 pixel padded to 4 bytes, white over black
+	b := &Bitmap{Width: 1, Height: 2, BitsPerPixel: 2, Format: rdpFormat(16, false),
+		Data: []byte{0, 0, 0, 0, 0xff, 0xff, 0, 0}}
+	dst := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	// half out of dst
+	if b.RGBA(dst, image.Pt(3, 3)) != dst {
+		t.Fatal("new image")
+	}
+	if dst.RGBAAt(3, 3) != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("blit %v", dst.RGBAAt(3, 3))
+	}
+	for i, v := range dst.Pix[:len(dst.Pix)-4] {
+		if v != 0 {
+			t.Fatalf("pixel %d written", i/4)
+		}
+	}
+
+	// short data leaves the rows it misses
+	b.Data = b.Data[:3]
+	dst = b.RGBA(nil, image.Point{})
+	if dst.RGBAAt(0, 0) != (color.RGBA{}) || dst.RGBAAt(0, 1) != (color.RGBA{0, 0, 0, 0xff}) {
+		t.Errorf("short %v %v", dst.RGBAAt(0, 0), dst.RGBAAt(0, 1))
+	}
+}
@@ -2,12 +2,20 @@
 package client
 
 import (
+	"context"
+	"image"
+	"image/color"
 	"log"
 	"os"
 
+	"github.com/tomatome/grdp/core"
 	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/gdi"
+	"github.com/tomatome/grdp/protocol/nla/kerberos"
 	"github.com/tomatome/grdp/protocol/pdu"
 	"github.com/tomatome/grdp/protocol/rfb"
+	"github.com/tomatome/grdp/protocol/t125/gcc"
+	"github.com/tomatome/grdp/protocol/x224"
 )
 
 const (
@@ -21,8 +29,12 @@ const (
 	TC_VNC = 1
 )
 
+// Setting.Compression without bulk compression
+const COMPRESSION_OFF = -1
+
 type Control interface {
 	Login(host, user, passwd string, width, height int) error
+	LoginContext(ctx context.Context, host, user, passwd string, width, height int) error
 	KeyUp(sc int, name string)
 	KeyDown(sc int, name string)
 	MouseMove(x, y int)
@@ -75,6 +87,20 @@ func (c *Client) Login() error {
 	return c.ctl.Login(c.host, c.user, c.passwd, c.setting.Width, c.setting.Height)
 }
 
+// LoginContext blocks until the session is ready to use. Errors are
+// *LoginError values telling which stage of the connection failed.
+func (c *Client) LoginContext(ctx context.Context) error {
+	return c.ctl.LoginContext(ctx, c.host, c.user, c.passwd, c.setting.Width, c.setting.Height)
+}
+
+// SelectedProtocol returns the x224.PROTOCOL_* used by an RDP session
+func (c *Client) SelectedProtocol() uint32 {
+	if r, ok := c.ctl.(*RdpClient); ok {
+		return r.SelectedProtocol()
+	}
+	return x224.PROTOCOL_RDP
+}
+
 func (c *Client) KeyUp(sc int, name string) {
 	c.ctl.KeyUp(sc, name)
 }
@@ -113,7 +139,7 @@ func (c *Client) OnBitmap(f func([]Bitmap)) {
 			for _, v := range br.Rects {
 				b := Bitmap{int(v.Rect.X), int(v.Rect.Y), int(v.Rect.X + v.Rect.Width), int(v.Rect.Y + v.Rect.Height),
 					int(v.Rect.Width), int(v.Rect.Height),
-					Bpp(uint16(br.Pf.BitsPerPixel)), false, v.Data}
+					Bpp(uint16(br.Pf.BitsPerPixel)), false, v.Data, rfbFormat(br.Pf)}
 				bs = append(bs, b)
 			}
 		} else {
@@ -124,9 +150,17 @@ func (c *Client) OnBitmap(f func([]Bitmap)) {
 					stream = bitmapDecompress(&v)
 					IsCompress = false
 				}
+				bpp := Bpp(v.BitsPerPixel)
+				format := rdpFormat(int(v.BitsPerPixel), v.IsCompress())
+				if r, ok := c.ctl.(*RdpClient); ok && v.BitsPerPixel == 8 {
+					// Bpp(8) is 1 like Bpp(15), which consumers take for 15 bpp
+					stream = r.expandPalette(stream)
+					bpp = 4
+					format = rdpFormat(32, v.IsCompress())
+				}
 
 				b := Bitmap{int(v.DestLeft), int(v.DestTop), int(v.DestRight), int(v.DestBottom),
-					int(v.Width), int(v.Height), Bpp(v.BitsPerPixel), IsCompress, stream}
+					int(v.Width), int(v.Height), bpp, IsCompress, stream, format}
 				bs = append(bs, b)
 			}
 		}
@@ -136,6 +170,71 @@ func (c *Client) OnBitmap(f func([]Bitmap)) {
 	c.ctl.On("bitmap", f1)
 }
 
+// OnDamage is called with the framebuffer of a RDP session
+// and the rectangles changed by each update
+func (c *Client) OnDamage(f func(*image.RGBA, []image.Rectangle)) {
+	r, ok := c.ctl.(*RdpClient)
+	if !ok {
+		return
+	}
+	r.On("damage", func(rects []image.Rectangle) {
+		f(r.gdi.Image(), rects)
+	})
+}
+
+// OnFrame is called with the begin and end markers
+// of the frames of surface commands of a RDP session
+func (c *Client) OnFrame(f func(*pdu.FrameMarker)) {
+	if _, ok := c.ctl.(*RdpClient); ok {
+		c.ctl.On("frame", f)
+	}
+}
+
+// OnPalette is called with the colors of a 8 bpp RDP session when the server
+// changes them, surfaces drawn with the former colors may need drawing again
+func (c *Client) OnPalette(f func(color.Palette)) {
+	if _, ok := c.ctl.(*RdpClient); ok {
+		c.ctl.On("palette", f)
+	}
+}
+
+// OnPointer is called with the pointer to show over the desktop of a RDP session
+func (c *Client) OnPointer(f func(*gdi.Pointer)) {
+	if _, ok := c.ctl.(*RdpClient); ok {
+		c.ctl.On("pointer", f)
+	}
+}
+
+// OnPointerPosition is called when the server of a RDP session moves the pointer
+func (c *Client) OnPointerPosition(f func(x, y int)) {
+	if _, ok := c.ctl.(*RdpClient); ok {
+		c.ctl.On("pointer-position", f)
+	}
+}
+
+// OnPointerHidden is called when the server of a RDP session hides the pointer
+func (c *Client) OnPointerHidden(f func()) {
+	if _, ok := c.ctl.(*RdpClient); ok {
+		c.ctl.On("pointer-hidden", f)
+	}
+}
+
+// RegisterCodec draws the surface bits of codec id of a RDP session with codec
+func (c *Client) RegisterCodec(id uint8, codec gdi.SurfaceCodec) {
+	if r, ok := c.ctl.(*RdpClient); ok {
+		r.gdi.RegisterCodec(id, codec)
+	}
+}
+
+// BitmapCacheStats returns the bitmap cache lookups of a RDP session
+func (c *Client) BitmapCacheStats() gdi.CacheStats {
+	r, ok := c.ctl.(*RdpClient)
+	if !ok || r.gdi.BitmapCache() == nil {
+		return gdi.CacheStats{}
+	}
+	return r.gdi.BitmapCache().Stats()
+}
+
 type Bitmap struct {
 	DestLeft     int    `json:"destLeft"`
 	DestTop      int    `json:"destTop"`
@@ -146,6 +245,8 @@ type Bitmap struct {
 	BitsPerPixel int    `json:"bitsPerPixel"`
 	IsCompress   bool   `json:"isCompress"`
 	Data         []byte `json:"data"`
+	// layout of Data, RGBA and NRGBA convert it to an image
+	Format *BitmapFormat `json:"format"`
 }
 
 func Bpp(bp uint16) int {
@@ -157,18 +258,112 @@ type Setting struct {
 	Height   int
 	Protocol string
 	LogLevel glog.LEVEL
+
+	// security protocols offered to the server, x224.PROTOCOL_*
+	RequestedProtocol uint32
+	// protocol sets tried in order by LoginContext when the server answers
+	// with a negotiation failure, only those matching the failure code are used
+	Fallback []uint32
+	// 8, 15, 16, 24 or 32
+	ColorDepth      int
+	KeyboardLayout  uint32
+	KeyboardType    uint32
+	KeyboardSubType uint32
+	KeyboardFnKeys  uint32
+	// empty means the local host name
+	ClientName       string
+	ClientBuild      uint32
+	PerformanceFlags uint32
+	AlternateShell   string
+	WorkingDir       string
+	AutoLogon        bool
+	Clipboard        int
+	// highest bulk compression offered to the server, core.PACKET_COMPR_TYPE_*
+	// or COMPRESSION_OFF
+	Compression int
+	// static virtual channels opened on connect, plugin.*_SVC_CHANNEL_NAME
+	Channels []string
+	// checks the server TLS certificate, nil accepts any certificate.
+	// Refusals are reported as *core.CertificateError
+	CertVerifier core.CertVerifier
+	// authenticate NLA with Kerberos instead of NTLM, empty fields are
+	// taken from the login: realm from the domain, SPN TERMSRV/host
+	Kerberos *kerberos.Config
+	// Restricted Admin mode: NLA only, the credentials are not
+	// delegated to the server
+	RestrictedAdmin bool
+	// NT hash used by NTLM instead of the password, in Restricted Admin
+	// mode only as there is no password to delegate
+	NTHash []byte
+	// user name of the mstshash cookie, "test" when empty
+	Cookie string
+	// routing token of the first connection request, the load balance
+	// info of a connection broker
+	LoadBalanceInfo []byte
+	// sent before the connection request when not nil, the VM id of
+	// a Hyper-V console goes in Blob
+	Preconnection *x224.PreconnectionPDU
+	// file of the persistent bitmap cache, empty disables it
+	BitmapCacheFile string
+	// size limit of BitmapCacheFile, gdi.DEFAULT_PERSISTENT_CACHE_SIZE when 0
+	BitmapCacheFileSize int64
 }
 
 func NewSetting() *Setting {
 	return &Setting{
-		Width:    1024,
-		Height:   768,
-		LogLevel: glog.INFO,
+		Width:             1024,
+		Height:            768,
+		LogLevel:          glog.INFO,
+		RequestedProtocol: x224.PROTOCOL_RDP | x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID | x224.PROTOCOL_HYBRID_EX,
+		Fallback:          []uint32{x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL, x224.PROTOCOL_RDP},
+		ColorDepth:        24,
+		KeyboardLayout:    gcc.US,
+		KeyboardType:      gcc.KT_IBM_101_102_KEYS,
+		KeyboardFnKeys:    12,
+		ClientBuild:       3790,
+		AutoLogon:         true,
+		Clipboard:         CLIP_OFF,
+		Compression:       core.PACKET_COMPR_TYPE_64K,
 	}
 }
 func (s *Setting) SetLogLevel() {
 	glog.SetLevel(s.LogLevel)
 }
 
-func (s *Setting) SetRequestedProtocol(p uint32) {}
-func (s *Setting) SetClipboard(c int)            {}
+func (s *Setting) SetRequestedProtocol(p uint32) {
+	s.RequestedProtocol = p
+}
+func (s *Setting) SetFallback(p ...uint32) {
+	s.Fallback = p
+}
+func (s *Setting) SetCertVerifier(v core.CertVerifier) {
+	s.CertVerifier = v
+}
+func (s *Setting) SetKerberos(cfg *kerberos.Config) {
+	s.Kerberos = cfg
+}
+func (s *Setting) SetRestrictedAdmin(b bool) {
+	s.RestrictedAdmin = b
+}
+func (s *Setting) SetNTHash(h []byte) {
+	s.NTHash = h
+}
+func (s *Setting) SetCookie(user string) {
+	s.Cookie = user
+}
+func (s *Setting) SetLoadBalanceInfo(info []byte) {
+	s.LoadBalanceInfo = info
+}
+func (s *Setting) SetPreconnection(id uint32, blob string) {
+	s.Preconnection = &x224.PreconnectionPDU{Id: id, Blob: blob}
+}
+func (s *Setting) SetBitmapCacheFile(path string, size int64) {
+	s.BitmapCacheFile = path
+	s.BitmapCacheFileSize = size
+}
+func (s *Setting) SetClipboard(c int) {
+	s.Clipboard = c
+}
+func (s *Setting) SetCompression(t int) {
+	s.Compression = t
+}
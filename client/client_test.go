@@ -2,9 +2,23 @@
 package client
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"testing"
 	"time"
+
+	"github.com/tomatome/grdp/protocol/nla"
+	"github.com/tomatome/grdp/protocol/tpkt"
 )
 
 func TestClient(t *testing.T) {
@@ -18,3 +32,181 @@ func TestClient(t *testing.T) {
 	})
 	time.Sleep(100 * time.Second)
 }
+
+func TestLoginContextTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			// never answer the connection request
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	c := NewClient(ln.Addr().String(), "administrator", "Jhadmin123", TC_RDP, nil)
+	err = c.LoginContext(ctx)
+
+	var le *LoginError
+	if !errors.As(err, &le) {
+		t.Fatal("expected LoginError, got", err)
+	}
+	if le.Stage != STAGE_X224 || !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("unexpected error", err)
+	}
+}
+
+func TestLoginContextRestrictedAdmin(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	neg := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		hdr := make([]byte, 4)
+		if _, err = io.ReadFull(conn, hdr); err != nil {
+			return
+		}
+		req := make([]byte, int(hdr[2])<<8|int(hdr[3])-4)
+		if _, err = io.ReadFull(conn, req); err != nil {
+			return
+		}
+		// RDP_NEG_REQ ends the connection request
+		neg <- req[len(req)-8:]
+		io.Copy(io.Discard, conn)
+	}()
+
+	s := NewSetting()
+	s.SetRestrictedAdmin(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	c := NewClient(ln.Addr().String(), "administrator", "Jhadmin123", TC_RDP, s)
+	c.LoginContext(ctx)
+
+	b := <-neg
+	if b[0] != 0x01 || b[1] != 0x01 || b[4] != 0x0a {
+		t.Errorf("unexpected RDP_NEG_REQ % x", b)
+	}
+
+	s = NewSetting()
+	s.SetRestrictedAdmin(true)
+	s.RequestedProtocol = 0x01
+	err = NewClient(ln.Addr().String(), "administrator", "Jhadmin123", TC_RDP, s).LoginContext(context.Background())
+	if !errors.Is(err, errRestrictedAdmin) {
+		t.Error("expected restricted admin error, got", err)
+	}
+
+	s = NewSetting()
+	s.SetNTHash(make([]byte, 16))
+	err = NewClient(ln.Addr().String(), "administrator", "", TC_RDP, s).LoginContext(context.Background())
+	if !errors.Is(err, errNTHash) {
+		t.Error("expected NT hash error, got", err)
+	}
+}
+
+// nlaServer accepts a connection on ln, selects PROTOCOL_HYBRID_EX and
+// authenticates the NTLM user with CredSSP version 2, then sends result
+// in the Early User Authorization Result PDU
+func nlaServer(t *testing.T, ln net.Listener, user, pwd string, result uint32) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	hdr := make([]byte, 4)
+	if _, err = io.ReadFull(conn, hdr); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(conn, make([]byte, int(hdr[2])<<8|int(hdr[3])-4)); err != nil {
+		return
+	}
+	// connection confirm with RDP_NEG_RSP
+	conn.Write([]byte{3, 0, 0, 19, 14, 0xd0, 0, 0, 0, 0, 0, 2, 0, 8, 0, 8, 0, 0, 0})
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+	cert, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	tc := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}}})
+	read := func() *nla.TSRequest {
+		b := make([]byte, 4096)
+		n, err := tc.Read(b)
+		if err != nil {
+			return nil
+		}
+		req, err := nla.DecodeDERTRequest(b[:n])
+		if err != nil {
+			t.Error("server:", err)
+			return nil
+		}
+		return req
+	}
+
+	if read() == nil {
+		return
+	}
+	challenge := nla.NewChallengeMessage()
+	challenge.NegotiateFlags = nla.NTLMSSP_NEGOTIATE_UNICODE
+	copy(challenge.ServerChallenge[:], "01234567")
+	tc.Write(nla.EncodeDERTRequestV(2, challenge.Serialize(), nil, nil, nil))
+
+	req := read()
+	if req == nil || len(req.NegoTokens) == 0 {
+		return
+	}
+	// the exported session key, from the NTProofStr and the encrypted one
+	auth := req.NegoTokens[0].Data
+	field := func(i int) []byte {
+		n, off := binary.LittleEndian.Uint16(auth[i:]), binary.LittleEndian.Uint32(auth[i+4:])
+		return auth[off : off+uint32(n)]
+	}
+	baseKey := nla.HMAC_MD5(nla.NTOWFv2(pwd, user, ""), field(20)[:16])
+	sessionKey := nla.RC4K(baseKey, field(52))
+	decrypt, _ := rc4.NewCipher(nla.SEALKEY(sessionKey, true))
+	encrypt, _ := rc4.NewCipher(nla.SEALKEY(sessionKey, false))
+	client := &nla.NTLMv2Security{DecryptRC4: decrypt, VerifyKey: nla.SIGNKEY(sessionKey, true)}
+	server := &nla.NTLMv2Security{EncryptRC4: encrypt, SigningKey: nla.SIGNKEY(sessionKey, false)}
+
+	pubKey := client.GssDecrypt(req.PubKeyAuth)
+	if pubKey == nil {
+		t.Error("server: bad pubKeyAuth")
+		return
+	}
+	pubKey[0]++
+	tc.Write(nla.EncodeDERTRequestV(2, nil, nil, server.GssEncrypt(pubKey), nil))
+	if read() == nil {
+		return
+	}
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, result)
+	tc.Write(b)
+	io.Copy(io.Discard, tc)
+}
+
+func TestLoginContextAccessDenied(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go nlaServer(t, ln, "administrator", "Jhadmin123", tpkt.AUTHZ_ACCESS_DENIED)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = NewClient(ln.Addr().String(), "administrator", "Jhadmin123", TC_RDP, nil).LoginContext(ctx)
+	var le *LoginError
+	if !errors.As(err, &le) || le.Stage != STAGE_NLA || !errors.Is(err, tpkt.ErrAccessDenied) {
+		t.Error("expected access denied, got", err)
+	}
+}
@@ -0,0 +1,151 @@
+// login.go
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tomatome/grdp/protocol/sec"
+)
+
+/**
+ * Stage of the connection sequence reached when a login failed
+ */
+type LoginStage int
+
+const (
+	STAGE_DIAL LoginStage = iota
+	STAGE_X224
+	STAGE_TLS
+	STAGE_NLA
+	STAGE_MCS
+	STAGE_LICENSING
+	STAGE_CAPABILITIES
+	STAGE_RFB
+)
+
+func (s LoginStage) String() string {
+	switch s {
+	case STAGE_DIAL:
+		return "dial"
+	case STAGE_X224:
+		return "x224 negotiation"
+	case STAGE_TLS:
+		return "tls"
+	case STAGE_NLA:
+		return "credssp"
+	case STAGE_MCS:
+		return "mcs attach/join"
+	case STAGE_LICENSING:
+		return "licensing"
+	case STAGE_CAPABILITIES:
+		return "capability exchange"
+	case STAGE_RFB:
+		return "rfb handshake"
+	}
+
+	return "unknown"
+}
+
+// LoginError is returned by LoginContext, Stage tells which
+// part of the connection sequence broke and Err why
+type LoginError struct {
+	Stage LoginStage
+	Err   error
+}
+
+func (e *LoginError) Error() string {
+	return fmt.Sprintf("[%s err] %v", e.Stage, e.Err)
+}
+
+func (e *LoginError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	errClosed           = errors.New("connection closed")
+	errRestrictedAdmin  = errors.New("restricted admin mode requires NLA")
+	errNTHash           = errors.New("NT hash authentication requires restricted admin mode")
+	errTooManyRedirects = errors.New("too many server redirections")
+)
+
+// at most this many Server Redirection PDUs are followed by LoginContext
+const maxRedirects = 5
+
+// redirectError ends a login attempt when the server redirects the client
+type redirectError struct {
+	*sec.ServerRedirection
+}
+
+func (e *redirectError) Error() string {
+	return fmt.Sprintf("server redirection to %q", e.Target())
+}
+
+// loginWatcher follows the progress events of the protocol layers and
+// collects the first outcome of a login attempt
+type loginWatcher struct {
+	sync.Mutex
+	stage LoginStage
+	done  chan error
+}
+
+func newLoginWatcher(stage LoginStage) *loginWatcher {
+	return &loginWatcher{
+		stage: stage,
+		done:  make(chan error, 1),
+	}
+}
+
+func (w *loginWatcher) setStage(stage LoginStage) {
+	w.Lock()
+	defer w.Unlock()
+	w.stage = stage
+}
+
+func (w *loginWatcher) Stage() LoginStage {
+	w.Lock()
+	defer w.Unlock()
+	return w.stage
+}
+
+func (w *loginWatcher) fail(err error) {
+	if err == nil {
+		err = errClosed
+	}
+	select {
+	case w.done <- &LoginError{w.Stage(), err}:
+	default:
+	}
+}
+
+func (w *loginWatcher) redirect(rd *sec.ServerRedirection) {
+	select {
+	case w.done <- &redirectError{rd}:
+	default:
+	}
+}
+
+func (w *loginWatcher) ready() {
+	select {
+	case w.done <- nil:
+	default:
+	}
+}
+
+// wait blocks until the session is usable, an error is reported or ctx
+// is done. On failure abort is called to tear down the connection.
+func (w *loginWatcher) wait(ctx context.Context, abort func()) error {
+	select {
+	case err := <-w.done:
+		if err != nil {
+			abort()
+		}
+		return err
+	case <-ctx.Done():
+		stage := w.Stage()
+		abort()
+		return &LoginError{stage, ctx.Err()}
+	}
+}
@@ -1,37 +1,76 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
 	"time"
 
 	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
 	"github.com/tomatome/grdp/plugin"
+	"github.com/tomatome/grdp/plugin/cliprdr"
+	"github.com/tomatome/grdp/plugin/drdynvc"
+	"github.com/tomatome/grdp/plugin/rail"
+	"github.com/tomatome/grdp/protocol/gdi"
 	"github.com/tomatome/grdp/protocol/nla"
+	"github.com/tomatome/grdp/protocol/nla/kerberos"
 	"github.com/tomatome/grdp/protocol/pdu"
 	"github.com/tomatome/grdp/protocol/sec"
 	"github.com/tomatome/grdp/protocol/t125"
+	"github.com/tomatome/grdp/protocol/t125/gcc"
 	"github.com/tomatome/grdp/protocol/tpkt"
 	"github.com/tomatome/grdp/protocol/x224"
 )
 
 type RdpClient struct {
+	setting  *Setting
 	tpkt     *tpkt.TPKT
 	x224     *x224.X224
 	mcs      *t125.MCSClient
 	sec      *sec.Client
 	pdu      *pdu.Client
 	channels *plugin.Channels
+	// desktop drawn from the updates, kept across connections
+	gdi *gdi.GDI
+	// bitmaps kept across sessions, nil without Setting.BitmapCacheFile
+	persist *gdi.PersistentCache
+	// redirection followed by the current connection
+	redirection *sec.ServerRedirection
 }
 
 func newRdpClient(s *Setting) *RdpClient {
-	return &RdpClient{}
+	if s == nil {
+		s = NewSetting()
+	}
+	return &RdpClient{setting: s, gdi: gdi.New(s.Width, s.Height, s.ColorDepth)}
 }
 
+// bitmapDecompress decodes a compressed bitmap to pixels of (bpp+7)/8 bytes,
+// the rows past malformed data are black
 func bitmapDecompress(bitmap *pdu.BitmapData) []byte {
-	return core.Decompress(bitmap.BitmapDataStream, int(bitmap.Width), int(bitmap.Height), Bpp(bitmap.BitsPerPixel))
+	w, h, bpp := int(bitmap.Width), int(bitmap.Height), int(bitmap.BitsPerPixel)
+	out := make([]byte, w*h*((bpp+7)/8))
+	if err := (&core.RLEDecoder{}).Decode(&core.Target{Pix: out}, bitmap.BitmapDataStream, w, h, bpp); err != nil {
+		glog.Warn("bitmap", w, h, bpp, err)
+	}
+	return out
+}
+
+// expandPalette converts the color indices of a 8 bpp bitmap
+// to 32 bpp pixels through the palette of the session
+func (c *RdpClient) expandPalette(data []byte) []byte {
+	pal := c.gdi.Palette()
+	out := make([]byte, 4*len(data))
+	for i, v := range data {
+		rgb := pal[v]
+		out[4*i], out[4*i+1], out[4*i+2], out[4*i+3] = uint8(rgb), uint8(rgb>>8), uint8(rgb>>16), 0xff
+	}
+	return out
 }
+
 func split(user string) (domain string, uname string) {
 	if strings.Index(user, "\\") != -1 {
 		t := strings.Split(user, "\\")
@@ -52,8 +91,148 @@ func (c *RdpClient) Login(host, user, pwd string, width, height int) error {
 		return fmt.Errorf("[dial err] %v", err)
 	}
 
+	c.setup(context.Background(), conn, host, user, pwd, width, height)
+
+	err = c.x224.Connect()
+	if err != nil {
+		return fmt.Errorf("[x224 connect err] %v", err)
+	}
+	return nil
+}
+
+// LoginContext connects like Login but only returns once the server has
+// finalized the connection ("ready"), or with a *LoginError naming the
+// failed stage. If ctx is done first the connection is closed.
+// When the server refuses the requested security protocols the login is
+// retried on a fresh connection following Setting.Fallback, and a Server
+// Redirection PDU reconnects to the target it names.
+func (c *RdpClient) LoginContext(ctx context.Context, host, user, pwd string, width, height int) error {
+	c.redirection = nil
+	for i := 0; ; i++ {
+		err := c.loginFallback(ctx, host, user, pwd, width, height)
+		rd := &redirectError{}
+		if !errors.As(err, &rd) {
+			return err
+		}
+		if i == maxRedirects {
+			return &LoginError{STAGE_CAPABILITIES, errTooManyRedirects}
+		}
+		host, user = redirectTarget(host, user, rd.ServerRedirection)
+		glog.Infof("server redirection to %s", host)
+		c.redirection = rd.ServerRedirection
+	}
+}
+
+// redirectTarget returns the address and login to use after rd
+func redirectTarget(host, user string, rd *sec.ServerRedirection) (string, string) {
+	if t := rd.Target(); t != "" {
+		_, port, err := net.SplitHostPort(host)
+		if err != nil {
+			port = "3389"
+		}
+		host = net.JoinHostPort(t, port)
+	}
+	if rd.RedirFlags&sec.LB_USERNAME != 0 {
+		domain, _ := split(user)
+		if rd.RedirFlags&sec.LB_DOMAIN != 0 {
+			domain = rd.Domain
+		}
+		user = rd.UserName
+		if domain != "" {
+			user = domain + "\\" + rd.UserName
+		}
+	}
+	return host, user
+}
+
+func (c *RdpClient) loginFallback(ctx context.Context, host, user, pwd string, width, height int) error {
+	protocol := c.setting.RequestedProtocol
+	if c.setting.NTHash != nil && !c.setting.RestrictedAdmin {
+		// the TSCredentials would carry an empty password
+		return &LoginError{STAGE_X224, errNTHash}
+	}
+	if c.setting.RestrictedAdmin {
+		// without NLA the password would be sent in the info packet
+		protocol &= x224.PROTOCOL_HYBRID | x224.PROTOCOL_HYBRID_EX
+		if protocol == 0 {
+			return &LoginError{STAGE_X224, errRestrictedAdmin}
+		}
+	}
+	tried := []uint32{}
+	for {
+		err := c.login(ctx, host, user, pwd, width, height, protocol)
+		neg := &x224.NegotiationError{}
+		if !errors.As(err, &neg) {
+			return err
+		}
+		tried = append(tried, protocol)
+		next, ok := x224.NextProtocol(c.setting.Fallback, tried, neg.Code)
+		if !ok || c.setting.RestrictedAdmin && next&(x224.PROTOCOL_HYBRID|x224.PROTOCOL_HYBRID_EX) == 0 {
+			return err
+		}
+		glog.Infof("server refused protocol %d with code %d, retry with %d", protocol, neg.Code, next)
+		protocol = next
+	}
+}
+
+// SelectedProtocol returns the security protocol agreed with the server
+func (c *RdpClient) SelectedProtocol() uint32 {
+	if c.x224 == nil {
+		return x224.PROTOCOL_RDP
+	}
+	return c.x224.SelectedProtocol()
+}
+
+func (c *RdpClient) login(ctx context.Context, host, user, pwd string, width, height int, protocol uint32) error {
+	d := net.Dialer{Timeout: 3 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return &LoginError{STAGE_DIAL, err}
+	}
+
+	c.setup(ctx, conn, host, user, pwd, width, height)
+	c.x224.SetRequestedProtocol(protocol)
+
+	w := newLoginWatcher(STAGE_X224)
+	c.x224.On("negotiate", func(protocol uint32) {
+		if protocol == x224.PROTOCOL_RDP {
+			w.setStage(STAGE_MCS)
+		} else {
+			w.setStage(STAGE_TLS)
+		}
+	}).On("connect", func(protocol uint32) {
+		w.setStage(STAGE_MCS)
+	})
+	c.tpkt.On("tls", func() {
+		if w.Stage() == STAGE_TLS {
+			w.setStage(STAGE_NLA)
+		}
+	})
+	c.mcs.On("connect", func(clientData []interface{}, serverData []interface{}, userId uint16, channels []t125.MCSChannelInfo) {
+		w.setStage(STAGE_LICENSING)
+	})
+	c.sec.On("connect", func(*gcc.ClientCoreData, uint16, uint16) {
+		w.setStage(STAGE_CAPABILITIES)
+	})
+	c.pdu.On("error", w.fail).On("close", func() {
+		w.fail(nil)
+	}).On("redirect", w.redirect).Once("ready", w.ready)
+
+	err = c.x224.Connect()
+	if err != nil {
+		c.Close()
+		return &LoginError{STAGE_X224, err}
+	}
+	return w.wait(ctx, c.Close)
+}
+
+func (c *RdpClient) setup(ctx context.Context, conn net.Conn, host, user, pwd string, width, height int) {
 	domain, user := split(user)
-	c.tpkt = tpkt.New(core.NewSocketLayer(conn), nla.NewNTLMv2(domain, user, pwd))
+	socket := core.NewSocketLayer(conn)
+	if c.setting.CertVerifier != nil {
+		socket.SetVerifier(host, c.setting.CertVerifier)
+	}
+	c.tpkt = tpkt.New(socket, c.authenticator(ctx, host, domain, user, pwd))
 	c.x224 = x224.New(c.tpkt)
 	c.mcs = t125.NewMCSClient(c.x224)
 	c.sec = sec.NewClient(c.mcs)
@@ -63,7 +242,9 @@ func (c *RdpClient) Login(host, user, pwd string, width, height int) error {
 	c.mcs.SetClientDesktop(uint16(width), uint16(height))
 
 	c.sec.SetUser(user)
-	c.sec.SetPwd(pwd)
+	if !c.setting.RestrictedAdmin {
+		c.sec.SetPwd(pwd)
+	}
 	c.sec.SetDomain(domain)
 
 	c.tpkt.SetFastPathListener(c.sec)
@@ -71,16 +252,158 @@ func (c *RdpClient) Login(host, user, pwd string, width, height int) error {
 	c.sec.SetChannelSender(c.mcs)
 	c.channels.SetChannelSender(c.sec)
 
-	//c.x224.SetRequestedProtocol(x224.PROTOCOL_RDP)
-	//c.x224.SetRequestedProtocol(x224.PROTOCOL_SSL)
+	c.gdi.SetBitmapCache(gdi.NewBitmapCache(c.pdu.BitmapCacheCells()...))
+	c.gdi.SetGlyphCache(gdi.NewGlyphCache(c.pdu.GlyphCacheCells()...))
+	c.gdi.SetBrushCache(gdi.NewBrushCache(c.pdu.BrushSupport()), gdi.NewColorTableCache(c.pdu.ColorTableCacheSize()))
+	c.gdi.SetOffscreenCache(gdi.NewOffscreenCache(c.pdu.OffscreenCache()))
+	c.gdi.SetPointerCache(gdi.NewPointerCache(c.pdu.PointerCacheSize()))
+	c.setupPersistentCache()
+	c.pdu.On("ready", func() {
+		c.gdi.Resize(c.pdu.Desktop())
+	}).On("bitmap", c.gdi.Bitmap).On("orders", c.gdi.Orders).On("surfacebits", c.gdi.SurfaceBits)
+	c.pdu.On("pointerupdate", c.gdi.PointerUpdate).On("paletteupdate", c.gdi.PaletteUpdate)
 
-	err = c.x224.Connect()
-	if err != nil {
-		return fmt.Errorf("[x224 connect err] %v", err)
+	c.applySetting()
+}
+
+// setupPersistentCache preloads the bitmap cache from Setting.BitmapCacheFile,
+// the file is written back when the connection ends, which the transport
+// reports as a read error
+func (c *RdpClient) setupPersistentCache() {
+	s := c.setting
+	if s.BitmapCacheFile == "" {
+		return
 	}
-	return nil
+	if c.persist == nil {
+		p, err := gdi.OpenPersistentCache(s.BitmapCacheFile, s.BitmapCacheFileSize)
+		if err != nil {
+			glog.Warn("persistent bitmap cache:", err)
+			return
+		}
+		c.persist = p
+	}
+	c.pdu.SetPersistentKeys(c.gdi.LoadPersistentCache(c.persist, c.pdu.BitmapCacheCells()))
+	save := func() {
+		if err := c.persist.Save(); err != nil {
+			glog.Warn("save persistent bitmap cache:", err)
+		}
+	}
+	c.pdu.On("close", save).On("error", func(error) {
+		save()
+	})
 }
+
+// authenticator returns the NLA security package, Kerberos when configured,
+// whose exchanges with the KDC end with ctx
+func (c *RdpClient) authenticator(ctx context.Context, host, domain, user, pwd string) nla.Authenticator {
+	if c.setting.Kerberos == nil {
+		if c.setting.NTHash != nil {
+			return nla.NewNTLMv2Hash(domain, user, c.setting.NTHash)
+		}
+		return nla.NewNTLMv2(domain, user, pwd)
+	}
+	cfg := *c.setting.Kerberos
+	if cfg.Realm == "" {
+		cfg.Realm = strings.ToUpper(domain)
+	}
+	if cfg.User == "" {
+		cfg.User = user
+	}
+	if cfg.Password == "" && cfg.Keytab == "" && cfg.CCache == "" {
+		cfg.Password = pwd
+	}
+	if cfg.SPN == "" {
+		name, _, err := net.SplitHostPort(host)
+		if err != nil {
+			name = host
+		}
+		cfg.SPN = "TERMSRV/" + name
+	}
+	k := kerberos.NewContext(&cfg)
+	k.SetContext(ctx)
+	if domain != "" {
+		k.SetDomain(domain)
+	}
+	return k
+}
+
+func (c *RdpClient) applySetting() {
+	s := c.setting
+	c.x224.SetRequestedProtocol(s.RequestedProtocol)
+	c.x224.SetRestrictedAdmin(s.RestrictedAdmin)
+	c.tpkt.SetRestrictedAdmin(s.RestrictedAdmin)
+	c.x224.SetPreconnection(s.Preconnection)
+	if s.Cookie != "" {
+		c.x224.SetCookie(s.Cookie)
+	}
+	if s.LoadBalanceInfo != nil {
+		c.x224.SetRoutingToken(s.LoadBalanceInfo)
+	}
+	if rd := c.redirection; rd != nil {
+		if rd.RedirFlags&sec.LB_LOAD_BALANCE_INFO != 0 {
+			c.x224.SetRoutingToken(rd.LoadBalanceInfo)
+		}
+		c.mcs.SetClientRedirectedSession(rd.SessionId)
+		if rd.RedirFlags&sec.LB_PASSWORD != 0 && !s.RestrictedAdmin {
+			c.sec.SetPasswordCookie(rd.Password)
+		}
+	}
+
+	if s.ColorDepth != 0 {
+		c.mcs.SetClientColorDepth(s.ColorDepth)
+	}
+	if s.KeyboardLayout != 0 {
+		c.mcs.SetClientKeyboard(s.KeyboardLayout, s.KeyboardType, s.KeyboardSubType, s.KeyboardFnKeys)
+	}
+	if s.ClientName != "" {
+		c.mcs.SetClientName(s.ClientName)
+	}
+	if s.ClientBuild != 0 {
+		c.mcs.SetClientBuild(s.ClientBuild)
+	}
+
+	c.sec.SetPerformanceFlags(s.PerformanceFlags)
+	c.sec.SetShell(s.AlternateShell)
+	c.sec.SetWorkingDir(s.WorkingDir)
+	c.sec.SetAutoLogon(s.AutoLogon)
+	c.sec.SetCompression(s.Compression)
+
+	if s.Clipboard != CLIP_OFF {
+		c.registerChannel(plugin.CLIPRDR_SVC_CHANNEL_NAME)
+	}
+	for _, name := range s.Channels {
+		c.registerChannel(name)
+	}
+}
+
+func (c *RdpClient) registerChannel(name string) {
+	if c.channels.Registered(name) {
+		return
+	}
+	var t plugin.ChannelTransport
+	switch name {
+	case cliprdr.ChannelName:
+		t = cliprdr.NewCliprdrClient()
+		c.mcs.SetClientCliprdr()
+	case rail.ChannelName:
+		t = rail.NewClient()
+		c.mcs.SetClientRemoteProgram()
+	case drdynvc.ChannelName:
+		t = drdynvc.NewDvcClient()
+		c.mcs.SetClientDynvcProtocol()
+	default:
+		glog.Warn("Unsupported channel:", name)
+		return
+	}
+	c.channels.Register(t)
+}
+
 func (c *RdpClient) On(event string, f interface{}) {
+	switch event {
+	case "damage", "palette", "pointer", "pointer-position", "pointer-hidden":
+		c.gdi.On(event, f)
+		return
+	}
 	c.pdu.On(event, f)
 }
 func (c *RdpClient) KeyUp(sc int, name string) {
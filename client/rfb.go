@@ -2,6 +2,7 @@
 package client
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"time"
@@ -32,6 +33,27 @@ func (c *VncClient) Login(host, user, pwd string, width, height int) error {
 
 	return nil
 }
+
+func (c *VncClient) LoginContext(ctx context.Context, host, user, pwd string, width, height int) error {
+	d := net.Dialer{Timeout: 3 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return &LoginError{STAGE_DIAL, err}
+	}
+
+	c.vnc = rfb.NewRFB(rfb.NewRFBConn(conn, pwd))
+
+	w := newLoginWatcher(STAGE_RFB)
+	c.vnc.On("error", w.fail).Once("ready", w.ready)
+
+	err = c.vnc.Connect()
+	if err != nil {
+		c.Close()
+		return &LoginError{STAGE_RFB, err}
+	}
+	return w.wait(ctx, c.Close)
+}
+
 func (c *VncClient) On(event string, f interface{}) {
 	c.vnc.On(event, f)
 }
@@ -0,0 +1,50 @@
+// bulk.go
+package core
+
+import "fmt"
+
+// compression type and flags of the bulk compressed packets
+const (
+	COMPRESSION_TYPE_MASK = 0x0F
+	PACKET_COMPRESSED     = 0x20
+	PACKET_AT_FRONT       = 0x40
+	PACKET_FLUSHED        = 0x80
+)
+
+// compression types
+const (
+	PACKET_COMPR_TYPE_8K    = 0x0
+	PACKET_COMPR_TYPE_64K   = 0x1
+	PACKET_COMPR_TYPE_RDP6  = 0x2
+	PACKET_COMPR_TYPE_RDP61 = 0x3
+)
+
+/**
+ * BulkDecompressor decompresses a stream of bulk compressed packets,
+ * the updates and the virtual channels of a session are two streams
+ * with their own history each.
+ * @see MS-RDPBCGR 3.1.8 Bulk Data Compression
+ */
+type BulkDecompressor struct {
+	mppc   *MPPC
+	ncrush *NCRUSH
+	xcrush *XCRUSH
+}
+
+func NewBulkDecompressor() *BulkDecompressor {
+	return &BulkDecompressor{mppc: NewMPPC(), ncrush: NewNCRUSH(), xcrush: NewXCRUSH()}
+}
+
+// Decompress decompresses a packet of the compression type and flags of flags
+func (d *BulkDecompressor) Decompress(data []byte, flags uint8) ([]byte, error) {
+	switch t := flags & COMPRESSION_TYPE_MASK; t {
+	case PACKET_COMPR_TYPE_8K, PACKET_COMPR_TYPE_64K:
+		return d.mppc.Decompress(data, flags)
+	case PACKET_COMPR_TYPE_RDP6:
+		return d.ncrush.Decompress(data, flags)
+	case PACKET_COMPR_TYPE_RDP61:
+		return d.xcrush.Decompress(data, flags)
+	default:
+		return nil, fmt.Errorf("unsupported compression type %d", t)
+	}
+}
@@ -0,0 +1,174 @@
+// mppc.go
+package core
+
+import (
+	"errors"
+	"math/bits"
+)
+
+// history sizes of RDP 4.0 and RDP 5.0 bulk compression
+const (
+	MPPC_HISTORY_SIZE_8K  = 8192
+	MPPC_HISTORY_SIZE_64K = 65536
+)
+
+var errMPPC = errors.New("bad MPPC compressed data")
+
+/**
+ * MPPC decompresses the packets of a RDP 4.0 (8K) or RDP 5.0 (64K)
+ * bulk compressed stream, copies refer to the history of the packets
+ * decompressed since the last flush.
+ * @see MS-RDPBCGR 3.1.8.4 Compression Types (RDP 4.0 and RDP 5.0 Bulk Compression)
+ */
+type MPPC struct {
+	history []byte
+	// end of the history
+	offset int
+}
+
+func NewMPPC() *MPPC {
+	return &MPPC{}
+}
+
+// Decompress decompresses data with the type and PACKET_* flags of flags
+func (m *MPPC) Decompress(data []byte, flags uint8) ([]byte, error) {
+	size := MPPC_HISTORY_SIZE_8K
+	if flags&COMPRESSION_TYPE_MASK == PACKET_COMPR_TYPE_64K {
+		size = MPPC_HISTORY_SIZE_64K
+	}
+	if len(m.history) != size {
+		m.history = make([]byte, size)
+		m.offset = 0
+	}
+	if flags&PACKET_FLUSHED != 0 {
+		for i := range m.history {
+			m.history[i] = 0
+		}
+		m.offset = 0
+	}
+	if flags&PACKET_AT_FRONT != 0 {
+		m.offset = 0
+	}
+	if flags&PACKET_COMPRESSED == 0 {
+		return data, nil
+	}
+
+	start := m.offset
+	if err := m.decode(data, size == MPPC_HISTORY_SIZE_64K); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), m.history[start:m.offset]...), nil
+}
+
+// mppcBits reads bits most significant first, zeros past the end
+type mppcBits struct {
+	data []byte
+	pos  int
+}
+
+func (b *mppcBits) left() int {
+	return len(b.data)*8 - b.pos
+}
+
+// peek returns the next 32 bits
+func (b *mppcBits) peek() uint32 {
+	i := b.pos >> 3
+	var v uint64
+	for k := i; k < i+5; k++ {
+		v <<= 8
+		if k < len(b.data) {
+			v |= uint64(b.data[k])
+		}
+	}
+	return uint32(v << uint(24+b.pos&7) >> 32)
+}
+
+// decode appends the literals and copies of data to the history,
+// the last bits of data too few for a literal are padding
+func (m *MPPC) decode(data []byte, big bool) error {
+	h := m.history
+	b := &mppcBits{data: data}
+	for b.left() >= 8 {
+		acc := b.peek()
+		// literals: 0 and 7 bits, 10 and 7 bits for 0x80 and over
+		if acc&0x80000000 == 0 {
+			if m.offset >= len(h) {
+				return errMPPC
+			}
+			h[m.offset] = byte(acc >> 24)
+			m.offset++
+			b.pos += 8
+			continue
+		}
+		if acc&0xc0000000 == 0x80000000 {
+			if b.left() < 9 || m.offset >= len(h) {
+				return errMPPC
+			}
+			h[m.offset] = byte(0x80 | acc>>23&0x7f)
+			m.offset++
+			b.pos += 9
+			continue
+		}
+
+		// copy offset
+		var offset, n int
+		if big {
+			switch {
+			case acc&0xf8000000 == 0xf8000000:
+				offset, n = int(acc>>21&0x3f), 11
+			case acc&0xf8000000 == 0xf0000000:
+				offset, n = int(acc>>19&0xff)+64, 13
+			case acc&0xf0000000 == 0xe0000000:
+				offset, n = int(acc>>17&0x7ff)+320, 15
+			default:
+				offset, n = int(acc>>13&0xffff)+2368, 19
+			}
+		} else {
+			switch {
+			case acc&0xf0000000 == 0xf0000000:
+				offset, n = int(acc>>22&0x3f), 10
+			case acc&0xf0000000 == 0xe0000000:
+				offset, n = int(acc>>20&0xff)+64, 12
+			default:
+				offset, n = int(acc>>16&0x1fff)+320, 16
+			}
+		}
+		if b.left() < n {
+			return errMPPC
+		}
+		b.pos += n
+
+		// length of match: 0 for 3, else k 1s, a 0 and k + 1 bits
+		// over 1 << (k + 1)
+		acc = b.peek()
+		length := 3
+		n = 1
+		if k := bits.LeadingZeros32(^acc); k > 0 {
+			max := 11
+			if big {
+				max = 14
+			}
+			if k > max {
+				return errMPPC
+			}
+			w := uint(k + 1)
+			length = 1<<w + int(acc<<w>>(32-w))
+			n = 2*k + 2
+		}
+		if b.left() < n {
+			return errMPPC
+		}
+		b.pos += n
+
+		src := m.offset - offset
+		if src < 0 || m.offset+length > len(h) {
+			return errMPPC
+		}
+		// byte by byte, copies may overlap what they write
+		for i := 0; i < length; i++ {
+			h[m.offset+i] = h[src+i]
+		}
+		m.offset += length
+	}
+	return nil
+}
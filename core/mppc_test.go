@@ -0,0 +1,181 @@
+package core
+
+import (
+	"bytes"
+	"math/bits"
+	"math/rand"
+	"testing"
+)
+
+// mppcWriter writes the literal and copy tokens of a MPPC stream
+type mppcWriter struct {
+	buf []byte
+	n   int
+	big bool
+}
+
+func (w *mppcWriter) put(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n == len(w.buf)*8 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			w.buf[w.n>>3] |= 0x80 >> uint(w.n&7)
+		}
+		w.n++
+	}
+}
+
+func (w *mppcWriter) literal(c byte) {
+	if c < 0x80 {
+		w.put(uint32(c), 8)
+		return
+	}
+	w.put(2, 2)
+	w.put(uint32(c&0x7f), 7)
+}
+
+func (w *mppcWriter) copy(offset, length int) {
+	o := uint32(offset)
+	switch {
+	case w.big && offset < 64:
+		w.put(0x1f, 5)
+		w.put(o, 6)
+	case w.big && offset < 320:
+		w.put(0x1e, 5)
+		w.put(o-64, 8)
+	case w.big && offset < 2368:
+		w.put(0xe, 4)
+		w.put(o-320, 11)
+	case w.big:
+		w.put(0x6, 3)
+		w.put(o-2368, 16)
+	case offset < 64:
+		w.put(0xf, 4)
+		w.put(o, 6)
+	case offset < 320:
+		w.put(0xe, 4)
+		w.put(o-64, 8)
+	default:
+		w.put(0x6, 3)
+		w.put(o-320, 13)
+	}
+	if length == 3 {
+		w.put(0, 1)
+		return
+	}
+	n := bits.Len(uint(length)) - 1
+	w.put(1<<uint(n)-2, n)
+	w.put(uint32(length-1<<uint(n)), n)
+}
+
+// randomPacket returns a packet of random tokens and the data it stands for
+func randomPacket(rnd *rand.Rand, history []byte, big bool, size int) ([]byte, []byte) {
+	w := &mppcWriter{big: big}
+	out := append([]byte(nil), history...)
+	for len(out) < len(history)+size {
+		if len(out) < 3 || rnd.Intn(3) == 0 {
+			c := byte(rnd.Intn(256))
+			w.literal(c)
+			out = append(out, c)
+			continue
+		}
+		offset := 1 + rnd.Intn(len(out))
+		length := 3 + rnd.Intn(100)
+		if rnd.Intn(8) == 0 {
+			length = 3 + rnd.Intn(3000)
+		}
+		w.copy(offset, length)
+		for i := 0; i < length; i++ {
+			out = append(out, out[len(out)-offset])
+		}
+	}
+	return w.buf, out[len(history):]
+}
+
+func TestMPPCDecompress(t *testing.T) {
+	for _, c := range []struct {
+		flags uint8
+		size  int
+	}{
+		{PACKET_COMPR_TYPE_8K, MPPC_HISTORY_SIZE_8K},
+		{PACKET_COMPR_TYPE_64K, MPPC_HISTORY_SIZE_64K},
+	} {
+		rnd := rand.New(rand.NewSource(1))
+		m := NewMPPC()
+		var history []byte
+		flags := c.flags | PACKET_COMPRESSED | PACKET_FLUSHED
+		for i := 0; i < 20; i++ {
+			if len(history) > c.size-8000 {
+				// the history is full, the next packet starts over
+				flags |= PACKET_AT_FRONT
+				history = nil
+			}
+			data, want := randomPacket(rnd, history, c.flags == PACKET_COMPR_TYPE_64K, 1000+rnd.Intn(4000))
+			got, err := m.Decompress(data, flags)
+			if err != nil {
+				t.Fatalf("type %d packet %d: %v", c.flags, i, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("type %d packet %d differs", c.flags, i)
+			}
+			history = append(history, want...)
+			flags = c.flags | PACKET_COMPRESSED
+		}
+	}
+}
+
+func TestMPPCFlags(t *testing.T) {
+	// "abc" then a copy of 3 bytes 3 back
+	w := &mppcWriter{big: true}
+	for _, c := range []byte("abc") {
+		w.literal(c)
+	}
+	w.copy(3, 3)
+	m := NewMPPC()
+	got, err := m.Decompress(w.buf, PACKET_COMPR_TYPE_64K|PACKET_COMPRESSED)
+	if err != nil || string(got) != "abcabc" {
+		t.Fatalf("%q %v", got, err)
+	}
+
+	// uncompressed packets leave the history as it is
+	if got, _ := m.Decompress([]byte("xyz"), PACKET_COMPR_TYPE_64K); string(got) != "xyz" {
+		t.Errorf("uncompressed %q", got)
+	}
+	w = &mppcWriter{big: true}
+	w.copy(6, 4)
+	if got, err := m.Decompress(w.buf, PACKET_COMPR_TYPE_64K|PACKET_COMPRESSED); err != nil || string(got) != "abca" {
+		t.Errorf("history %q %v", got, err)
+	}
+
+	// nothing to copy once flushed
+	if _, err := m.Decompress(w.buf, PACKET_COMPR_TYPE_64K|PACKET_COMPRESSED|PACKET_FLUSHED); err == nil {
+		t.Error("copy past a flush")
+	}
+
+	// a length code over the 8K limit
+	w = &mppcWriter{}
+	w.literal('a')
+	w.copy(1, 8192)
+	if _, err := NewMPPC().Decompress(w.buf, PACKET_COMPR_TYPE_8K|PACKET_COMPRESSED); err == nil {
+		t.Error("copy over the history size")
+	}
+}
+
+// bells is the sample text of the bulk compression test vectors
+const bells = "for.whom.the.bell.tolls,.the.bell.tolls.for.thee!"
+
+func TestMPPCBells(t *testing.T) {
+	for _, c := range []struct {
+		flags uint8
+		data  string
+	}{
+		{PACKET_COMPR_TYPE_8K, "for.whom.the.bell.tolls,\xf4\x37\x2e\x66\xfa\x1f\x19\x94\x84"},
+		{PACKET_COMPR_TYPE_64K, "for.whom.the.bell.tolls,\xfa\x1b\x97\x33\x7e\x87\xe3\x32\x90\x80"},
+	} {
+		got, err := NewMPPC().Decompress([]byte(c.data), c.flags|PACKET_COMPRESSED|PACKET_FLUSHED)
+		if err != nil || string(got) != bells {
+			t.Errorf("type %d: %q %v", c.flags, got, err)
+		}
+	}
+}
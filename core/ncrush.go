@@ -0,0 +1,274 @@
+// ncrush.go
+package core
+
+import "errors"
+
+// history size of RDP 6.0 bulk compression
+const NCRUSH_HISTORY_SIZE = 65536
+
+// symbols of the literal, end of stream and copy offset (LEC) alphabet
+const (
+	NCRUSH_EOS          = 256
+	NCRUSH_COPY_OFFSET  = 257
+	NCRUSH_OFFSET_CACHE = 289
+)
+
+var errNCRUSH = errors.New("bad RDP 6.0 compressed data")
+
+// code lengths of the LEC alphabet: 256 literals, the end of stream,
+// 32 copy offsets and 4 offset cache entries, the last one is unused
+var huffLengthLEC = [294]uint8{
+	6, 6, 6, 7, 7, 7, 7, 7, 7, 7, 7, 8, 8, 8, 8, 8,
+	8, 8, 9, 8, 9, 9, 9, 9, 8, 8, 9, 9, 9, 9, 9, 9,
+	8, 9, 9, 10, 9, 9, 9, 9, 9, 9, 9, 10, 9, 10, 10, 10,
+	9, 9, 10, 9, 10, 9, 10, 9, 9, 9, 10, 10, 9, 10, 9, 9,
+	8, 9, 9, 9, 9, 10, 10, 10, 9, 9, 10, 10, 10, 10, 10, 10,
+	9, 9, 10, 10, 10, 10, 10, 10, 10, 9, 10, 10, 10, 10, 10, 10,
+	8, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10,
+	9, 10, 10, 10, 10, 10, 10, 10, 9, 10, 10, 10, 10, 10, 10, 9,
+	7, 9, 9, 10, 9, 10, 10, 10, 9, 10, 10, 10, 10, 10, 10, 10,
+	9, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10,
+	10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 13, 10, 10, 10, 10,
+	10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 9,
+	10, 10, 10, 10, 10, 9, 10, 10, 10, 10, 10, 9, 10, 10, 10, 9,
+	10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10,
+	10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10, 10,
+	10, 10, 10, 10, 9, 10, 11, 9, 9, 9, 9, 9, 9, 8, 8, 7,
+	13, 13, 7, 7, 9, 7, 7, 6, 6, 6, 6, 5, 6, 6, 6, 5,
+	6, 5, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6,
+	8, 5, 6, 7, 7, 13,
+}
+
+// code lengths of the length of match (LOM) alphabet
+var huffLengthLOM = [32]uint8{
+	4, 2, 3, 4, 3, 4, 4, 5, 4, 5, 5, 6, 6, 7, 7, 8,
+	7, 8, 8, 9, 9, 8, 9, 9, 9, 9, 9, 9, 9, 9, 9, 9,
+}
+
+// base and extra bits of the copy offsets, plus one
+var (
+	copyOffsetBaseLUT = [32]int{
+		1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193,
+		257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577, 32769, 49153,
+	}
+	copyOffsetBitsLUT = [32]uint{
+		0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6,
+		7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13, 14, 14,
+	}
+)
+
+// base and extra bits of the lengths of match, the last LOM codes are unused
+var (
+	lomBaseLUT = [30]int{
+		2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 16, 18, 22, 26, 30,
+		34, 42, 50, 58, 66, 82, 98, 114, 130, 194, 258, 514, 2, 2,
+	}
+	lomBitsLUT = [30]uint{
+		0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2,
+		3, 3, 3, 3, 4, 4, 4, 4, 6, 6, 8, 8, 14, 14,
+	}
+)
+
+/**
+ * huffman decodes a prefix code read least significant bit first,
+ * the codes are the canonical codes of the lengths, bit reversed.
+ * table maps the next maxLen bits to a symbol and its length.
+ */
+type huffman struct {
+	codes  []uint16
+	lens   []uint8
+	maxLen uint
+	table  []uint16
+}
+
+func newHuffman(lens []uint8) *huffman {
+	h := &huffman{codes: make([]uint16, len(lens)), lens: lens}
+	var count [16]int
+	for _, l := range lens {
+		count[l]++
+		if uint(l) > h.maxLen {
+			h.maxLen = uint(l)
+		}
+	}
+	var next [16]int
+	code := 0
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+	h.table = make([]uint16, 1<<h.maxLen)
+	for s, l := range lens {
+		if l == 0 {
+			continue
+		}
+		c := 0
+		for i := uint8(0); i < l; i++ {
+			c |= next[l] >> i & 1 << (l - 1 - i)
+		}
+		next[l]++
+		h.codes[s] = uint16(c)
+		for i := c; i < len(h.table); i += 1 << l {
+			h.table[i] = uint16(s)<<4 | uint16(l)
+		}
+	}
+	return h
+}
+
+var (
+	ncrushLEC = newHuffman(huffLengthLEC[:])
+	ncrushLOM = newHuffman(huffLengthLOM[:])
+)
+
+// ncrushBits reads bits least significant first, zeros past the end
+type ncrushBits struct {
+	data []byte
+	pos  uint
+}
+
+// peek returns the next n bits, at most 25
+func (b *ncrushBits) peek(n uint) uint32 {
+	i := b.pos >> 3
+	var v uint32
+	for k := uint(0); k < 4; k++ {
+		if i+k < uint(len(b.data)) {
+			v |= uint32(b.data[i+k]) << (8 * k)
+		}
+	}
+	return v >> (b.pos & 7) & (1<<n - 1)
+}
+
+func (b *ncrushBits) read(n uint) (int, error) {
+	v := b.peek(n)
+	b.pos += n
+	if b.pos > uint(len(b.data))*8 {
+		return 0, errNCRUSH
+	}
+	return int(v), nil
+}
+
+func (b *ncrushBits) symbol(h *huffman) (int, error) {
+	e := h.table[b.peek(h.maxLen)]
+	if _, err := b.read(uint(e & 0xf)); err != nil {
+		return 0, err
+	}
+	return int(e >> 4), nil
+}
+
+/**
+ * NCRUSH decompresses the packets of a RDP 6.0 bulk compressed stream,
+ * Huffman coded literals and copies from a 64K history of the packets
+ * decompressed since the last flush. The last 4 copy offsets are kept
+ * in a cache, most recently used first.
+ * @see MS-RDPEGDI 3.1.8.1 RDP 6.0 Bulk Compression
+ */
+type NCRUSH struct {
+	history []byte
+	// end of the history
+	offset      int
+	offsetCache [4]int
+}
+
+func NewNCRUSH() *NCRUSH {
+	return &NCRUSH{}
+}
+
+// Decompress decompresses data with the PACKET_* flags of flags
+func (n *NCRUSH) Decompress(data []byte, flags uint8) ([]byte, error) {
+	if n.history == nil {
+		n.history = make([]byte, NCRUSH_HISTORY_SIZE)
+	}
+	if flags&PACKET_FLUSHED != 0 {
+		for i := range n.history {
+			n.history[i] = 0
+		}
+		n.offset = 0
+		n.offsetCache = [4]int{}
+	} else if flags&PACKET_AT_FRONT != 0 {
+		// the last 32K of the history move to its front
+		const half = NCRUSH_HISTORY_SIZE / 2
+		if n.offset < half {
+			return nil, errNCRUSH
+		}
+		copy(n.history, n.history[n.offset-half:n.offset])
+		for i := half; i < len(n.history); i++ {
+			n.history[i] = 0
+		}
+		n.offset = half
+	}
+	if flags&PACKET_COMPRESSED == 0 {
+		return data, nil
+	}
+
+	start := n.offset
+	if err := n.decode(data); err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), n.history[start:n.offset]...), nil
+}
+
+// decode appends the literals and copies of data to the history,
+// up to the end of stream symbol
+func (n *NCRUSH) decode(data []byte) error {
+	h := n.history
+	b := &ncrushBits{data: data}
+	for {
+		s, err := b.symbol(ncrushLEC)
+		if err != nil {
+			return err
+		}
+		if s < NCRUSH_EOS {
+			if n.offset >= len(h) {
+				return errNCRUSH
+			}
+			h[n.offset] = byte(s)
+			n.offset++
+			continue
+		}
+		if s == NCRUSH_EOS {
+			return nil
+		}
+
+		var offset int
+		if s < NCRUSH_OFFSET_CACHE {
+			i := s - NCRUSH_COPY_OFFSET
+			extra, err := b.read(copyOffsetBitsLUT[i])
+			if err != nil {
+				return err
+			}
+			offset = copyOffsetBaseLUT[i] - 1 + extra
+			c := &n.offsetCache
+			c[3], c[2], c[1], c[0] = c[2], c[1], c[0], offset
+		} else {
+			i := s - NCRUSH_OFFSET_CACHE
+			if i >= len(n.offsetCache) {
+				return errNCRUSH
+			}
+			c := &n.offsetCache
+			offset = c[i]
+			c[i], c[0] = c[0], c[i]
+		}
+
+		i, err := b.symbol(ncrushLOM)
+		if err != nil {
+			return err
+		}
+		if i >= len(lomBaseLUT) {
+			return errNCRUSH
+		}
+		extra, err := b.read(lomBitsLUT[i])
+		if err != nil {
+			return err
+		}
+		length := lomBaseLUT[i] + extra
+
+		if offset == 0 || offset > n.offset || length > len(h)-n.offset {
+			return errNCRUSH
+		}
+		// byte by byte, a copy can overlap its output
+		for src := n.offset - offset; length > 0; length-- {
+			h[n.offset] = h[src]
+			n.offset++
+			src++
+		}
+	}
+}
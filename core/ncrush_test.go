@@ -0,0 +1,224 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+// ncrushWriter writes the Huffman coded symbols of a NCRUSH stream
+type ncrushWriter struct {
+	buf []byte
+	n   uint
+}
+
+func (w *ncrushWriter) put(v int, n uint) {
+	for i := uint(0); i < n; i++ {
+		if w.n == uint(len(w.buf))*8 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>i&1 != 0 {
+			w.buf[w.n>>3] |= 1 << (w.n & 7)
+		}
+		w.n++
+	}
+}
+
+func (w *ncrushWriter) symbol(h *huffman, s int) {
+	w.put(int(h.codes[s]), uint(h.lens[s]))
+}
+
+func (w *ncrushWriter) literals(s string) {
+	for _, c := range []byte(s) {
+		w.symbol(ncrushLEC, int(c))
+	}
+}
+
+// length writes the length of match of a copy, 2 to 513
+func (w *ncrushWriter) length(n int) {
+	i := len(lomBaseLUT) - 3
+	for lomBaseLUT[i] > n {
+		i--
+	}
+	w.symbol(ncrushLOM, i)
+	w.put(n-lomBaseLUT[i], lomBitsLUT[i])
+}
+
+func (w *ncrushWriter) copy(offset, length int) {
+	i := len(copyOffsetBaseLUT) - 1
+	for copyOffsetBaseLUT[i]-1 > offset {
+		i--
+	}
+	w.symbol(ncrushLEC, NCRUSH_COPY_OFFSET+i)
+	w.put(offset-copyOffsetBaseLUT[i]+1, copyOffsetBitsLUT[i])
+	w.length(length)
+}
+
+// cached copies with the offset at index i of the cache
+func (w *ncrushWriter) cached(i, length int) {
+	w.symbol(ncrushLEC, NCRUSH_OFFSET_CACHE+i)
+	w.length(length)
+}
+
+func (w *ncrushWriter) bytes() []byte {
+	w.symbol(ncrushLEC, NCRUSH_EOS)
+	return w.buf
+}
+
+func TestNCRUSHTables(t *testing.T) {
+	// complete prefix codes
+	for name, lens := range map[string][]uint8{"LEC": huffLengthLEC[:], "LOM": huffLengthLOM[:]} {
+		sum := 0
+		for _, l := range lens {
+			sum += 1 << (13 - l)
+		}
+		if sum != 1<<13 {
+			t.Errorf("%s codes are not complete: %d", name, sum)
+		}
+	}
+	for s, c := range map[int]uint16{0: 0x04, 'f': 0x1fb, 171: 0x7ff, 246: 0x3ff, NCRUSH_EOS: 0x17ff} {
+		if ncrushLEC.codes[s] != c {
+			t.Errorf("LEC code of %d is %#x, not %#x", s, ncrushLEC.codes[s], c)
+		}
+	}
+}
+
+func TestNCRUSHBells(t *testing.T) {
+	data := []byte("\xfb\x1d\x7e\xe4\xda\xc7\x1d\x70\xf8\xa1\x6b\x1f\x7d\xc0\xbe\x6b" +
+		"\xef\xb5\xef\x21\x87\xd0\xc5\xe1\x85\x71\xd4\x10\x16\xe7\xda\xfb" +
+		"\x1d\x7e\xe4\xda\x47\x1f\xb0\xef\xbe\xbd\xff\x2f")
+	got, err := NewNCRUSH().Decompress(data, PACKET_COMPR_TYPE_RDP6|PACKET_COMPRESSED|PACKET_FLUSHED)
+	if err != nil || string(got) != bells {
+		t.Fatalf("%q %v", got, err)
+	}
+}
+
+func TestNCRUSHDecompress(t *testing.T) {
+	flags := uint8(PACKET_COMPR_TYPE_RDP6 | PACKET_COMPRESSED)
+	n := NewNCRUSH()
+
+	// all literals
+	lit := make([]byte, 256)
+	for i := range lit {
+		lit[i] = byte(255 - i)
+	}
+	w := &ncrushWriter{}
+	w.literals(string(lit))
+	got, err := n.Decompress(w.bytes(), flags|PACKET_FLUSHED)
+	if err != nil || !bytes.Equal(got, lit) {
+		t.Fatalf("literals: %q %v", got, err)
+	}
+
+	// copies of offsets with and without extra bits, from the previous packet
+	// and overlapping their output
+	w = &ncrushWriter{}
+	w.literals("ab")
+	w.copy(2, 5)
+	w.copy(258, 3)
+	w.copy(1, 300)
+	got, err = n.Decompress(w.bytes(), flags)
+	want := "abababa" + string(lit[5:8]) + string(bytes.Repeat(lit[7:8], 300))
+	if err != nil || string(got) != want {
+		t.Fatalf("copies: %q %v", got, err)
+	}
+
+	// the cache holds the last 4 offsets, a hit swaps its entry with the first
+	w = &ncrushWriter{}
+	w.literals("abcdefgh")
+	w.copy(8, 3)
+	w.copy(5, 2)
+	w.copy(1, 2)
+	w.copy(13, 4)
+	// 13, 1, 5 and 8: 8 then 5 move to the front
+	w.cached(3, 3)
+	w.cached(2, 2)
+	w.cached(0, 2)
+	got, err = n.Decompress(w.bytes(), flags|PACKET_FLUSHED)
+	if err != nil || string(got) != "abcdefgh"+"abc"+"gh"+"hh"+"cdef"+"ghh"+"ef"+"gh" {
+		t.Fatalf("offset cache: %q %v", got, err)
+	}
+	if n.offsetCache != [4]int{5, 1, 8, 13} {
+		t.Errorf("offset cache %v", n.offsetCache)
+	}
+
+	// uncompressed packets are not in the history
+	if got, err = n.Decompress([]byte("xyz"), PACKET_COMPR_TYPE_RDP6); err != nil || string(got) != "xyz" {
+		t.Fatalf("uncompressed: %q %v", got, err)
+	}
+	w = &ncrushWriter{}
+	w.cached(1, 2)
+	got, err = n.Decompress(w.bytes(), flags)
+	if err != nil || string(got) != "hh" {
+		t.Fatalf("after uncompressed: %q %v", got, err)
+	}
+
+	// the last 32K move to the front of the history
+	n = NewNCRUSH()
+	w = &ncrushWriter{}
+	w.literals("0123456789")
+	for i := 0; i < 70; i++ {
+		w.copy(10, 510)
+	}
+	if _, err = n.Decompress(w.bytes(), flags|PACKET_FLUSHED); err != nil {
+		t.Fatal(err)
+	}
+	w = &ncrushWriter{}
+	w.copy(NCRUSH_HISTORY_SIZE/2, 10)
+	got, err = n.Decompress(w.bytes(), flags|PACKET_AT_FRONT)
+	if err != nil || string(got) != "2345678901" || n.offset != NCRUSH_HISTORY_SIZE/2+10 {
+		t.Fatalf("at front: %q %v", got, err)
+	}
+}
+
+func TestNCRUSHMalformed(t *testing.T) {
+	flags := uint8(PACKET_COMPR_TYPE_RDP6 | PACKET_COMPRESSED | PACKET_FLUSHED)
+	stream := func(f func(w *ncrushWriter)) []byte {
+		w := &ncrushWriter{}
+		f(w)
+		return w.bytes()
+	}
+	full := func(w *ncrushWriter) {
+		w.literals("a")
+		for i := 0; i < NCRUSH_HISTORY_SIZE/513; i++ {
+			w.copy(1, 513)
+		}
+		w.copy(1, NCRUSH_HISTORY_SIZE%513-1)
+	}
+	for name, data := range map[string][]byte{
+		"empty":         {},
+		"no end":        stream(func(w *ncrushWriter) { w.literals("abc") })[:2],
+		"empty history": stream(func(w *ncrushWriter) { w.copy(1, 2) }),
+		"before history": stream(func(w *ncrushWriter) {
+			w.literals("abc")
+			w.copy(4, 2)
+		}),
+		"empty cache": stream(func(w *ncrushWriter) {
+			w.literals("abc")
+			w.cached(3, 2)
+		}),
+		"unused LEC code": stream(func(w *ncrushWriter) {
+			w.literals("abc")
+			w.symbol(ncrushLEC, NCRUSH_OFFSET_CACHE+4)
+		}),
+		"unused LOM code": stream(func(w *ncrushWriter) {
+			w.literals("abc")
+			w.symbol(ncrushLEC, NCRUSH_COPY_OFFSET)
+			w.symbol(ncrushLOM, len(lomBaseLUT))
+		}),
+		"past history": stream(func(w *ncrushWriter) {
+			full(w)
+			w.copy(1, 2)
+		}),
+		"literal past history": stream(func(w *ncrushWriter) {
+			full(w)
+			w.literals("0")
+		}),
+	} {
+		if got, err := NewNCRUSH().Decompress(data, flags); err == nil {
+			t.Errorf("%s: %d bytes", name, len(got))
+		}
+	}
+	// nothing to move to the front
+	if _, err := NewNCRUSH().Decompress(stream(func(w *ncrushWriter) {}), PACKET_COMPRESSED|PACKET_AT_FRONT); err == nil {
+		t.Error("at front of an empty history")
+	}
+}
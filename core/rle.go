@@ -1,865 +1,532 @@
+// rle.go
 package core
 
 import (
+	"errors"
 	"fmt"
-	"unsafe"
 )
 
-func CVAL(p *[]uint8) int {
-	a := int((*p)[0])
-	*p = (*p)[1:]
-	return a
-}
+// PixelFormat is the layout of the pixels a RLEDecoder writes
+type PixelFormat int
+
+const (
+	// the bytes of the pixels of the bitmap: a palette index, 16 bits
+	// big endian, B G R or B G R A
+	PIXEL_FORMAT_RAW PixelFormat = iota
+	// R G B A, opaque, the layout of image.RGBA
+	PIXEL_FORMAT_RGBA
+	// B G R A, opaque
+	PIXEL_FORMAT_BGRA
+)
+
+// planar bitmap format header
+const (
+	PLANAR_FORMAT_HEADER_CLL_MASK = 0x07
+	PLANAR_FORMAT_HEADER_CS       = 0x08
+	PLANAR_FORMAT_HEADER_RLE      = 0x10
+	PLANAR_FORMAT_HEADER_NA       = 0x20
+)
 
-func CVAL2(p *[]uint8, v *uint16) {
-	*v = *((*uint16)(unsafe.Pointer(&(*p)[0])))
-	*p = (*p)[2:]
+var errRLE = errors.New("bad RLE bitmap data")
+
+/**
+ * Target is where a RLEDecoder writes a bitmap, rows top-down.
+ * Pixels of 8 bpp bitmaps are converted to RGBA or BGRA with Palette,
+ * gray levels when it is nil.
+ */
+type Target struct {
+	Pix []byte
+	// bytes from a row to the next, the size of a row when 0
+	Stride  int
+	Format  PixelFormat
+	Palette *[256]uint32
 }
 
-func CVAL3(p *[]uint8, v *[3]uint8) {
-	(*v)[0] = (*p)[0]
-	(*v)[1] = (*p)[1]
-	(*v)[2] = (*p)[2]
-	*p = (*p)[3:]
+/**
+ * RLEDecoder decodes the compressed bitmaps of bitmap updates and cache
+ * bitmap orders: interleaved RLE of 8, 15, 16 and 24 bpp and planar
+ * 32 bpp bitmaps. It keeps its buffers from a bitmap to the next and
+ * must not be used by several goroutines at once.
+ * @see MS-RDPBCGR 2.2.9.1.1.3.1.2.4 Compressed Bitmap Data (RLE_BITMAP_STREAM)
+ * @see MS-RDPEGDI 2.2.2.5.1 Planar Bitmap (RDP6_BITMAP_STREAM)
+ */
+type RLEDecoder struct {
+	// the row decoded and the one above it, in the order of the stream
+	cur, prev []uint32
 }
 
-func REPEAT(f func(), count *int, x *int, width int) {
-	for (*count & ^0x7) != 0 && ((*x + 8) < width) {
-		for i := 0; i < 8; i++ {
-			f()
-			*count = *count - 1
-			*x = *x + 1
-		}
+// Decode decodes the bitmap of width x height pixels of bpp bits to t
+func (d *RLEDecoder) Decode(t *Target, input []byte, width, height, bpp int) error {
+	Bpp := (bpp + 7) / 8
+	if width <= 0 || height <= 0 || Bpp < 1 || Bpp > 4 {
+		return fmt.Errorf("bad bitmap size %dx%d of %d bpp", width, height, bpp)
 	}
-
-	for (*count > 0) && (*x < width) {
-		f()
-		*count = *count - 1
-		*x = *x + 1
+	size := Bpp
+	if t.Format != PIXEL_FORMAT_RAW {
+		size = 4
+	}
+	stride := t.Stride
+	if stride == 0 {
+		stride = width * size
 	}
+	if stride < width*size || len(t.Pix) < (height-1)*stride+width*size {
+		return errors.New("bitmap target too small")
+	}
+	if Bpp == 4 {
+		return d.planar(t, stride, input, width, height)
+	}
+	return d.interleaved(t, stride, input, width, height, bpp)
 }
 
-/* 1 byte bitmap decompress */
-func decompress1(output *[]uint8, width, height int, input []uint8, size int) bool {
+// Decompress decodes a bitmap to a new buffer of PIXEL_FORMAT_RAW pixels,
+// the rows past malformed data are black
+func Decompress(input []uint8, width, height int, Bpp int) []uint8 {
+	output := make([]uint8, width*height*Bpp)
+	var d RLEDecoder
+	d.Decode(&Target{Pix: output}, input, width, height, Bpp*8)
+	return output
+}
+
+// interleaved RLE orders, the ones setting the foreground color
+// or with a mask of 8 pixels mapped to the plain ones
+const (
+	rleBgRun      = 0x0
+	rleFgRun      = 0x1
+	rleFgBgImage  = 0x2
+	rleColorRun   = 0x3
+	rleColorImage = 0x4
+	rleSetFgRun   = 0x6
+	rleSetFgBg    = 0x7
+	rleDithered   = 0x8
+	rleFgBg1      = 0x9
+	rleFgBg2      = 0xa
+	rleWhite      = 0xd
+	rleBlack      = 0xe
+)
+
+func (d *RLEDecoder) interleaved(t *Target, stride int, in []byte, width, height, bpp int) error {
+	Bpp := (bpp + 7) / 8
+	if cap(d.cur) < width {
+		d.cur, d.prev = make([]uint32, width), make([]uint32, width)
+	}
+	cur, prev := d.cur[:width], d.prev[:width]
+	white := uint32(1)<<uint(8*Bpp) - 1
+
 	var (
-		prevline, line, count            int
-		offset, code                     int
-		x                                int = width
-		opcode                           int
-		lastopcode                       int8 = -1
-		insertmix, bicolour, isfillormix bool
-		mixmask, mask                    uint8
-		colour1, colour2                 uint8
-		mix                              uint8 = 0xff
-		fom_mask                         uint8
+		i         int
+		x         = width
+		row       = -1
+		lastOp    = -1
+		insertMix bool
+		bicolor   bool
+		mix       = white
+		color1    uint32
+		color2    uint32
+		mask      byte
+		mixMask   byte
 	)
-	out := *output
-	for len(input) != 0 {
-		fom_mask = 0
-		code = CVAL(&input)
-		opcode = code >> 4
-		/* Handle different opcode forms */
-		switch opcode {
+	for i < len(in) {
+		code := int(in[i])
+		i++
+		var op, count, fgbgMask int
+		switch code >> 4 {
 		case 0xc, 0xd, 0xe:
-			opcode -= 6
-			count = int(code & 0xf)
-			offset = 16
-			break
-		case 0xf:
-			opcode = code & 0xf
-			if opcode < 9 {
-				count = int(CVAL(&input))
-				count |= int(CVAL(&input) << 8)
-			} else {
-				count = 1
-				if opcode < 0xb {
-					count = 8
-				}
-			}
-			offset = 0
-			break
-		default:
-			opcode >>= 1
-			count = int(code & 0x1f)
-			offset = 32
-			break
-		}
-		/* Handle strange cases for counts */
-		if offset != 0 {
-			isfillormix = ((opcode == 2) || (opcode == 7))
+			op, count = code>>4-6, code&0x0f
 			if count == 0 {
-				if isfillormix {
-					count = int(CVAL(&input)) + 1
+				if i >= len(in) {
+					return errRLE
+				}
+				if op == rleSetFgBg {
+					count = int(in[i]) + 1
 				} else {
-					count = int(CVAL(&input) + offset)
+					count = int(in[i]) + 16
 				}
-			} else if isfillormix {
+				i++
+			} else if op == rleSetFgBg {
 				count <<= 3
 			}
-		}
-		/* Read preliminary data */
-		switch opcode {
-		case 0: /* Fill */
-			if (lastopcode == int8(opcode)) && !((x == width) && (prevline == 0)) {
-				insertmix = true
-			}
-			break
-		case 8: /* Bicolour */
-			colour1 = uint8(CVAL(&input))
-			colour2 = uint8(CVAL(&input))
-			break
-		case 3: /* Colour */
-			colour2 = uint8(CVAL(&input))
-			break
-		case 6: /* SetMix/Mix */
-			fallthrough
-		case 7: /* SetMix/FillOrMix */
-			mix = uint8(CVAL(&input))
-			opcode -= 5
-			break
-		case 9: /* FillOrMix_1 */
-			mask = 0x03
-			opcode = 0x02
-			fom_mask = 3
-			break
-		case 0x0a: /* FillOrMix_2 */
-			mask = 0x05
-			opcode = 0x02
-			fom_mask = 5
-			break
-		}
-		lastopcode = int8(opcode)
-		mixmask = 0
-		/* Output body */
-		for count > 0 {
-			if x >= width {
-				if height <= 0 {
-					return false
-				}
-
-				x = 0
-				height--
-				prevline = line
-				line = height * width
-			}
-			switch opcode {
-			case 0: /* Fill */
-				if insertmix {
-					if prevline == 0 {
-						out[x+line] = mix
-					} else {
-						out[x+line] = out[prevline+x] ^ mix
-					}
-					insertmix = false
-					count--
-					x++
-				}
-				if prevline == 0 {
-					REPEAT(func() {
-						out[x+line] = 0
-					}, &count, &x, width)
-				} else {
-					REPEAT(func() {
-						out[x+line] = out[prevline+x]
-					}, &count, &x, width)
-				}
-				break
-			case 1: /* Mix */
-				if prevline == 0 {
-					REPEAT(func() {
-						out[x+line] = mix
-					}, &count, &x, width)
-				} else {
-					REPEAT(func() {
-						out[x+line] = out[prevline+x] ^ mix
-					}, &count, &x, width)
-				}
-				break
-			case 2: /* Fill or Mix */
-				if prevline == 0 {
-					REPEAT(func() {
-						mixmask <<= 1
-						if mixmask == 0 {
-							mask = fom_mask
-							if fom_mask == 0 {
-								mask = uint8(CVAL(&input))
-								mixmask = 1
-							}
-						}
-						if mask&mixmask != 0 {
-							out[x+line] = mix
-						} else {
-							out[x+line] = 0
-						}
-					}, &count, &x, width)
-				} else {
-					REPEAT(func() {
-						mixmask = mixmask << 1
-						if mixmask == 0 {
-							mask = fom_mask
-							if fom_mask == 0 {
-								mask = uint8(CVAL(&input))
-								mixmask = 1
-							}
-						}
-						if mask&mixmask != 0 {
-							out[x+line] = out[prevline+x] ^ mix
-						} else {
-							out[x+line] = out[prevline+x]
-						}
-					}, &count, &x, width)
+		case 0xf:
+			op = code & 0x0f
+			switch {
+			case op < rleFgBg1:
+				if i+2 > len(in) {
+					return errRLE
 				}
-				break
-			case 3: /* Colour */
-				REPEAT(func() {
-					out[x+line] = colour2
-				}, &count, &x, width)
-				break
-			case 4: /* Copy */
-				REPEAT(func() {
-					out[x+line] = uint8(CVAL(&input))
-				}, &count, &x, width)
-				break
-			case 8: /* Bicolour */
-				REPEAT(func() {
-					if bicolour {
-						out[x+line] = colour2
-						bicolour = false
-					} else {
-						out[x+line] = colour1
-						bicolour = true
-						count++
-					}
-				}, &count, &x, width)
-
-				break
-
-			case 0xd: /* White */
-				REPEAT(func() {
-					out[x+line] = 0xff
-				}, &count, &x, width)
-				break
-			case 0xe: /* Black */
-				REPEAT(func() {
-					out[x+line] = 0
-				}, &count, &x, width)
-				break
+				count = int(in[i]) | int(in[i+1])<<8
+				i += 2
+			case op < 0xb:
+				count = 8
 			default:
-				fmt.Printf("bitmap opcode 0x%x\n", opcode)
-				return false
-			}
-		}
-	}
-	return true
-}
-
-/* 2 byte bitmap decompress */
-func decompress2(output *[]uint8, width, height int, input []uint8, size int) bool {
-	var (
-		prevline, line, count            int
-		offset, code                     int
-		x                                int = width
-		opcode                           int
-		lastopcode                       int = -1
-		insertmix, bicolour, isfillormix bool
-		mixmask, mask                    uint8
-		colour1, colour2                 uint16
-		mix                              uint16 = 0xffff
-		fom_mask                         uint8
-	)
-
-	out := make([]uint16, width*height)
-	for len(input) != 0 {
-		fom_mask = 0
-		code = CVAL(&input)
-		opcode = code >> 4
-		/* Handle different opcode forms */
-		switch opcode {
-		case 0xc, 0xd, 0xe:
-			opcode -= 6
-			count = code & 0xf
-			offset = 16
-			break
-		case 0xf:
-			opcode = code & 0xf
-			if opcode < 9 {
-				count = CVAL(&input)
-				count |= CVAL(&input) << 8
-			} else {
 				count = 1
-				if opcode < 0xb {
-					count = 8
-				}
 			}
-			offset = 0
-			break
 		default:
-			opcode >>= 1
-			count = code & 0x1f
-			offset = 32
-			break
-		}
-
-		/* Handle strange cases for counts */
-		if offset != 0 {
-			isfillormix = ((opcode == 2) || (opcode == 7))
+			op, count = code>>5, code&0x1f
 			if count == 0 {
-				if isfillormix {
-					count = CVAL(&input) + 1
+				if i >= len(in) {
+					return errRLE
+				}
+				if op == rleFgBgImage {
+					count = int(in[i]) + 1
 				} else {
-					count = CVAL(&input) + offset
+					count = int(in[i]) + 32
 				}
-			} else if isfillormix {
+				i++
+			} else if op == rleFgBgImage {
 				count <<= 3
 			}
 		}
-		/* Read preliminary data */
-		switch opcode {
-		case 0: /* Fill */
-			if (lastopcode == opcode) && !((x == width) && (prevline == 0)) {
-				insertmix = true
+
+		switch op {
+		case rleBgRun:
+			// a background run after another one starts with a foreground pixel
+			if lastOp == rleBgRun && !(x == width && row <= 0) {
+				insertMix = true
+			}
+		case rleDithered:
+			if i+2*Bpp > len(in) {
+				return errRLE
+			}
+			color1, color2 = pixelAt(in, i, Bpp), pixelAt(in, i+Bpp, Bpp)
+			i += 2 * Bpp
+		case rleColorRun:
+			if i+Bpp > len(in) {
+				return errRLE
+			}
+			color2 = pixelAt(in, i, Bpp)
+			i += Bpp
+		case rleSetFgRun, rleSetFgBg:
+			if i+Bpp > len(in) {
+				return errRLE
 			}
-			break
-		case 8: /* Bicolour */
-			CVAL2(&input, &colour1)
-			CVAL2(&input, &colour2)
-			break
-		case 3: /* Colour */
-			CVAL2(&input, &colour2)
-			break
-		case 6: /* SetMix/Mix */
-			fallthrough
-		case 7: /* SetMix/FillOrMix */
-			CVAL2(&input, &mix)
-			opcode -= 5
-			break
-		case 9: /* FillOrMix_1 */
-			mask = 0x03
-			opcode = 0x02
-			fom_mask = 3
-			break
-		case 0x0a: /* FillOrMix_2 */
-			mask = 0x05
-			opcode = 0x02
-			fom_mask = 5
-			break
+			mix = pixelAt(in, i, Bpp)
+			i += Bpp
+			op -= 5
+		case rleFgBg1:
+			op, fgbgMask = rleFgBgImage, 0x03
+		case rleFgBg2:
+			op, fgbgMask = rleFgBgImage, 0x05
+		case rleFgRun, rleFgBgImage, rleColorImage, rleWhite, rleBlack:
+		default:
+			return fmt.Errorf("bad bitmap order 0x%x", code)
 		}
-		lastopcode = opcode
-		mixmask = 0
-		/* Output body */
+		lastOp = op
+		mixMask = 0
+
 		for count > 0 {
 			if x >= width {
-				if height <= 0 {
-					return false
+				if row+1 >= height {
+					return errRLE
 				}
-
+				if row >= 0 {
+					d.writeRow(t, stride, height-1-row, cur, bpp)
+				}
+				row++
 				x = 0
-				height--
-				prevline = line
-				line = height * width
+				cur, prev = prev, cur
+			}
+			first := row == 0
+			n := count
+			if n > width-x {
+				n = width - x
 			}
-			switch opcode {
-			case 0: /* Fill */
-				if insertmix {
-					if prevline == 0 {
-						out[x+line] = mix
+			line, above := cur[x:x+n], prev[x:x+n]
+
+			switch op {
+			case rleBgRun:
+				if insertMix {
+					if first {
+						cur[x] = mix
 					} else {
-						out[x+line] = out[prevline+x] ^ mix
+						cur[x] = prev[x] ^ mix
 					}
-					insertmix = false
+					insertMix = false
 					count--
 					x++
+					continue
 				}
-				if prevline == 0 {
-					REPEAT(func() {
-						out[x+line] = 0
-					}, &count, &x, width)
+				if first {
+					for j := range line {
+						line[j] = 0
+					}
 				} else {
-					REPEAT(func() {
-						out[x+line] = out[prevline+x]
-					}, &count, &x, width)
+					copy(line, above)
 				}
-				break
-			case 1: /* Mix */
-				if prevline == 0 {
-					REPEAT(func() {
-						out[x+line] = mix
-					}, &count, &x, width)
+			case rleFgRun:
+				if first {
+					for j := range line {
+						line[j] = mix
+					}
 				} else {
-					REPEAT(func() {
-						out[x+line] = out[prevline+x] ^ mix
-					}, &count, &x, width)
+					for j := range line {
+						line[j] = above[j] ^ mix
+					}
 				}
-				break
-			case 2: /* Fill or Mix */
-				if prevline == 0 {
-					REPEAT(func() {
-						mixmask <<= 1
-						if mixmask == 0 {
-							mask = fom_mask
-							if fom_mask == 0 {
-								mask = uint8(CVAL(&input))
-								mixmask = 1
-							}
-						}
-						if mask&mixmask != 0 {
-							out[x+line] = mix
+			case rleFgBgImage:
+				for j := range line {
+					mixMask <<= 1
+					if mixMask == 0 {
+						if fgbgMask != 0 {
+							mask = byte(fgbgMask)
 						} else {
-							out[x+line] = 0
-						}
-					}, &count, &x, width)
-				} else {
-					REPEAT(func() {
-						mixmask = mixmask << 1
-						if mixmask == 0 {
-							mask = fom_mask
-							if fom_mask == 0 {
-								mask = uint8(CVAL(&input))
-								mixmask = 1
+							if i >= len(in) {
+								return errRLE
 							}
+							mask = in[i]
+							i++
 						}
-						if mask&mixmask != 0 {
-							out[x+line] = out[prevline+x] ^ mix
-						} else {
-							out[x+line] = out[prevline+x]
-						}
-					}, &count, &x, width)
+						mixMask = 1
+					}
+					var v uint32
+					if !first {
+						v = above[j]
+					}
+					if mask&mixMask != 0 {
+						v ^= mix
+					}
+					line[j] = v
 				}
-				break
-			case 3: /* Colour */
-				REPEAT(func() {
-					out[x+line] = colour2
-				}, &count, &x, width)
-				break
-			case 4: /* Copy */
-				REPEAT(func() {
-					var a uint16
-					CVAL2(&input, &a)
-					out[x+line] = a
-				}, &count, &x, width)
-
-				break
-			case 8: /* Bicolour */
-				REPEAT(func() {
-					if bicolour {
-						out[x+line] = colour2
-						bicolour = false
+			case rleColorRun:
+				for j := range line {
+					line[j] = color2
+				}
+			case rleColorImage:
+				if i+n*Bpp > len(in) {
+					return errRLE
+				}
+				for j := range line {
+					line[j] = pixelAt(in, i, Bpp)
+					i += Bpp
+				}
+			case rleDithered:
+				// count is the number of pairs of pixels
+				line = cur[x:]
+				j := 0
+				for ; j < len(line) && count > 0; j++ {
+					if bicolor {
+						line[j] = color2
+						count--
 					} else {
-						out[x+line] = colour1
-						bicolour = true
-						count++
+						line[j] = color1
 					}
-				}, &count, &x, width)
-
-				break
-			case 0xd: /* White */
-				REPEAT(func() {
-					out[x+line] = 0xffff
-				}, &count, &x, width)
-				break
-			case 0xe: /* Black */
-				REPEAT(func() {
-					out[x+line] = 0
-				}, &count, &x, width)
-				break
-			default:
-				fmt.Printf("bitmap opcode 0x%x\n", opcode)
-				return false
+					bicolor = !bicolor
+				}
+				x += j
+				continue
+			case rleWhite:
+				for j := range line {
+					line[j] = white
+				}
+			case rleBlack:
+				for j := range line {
+					line[j] = 0
+				}
 			}
+			count -= n
+			x += n
 		}
 	}
-	j := 0
-	for _, v := range out {
-		(*output)[j], (*output)[j+1] = PutUint16BE(v)
-		j += 2
+	if row >= 0 {
+		d.writeRow(t, stride, height-1-row, cur[:x], bpp)
 	}
-	return true
+	return nil
 }
 
-// /* 3 byte bitmap decompress */
-func decompress3(output *[]uint8, width, height int, input []uint8, size int) bool {
-	var (
-		prevline, line, count            int
-		opcode, offset, code             int
-		x                                int = width
-		lastopcode                       int = -1
-		insertmix, bicolour, isfillormix bool
-		mixmask, mask                    uint8
-		colour1                          = [3]uint8{0, 0, 0}
-		colour2                          = [3]uint8{0, 0, 0}
-		mix                              = [3]uint8{0xff, 0xff, 0xff}
-		fom_mask                         uint8
-	)
-	out := *output
-	for len(input) != 0 {
-		fom_mask = 0
-		code = CVAL(&input)
-		opcode = code >> 4
-		/* Handle different opcode forms */
-		switch opcode {
-		case 0xc, 0xd, 0xe:
-			opcode -= 6
-			count = code & 0xf
-			offset = 16
-			break
-		case 0xf:
-			opcode = code & 0xf
-			if opcode < 9 {
-				count = CVAL(&input)
-				count |= CVAL(&input) << 8
-			} else {
-				count = 1
-				if opcode < 0xb {
-					count = 8
-				}
-			}
-			offset = 0
-			break
-		default:
-			opcode >>= 1
-			count = code & 0x1f
-			offset = 32
-			break
-		}
+// pixelAt reads a little endian pixel of Bpp bytes
+func pixelAt(in []byte, i, Bpp int) uint32 {
+	switch Bpp {
+	case 1:
+		return uint32(in[i])
+	case 2:
+		return uint32(in[i]) | uint32(in[i+1])<<8
+	}
+	return uint32(in[i]) | uint32(in[i+1])<<8 | uint32(in[i+2])<<16
+}
 
-		/* Handle strange cases for counts */
-		if offset != 0 {
-			isfillormix = ((opcode == 2) || (opcode == 7))
-			if count == 0 {
-				if isfillormix {
-					count = CVAL(&input) + 1
-				} else {
-					count = CVAL(&input) + offset
-				}
-			} else if isfillormix {
-				count <<= 3
-			}
+// writeRow converts the pixels of a row to the row y of t
+func (d *RLEDecoder) writeRow(t *Target, stride, y int, row []uint32, bpp int) {
+	pix := t.Pix[y*stride:]
+	switch {
+	case t.Format == PIXEL_FORMAT_RAW && bpp <= 8:
+		for x, v := range row {
+			pix[x] = byte(v)
 		}
-		/* Read preliminary data */
-		switch opcode {
-		case 0: /* Fill */
-			if (lastopcode == opcode) && !((x == width) && (prevline == 0)) {
-				insertmix = true
-			}
-			break
-		case 8: /* Bicolour */
-			CVAL3(&input, &colour1)
-			CVAL3(&input, &colour2)
-			break
-		case 3: /* Colour */
-			CVAL3(&input, &colour2)
-			break
-		case 6: /* SetMix/Mix */
-			fallthrough
-		case 7: /* SetMix/FillOrMix */
-			CVAL3(&input, &mix)
-			opcode -= 5
-			break
-		case 9: /* FillOrMix_1 */
-			mask = 0x03
-			opcode = 0x02
-			fom_mask = 3
-			break
-		case 0x0a: /* FillOrMix_2 */
-			mask = 0x05
-			opcode = 0x02
-			fom_mask = 5
-			break
+	case t.Format == PIXEL_FORMAT_RAW && bpp <= 16:
+		for x, v := range row {
+			p := pix[x*2 : x*2+2 : x*2+2]
+			p[0], p[1] = byte(v>>8), byte(v)
 		}
-
-		lastopcode = opcode
-		mixmask = 0
-		/* Output body */
-		for count > 0 {
-			if x >= width {
-				if height <= 0 {
-					return false
-				}
-
-				x = 0
-				height--
-				prevline = line
-				line = height * width * 3
+	case t.Format == PIXEL_FORMAT_RAW:
+		for x, v := range row {
+			p := pix[x*3 : x*3+3 : x*3+3]
+			p[0], p[1], p[2] = byte(v), byte(v>>8), byte(v>>16)
+		}
+	default:
+		r, b := 0, 2
+		if t.Format == PIXEL_FORMAT_BGRA {
+			r, b = 2, 0
+		}
+		pix = pix[:len(row)*4]
+		switch {
+		case bpp <= 8 && t.Palette != nil:
+			for x, v := range row {
+				putRGB(pix[x*4:x*4+4:x*4+4], t.Palette[v&0xff], r, b)
 			}
-			switch opcode {
-			case 0: /* Fill */
-				if insertmix {
-					if prevline == 0 {
-						out[3*x+line] = mix[0]
-						out[3*x+line+1] = mix[1]
-						out[3*x+line+2] = mix[2]
-					} else {
-						out[3*x+line] = out[prevline+3*x] ^ mix[0]
-						out[3*x+line+1] = out[prevline+3*x+1] ^ mix[1]
-						out[3*x+line+2] = out[prevline+3*x+2] ^ mix[2]
-					}
-					insertmix = false
-					count--
-					x++
-				}
-				if prevline == 0 {
-					REPEAT(func() {
-						out[3*x+line] = 0
-						out[3*x+line+1] = 0
-						out[3*x+line+2] = 0
-					}, &count, &x, width)
-				} else {
-					REPEAT(func() {
-						out[3*x+line] = out[prevline+3*x]
-						out[3*x+line+1] = out[prevline+3*x+1]
-						out[3*x+line+2] = out[prevline+3*x+2]
-					}, &count, &x, width)
-				}
-				break
-			case 1: /* Mix */
-				if prevline == 0 {
-					REPEAT(func() {
-						out[3*x+line] = mix[0]
-						out[3*x+line+1] = mix[1]
-						out[3*x+line+2] = mix[2]
-					}, &count, &x, width)
-				} else {
-					REPEAT(func() {
-						out[3*x+line] = out[prevline+3*x] ^ mix[0]
-						out[3*x+line+1] = out[prevline+3*x+1] ^ mix[1]
-						out[3*x+line+2] = out[prevline+3*x+2] ^ mix[2]
-					}, &count, &x, width)
-				}
-				break
-			case 2: /* Fill or Mix */
-				if prevline == 0 {
-					REPEAT(func() {
-						mixmask = mixmask << 1
-						if mixmask == 0 {
-							mask = fom_mask
-							if fom_mask == 0 {
-								mask = uint8(CVAL(&input))
-								mixmask = 1
-							}
-						}
-						if mask&mixmask != 0 {
-							out[3*x+line] = mix[0]
-							out[3*x+line+1] = mix[1]
-							out[3*x+line+2] = mix[2]
-						} else {
-							out[3*x+line] = 0
-							out[3*x+line+1] = 0
-							out[3*x+line+2] = 0
-						}
-					}, &count, &x, width)
-				} else {
-					REPEAT(func() {
-						mixmask = mixmask << 1
-						if mixmask == 0 {
-							mask = fom_mask
-							if fom_mask == 0 {
-								mask = uint8(CVAL(&input))
-								mixmask = 1
-							}
-						}
-						if mask&mixmask != 0 {
-							out[3*x+line] = out[prevline+3*x] ^ mix[0]
-							out[3*x+line+1] = out[prevline+3*x+1] ^ mix[1]
-							out[3*x+line+2] = out[prevline+3*x+2] ^ mix[2]
-						} else {
-							out[3*x+line] = out[prevline+3*x]
-							out[3*x+line+1] = out[prevline+3*x+1]
-							out[3*x+line+2] = out[prevline+3*x+2]
-						}
-					}, &count, &x, width)
+		case bpp == 15:
+			for x, v := range row {
+				putRGB(pix[x*4:x*4+4:x*4+4], rgb555(v), r, b)
+			}
+		case bpp == 16:
+			for x, v := range row {
+				putRGB(pix[x*4:x*4+4:x*4+4], rgb565(v), r, b)
+			}
+		default:
+			for x, v := range row {
+				if bpp <= 8 {
+					v = v<<16 | v<<8 | v
 				}
-				break
-			case 3: /* Colour */
-				REPEAT(func() {
-					out[3*x+line] = colour2[0]
-					out[3*x+line+1] = colour2[1]
-					out[3*x+line+2] = colour2[2]
-
-				}, &count, &x, width)
-				break
-			case 4: /* Copy */
-				REPEAT(func() {
-					out[3*x+line] = uint8(CVAL(&input))
-					out[3*x+line+1] = uint8(CVAL(&input))
-					out[3*x+line+2] = uint8(CVAL(&input))
-				}, &count, &x, width)
-				break
-			case 8: /* Bicolour */
-				REPEAT(func() {
-					if bicolour {
-						out[3*x+line] = colour2[0]
-						out[3*x+line+1] = colour2[1]
-						out[3*x+line+2] = colour2[2]
-						bicolour = false
-					} else {
-						out[3*x+line] = colour1[0]
-						out[3*x+line+1] = colour1[1]
-						out[3*x+line+2] = colour1[2]
-						bicolour = true
-						count++
-					}
-				}, &count, &x, width)
-				break
-			case 0xd: /* White */
-				REPEAT(func() {
-					out[3*x+line] = 0xff
-					out[3*x+line+1] = 0xff
-					out[3*x+line+2] = 0xff
-
-				}, &count, &x, width)
-				break
-			case 0xe: /* Black */
-				REPEAT(func() {
-					out[3*x+line] = 0
-					out[3*x+line+1] = 0
-					out[3*x+line+2] = 0
-				}, &count, &x, width)
-				break
-			default:
-				fmt.Printf("bitmap opcode 0x%x\n", opcode)
-				return false
+				putRGB(pix[x*4:x*4+4:x*4+4], v, r, b)
 			}
 		}
 	}
-
-	return true
 }
 
-/* decompress a colour plane */
-func processPlane(in *[]uint8, width, height int, output *[]uint8, j int) int {
-	var (
-		indexw   int
-		indexh   int
-		code     int
-		collen   int
-		replen   int
-		color    uint8
-		x        uint8
-		revcode  int
-		lastline int
-		thisline int
-	)
-	ln := len(*in)
+// putRGB writes the color 0xRRGGBB to p, red at r and blue at b
+func putRGB(p []byte, c uint32, r, b int) {
+	p[r], p[1], p[b], p[3] = byte(c>>16), byte(c>>8), byte(c), 0xff
+}
 
-	lastline = 0
-	indexh = 0
-	i := 0
-	for indexh < height {
-		thisline = j + (width * height * 4) - ((indexh + 1) * width * 4)
-		color = 0
-		indexw = 0
-		i = thisline
+func rgb555(v uint32) uint32 {
+	r, g, b := v>>10&0x1f, v>>5&0x1f, v&0x1f
+	return (r<<3|r>>2)<<16 | (g<<3|g>>2)<<8 | (b<<3 | b>>2)
+}
 
-		if lastline == 0 {
-			for indexw < width {
-				code = CVAL(in)
-				replen = int(code & 0xf)
-				collen = int((code >> 4) & 0xf)
-				revcode = (replen << 4) | collen
-				if (revcode <= 47) && (revcode >= 16) {
-					replen = revcode
-					collen = 0
-				}
-				for collen > 0 {
-					color = uint8(CVAL(in))
-					(*output)[i] = uint8(color)
-					i += 4
+func rgb565(v uint32) uint32 {
+	r, g, b := v>>11&0x1f, v>>5&0x3f, v&0x1f
+	return (r<<3|r>>2)<<16 | (g<<2|g>>4)<<8 | (b<<3 | b>>2)
+}
 
-					indexw++
-					collen--
-				}
-				for replen > 0 {
-					(*output)[i] = uint8(color)
-					i += 4
-					indexw++
-					replen--
-				}
-			}
+/**
+ * planar decodes the alpha, red, green and blue planes of a planar
+ * bitmap, raw or run-length encoded, to their channel of t. Rows of
+ * the planes are bottom-up.
+ */
+func (d *RLEDecoder) planar(t *Target, stride int, in []byte, width, height int) error {
+	if len(in) < 1 {
+		return errRLE
+	}
+	header := in[0]
+	in = in[1:]
+	if header&(PLANAR_FORMAT_HEADER_CLL_MASK|PLANAR_FORMAT_HEADER_CS) != 0 {
+		return fmt.Errorf("unsupported planar bitmap 0x%x", header)
+	}
+	// offsets of alpha, red, green and blue in a pixel
+	channels := [4]int{3, 2, 1, 0}
+	if t.Format == PIXEL_FORMAT_RGBA {
+		channels = [4]int{3, 0, 1, 2}
+	}
+	planes := channels[:]
+	if header&PLANAR_FORMAT_HEADER_NA != 0 {
+		planes = channels[1:]
+	}
+	for _, c := range planes {
+		var n int
+		var err error
+		if header&PLANAR_FORMAT_HEADER_RLE != 0 {
+			n, err = rlePlane(t.Pix[c:], stride, in, width, height)
 		} else {
-			for indexw < width {
-				code = CVAL(in)
-				replen = int(code & 0xf)
-				collen = int((code >> 4) & 0xf)
-				revcode = (replen << 4) | collen
-				if (revcode <= 47) && (revcode >= 16) {
-					replen = revcode
-					collen = 0
-				}
-				for collen > 0 {
-					x = uint8(CVAL(in))
-					if x&1 != 0 {
-						x = x >> 1
-						x = x + 1
-						color = -x
-					} else {
-						x = x >> 1
-						color = x
-					}
-					x = (*output)[indexw*4+lastline] + color
-					(*output)[i] = uint8(x)
-					i += 4
-					indexw++
-					collen--
-				}
-				for replen > 0 {
-					x = (*output)[indexw*4+lastline] + color
-					(*output)[i] = uint8(x)
-					i += 4
-					indexw++
-					replen--
-				}
+			n, err = rawPlane(t.Pix[c:], stride, in, width, height)
+		}
+		if err != nil {
+			return err
+		}
+		in = in[n:]
+	}
+	if t.Format != PIXEL_FORMAT_RAW || header&PLANAR_FORMAT_HEADER_NA != 0 {
+		for y := 0; y < height; y++ {
+			row := t.Pix[y*stride+3:]
+			for x := 0; x < width; x++ {
+				row[x*4] = 0xff
 			}
 		}
-		indexh++
-		lastline = thisline
 	}
-	return ln - len(*in)
+	return nil
 }
 
-/* 4 byte bitmap decompress */
-func decompress4(output *[]uint8, width, height int, input []uint8, size int) bool {
-	var (
-		code             int
-		onceBytes, total int
-	)
-
-	code = CVAL(&input)
-	if code != 0x10 {
-		return false
+// rawPlane copies a plane of width x height bytes to every 4 bytes of
+// pix, it returns the size of the plane
+func rawPlane(pix []byte, stride int, in []byte, width, height int) (int, error) {
+	if len(in) < width*height {
+		return 0, errRLE
 	}
-
-	total = 1
-	onceBytes = processPlane(&input, width, height, output, 3)
-	total += onceBytes
-
-	onceBytes = processPlane(&input, width, height, output, 2)
-	total += onceBytes
-
-	onceBytes = processPlane(&input, width, height, output, 1)
-	total += onceBytes
-
-	onceBytes = processPlane(&input, width, height, output, 0)
-	total += onceBytes
-
-	return size == total
+	for r := 0; r < height; r++ {
+		src := in[r*width : r*width+width]
+		dst := pix[(height-1-r)*stride:]
+		for x, v := range src {
+			dst[x*4] = v
+		}
+	}
+	return width * height, nil
 }
 
-/* main decompress function */
-func Decompress(input []uint8, width, height int, Bpp int) []uint8 {
-	size := width * height * Bpp
-	output := make([]uint8, size)
-	switch Bpp {
-	case 1:
-		decompress1(&output, width, height, input, size)
-	case 2:
-		decompress2(&output, width, height, input, size)
-	case 3:
-		decompress3(&output, width, height, input, size)
-	case 4:
-		decompress4(&output, width, height, input, size)
-	default:
-		fmt.Printf("Bpp %d\n", Bpp)
+/**
+ * rlePlane decodes a run-length encoded plane to every 4 bytes of pix:
+ * each segment is raw bytes then a run of the last one, rows after the
+ * first one are the differences to the row above.
+ * It returns the size of the plane.
+ * @see MS-RDPEGDI 2.2.2.5.1.1 Encoded Scan Line (RDP6_RLE_SEGMENTS)
+ */
+func rlePlane(pix []byte, stride int, in []byte, width, height int) (int, error) {
+	i := 0
+	for r := 0; r < height; r++ {
+		line := pix[(height-1-r)*stride:]
+		var above []byte
+		if r > 0 {
+			above = pix[(height-r)*stride:]
+		}
+		var v byte
+		for x := 0; x < width; {
+			if i >= len(in) {
+				return 0, errRLE
+			}
+			run, raw := int(in[i]&0x0f), int(in[i]>>4)
+			i++
+			if run == 1 {
+				run, raw = raw+16, 0
+			} else if run == 2 {
+				run, raw = raw+32, 0
+			}
+			if raw+run == 0 || x+raw+run > width || i+raw > len(in) {
+				return 0, errRLE
+			}
+			if above == nil {
+				for ; raw > 0; raw-- {
+					v = in[i]
+					i++
+					line[x*4] = v
+					x++
+				}
+				for ; run > 0; run-- {
+					line[x*4] = v
+					x++
+				}
+				continue
+			}
+			for ; raw > 0; raw-- {
+				// 2 * magnitude - sign
+				if v = in[i]; v&1 != 0 {
+					v = -(v>>1 + 1)
+				} else {
+					v >>= 1
+				}
+				i++
+				line[x*4] = above[x*4] + v
+				x++
+			}
+			for ; run > 0; run-- {
+				line[x*4] = above[x*4] + v
+				x++
+			}
+		}
 	}
-
-	return output
+	return i, nil
 }
@@ -2,7 +2,9 @@
 package core
 
 import (
+	"bytes"
 	"fmt"
+	"math/rand"
 	"testing"
 )
 
@@ -13,3 +15,278 @@ func TestSum(t *testing.T) {
 	out := Decompress(input, 64, 64, 3)
 	fmt.Println(out)
 }
+
+// randomRLE returns an interleaved RLE stream of all the orders but the
+// special FgBg ones, of n pixels of Bpp bytes
+func randomRLE(rng *rand.Rand, n, Bpp int) []byte {
+	b := &bytes.Buffer{}
+	pixel := func() {
+		for i := 0; i < Bpp; i++ {
+			b.WriteByte(byte(rng.Intn(256)))
+		}
+	}
+	masks := func(n int) {
+		for i := 0; i < (n+7)/8; i++ {
+			b.WriteByte(byte(rng.Intn(256)))
+		}
+	}
+	for n > 0 {
+		count := 1 + rng.Intn(n)
+		if count > 200 {
+			count = 1 + rng.Intn(200)
+		}
+		switch order := rng.Intn(11); order {
+		case 0, 1, 3, 4:
+			// regular background, foreground, color runs and color image
+			if count < 32 {
+				b.WriteByte(byte(order<<5 | count))
+			} else {
+				b.Write([]byte{byte(order << 5), byte(count - 32)})
+			}
+			if order == 3 {
+				pixel()
+			}
+			if order == 4 {
+				for i := 0; i < count; i++ {
+					pixel()
+				}
+			}
+		case 2:
+			// regular foreground/background image
+			if count%8 == 0 && count/8 < 32 {
+				b.WriteByte(byte(0x40 | count/8))
+			} else {
+				b.Write([]byte{0x40, byte(count - 1)})
+			}
+			masks(count)
+		case 5:
+			// set foreground and run
+			if count < 16 {
+				b.WriteByte(byte(0xc0 | count))
+			} else {
+				b.Write([]byte{0xc0, byte(count - 16)})
+			}
+			pixel()
+		case 6:
+			// set foreground and foreground/background image
+			if count%8 == 0 && count/8 < 16 {
+				b.WriteByte(byte(0xd0 | count/8))
+			} else {
+				b.Write([]byte{0xd0, byte(count - 1)})
+			}
+			pixel()
+			masks(count)
+		case 7:
+			// dithered run of pairs
+			if count /= 2; count == 0 {
+				continue
+			}
+			if count < 16 {
+				b.WriteByte(byte(0xe0 | count))
+			} else {
+				b.Write([]byte{0xe0, byte(count - 16)})
+			}
+			pixel()
+			pixel()
+			count *= 2
+		case 8:
+			// mega mega background, foreground and foreground/background image
+			order := []int{0, 1, 2}[rng.Intn(3)]
+			b.Write([]byte{byte(0xf0 | order), byte(count), byte(count >> 8)})
+			if order == 2 {
+				masks(count)
+			}
+		case 9, 10:
+			// white and black pixels
+			count = 1
+			b.WriteByte(byte(0xf4 + order))
+		}
+		n -= count
+	}
+	return b.Bytes()
+}
+
+// randomPlanar returns a run-length encoded planar bitmap with alpha
+func randomPlanar(rng *rand.Rand, width, height int) []byte {
+	b := &bytes.Buffer{}
+	b.WriteByte(PLANAR_FORMAT_HEADER_RLE)
+	for plane := 0; plane < 4; plane++ {
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; {
+				raw := rng.Intn(16)
+				if raw > width-x {
+					raw = width - x
+				}
+				run := []int{0, 3, 9, 15}[rng.Intn(4)]
+				if run > width-x-raw {
+					run = 0
+				}
+				if raw+run == 0 {
+					raw = 1
+				}
+				if raw == 0 && rng.Intn(2) == 0 && width-x >= 16 {
+					// a long run
+					run = 16 + rng.Intn(width-x-15)
+					if run > 47 {
+						run = 47
+					}
+					b.WriteByte(byte((run%16)<<4 | run/16))
+				} else {
+					b.WriteByte(byte(raw<<4 | run))
+				}
+				for i := 0; i < raw; i++ {
+					b.WriteByte(byte(rng.Intn(256)))
+				}
+				x += raw + run
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+type rleCase struct {
+	width, height, bpp int
+	data               []byte
+}
+
+func rleCases(rng *rand.Rand, count int) []rleCase {
+	var cases []rleCase
+	for _, bpp := range []int{8, 15, 16, 24, 32} {
+		for i := 0; i < count; i++ {
+			w, h := 1+rng.Intn(70), 1+rng.Intn(70)
+			c := rleCase{w, h, bpp, nil}
+			if bpp == 32 {
+				c.data = randomPlanar(rng, w, h)
+			} else {
+				c.data = randomRLE(rng, w*h, (bpp+7)/8)
+			}
+			cases = append(cases, c)
+		}
+	}
+	return cases
+}
+
+// toRGBA converts the pixels of refDecompress to R G B A rows of stride bytes
+func toRGBA(raw []byte, width, height, bpp, stride int, palette *[256]uint32) []byte {
+	Bpp := (bpp + 7) / 8
+	out := make([]byte, stride*height)
+	for i := 0; i < width*height; i++ {
+		p := raw[i*Bpp:]
+		var c uint32
+		switch Bpp {
+		case 1:
+			c = palette[p[0]]
+		case 2:
+			if c = rgb565(uint32(p[0])<<8 | uint32(p[1])); bpp == 15 {
+				c = rgb555(uint32(p[0])<<8 | uint32(p[1]))
+			}
+		default:
+			c = uint32(p[2])<<16 | uint32(p[1])<<8 | uint32(p[0])
+		}
+		o := out[i/width*stride+i%width*4:]
+		o[0], o[1], o[2], o[3] = byte(c>>16), byte(c>>8), byte(c), 0xff
+	}
+	return out
+}
+
+func TestDecompressCrossCheck(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	palette := new([256]uint32)
+	for i := range palette {
+		palette[i] = rng.Uint32() & 0xffffff
+	}
+	var d RLEDecoder
+	for _, c := range rleCases(rng, 200) {
+		Bpp := (c.bpp + 7) / 8
+		want := refDecompress(c.data, c.width, c.height, Bpp)
+		if got := Decompress(c.data, c.width, c.height, Bpp); !bytes.Equal(got, want) {
+			t.Fatalf("%dx%d %d bpp differs from the reference", c.width, c.height, c.bpp)
+		}
+
+		stride := c.width*4 + 12
+		rgba := make([]byte, stride*c.height)
+		err := d.Decode(&Target{Pix: rgba, Stride: stride, Format: PIXEL_FORMAT_RGBA, Palette: palette}, c.data, c.width, c.height, c.bpp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(rgba, toRGBA(want, c.width, c.height, c.bpp, stride, palette)) {
+			t.Fatalf("%dx%d %d bpp RGBA differs from the reference", c.width, c.height, c.bpp)
+		}
+	}
+}
+
+func TestDecompressSpecialFgBg(t *testing.T) {
+	out := make([]byte, 8*3)
+	var d RLEDecoder
+	// a white row, then the masks 0x03 and 0x05 of FgBg 1 and 2 over the row above
+	in := []byte{0xfd, 0xfd, 0xfd, 0xfd, 0xfd, 0xfd, 0xfd, 0xfd, 0xf9, 0xfa}
+	if err := d.Decode(&Target{Pix: out}, in, 8, 3, 8); err != nil {
+		t.Fatal(err)
+	}
+	// the mix color 0xff flips the pixels where the mask is set, rows top-down
+	want := []byte{
+		0xff, 0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x00, 0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	}
+	if !bytes.Equal(out, want) {
+		t.Errorf("unexpected pixels %x", out)
+	}
+}
+
+func TestDecompressMalformed(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	var d RLEDecoder
+	for _, c := range rleCases(rng, 5) {
+		out := make([]byte, c.width*c.height*4)
+		for n := range c.data {
+			// truncated data and random bytes must not panic
+			d.Decode(&Target{Pix: out}, c.data[:n], c.width, c.height, c.bpp)
+			junk := append([]byte(nil), c.data[:n]...)
+			rng.Read(junk)
+			d.Decode(&Target{Pix: out}, junk, c.width, c.height, c.bpp)
+		}
+	}
+	if err := d.Decode(&Target{Pix: make([]byte, 10)}, []byte{0x00}, 4, 4, 8); err == nil {
+		t.Error("decoded to a too small target")
+	}
+}
+
+func benchmarkDecompress(b *testing.B, bpp int, decode func(c rleCase)) {
+	rng := rand.New(rand.NewSource(3))
+	c := rleCase{64, 64, bpp, nil}
+	if bpp == 32 {
+		c.data = randomPlanar(rng, 64, 64)
+	} else {
+		c.data = randomRLE(rng, 64*64, (bpp+7)/8)
+	}
+	b.SetBytes(int64(len(c.data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		decode(c)
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	for _, bpp := range []int{8, 16, 24, 32} {
+		b.Run(fmt.Sprintf("reference/%d", bpp), func(b *testing.B) {
+			benchmarkDecompress(b, bpp, func(c rleCase) {
+				refDecompress(c.data, c.width, c.height, (c.bpp+7)/8)
+			})
+		})
+		b.Run(fmt.Sprintf("raw/%d", bpp), func(b *testing.B) {
+			var d RLEDecoder
+			pix := make([]byte, 64*64*4)
+			benchmarkDecompress(b, bpp, func(c rleCase) {
+				d.Decode(&Target{Pix: pix}, c.data, c.width, c.height, c.bpp)
+			})
+		})
+		b.Run(fmt.Sprintf("rgba/%d", bpp), func(b *testing.B) {
+			var d RLEDecoder
+			pix := make([]byte, 64*64*4)
+			benchmarkDecompress(b, bpp, func(c rleCase) {
+				d.Decode(&Target{Pix: pix, Format: PIXEL_FORMAT_RGBA}, c.data, c.width, c.height, c.bpp)
+			})
+		})
+	}
+}
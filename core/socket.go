@@ -2,6 +2,7 @@ package core
 
 import (
 	"crypto/rsa"
+	"crypto/x509"
 	"math/big"
 
 	"github.com/huin/asn1ber"
@@ -13,8 +14,10 @@ import (
 )
 
 type SocketLayer struct {
-	conn    net.Conn
-	tlsConn *tls.Conn
+	conn     net.Conn
+	tlsConn  *tls.Conn
+	host     string
+	verifier CertVerifier
 }
 
 func NewSocketLayer(conn net.Conn) *SocketLayer {
@@ -25,6 +28,31 @@ func NewSocketLayer(conn net.Conn) *SocketLayer {
 	return l
 }
 
+// SetVerifier checks the server certificate of host on StartTLS,
+// without verifier any certificate is accepted
+func (s *SocketLayer) SetVerifier(host string, v CertVerifier) {
+	s.host = host
+	s.verifier = v
+}
+
+func (s *SocketLayer) verifyPeer(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return &CertificateError{s.host, "", ErrCertMissing}
+	}
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		c, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return &CertificateError{s.host, "", err}
+		}
+		certs = append(certs, c)
+	}
+	if err := s.verifier.Verify(s.host, certs); err != nil {
+		return &CertificateError{s.host, Fingerprint(certs[0]), err}
+	}
+	return nil
+}
+
 func (s *SocketLayer) Read(b []byte) (n int, err error) {
 	if s.tlsConn != nil {
 		return s.tlsConn.Read(b)
@@ -56,6 +84,9 @@ func (s *SocketLayer) StartTLS() error {
 		MaxVersion:               tls.VersionTLS13,
 		PreferServerCipherSuites: true,
 	}
+	if s.verifier != nil {
+		config.VerifyPeerCertificate = s.verifyPeer
+	}
 	s.tlsConn = tls.Client(s.conn, config)
 	return s.tlsConn.Handshake()
 }
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrCertUntrusted = errors.New("certificate not trusted")
+	ErrCertChanged   = errors.New("certificate changed since last connection")
+	ErrCertMissing   = errors.New("no certificate presented")
+)
+
+// CertificateError is returned by StartTLS when the verifier refuses the
+// server certificate
+type CertificateError struct {
+	Host        string
+	Fingerprint string
+	Err         error
+}
+
+func (e *CertificateError) Error() string {
+	return fmt.Sprintf("tls certificate of %s (%s): %v", e.Host, e.Fingerprint, e.Err)
+}
+
+func (e *CertificateError) Unwrap() error {
+	return e.Err
+}
+
+// CertVerifier checks the chain presented by the server, leaf first.
+// host is the address the connection was dialed with.
+type CertVerifier interface {
+	Verify(host string, certs []*x509.Certificate) error
+}
+
+type VerifierFunc func(host string, certs []*x509.Certificate) error
+
+func (f VerifierFunc) Verify(host string, certs []*x509.Certificate) error {
+	return f(host, certs)
+}
+
+// Fingerprint is the hex encoded SHA-256 of the DER certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeFingerprint(fp string) string {
+	fp = strings.TrimPrefix(strings.ToLower(fp), "sha256:")
+	return strings.NewReplacer(":", "", " ", "").Replace(fp)
+}
+
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// SystemRoots validates the chain and the host name against roots,
+// nil means the system pool
+func SystemRoots(roots *x509.CertPool) CertVerifier {
+	return VerifierFunc(func(host string, certs []*x509.Certificate) error {
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			DNSName:       hostname(host),
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, c := range certs[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+		_, err := certs[0].Verify(opts)
+		return err
+	})
+}
+
+// PinFingerprints only accepts a leaf certificate with one of the given
+// SHA-256 fingerprints, colons and a "sha256:" prefix are ignored
+func PinFingerprints(fps ...string) CertVerifier {
+	pins := make(map[string]bool, len(fps))
+	for _, fp := range fps {
+		pins[normalizeFingerprint(fp)] = true
+	}
+	return VerifierFunc(func(host string, certs []*x509.Certificate) error {
+		if !pins[Fingerprint(certs[0])] {
+			return ErrCertUntrusted
+		}
+		return nil
+	})
+}
+
+/**
+ * Trust on first use store, one "host fingerprint" line per server.
+ * Unknown hosts are recorded, a changed certificate is refused unless
+ * OnChange returns true, in which case the entry is replaced.
+ */
+type KnownHosts struct {
+	sync.Mutex
+	path     string
+	OnChange func(host, known, presented string) bool
+}
+
+func NewKnownHosts(path string) *KnownHosts {
+	return &KnownHosts{path: path}
+}
+
+func (k *KnownHosts) load() (map[string]string, error) {
+	hosts := make(map[string]string)
+	f, err := os.Open(k.path)
+	if os.IsNotExist(err) {
+		return hosts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		hosts[fields[0]] = normalizeFingerprint(fields[1])
+	}
+	return hosts, s.Err()
+}
+
+func (k *KnownHosts) save(hosts map[string]string) error {
+	var b strings.Builder
+	for h, fp := range hosts {
+		fmt.Fprintf(&b, "%s sha256:%s\n", h, fp)
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+func (k *KnownHosts) Verify(host string, certs []*x509.Certificate) error {
+	k.Lock()
+	defer k.Unlock()
+
+	hosts, err := k.load()
+	if err != nil {
+		return err
+	}
+	fp := Fingerprint(certs[0])
+	known, ok := hosts[host]
+	if ok && known == fp {
+		return nil
+	}
+	if ok && (k.OnChange == nil || !k.OnChange(host, known, fp)) {
+		return ErrCertChanged
+	}
+	hosts[host] = fp
+	return k.save(hosts)
+}
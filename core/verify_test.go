@@ -0,0 +1,67 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func selfSigned(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "rdp"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestPinFingerprints(t *testing.T) {
+	cert := selfSigned(t)
+	if err := PinFingerprints("sha256:"+Fingerprint(cert)).Verify("h:3389", []*x509.Certificate{cert}); err != nil {
+		t.Error(err)
+	}
+	if err := PinFingerprints("00").Verify("h:3389", []*x509.Certificate{cert}); !errors.Is(err, ErrCertUntrusted) {
+		t.Error("unexpected", err)
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	first, second := selfSigned(t), selfSigned(t)
+
+	k := NewKnownHosts(path)
+	if err := k.Verify("h:3389", []*x509.Certificate{first}); err != nil {
+		t.Fatal(err)
+	}
+	k = NewKnownHosts(path)
+	if err := k.Verify("h:3389", []*x509.Certificate{first}); err != nil {
+		t.Error(err)
+	}
+	if err := k.Verify("h:3389", []*x509.Certificate{second}); !errors.Is(err, ErrCertChanged) {
+		t.Error("unexpected", err)
+	}
+	k.OnChange = func(host, known, presented string) bool { return true }
+	if err := k.Verify("h:3389", []*x509.Certificate{second}); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,122 @@
+// xcrush.go
+package core
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// level 1 flags of RDP 6.1 bulk compression
+const (
+	L1_COMPRESSED        = 0x01
+	L1_NO_COMPRESSION    = 0x02
+	L1_PACKET_AT_FRONT   = 0x04
+	L1_INNER_COMPRESSION = 0x10
+)
+
+// history size of RDP 6.1 bulk compression
+const XCRUSH_HISTORY_SIZE = 2000000
+
+var errXCRUSH = errors.New("bad RDP 6.1 compressed data")
+
+/**
+ * XCRUSH decompresses the packets of a RDP 6.1 bulk compressed stream,
+ * the level 1 matches refer to a 2,000,000 bytes history and the level 2
+ * compressor is a MPPC of 64K of its own.
+ * @see MS-RDPEGDI 3.1.8.2 RDP 6.1 Bulk Compression
+ */
+type XCRUSH struct {
+	mppc    *MPPC
+	history []byte
+	// end of the history
+	offset int
+}
+
+func NewXCRUSH() *XCRUSH {
+	return &XCRUSH{mppc: NewMPPC()}
+}
+
+/**
+ * Decompress decompresses data with the PACKET_* flags of flags,
+ * data starts with the level 1 and level 2 flags.
+ * @see MS-RDPEGDI 2.2.2.4 RDP 6.1 Compressed Data (RDP61_COMPRESSED_DATA)
+ */
+func (x *XCRUSH) Decompress(data []byte, flags uint8) ([]byte, error) {
+	if x.history == nil {
+		x.history = make([]byte, XCRUSH_HISTORY_SIZE)
+	}
+	if flags&PACKET_FLUSHED != 0 {
+		for i := range x.history {
+			x.history[i] = 0
+		}
+		x.offset = 0
+	}
+	if flags&PACKET_COMPRESSED == 0 {
+		return data, nil
+	}
+	if len(data) < 2 {
+		return nil, errXCRUSH
+	}
+	l1, l2 := data[0], data[1]
+	data = data[2:]
+	if l2&PACKET_COMPRESSED != 0 {
+		var err error
+		// the level 2 flags have no compression type
+		data, err = x.mppc.Decompress(data, l2&^COMPRESSION_TYPE_MASK|PACKET_COMPR_TYPE_64K)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return x.decompressL1(data, l1)
+}
+
+// decompressL1 appends the literals and matches of data to the history
+func (x *XCRUSH) decompressL1(data []byte, flags uint8) ([]byte, error) {
+	if flags&L1_PACKET_AT_FRONT != 0 {
+		x.offset = 0
+	}
+	start := x.offset
+	literals := data
+	var matches []byte
+	if flags&L1_NO_COMPRESSION == 0 && flags&L1_COMPRESSED != 0 {
+		// MatchCount then RDP61_MATCH_DETAILS of 8 bytes each
+		if len(data) < 2 {
+			return nil, errXCRUSH
+		}
+		n := int(binary.LittleEndian.Uint16(data)) * 8
+		if len(data) < 2+n {
+			return nil, errXCRUSH
+		}
+		matches, literals = data[2:2+n], data[2+n:]
+	}
+
+	h := x.history
+	for ; len(matches) > 0; matches = matches[8:] {
+		length := int(binary.LittleEndian.Uint16(matches))
+		output := start + int(binary.LittleEndian.Uint16(matches[2:]))
+		src := int(binary.LittleEndian.Uint32(matches[4:]))
+
+		// the literals before the match
+		n := output - x.offset
+		if n < 0 || n > len(literals) || output+length > len(h) {
+			return nil, errXCRUSH
+		}
+		copy(h[x.offset:], literals[:n])
+		literals = literals[n:]
+		x.offset = output
+
+		if src >= x.offset || src+length > len(h) {
+			return nil, errXCRUSH
+		}
+		// byte by byte, matches may overlap what they write
+		for i := 0; i < length; i++ {
+			h[x.offset+i] = h[src+i]
+		}
+		x.offset += length
+	}
+	if x.offset+len(literals) > len(h) {
+		return nil, errXCRUSH
+	}
+	x.offset += copy(h[x.offset:], literals)
+	return append([]byte(nil), h[start:x.offset]...), nil
+}
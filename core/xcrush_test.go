@@ -0,0 +1,88 @@
+package core
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// xcrushPacket returns a level 1 compressed packet of matches
+// {length, output offset, history offset} and literals
+func xcrushPacket(matches [][3]int, literals string) []byte {
+	p := []byte{L1_COMPRESSED, 0, 0, 0}
+	binary.LittleEndian.PutUint16(p[2:], uint16(len(matches)))
+	for _, m := range matches {
+		d := make([]byte, 8)
+		binary.LittleEndian.PutUint16(d, uint16(m[0]))
+		binary.LittleEndian.PutUint16(d[2:], uint16(m[1]))
+		binary.LittleEndian.PutUint32(d[4:], uint32(m[2]))
+		p = append(p, d...)
+	}
+	return append(p, literals...)
+}
+
+func TestXCRUSHDecompress(t *testing.T) {
+	flags := uint8(PACKET_COMPR_TYPE_RDP61 | PACKET_COMPRESSED)
+	x := NewXCRUSH()
+	got, err := x.Decompress([]byte("\x12\x00"+bells), flags|PACKET_FLUSHED)
+	if err != nil || string(got) != bells {
+		t.Fatalf("no compression: %q %v", got, err)
+	}
+
+	// ".the.bell.tolls" twice, the second from the first packet
+	got, err = x.Decompress(xcrushPacket([][3]int{{15, 0, 8}, {15, 16, 8}}, "-"), flags)
+	if err != nil || string(got) != ".the.bell.tolls-.the.bell.tolls" {
+		t.Fatalf("matches: %q %v", got, err)
+	}
+
+	// an overlapping match at the front of the history
+	p := xcrushPacket([][3]int{{5, 1, 0}}, "ab")
+	p[0] |= L1_PACKET_AT_FRONT
+	got, err = x.Decompress(p, flags)
+	if err != nil || string(got) != "aaaaaab" {
+		t.Fatalf("overlap: %q %v", got, err)
+	}
+	got, err = x.Decompress(xcrushPacket([][3]int{{2, 0, 5}}, ""), flags)
+	if err != nil || string(got) != "ab" {
+		t.Fatalf("after front: %q %v", got, err)
+	}
+
+	// level 2 compressed with MPPC
+	w := &mppcWriter{big: true}
+	for _, c := range []byte("xyz") {
+		w.literal(c)
+	}
+	got, err = NewXCRUSH().Decompress(append([]byte{L1_NO_COMPRESSION | L1_INNER_COMPRESSION, PACKET_COMPRESSED | PACKET_FLUSHED}, w.buf...), flags)
+	if err != nil || string(got) != "xyz" {
+		t.Fatalf("level 2: %q %v", got, err)
+	}
+}
+
+func TestXCRUSHMalformed(t *testing.T) {
+	flags := uint8(PACKET_COMPR_TYPE_RDP61 | PACKET_COMPRESSED | PACKET_FLUSHED)
+	for name, data := range map[string][]byte{
+		"no flags":        {L1_COMPRESSED},
+		"match count":     {L1_COMPRESSED, 0, 2, 0},
+		"empty history":   xcrushPacket([][3]int{{3, 0, 0}}, ""),
+		"ahead of output": xcrushPacket([][3]int{{3, 2, 2}}, "ab"),
+		"past literals":   xcrushPacket([][3]int{{3, 5, 0}}, "ab"),
+		"backwards":       xcrushPacket([][3]int{{1, 2, 0}, {1, 1, 0}}, "ab"),
+		"past history":    xcrushPacket([][3]int{{0xffff, 1, 0}, {0xffff, 0xfffe, 0}}, "a"),
+		"history offset":  xcrushPacket([][3]int{{3, 1, XCRUSH_HISTORY_SIZE}}, "a"),
+	} {
+		if got, err := NewXCRUSH().Decompress(data, flags); err == nil {
+			t.Errorf("%s: %q", name, got)
+		}
+	}
+}
+
+func TestBulkDecompressor(t *testing.T) {
+	d := NewBulkDecompressor()
+	if got, err := d.Decompress([]byte("\x02\x00abc"), PACKET_COMPR_TYPE_RDP61|PACKET_COMPRESSED); err != nil || string(got) != "abc" {
+		t.Errorf("RDP 6.1: %q %v", got, err)
+	}
+	w := &ncrushWriter{}
+	w.literals("abc")
+	if got, err := d.Decompress(w.bytes(), PACKET_COMPR_TYPE_RDP6|PACKET_COMPRESSED); err != nil || string(got) != "abc" {
+		t.Errorf("RDP 6.0: %q %v", got, err)
+	}
+}
@@ -196,6 +196,14 @@ const (
 	CHANNEL_FLAG_SHOW_PROTOCOL = 0x10
 )
 
+// bulk compression of the chunks, core.PACKET_* flags shifted by 16
+const (
+	CHANNEL_COMPRESSION_TYPE_MASK = 0x000F0000
+	CHANNEL_PACKET_COMPRESSED     = 0x00200000
+	CHANNEL_PACKET_AT_FRONT       = 0x00400000
+	CHANNEL_PACKET_FLUSHED        = 0x00800000
+)
+
 type ChannelTransport interface {
 	GetType() (string, uint32)
 	Sender(core.ChannelSender)
@@ -212,6 +220,8 @@ type Channels struct {
 	transport     core.Transport
 	buff          *bytes.Buffer
 	channelSender core.ChannelSender
+	// history of the compressed chunks of all channels
+	bulk *core.BulkDecompressor
 }
 
 func NewChannels(t core.Transport) *Channels {
@@ -220,6 +230,7 @@ func NewChannels(t core.Transport) *Channels {
 		channels:  make(map[string]ChannelClient, 20),
 		transport: t,
 		buff:      &bytes.Buffer{},
+		bulk:      core.NewBulkDecompressor(),
 	}
 	t.On("channel", c.process)
 	return c
@@ -239,6 +250,11 @@ func (c *Channels) Register(t ChannelTransport) {
 	c.channels[name] = ChannelClient{ChannelDef{name, option}, t}
 }
 
+func (c *Channels) Registered(name string) bool {
+	_, ok := c.channels[name]
+	return ok
+}
+
 func (c *Channels) SendToChannel(channel string, s []byte) (int, error) {
 	cli, ok := c.channels[channel]
 	if !ok {
@@ -286,18 +302,25 @@ func (c *Channels) process(channel string, s []byte) {
 	ln, _ := core.ReadUInt32LE(r)
 	flags, _ := core.ReadUInt32LE(r)
 	glog.Debugf("channel:%s length: %d, flags: %d", channel, ln, flags)
+	b, _ := core.ReadBytes(r.Len(), r)
+	if compression := uint8(flags >> 16); compression != 0 {
+		var err error
+		if b, err = c.bulk.Decompress(b, compression); err != nil {
+			glog.Error("decompress channel", channel, err)
+			return
+		}
+	}
 	if flags&CHANNEL_FLAG_FIRST == 0 || flags&CHANNEL_FLAG_LAST == 0 {
 		if flags&CHANNEL_FLAG_FIRST != 0 {
 			c.buff.Reset()
 		}
-		b, _ := core.ReadBytes(r.Len(), r)
 		c.buff.Write(b)
 		if flags&CHANNEL_FLAG_LAST == 0 {
 			return
 		}
 		s = c.buff.Bytes()
 	} else {
-		s, _ = core.ReadBytes(r.Len(), r)
+		s = b
 	}
 
 	cli.t.Process(s)
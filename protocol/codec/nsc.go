@@ -0,0 +1,159 @@
+// nsc.go
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+)
+
+// NSC_HEADER_SIZE is the size of the header of a NSCodec bitmap stream
+const NSC_HEADER_SIZE = 20
+
+var errNSCodec = errors.New("bad NSCodec bitmap stream")
+
+/**
+ * DecodeNSCodec decodes a NSCodec bitmap stream of width x height pixels:
+ * it expands the run-length encoded luma, orange chroma, green chroma and
+ * alpha planes, super-samples the chroma planes when they were sub-sampled,
+ * restores the color loss and converts YCoCg to RGB.
+ * @see MS-RDPNSC 2.2.2 NSCodec Bitmap Stream (TS_NSCODEC_BITMAP_STREAM)
+ */
+func DecodeNSCodec(data []byte, width, height int) (*image.RGBA, error) {
+	if len(data) < NSC_HEADER_SIZE || width <= 0 || height <= 0 {
+		return nil, errNSCodec
+	}
+	var planeByteCount [4]int
+	for i := range planeByteCount {
+		planeByteCount[i] = int(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+	colorLossLevel := int(data[16])
+	subsampling := data[17] != 0
+	if colorLossLevel < 1 || colorLossLevel > 7 {
+		return nil, errNSCodec
+	}
+
+	// sub-sampled planes have rows of a multiple of 8 pixels
+	// and chroma planes half the width and height of the luma one
+	lumaWidth, chromaWidth := width, width
+	orgByteCount := [4]int{width * height, width * height, width * height, width * height}
+	if subsampling {
+		lumaWidth = (width + 7) &^ 7
+		chromaWidth = lumaWidth / 2
+		orgByteCount[0] = lumaWidth * height
+		orgByteCount[1] = chromaWidth * ((height + 1) / 2)
+		orgByteCount[2] = orgByteCount[1]
+	}
+
+	var planes [4][]byte
+	data = data[NSC_HEADER_SIZE:]
+	for i := range planes {
+		size := planeByteCount[i]
+		if size > len(data) {
+			return nil, errNSCodec
+		}
+		switch plane := data[:size]; {
+		case size == 0:
+			// an opaque alpha plane
+			planes[i] = make([]byte, orgByteCount[i])
+			for j := range planes[i] {
+				planes[i][j] = 0xff
+			}
+		case size < orgByteCount[i]:
+			planes[i] = nscRLEDecode(plane, orgByteCount[i])
+			if planes[i] == nil {
+				return nil, errNSCodec
+			}
+		default:
+			planes[i] = plane[:orgByteCount[i]]
+		}
+		data = data[size:]
+	}
+
+	shift := uint(colorLossLevel - 1)
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		yplane := planes[0][y*lumaWidth:]
+		coplane := planes[1][y*chromaWidth:]
+		cgplane := planes[2][y*chromaWidth:]
+		if subsampling {
+			coplane = planes[1][(y/2)*chromaWidth:]
+			cgplane = planes[2][(y/2)*chromaWidth:]
+		}
+		aplane := planes[3][y*width:]
+		pix := img.Pix[y*img.Stride:]
+		for x := 0; x < width; x++ {
+			cx := x
+			if subsampling {
+				cx = x / 2
+			}
+			yv := int(yplane[x])
+			co := int(int8(coplane[cx] << shift))
+			cg := int(int8(cgplane[cx] << shift))
+			p := pix[x*4 : x*4+4 : x*4+4]
+			p[0] = clamp(yv + co - cg)
+			p[1] = clamp(yv + cg)
+			p[2] = clamp(yv - co - cg)
+			p[3] = aplane[x]
+		}
+	}
+	return img, nil
+}
+
+/**
+ * nscRLEDecode expands a run-length encoded plane of size bytes: a byte
+ * repeated is followed by the run length minus 2, or 0xFF and the 32 bits
+ * run length, and the last 4 bytes of the plane are raw.
+ * @see MS-RDPNSC 2.2.2.1 NSCodec RLE Segments (NSCODEC_RLE_SEGMENTS)
+ */
+func nscRLEDecode(in []byte, size int) []byte {
+	if size < 4 {
+		return nil
+	}
+	out := make([]byte, 0, size)
+	i := 0
+	for size-len(out) > 4 {
+		if i >= len(in) {
+			return nil
+		}
+		v := in[i]
+		i++
+		if size-len(out) == 5 || i >= len(in) || in[i] != v {
+			out = append(out, v)
+			continue
+		}
+		i++
+		if i >= len(in) {
+			return nil
+		}
+		n := int(in[i]) + 2
+		i++
+		if n == 0xff+2 {
+			if i+4 > len(in) {
+				return nil
+			}
+			n = int(binary.LittleEndian.Uint32(in[i:]))
+			i += 4
+		}
+		if n > size-len(out) {
+			return nil
+		}
+		for ; n > 0; n-- {
+			out = append(out, v)
+		}
+	}
+	if i+4 > len(in) {
+		return nil
+	}
+	return append(out, in[i:i+4]...)
+}
+
+func clamp(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 0xff {
+		return 0xff
+	}
+	return uint8(v)
+}
@@ -0,0 +1,42 @@
+package codec_test
+
+import (
+	"bytes"
+	"image/color"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/protocol/codec"
+)
+
+func TestDecodeNSCodec(t *testing.T) {
+	b := &bytes.Buffer{}
+	// run-length encoded luma, raw chroma planes and no alpha plane
+	for _, n := range []uint32{7, 4, 4, 0} {
+		core.WriteUInt32LE(n, b)
+	}
+	// color loss level 2, chroma sub-sampled
+	b.Write([]byte{2, 1, 0, 0})
+	// 16 luma bytes of rows of 8 pixels: 12 repeated, then 4 raw
+	b.Write([]byte{60, 60, 10, 60, 60, 60, 60})
+	// 2x1 chroma pixels of rows of 4
+	b.Write([]byte{10, 0, 0, 0})
+	b.Write([]byte{0xfb, 0, 0, 0})
+
+	img, err := codec.DecodeNSCodec(b.Bytes(), 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := color.RGBA{90, 50, 50, 0xff}
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 2; x++ {
+			if c := img.RGBAAt(x, y); c != want {
+				t.Errorf("pixel (%d, %d) is %v, not %v", x, y, c, want)
+			}
+		}
+	}
+
+	if _, err := codec.DecodeNSCodec(b.Bytes()[:30], 2, 2); err == nil {
+		t.Error("truncated stream decoded")
+	}
+}
@@ -0,0 +1,342 @@
+// rfx.go
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+)
+
+// RemoteFX message block types
+const (
+	WBT_SYNC           = 0xCCC0
+	WBT_CODEC_VERSIONS = 0xCCC1
+	WBT_CHANNELS       = 0xCCC2
+	WBT_CONTEXT        = 0xCCC3
+	WBT_FRAME_BEGIN    = 0xCCC4
+	WBT_FRAME_END      = 0xCCC5
+	WBT_REGION         = 0xCCC6
+	WBT_EXTENSION      = 0xCCC7
+	CBT_REGION         = 0xCAC1
+	CBT_TILESET        = 0xCAC2
+	CBT_TILE           = 0xCAC3
+)
+
+const (
+	WF_MAGIC       = 0xCACCACCA
+	WF_VERSION_1_0 = 0x0100
+)
+
+// entropy algorithms of the context and tileset properties
+const (
+	CLW_ENTROPY_RLGR1 = 0x01
+	CLW_ENTROPY_RLGR3 = 0x04
+)
+
+// RFX_TILE_SIZE is the width and height of a tile
+const RFX_TILE_SIZE = 64
+
+var errRFX = errors.New("bad RemoteFX message")
+
+/**
+ * RFX decodes the RemoteFX messages of a session: the stream starts with
+ * the sync, codec versions, channels and context blocks, then each frame
+ * has a region and a tileset of 64x64 tiles.
+ * @see MS-RDPRFX 2.2.2 Message Type
+ */
+type RFX struct {
+	entropy int
+	rects   []image.Rectangle
+	quants  [][10]uint8
+	tiles   []rfxTile
+	// coefficients of the Y, Cb and Cr components and the DWT temporary buffer
+	coeffs [3][RFX_TILE_SIZE * RFX_TILE_SIZE]int16
+	dwt    [RFX_TILE_SIZE * RFX_TILE_SIZE]int16
+}
+
+type rfxTile struct {
+	quant [3]uint8
+	x, y  int
+	data  [3][]byte
+}
+
+func NewRFX() *RFX {
+	return &RFX{entropy: CLW_ENTROPY_RLGR1}
+}
+
+/**
+ * Decode decodes the blocks of a RemoteFX message. It returns the tiles
+ * of the message, nil if there are none, and the rectangles of them
+ * in the region to draw.
+ */
+func (d *RFX) Decode(data []byte) (*image.RGBA, []image.Rectangle, error) {
+	d.rects, d.quants, d.tiles = nil, nil, nil
+	for len(data) > 0 {
+		if len(data) < 6 {
+			return nil, nil, errRFX
+		}
+		blockType := binary.LittleEndian.Uint16(data)
+		blockLen := int(binary.LittleEndian.Uint32(data[2:]))
+		if blockLen < 6 || blockLen > len(data) {
+			return nil, nil, errRFX
+		}
+		block := data[6:blockLen]
+		data = data[blockLen:]
+
+		var err error
+		switch blockType {
+		case WBT_SYNC:
+			if len(block) < 6 || binary.LittleEndian.Uint32(block) != WF_MAGIC ||
+				binary.LittleEndian.Uint16(block[4:]) != WF_VERSION_1_0 {
+				err = errRFX
+			}
+		case WBT_CONTEXT:
+			// codecId, channelId, ctxId, tileSize and properties
+			if len(block) < 7 {
+				return nil, nil, errRFX
+			}
+			d.entropy = int(binary.LittleEndian.Uint16(block[5:])>>9) & 0x0f
+		case WBT_REGION:
+			err = d.region(block)
+		case WBT_EXTENSION:
+			err = d.tileset(block)
+		case WBT_CODEC_VERSIONS, WBT_CHANNELS, WBT_FRAME_BEGIN, WBT_FRAME_END:
+		default:
+			err = fmt.Errorf("unknown RemoteFX block 0x%x", blockType)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(d.tiles) == 0 {
+		return nil, nil, nil
+	}
+
+	var bounds image.Rectangle
+	for i := range d.tiles {
+		bounds = bounds.Union(d.tiles[i].rect())
+	}
+	img := image.NewRGBA(bounds)
+	var rects []image.Rectangle
+	for i := range d.tiles {
+		t := &d.tiles[i]
+		if err := d.decodeTile(t, img); err != nil {
+			return nil, nil, err
+		}
+		// no rectangles stand for the whole tiles
+		if d.rects == nil {
+			rects = append(rects, t.rect())
+		}
+		for _, r := range d.rects {
+			if r = r.Intersect(t.rect()); !r.Empty() {
+				rects = append(rects, r)
+			}
+		}
+	}
+	return img, rects, nil
+}
+
+// @see MS-RDPRFX 2.2.2.3.3 TS_RFX_REGION
+func (d *RFX) region(b []byte) error {
+	// codecId, channelId, regionFlags and numRects
+	if len(b) < 5 {
+		return errRFX
+	}
+	n := int(binary.LittleEndian.Uint16(b[3:]))
+	b = b[5:]
+	if len(b) < n*8 {
+		return errRFX
+	}
+	if n == 0 {
+		// the whole destination
+		d.rects = nil
+		return nil
+	}
+	d.rects = make([]image.Rectangle, 0, n)
+	for i := 0; i < n; i++ {
+		x := int(binary.LittleEndian.Uint16(b[i*8:]))
+		y := int(binary.LittleEndian.Uint16(b[i*8+2:]))
+		w := int(binary.LittleEndian.Uint16(b[i*8+4:]))
+		h := int(binary.LittleEndian.Uint16(b[i*8+6:]))
+		d.rects = append(d.rects, image.Rect(x, y, x+w, y+h))
+	}
+	return nil
+}
+
+// @see MS-RDPRFX 2.2.2.3.4 TS_RFX_TILESET
+func (d *RFX) tileset(b []byte) error {
+	// codecId, channelId, subtype, idx, properties,
+	// numQuant, tileSize, numTiles and tilesDataSize
+	if len(b) < 16 {
+		return errRFX
+	}
+	if binary.LittleEndian.Uint16(b[2:]) != CBT_TILESET {
+		return nil
+	}
+	d.entropy = int(binary.LittleEndian.Uint16(b[6:])>>10) & 0x0f
+	numQuant := int(b[8])
+	if b[9] != RFX_TILE_SIZE {
+		return errRFX
+	}
+	numTiles := int(binary.LittleEndian.Uint16(b[10:]))
+	b = b[16:]
+
+	// TS_RFX_CODEC_QUANT, 4 bits values of LL3, LH3, HL3, HH3, LH2, HL2, HH2, LH1, HL1, HH1
+	if len(b) < numQuant*5 {
+		return errRFX
+	}
+	d.quants = make([][10]uint8, numQuant)
+	for i := range d.quants {
+		for j := 0; j < 5; j++ {
+			v := b[i*5+j]
+			d.quants[i][j*2], d.quants[i][j*2+1] = v&0x0f, v>>4
+		}
+	}
+	b = b[numQuant*5:]
+
+	d.tiles = make([]rfxTile, 0, numTiles)
+	for i := 0; i < numTiles; i++ {
+		if len(b) < 19 {
+			return errRFX
+		}
+		blockLen := int(binary.LittleEndian.Uint32(b[2:]))
+		if binary.LittleEndian.Uint16(b) != CBT_TILE || blockLen < 19 || blockLen > len(b) {
+			return errRFX
+		}
+		t := rfxTile{
+			quant: [3]uint8{b[6], b[7], b[8]},
+			x:     int(binary.LittleEndian.Uint16(b[9:])) * RFX_TILE_SIZE,
+			y:     int(binary.LittleEndian.Uint16(b[11:])) * RFX_TILE_SIZE,
+		}
+		data := b[19:blockLen]
+		for c := range t.data {
+			n := int(binary.LittleEndian.Uint16(b[13+c*2:]))
+			if n > len(data) {
+				return errRFX
+			}
+			t.data[c], data = data[:n], data[n:]
+		}
+		for _, q := range t.quant {
+			if int(q) >= numQuant {
+				return errRFX
+			}
+		}
+		d.tiles = append(d.tiles, t)
+		b = b[blockLen:]
+	}
+	return nil
+}
+
+func (t *rfxTile) rect() image.Rectangle {
+	return image.Rect(t.x, t.y, t.x+RFX_TILE_SIZE, t.y+RFX_TILE_SIZE)
+}
+
+// decodeTile decodes the components of a tile and converts them to RGB
+func (d *RFX) decodeTile(t *rfxTile, img *image.RGBA) error {
+	if d.entropy != CLW_ENTROPY_RLGR1 && d.entropy != CLW_ENTROPY_RLGR3 {
+		return fmt.Errorf("unknown RemoteFX entropy 0x%x", d.entropy)
+	}
+	for c := range d.coeffs {
+		buf := d.coeffs[c][:]
+		rlgrDecode(t.data[c], buf, d.entropy == CLW_ENTROPY_RLGR3)
+		// LL3 is delta encoded
+		ll3 := buf[4032:]
+		for i := 1; i < len(ll3); i++ {
+			ll3[i] += ll3[i-1]
+		}
+		dequantize(buf, &d.quants[t.quant[c]])
+		inverseDWT(buf, d.dwt[:])
+	}
+	ycbcrToRGB(&d.coeffs, img, t.x, t.y)
+	return nil
+}
+
+/**
+ * dequantize scales the sub-bands by their quantization factor,
+ * the sub-bands are HL1, LH1, HH1, HL2, LH2, HH2, HL3, LH3, HH3, LL3.
+ * @see MS-RDPRFX 3.1.8.1.5 Quantization
+ */
+func dequantize(buf []int16, q *[10]uint8) {
+	bands := [...]struct{ offset, size, q int }{
+		{0, 1024, 8}, {1024, 1024, 7}, {2048, 1024, 9},
+		{3072, 256, 5}, {3328, 256, 4}, {3584, 256, 6},
+		{3840, 64, 2}, {3904, 64, 1}, {3968, 64, 3}, {4032, 64, 0},
+	}
+	for _, b := range bands {
+		shift := int(q[b.q]) - 1
+		if shift <= 0 {
+			continue
+		}
+		s := buf[b.offset : b.offset+b.size]
+		for i := range s {
+			s[i] <<= uint(shift)
+		}
+	}
+}
+
+/**
+ * inverseDWT reverses the 3 levels of the DWT of a tile, the sub-bands
+ * of each level making the LL band of the level above.
+ * @see MS-RDPRFX 3.1.8.1.4 DWT
+ */
+func inverseDWT(buf, tmp []int16) {
+	idwtBlock(buf[3840:], tmp, 8)
+	idwtBlock(buf[3072:], tmp, 16)
+	idwtBlock(buf, tmp, 32)
+}
+
+// idwtBlock reverses a level of the 5/3 lifting DWT, of sub-bands HL,
+// LH, HH and LL of n x n values, to 2n x 2n values at the start of buf
+func idwtBlock(buf, tmp []int16, n int) {
+	w := n * 2
+	hl, lh, hh, ll := buf[:n*n], buf[n*n:2*n*n], buf[2*n*n:3*n*n], buf[3*n*n:4*n*n]
+	lo, hi := tmp[:2*n*n], tmp[2*n*n:4*n*n]
+
+	// horizontally, L from LL and HL and H from LH and HH
+	for y := 0; y < n; y++ {
+		idwtLine(lo[y*w:y*w+w], ll[y*n:], hl[y*n:], n, 1)
+		idwtLine(hi[y*w:y*w+w], lh[y*n:], hh[y*n:], n, 1)
+	}
+	// vertically, from L and H
+	for x := 0; x < w; x++ {
+		idwtLine(buf[x:], lo[x:], hi[x:], n, w)
+	}
+}
+
+// idwtLine computes the 2n values of dst, every stride values,
+// from the n low and high coefficients of l and h
+func idwtLine(dst, l, h []int16, n, stride int) {
+	// even values
+	dst[0] = int16(int(l[0]) - (int(h[0])*2+1)>>1)
+	for i := 1; i < n; i++ {
+		dst[2*i*stride] = int16(int(l[i*stride]) - (int(h[(i-1)*stride])+int(h[i*stride])+1)>>1)
+	}
+	// odd values
+	for i := 0; i < n-1; i++ {
+		dst[(2*i+1)*stride] = int16(int(h[i*stride])<<1 + (int(dst[2*i*stride])+int(dst[(2*i+2)*stride]))>>1)
+	}
+	i := n - 1
+	dst[(2*i+1)*stride] = int16(int(h[i*stride])<<1 + int(dst[2*i*stride]))
+}
+
+/**
+ * ycbcrToRGB converts the components of a tile, scaled by 32 with
+ * luma centered on 0, to the pixels of img at (x0, y0).
+ * @see MS-RDPRFX 3.1.8.1.3 Color Conversion
+ */
+func ycbcrToRGB(c *[3][RFX_TILE_SIZE * RFX_TILE_SIZE]int16, img *image.RGBA, x0, y0 int) {
+	for y := 0; y < RFX_TILE_SIZE; y++ {
+		pix := img.Pix[img.PixOffset(x0, y0+y):]
+		for x := 0; x < RFX_TILE_SIZE; x++ {
+			i := y*RFX_TILE_SIZE + x
+			Y := (int(c[0][i]) + 4096) << 16
+			cb, cr := int(c[1][i]), int(c[2][i])
+			p := pix[x*4 : x*4+4 : x*4+4]
+			p[0] = clamp((Y + cr*91916) >> 21)
+			p[1] = clamp((Y - cb*22527 - cr*46819) >> 21)
+			p[2] = clamp((Y + cb*115992) >> 21)
+			p[3] = 0xff
+		}
+	}
+}
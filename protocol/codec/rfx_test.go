@@ -0,0 +1,98 @@
+package codec_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/protocol/codec"
+)
+
+func rfxBlock(b *bytes.Buffer, blockType uint16, data ...[]byte) {
+	n := 6
+	for _, d := range data {
+		n += len(d)
+	}
+	core.WriteUInt16LE(blockType, b)
+	core.WriteUInt32LE(uint32(n), b)
+	for _, d := range data {
+		b.Write(d)
+	}
+}
+
+// rfxMessage returns a frame of one tile at (64, 0) and the region
+// rectangles, in TS_RFX_RECT
+func rfxMessage(rects ...[]byte) []byte {
+	// RLGR1 coefficients, all zero but the first LL3 one,
+	// 10 for luma and 2 for red chroma
+	y := []byte{0x00, 0x00, 0x1f, 0x11, 0xe8}
+	cr := []byte{0x00, 0x00, 0x1f, 0x10, 0x80}
+
+	b := &bytes.Buffer{}
+	rfxBlock(b, codec.WBT_SYNC, []byte{0xca, 0xac, 0xcc, 0xca, 0x00, 0x01})
+	// RLGR1 entropy in the context properties
+	rfxBlock(b, codec.WBT_CONTEXT, []byte{0, 0xff, 0, 64, 0, 0x28, 0x02})
+	rfxBlock(b, codec.WBT_FRAME_BEGIN, []byte{1, 0, 0, 0, 0, 0, 1, 0})
+	region := []byte{1, 0, 1, byte(len(rects)), 0}
+	for _, r := range rects {
+		region = append(region, r...)
+	}
+	rfxBlock(b, codec.WBT_REGION, append(region, 0xc1, 0xca, 1, 0))
+
+	tile := &bytes.Buffer{}
+	// quantization 6 for all sub-bands, the tile at (64, 0)
+	tile.Write([]byte{0, 0, 0, 1, 0, 0, 0})
+	core.WriteUInt16LE(uint16(len(y)), tile)
+	core.WriteUInt16LE(0, tile)
+	core.WriteUInt16LE(uint16(len(cr)), tile)
+	tile.Write(y)
+	tile.Write(cr)
+	tiles := &bytes.Buffer{}
+	rfxBlock(tiles, codec.CBT_TILE, tile.Bytes())
+
+	tileset := &bytes.Buffer{}
+	tileset.Write([]byte{1, 0})
+	core.WriteUInt16LE(codec.CBT_TILESET, tileset)
+	core.WriteUInt16LE(0, tileset)
+	core.WriteUInt16LE(codec.CLW_ENTROPY_RLGR1<<10|0x0051, tileset)
+	tileset.Write([]byte{1, 64, 1, 0})
+	core.WriteUInt32LE(uint32(tiles.Len()), tileset)
+	tileset.Write([]byte{0x66, 0x66, 0x66, 0x66, 0x66})
+	tileset.Write(tiles.Bytes())
+	rfxBlock(b, codec.WBT_EXTENSION, tileset.Bytes())
+	rfxBlock(b, codec.WBT_FRAME_END, []byte{1, 0})
+	return b.Bytes()
+}
+
+func TestDecodeRFX(t *testing.T) {
+	// a rectangle of 30x10 at (70, 0)
+	img, rects, err := codec.NewRFX().Decode(rfxMessage([]byte{70, 0, 0, 0, 30, 0, 10, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Rect != image.Rect(64, 0, 128, 64) {
+		t.Fatal("unexpected tiles", img.Rect)
+	}
+	if len(rects) != 1 || rects[0] != image.Rect(70, 0, 100, 10) {
+		t.Error("unexpected rectangles", rects)
+	}
+	want := color.RGBA{140, 136, 138, 0xff}
+	for _, p := range []image.Point{{64, 0}, {100, 31}, {127, 63}} {
+		if c := img.RGBAAt(p.X, p.Y); c != want {
+			t.Errorf("pixel %v is %v, not %v", p, c, want)
+		}
+	}
+}
+
+func TestDecodeRFXNoRects(t *testing.T) {
+	// no rectangles stand for the whole destination
+	_, rects, err := codec.NewRFX().Decode(rfxMessage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rects) != 1 || rects[0] != image.Rect(64, 0, 128, 64) {
+		t.Error("unexpected rectangles", rects)
+	}
+}
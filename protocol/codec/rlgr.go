@@ -0,0 +1,145 @@
+// rlgr.go
+package codec
+
+// parameters of the adaptive run-length Golomb-Rice coding
+const (
+	KPMAX = 80
+	LSGR  = 3
+	UP_GR = 4
+	DN_GR = 6
+	UQ_GR = 3
+	DQ_GR = 3
+)
+
+// bitReader reads bits most significant first, zeros past the end
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (b *bitReader) more() bool {
+	return b.pos < len(b.data)*8
+}
+
+func (b *bitReader) bits(n int) int {
+	v := 0
+	for ; n > 0; n-- {
+		v <<= 1
+		if b.more() && b.data[b.pos>>3]&(0x80>>uint(b.pos&7)) != 0 {
+			v |= 1
+		}
+		b.pos++
+	}
+	return v
+}
+
+// updateParam adds d to the parameter p, within 0 and KPMAX,
+// and returns it with the value it stands for
+func updateParam(p, d int) (int, int) {
+	p += d
+	if p < 0 {
+		p = 0
+	} else if p > KPMAX {
+		p = KPMAX
+	}
+	return p, p >> LSGR
+}
+
+// grCode reads a Golomb-Rice code of parameter kr, a unary count of 1s
+// and kr bits, and adapts the parameter
+func grCode(b *bitReader, krp, kr *int) int {
+	vk := 0
+	for b.more() && b.bits(1) == 1 {
+		vk++
+	}
+	mag := vk<<uint(*kr) | b.bits(*kr)
+	if vk == 0 {
+		*krp, *kr = updateParam(*krp, -2)
+	} else if vk != 1 {
+		*krp, *kr = updateParam(*krp, vk)
+	}
+	return mag
+}
+
+// twoMagSign returns the value coded as 2 * magnitude - sign
+func twoMagSign(v int) int16 {
+	if v&1 != 0 {
+		return int16(-((v + 1) >> 1))
+	}
+	return int16(v >> 1)
+}
+
+/**
+ * rlgrDecode decodes RLGR1 or RLGR3 coefficients to out: runs of zeros
+ * while the parameter k is not 0, Golomb-Rice codes of one value with
+ * RLGR1 or two values with RLGR3 when it is. Values missing at the end
+ * of the data are zeros.
+ * @see MS-RDPRFX 3.1.8.1.7.3 RLGR1/RLGR3 Pseudocode
+ */
+func rlgrDecode(data []byte, out []int16, rlgr3 bool) {
+	for i := range out {
+		out[i] = 0
+	}
+	b := &bitReader{data: data}
+	kp, k := 1<<LSGR, 1
+	krp, kr := 1<<LSGR, 1
+	i := 0
+	for i < len(out) && b.more() {
+		if k != 0 {
+			// runs of 1 << k zeros, then a shorter run and a nonzero value
+			for b.bits(1) == 0 {
+				if !b.more() {
+					// the padding of the last byte
+					return
+				}
+				i += 1 << uint(k)
+				kp, k = updateParam(kp, UP_GR)
+			}
+			i += b.bits(k)
+			if i >= len(out) {
+				return
+			}
+			sign := b.bits(1)
+			mag := grCode(b, &krp, &kr) + 1
+			if sign != 0 {
+				mag = -mag
+			}
+			out[i] = int16(mag)
+			i++
+			kp, k = updateParam(kp, -DN_GR)
+			continue
+		}
+
+		mag := grCode(b, &krp, &kr)
+		if !rlgr3 {
+			if mag == 0 {
+				out[i] = 0
+				kp, k = updateParam(kp, UQ_GR)
+			} else {
+				out[i] = twoMagSign(mag)
+				kp, k = updateParam(kp, -DQ_GR)
+			}
+			i++
+			continue
+		}
+
+		// the sum of two values, then the first one in as many bits as the sum
+		n := 0
+		for v := mag; v != 0; v >>= 1 {
+			n++
+		}
+		v1 := b.bits(n)
+		v2 := mag - v1
+		if v1 != 0 && v2 != 0 {
+			kp, k = updateParam(kp, -2*DQ_GR)
+		} else if v1 == 0 && v2 == 0 {
+			kp, k = updateParam(kp, 2*UQ_GR)
+		}
+		out[i] = twoMagSign(v1)
+		i++
+		if i < len(out) {
+			out[i] = twoMagSign(v2)
+			i++
+		}
+	}
+}
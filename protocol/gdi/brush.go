@@ -0,0 +1,126 @@
+// brush.go
+package gdi
+
+import (
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+// BRUSH_CACHE_ENTRIES is the number of entries of each brush cache
+const BRUSH_CACHE_ENTRIES = 64
+
+/**
+ * BrushCache holds the brushes of the Cache Brush orders, monochrome
+ * brushes and color ones have a cache each. Color brushes are only
+ * kept when the client advertised them.
+ */
+type BrushCache struct {
+	support pdu.BrushSupport
+	mono    [BRUSH_CACHE_ENTRIES]*pdu.CacheBrushOrder
+	color   [BRUSH_CACHE_ENTRIES]*pdu.CacheBrushOrder
+}
+
+func NewBrushCache(support pdu.BrushSupport) *BrushCache {
+	return &BrushCache{support: support}
+}
+
+func (c *BrushCache) Put(b *pdu.CacheBrushOrder) {
+	if b.Bpp != 1 && c.support == pdu.BRUSH_DEFAULT {
+		glog.Warn("color brush not supported")
+		return
+	}
+	if int(b.CacheIndex) >= BRUSH_CACHE_ENTRIES {
+		glog.Warnf("brush cache %d out of range", b.CacheIndex)
+		return
+	}
+	if b.Bpp == 1 {
+		c.mono[b.CacheIndex] = b
+	} else {
+		c.color[b.CacheIndex] = b
+	}
+}
+
+// Brush returns the brush at index of the mono or color cache, nil if there is none
+func (c *BrushCache) Brush(index int, mono bool) *pdu.CacheBrushOrder {
+	if index < 0 || index >= BRUSH_CACHE_ENTRIES {
+		return nil
+	}
+	if mono {
+		return c.mono[index]
+	}
+	return c.color[index]
+}
+
+// ColorTableCache holds the palettes of the Cache Color Table orders
+type ColorTableCache struct {
+	tables []*[256]uint32
+}
+
+// NewColorTableCache returns a cache of size color tables
+func NewColorTableCache(size int) *ColorTableCache {
+	return &ColorTableCache{tables: make([]*[256]uint32, size)}
+}
+
+func (c *ColorTableCache) Put(o *pdu.CacheColorTableOrder) {
+	if int(o.CacheIndex) >= len(c.tables) {
+		glog.Warnf("color table cache %d out of range", o.CacheIndex)
+		return
+	}
+	t := new([256]uint32)
+	for i := range t {
+		q := o.ColorTable[i*4:]
+		t[i] = uint32(q[0])<<16 | uint32(q[1])<<8 | uint32(q[2])
+	}
+	c.tables[o.CacheIndex] = t
+}
+
+// Table returns the color table at index, nil if there is none
+func (c *ColorTableCache) Table(index int) *[256]uint32 {
+	if index < 0 || index >= len(c.tables) {
+		return nil
+	}
+	return c.tables[index]
+}
+
+// SetBrushCache sets the caches of a new session, nil ignores their orders
+func (g *GDI) SetBrushCache(brushes *BrushCache, colorTables *ColorTableCache) {
+	g.brushes = brushes
+	g.colorTables = colorTables
+}
+
+// colorTable returns the cached color table of a MemBlt or Mem3Blt order,
+// the session palette if there is none
+func (g *GDI) colorTable(index uint8) *[256]uint32 {
+	if g.colorTables != nil {
+		if t := g.colorTables.Table(int(index)); t != nil {
+			return t
+		}
+	}
+	return &g.palette
+}
+
+// colorBrush converts the pixels of a cached color brush
+func (g *GDI) colorBrush(b *pdu.CacheBrushOrder, pal *[256]uint32) *[64]uint32 {
+	Bpp := b.Bpp / 8
+	if len(b.Data) < 64*Bpp {
+		return nil
+	}
+	c := new([64]uint32)
+	for i := range c {
+		p := b.Data[i*Bpp:]
+		switch Bpp {
+		case 1:
+			c[i] = pal[p[0]]
+		case 2:
+			v := uint16(p[0]) | uint16(p[1])<<8
+			if g.bpp == 15 {
+				c[i] = rgb555(v)
+			} else {
+				c[i] = rgb565(v)
+			}
+		default:
+			c[i] = uint32(p[2])<<16 | uint32(p[1])<<8 | uint32(p[0])
+		}
+	}
+	return c
+}
@@ -0,0 +1,185 @@
+// cache.go
+package gdi
+
+import (
+	"image"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+// CacheStats counts the bitmap cache lookups of MemBlt and Mem3Blt orders
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+	// entries replaced by another bitmap
+	Evictions uint64
+}
+
+/**
+ * BitmapCache holds the bitmaps of the Cache Bitmap orders.
+ * The server chooses the entry each bitmap replaces, a cache
+ * has one more entry for the waiting list, which keeps the
+ * last bitmap the server did not want to cache.
+ * Bitmaps are *image.RGBA, or *image.Paletted for 8 bpp ones,
+ * whose colors depend on the MemBlt or Mem3Blt order drawing them.
+ */
+type BitmapCache struct {
+	caches [][]image.Image
+	stats  CacheStats
+}
+
+// NewBitmapCache returns caches of cells entries
+func NewBitmapCache(cells ...int) *BitmapCache {
+	c := &BitmapCache{caches: make([][]image.Image, len(cells))}
+	for i, n := range cells {
+		c.caches[i] = make([]image.Image, n+1)
+	}
+	return c
+}
+
+func (c *BitmapCache) entry(id, index int) *image.Image {
+	if id < 0 || id >= len(c.caches) {
+		return nil
+	}
+	cache := c.caches[id]
+	if index == pdu.BITMAPCACHE_WAITING_LIST_INDEX {
+		index = len(cache) - 1
+	}
+	if index < 0 || index >= len(cache) {
+		return nil
+	}
+	return &cache[index]
+}
+
+// Put stores bmp, replacing the bitmap at the same place
+func (c *BitmapCache) Put(id, index int, bmp image.Image) {
+	e := c.entry(id, index)
+	if e == nil {
+		glog.Warnf("bitmap cache %d:%d out of range", id, index)
+		return
+	}
+	if *e != nil {
+		c.stats.Evictions++
+	}
+	*e = bmp
+}
+
+// Bitmap returns the bitmap at (id, index), nil if there is none
+func (c *BitmapCache) Bitmap(id, index int) image.Image {
+	var bmp image.Image
+	if e := c.entry(id, index); e != nil {
+		bmp = *e
+	}
+	if bmp == nil {
+		c.stats.Misses++
+	} else {
+		c.stats.Hits++
+	}
+	return bmp
+}
+
+func (c *BitmapCache) Stats() CacheStats {
+	return c.stats
+}
+
+// cacheBitmap decodes the bitmap of a Cache Bitmap order
+func (g *GDI) cacheBitmap(s *pdu.Secondary) {
+	if g.bitmaps == nil {
+		return
+	}
+	switch d := s.Data.(type) {
+	case *pdu.CacheBitmapOrder:
+		bmp := g.decodeCached(d.BitmapDataStream, int(d.BitmapWidth), int(d.BitmapHeight), int(d.BitmapBpp), d.Compressed)
+		g.bitmaps.Put(int(d.CacheId), int(d.CacheIndex), bmp)
+
+	case *pdu.CacheBitmapV2Order:
+		bpp := int(d.BitmapBpp)
+		if bpp == 16 && g.bpp == 15 {
+			bpp = 15
+		}
+		bmp := g.decodeCached(d.BitmapDataStream, int(d.BitmapWidth), int(d.BitmapHeight), bpp, d.Compressed)
+		g.bitmaps.Put(int(d.CacheId), int(d.CacheIndex), bmp)
+		if d.Flags&pdu.CBR2_PERSISTENT_KEY_PRESENT != 0 && g.persist != nil && bmp != nil {
+			g.persist.Put(&PersistentBitmap{
+				CacheId:    int(d.CacheId),
+				Key:        uint64(d.Key1) | uint64(d.Key2)<<32,
+				Width:      int(d.BitmapWidth),
+				Height:     int(d.BitmapHeight),
+				Bpp:        bpp,
+				Compressed: d.Compressed,
+				Data:       d.BitmapDataStream,
+			})
+		}
+
+	case *pdu.CacheBitmapV3Order:
+		b := &d.BitmapData
+		var bmp image.Image
+		if b.CodecID == pdu.CODEC_ID_NONE {
+			bmp = g.decodeCached(b.Data, int(b.Width), int(b.Height), int(b.Bpp), false)
+		} else if img, _ := g.decodeEx(b); img != nil {
+			bmp = img
+		}
+		g.bitmaps.Put(int(d.CacheId), int(d.CacheIndex), bmp)
+		// the persistent cache only keeps uncompressed bitmaps
+		if g.persist != nil && bmp != nil && b.CodecID == pdu.CODEC_ID_NONE {
+			g.persist.Put(&PersistentBitmap{
+				CacheId: int(d.CacheId),
+				Key:     uint64(d.Key1) | uint64(d.Key2)<<32,
+				Width:   int(b.Width),
+				Height:  int(b.Height),
+				Bpp:     int(b.Bpp),
+				Data:    b.Data,
+			})
+		}
+	}
+}
+
+// LoadPersistentCache fills the bitmap cache with the most recent bitmaps
+// of p, and keeps there the new ones. It returns the keys to send in the
+// Persistent Key List PDUs, in the order of the cache entries.
+func (g *GDI) LoadPersistentCache(p *PersistentCache, cells []int) [][]uint64 {
+	g.persist = p
+	if g.bitmaps == nil {
+		return nil
+	}
+	keys := p.Keys(cells)
+	for id := range keys {
+		for i, k := range keys[id] {
+			b := p.Bitmap(k)
+			g.bitmaps.Put(id, i, g.decodeCached(b.Data, b.Width, b.Height, b.Bpp, b.Compressed))
+		}
+	}
+	return keys
+}
+
+// decodeCached decodes a cached bitmap, nil if it is malformed.
+// 8 bpp bitmaps keep their color indices.
+func (g *GDI) decodeCached(data []byte, w, h, bpp int, compressed bool) image.Image {
+	if bpp != 8 {
+		if img := g.decode(data, w, h, bpp, compressed); img != nil {
+			return img
+		}
+		return nil
+	}
+	if w == 0 || h == 0 {
+		return nil
+	}
+	img := image.NewPaletted(image.Rect(0, 0, w, h), nil)
+	if compressed {
+		if err := g.rle.Decode(&core.Target{Pix: img.Pix, Stride: img.Stride}, data, w, h, bpp); err != nil {
+			glog.Warn("bitmap", w, h, bpp, err)
+			return nil
+		}
+		return img
+	}
+	if len(data) < w*h {
+		glog.Warn("bitmap data too short", len(data), w, h, bpp)
+		return nil
+	}
+	for y := 0; y < h; y++ {
+		copy(img.Pix[y*img.Stride:y*img.Stride+w], data[(h-1-y)*w:])
+	}
+	return img
+}
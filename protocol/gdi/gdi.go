@@ -0,0 +1,232 @@
+// gdi.go
+package gdi
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/emission"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+/**
+ * GDI keeps the desktop of a session in memory and draws bitmap
+ * updates and drawing orders on it.
+ * Each update emits "damage" with the []image.Rectangle it changed,
+ * pointer and palette updates emit the events of PointerUpdate
+ * and PaletteUpdate.
+ */
+type GDI struct {
+	emission.Emitter
+	screen *image.RGBA
+	// target of the drawing orders, the screen or an offscreen bitmap
+	fb  *image.RGBA
+	bpp int
+	// colors of a 8 bpp session
+	palette [256]uint32
+	bitmaps *BitmapCache
+	glyphs  *GlyphCache
+	brushes *BrushCache
+	// palettes of MemBlt and Mem3Blt orders
+	colorTables *ColorTableCache
+	offscreen   *OffscreenCache
+	pointers    *PointerCache
+	persist     *PersistentCache
+	rle         core.RLEDecoder
+	// decoders of the surface bits by codec id
+	codecs map[uint8]SurfaceCodec
+	damage []image.Rectangle
+}
+
+func New(width, height, bpp int) *GDI {
+	g := &GDI{
+		Emitter: *emission.NewEmitter(),
+	}
+	for i := range g.palette {
+		g.palette[i] = uint32(i)<<16 | uint32(i)<<8 | uint32(i)
+	}
+	g.RegisterCodec(pdu.CODEC_ID_NONE, SurfaceCodecFunc(g.decodeNone))
+	g.RegisterCodec(pdu.CODEC_ID_NSCODEC, SurfaceCodecFunc(decodeNSCodec))
+	g.RegisterCodec(pdu.CODEC_ID_REMOTEFX, newRFXCodec())
+	g.Resize(width, height, bpp)
+	return g
+}
+
+// Resize drops the framebuffer content when the size changes,
+// orders draw on the screen again
+func (g *GDI) Resize(width, height, bpp int) {
+	g.bpp = bpp
+	if g.screen == nil || g.screen.Rect.Dx() != width || g.screen.Rect.Dy() != height {
+		g.screen = image.NewRGBA(image.Rect(0, 0, width, height))
+	}
+	g.fb = g.screen
+}
+
+// Image returns the framebuffer, updated in place
+func (g *GDI) Image() *image.RGBA {
+	return g.screen
+}
+
+// SetBitmapCache sets the cache of a new session, nil ignores bitmap orders
+func (g *GDI) SetBitmapCache(c *BitmapCache) {
+	g.bitmaps = c
+}
+
+func (g *GDI) BitmapCache() *BitmapCache {
+	return g.bitmaps
+}
+
+// addDamage records r when drawing on the screen
+func (g *GDI) addDamage(r image.Rectangle) {
+	if !r.Empty() && g.fb == g.screen {
+		g.damage = append(g.damage, r)
+	}
+}
+
+func (g *GDI) flush() {
+	if len(g.damage) == 0 {
+		return
+	}
+	d := g.damage
+	g.damage = nil
+	g.Emit("damage", d)
+}
+
+func (g *GDI) pixel(x, y int) uint32 {
+	i := g.fb.PixOffset(x, y)
+	p := g.fb.Pix[i : i+3 : i+3]
+	return uint32(p[0])<<16 | uint32(p[1])<<8 | uint32(p[2])
+}
+
+func (g *GDI) setPixel(x, y int, c uint32) {
+	i := g.fb.PixOffset(x, y)
+	p := g.fb.Pix[i : i+4 : i+4]
+	p[0], p[1], p[2], p[3] = uint8(c>>16), uint8(c>>8), uint8(c), 0xff
+}
+
+// Palette returns the colors of a 8 bpp session, updated in place
+func (g *GDI) Palette() *[256]uint32 {
+	return &g.palette
+}
+
+/**
+ * PaletteUpdate replaces the colors of a 8 bpp session and emits "palette"
+ * with them, the screen and the cached bitmaps keep the former colors
+ * until the server draws them again.
+ * @see MS-RDPBCGR 2.2.9.1.1.3.1.1 Palette Update (TS_UPDATE_PALETTE)
+ */
+func (g *GDI) PaletteUpdate(p *pdu.PaletteUpdateData) {
+	pal := make(color.Palette, len(p.Entries))
+	for i, e := range p.Entries {
+		g.palette[i] = uint32(e.Red)<<16 | uint32(e.Green)<<8 | uint32(e.Blue)
+		pal[i] = color.RGBA{e.Red, e.Green, e.Blue, 0xff}
+	}
+	g.Emit("palette", pal)
+}
+
+// color converts a color of an order, sent in the session color depth
+func (g *GDI) color(c [4]uint8) uint32 {
+	return g.paletteColor(&g.palette, c)
+}
+
+// paletteColor converts a color of an order, pal resolves 8 bpp color indices
+func (g *GDI) paletteColor(pal *[256]uint32, c [4]uint8) uint32 {
+	switch g.bpp {
+	case 8:
+		return pal[c[0]]
+	case 15:
+		return rgb555(uint16(c[0]) | uint16(c[1])<<8)
+	case 16:
+		return rgb565(uint16(c[0]) | uint16(c[1])<<8)
+	}
+	return uint32(c[0])<<16 | uint32(c[1])<<8 | uint32(c[2])
+}
+
+func rgb555(v uint16) uint32 {
+	r, g, b := uint32(v>>10&0x1f), uint32(v>>5&0x1f), uint32(v&0x1f)
+	return (r<<3|r>>2)<<16 | (g<<3|g>>2)<<8 | (b<<3 | b>>2)
+}
+
+func rgb565(v uint16) uint32 {
+	r, g, b := uint32(v>>11&0x1f), uint32(v>>5&0x3f), uint32(v&0x1f)
+	return (r<<3|r>>2)<<16 | (g<<2|g>>4)<<8 | (b<<3 | b>>2)
+}
+
+// Bitmap draws the rectangles of a bitmap update on the screen
+func (g *GDI) Bitmap(bs []pdu.BitmapData) {
+	fb := g.fb
+	g.fb = g.screen
+	defer func() { g.fb = fb }()
+	for i := range bs {
+		b := &bs[i]
+		img := g.decode(b.BitmapDataStream, int(b.Width), int(b.Height), int(b.BitsPerPixel), b.IsCompress())
+		if img == nil {
+			continue
+		}
+		r := image.Rect(int(b.DestLeft), int(b.DestTop), int(b.DestRight)+1, int(b.DestBottom)+1)
+		g.copyImage(r, img)
+	}
+	g.flush()
+}
+
+// decode converts bitmap data to RGBA, uncompressed
+// rows are bottom-up, compressed ones use interleaved RLE
+func (g *GDI) decode(data []byte, w, h, bpp int, compressed bool) *image.RGBA {
+	Bpp := (bpp + 7) / 8
+	if w == 0 || h == 0 || Bpp == 0 {
+		return nil
+	}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	if compressed {
+		t := &core.Target{Pix: img.Pix, Stride: img.Stride, Format: core.PIXEL_FORMAT_RGBA, Palette: &g.palette}
+		if err := g.rle.Decode(t, data, w, h, bpp); err != nil {
+			glog.Warn("bitmap", w, h, bpp, err)
+			return nil
+		}
+		return img
+	}
+	if len(data) < w*h*Bpp {
+		glog.Warn("bitmap data too short", len(data), w, h, bpp)
+		return nil
+	}
+	for y := 0; y < h; y++ {
+		line := data[(h-1-y)*w*Bpp:]
+		for x := 0; x < w; x++ {
+			p := line[x*Bpp:]
+			var c uint32
+			switch Bpp {
+			case 1:
+				c = g.palette[p[0]]
+			case 2:
+				v := uint16(p[0]) | uint16(p[1])<<8
+				if bpp == 15 {
+					c = rgb555(v)
+				} else {
+					c = rgb565(v)
+				}
+			default:
+				c = uint32(p[2])<<16 | uint32(p[1])<<8 | uint32(p[0])
+			}
+			i := img.PixOffset(x, y)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(c>>16), uint8(c>>8), uint8(c), 0xff
+		}
+	}
+	return img
+}
+
+// copyImage copies img to r, clipped to the framebuffer
+func (g *GDI) copyImage(r image.Rectangle, img *image.RGBA) {
+	org := r.Min.Sub(img.Rect.Min)
+	r = r.Intersect(img.Rect.Add(org)).Intersect(g.fb.Rect)
+	if r.Empty() {
+		return
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		s := img.PixOffset(r.Min.X-org.X, y-org.Y)
+		d := g.fb.PixOffset(r.Min.X, y)
+		copy(g.fb.Pix[d:d+r.Dx()*4], img.Pix[s:s+r.Dx()*4])
+	}
+	g.addDamage(r)
+}
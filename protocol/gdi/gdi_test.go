@@ -0,0 +1,555 @@
+package gdi_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/gdi"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+func rgb(img *image.RGBA, x, y int) [3]uint8 {
+	c := img.RGBAAt(x, y)
+	return [3]uint8{c.R, c.G, c.B}
+}
+
+func TestOpaqueRectOrders(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(2, b)
+	// all fields of a 10x10 red rectangle at (0, 0)
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_TYPE_CHANGE, pdu.ORDER_TYPE_OPAQUERECT, 0x7f})
+	for _, v := range []uint16{0, 0, 10, 10} {
+		core.WriteUInt16LE(v, b)
+	}
+	b.Write([]byte{0xff, 0, 0})
+	// the same rectangle moved right by 20 and clipped to x <= 24
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_DELTA_COORDINATES | pdu.TS_BOUNDS, 0x01, 0x0c, 24, 0, 31, 0, 20})
+	o := &pdu.FastPathOrdersPDU{}
+	if err := o.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	g := gdi.New(64, 32, 24)
+	var damage []image.Rectangle
+	g.On("damage", func(r []image.Rectangle) {
+		damage = r
+	})
+	g.Orders(o.OrderPdus)
+
+	red := [3]uint8{0xff, 0, 0}
+	img := g.Image()
+	if rgb(img, 9, 9) != red || rgb(img, 20, 0) != red || rgb(img, 24, 9) != red {
+		t.Error("rectangles not drawn")
+	}
+	if rgb(img, 10, 0) == red || rgb(img, 25, 0) == red {
+		t.Error("rectangles drawn out of bounds")
+	}
+	if len(damage) != 2 || damage[1] != image.Rect(20, 0, 25, 10) {
+		t.Error("unexpected damage", damage)
+	}
+}
+
+func TestPatBltOrder(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(2, b)
+	// all fields of a PatBlt with a pattern brush
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_TYPE_CHANGE, pdu.ORDER_TYPE_PATBLT, 0xff, 0x0f})
+	for _, v := range []uint16{1, 2, 3, 4} {
+		core.WriteUInt16LE(v, b)
+	}
+	b.Write([]byte{0xf0, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 5, 6, 3, 0xaa, 1, 2, 3, 4, 5, 6, 7})
+	// the next order starts right after the brush
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_TYPE_CHANGE, pdu.ORDER_TYPE_OPAQUERECT, 0x01, 9, 0})
+	o := &pdu.FastPathOrdersPDU{}
+	if err := o.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	p, ok := o.OrderPdus[0].Primary.Data.(*pdu.Patblt)
+	if !ok {
+		t.Fatalf("%T", o.OrderPdus[0].Primary.Data)
+	}
+	if p.X != 1 || p.Cy != 4 || p.Opcode != 0xf0 ||
+		p.Bgcolour != [4]uint8{0x11, 0x22, 0x33, 0xff} || p.Fgcolour != [4]uint8{0x44, 0x55, 0x66, 0xff} {
+		t.Errorf("fields %+v", p)
+	}
+	if p.Brush.X != 5 || p.Brush.Y != 6 || p.Brush.Style != 3 || p.Brush.Hatch != 0xaa ||
+		!bytes.Equal(p.Brush.Data, []byte{0xaa, 1, 2, 3, 4, 5, 6, 7}) {
+		t.Errorf("brush %+v", p.Brush)
+	}
+	if r, ok := o.OrderPdus[1].Primary.Data.(*pdu.OpaqueRect); !ok || r.X != 9 {
+		t.Errorf("next order %+v", o.OrderPdus[1].Primary.Data)
+	}
+}
+
+func TestRasterOperations(t *testing.T) {
+	g := gdi.New(16, 16, 24)
+	white := [4]uint8{0xff, 0xff, 0xff}
+	g.Orders([]pdu.OrderPdu{
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.OpaqueRect{Cx: 8, Cy: 8, Colour: white}}},
+		// DSTINVERT over the right half
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Dstblt{X: 4, Cx: 12, Cy: 8, Opcode: 0x55}}},
+		// overlapping SRCCOPY one pixel down
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Scrblt{Y: 1, Cx: 16, Cy: 8, Opcode: 0xCC}}},
+		// R2_XORPEN line on the last row
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.LineTo{Starty: 15, Endx: 4, Endy: 15,
+			Opcode: pdu.GDI_R2_XORPEN, Pen: pdu.Pen{Colour: [4]uint8{0xff}}}}},
+	})
+
+	img := g.Image()
+	for _, c := range []struct {
+		x, y int
+		rgb  [3]uint8
+	}{
+		{0, 0, [3]uint8{0xff, 0xff, 0xff}},
+		{0, 8, [3]uint8{0xff, 0xff, 0xff}},
+		{5, 8, [3]uint8{0, 0, 0}},
+		{12, 8, [3]uint8{0xff, 0xff, 0xff}},
+		{12, 9, [3]uint8{0, 0, 0}},
+		{3, 15, [3]uint8{0xff, 0, 0}},
+		{4, 15, [3]uint8{0, 0, 0}},
+	} {
+		if got := rgb(img, c.x, c.y); got != c.rgb {
+			t.Errorf("pixel (%d, %d) = %v, want %v", c.x, c.y, got, c.rgb)
+		}
+	}
+}
+
+func TestPolygonSc(t *testing.T) {
+	g := gdi.New(16, 16, 16)
+	// 8x8 square, white in RGB565
+	p := &pdu.PolygonSc{X: 2, Y: 2, Opcode: pdu.GDI_R2_COPYPEN, Fillmode: gdi.ALTERNATE,
+		Fgcolour: [4]uint8{0xff, 0xff}, Points: []pdu.Point{{X: 8}, {Y: 8}, {X: -8}}}
+	g.Orders([]pdu.OrderPdu{{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: p}}})
+
+	img := g.Image()
+	if rgb(img, 2, 2) != [3]uint8{0xff, 0xff, 0xff} || rgb(img, 9, 9) != [3]uint8{0xff, 0xff, 0xff} {
+		t.Error("polygon not filled")
+	}
+	if rgb(img, 10, 5) != [3]uint8{} || rgb(img, 5, 10) != [3]uint8{} {
+		t.Error("polygon filled outside")
+	}
+}
+
+func TestBitmapCache(t *testing.T) {
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(1, b)
+	// uncompressed 2x2 24 bpp bitmap in cache 1 entry 5
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_SECONDARY})
+	core.WriteUInt16LE(8, b)
+	core.WriteUInt16LE(0x01|5<<3|pdu.CBR2_HEIGHT_SAME_AS_WIDTH<<7, b)
+	b.Write([]byte{pdu.ORDER_TYPE_BITMAP_UNCOMPRESSED_V2, 2, 12, 5})
+	// bottom row blue, top row red
+	b.Write([]byte{0xff, 0, 0, 0xff, 0, 0, 0, 0, 0xff, 0, 0, 0xff})
+	o := &pdu.FastPathOrdersPDU{}
+	if err := o.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	g := gdi.New(16, 16, 24)
+	g.SetBitmapCache(gdi.NewBitmapCache(10, 10))
+	g.Orders(o.OrderPdus)
+	g.Orders([]pdu.OrderPdu{
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Memblt{CacheId: 1, CacheIdx: 5, X: 10, Y: 10, Cx: 2, Cy: 2, Opcode: 0xCC}}},
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Memblt{CacheId: 1, CacheIdx: 6, Cx: 2, Cy: 2, Opcode: 0xCC}}},
+	})
+
+	img := g.Image()
+	if rgb(img, 11, 10) != [3]uint8{0xff, 0, 0} || rgb(img, 11, 11) != [3]uint8{0, 0, 0xff} {
+		t.Error("cached bitmap not drawn", rgb(img, 11, 10), rgb(img, 11, 11))
+	}
+	if s := g.BitmapCache().Stats(); s.Hits != 1 || s.Misses != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestBitmapCacheColorTable(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	g := gdi.New(8, 8, 8)
+	g.SetBitmapCache(gdi.NewBitmapCache(10))
+	g.SetBrushCache(nil, gdi.NewColorTableCache(6))
+	// color table 1 maps index 1 to red
+	table := &pdu.CacheColorTableOrder{CacheIndex: 1, NumberColors: 256}
+	table.ColorTable[4] = 0xff
+	// uncompressed 2x1 8 bpp bitmap of indices 1 and 2
+	g.Orders([]pdu.OrderPdu{
+		{Type: pdu.ORDER_SECONDARY, Secondary: &pdu.Secondary{Data: table}},
+		{Type: pdu.ORDER_SECONDARY, Secondary: &pdu.Secondary{Data: &pdu.CacheBitmapV2Order{
+			BitmapBpp: 8, BitmapWidth: 2, BitmapHeight: 1, BitmapDataStream: []byte{1, 2}}}},
+	})
+	g.Palette()[2] = 0x0000ff
+	g.Orders([]pdu.OrderPdu{
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Memblt{ColourTable: 1, Cx: 2, Cy: 1, Opcode: 0xCC}}},
+		// no color table 5, the session palette
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Memblt{ColourTable: 5, Y: 1, Cx: 2, Cy: 1, Opcode: 0xCC}}},
+	})
+
+	img := g.Image()
+	if rgb(img, 0, 0) != [3]uint8{0xff, 0, 0} || rgb(img, 1, 0) != [3]uint8{} {
+		t.Error("color table not used", rgb(img, 0, 0), rgb(img, 1, 0))
+	}
+	if rgb(img, 0, 1) != [3]uint8{1, 1, 1} || rgb(img, 1, 1) != [3]uint8{0, 0, 0xff} {
+		t.Error("session palette not used", rgb(img, 0, 1), rgb(img, 1, 1))
+	}
+}
+
+func TestPersistentCache(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	path := filepath.Join(t.TempDir(), "bitmaps")
+	p, err := gdi.OpenPersistentCache(path, 0)
+	if err != nil || p.Len() != 0 {
+		t.Fatal("open missing file", err)
+	}
+	for i := 0; i < 3; i++ {
+		p.Put(&gdi.PersistentBitmap{CacheId: i % 2, Key: uint64(i + 1), Width: 1, Height: 1, Bpp: 24, Data: []byte{0, 0, 0xff}})
+	}
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err = gdi.OpenPersistentCache(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := p.Keys([]int{1, 10}); len(keys[0]) != 1 || keys[0][0] != 3 || len(keys[1]) != 1 || keys[1][0] != 2 {
+		t.Error("unexpected keys", keys)
+	}
+
+	// a damaged last entry keeps the others
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0600)
+	p, _ = gdi.OpenPersistentCache(path, 0)
+	if p.Len() != 2 || p.Bitmap(3) != nil {
+		t.Error("damaged cache not recovered", p.Len())
+	}
+
+	// the file keeps the most recent bitmaps under its size limit
+	p, _ = gdi.OpenPersistentCache(path, int64(len(data)-1))
+	p.Put(&gdi.PersistentBitmap{Key: 4, Width: 1, Height: 1, Bpp: 24, Data: []byte{0, 0, 0}})
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if p.Len() != 2 || p.Bitmap(1) != nil || p.Bitmap(4) == nil {
+		t.Error("oldest bitmap not dropped", p.Len())
+	}
+
+	g := gdi.New(4, 4, 24)
+	g.SetBitmapCache(gdi.NewBitmapCache(10, 10))
+	keys := g.LoadPersistentCache(p, []int{10, 10})
+	if len(keys[0]) != 1 || keys[0][0] != 4 || g.BitmapCache().Bitmap(1, 0) == nil {
+		t.Error("bitmap cache not preloaded", keys)
+	}
+}
+
+func TestGlyphIndex(t *testing.T) {
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(2, b)
+	// glyph 1 of cache 0, 2x2 above the baseline
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_SECONDARY})
+	core.WriteUInt16LE(9, b)
+	core.WriteUInt16LE(0, b)
+	b.Write([]byte{pdu.ORDER_TYPE_CACHE_GLYPH, 0, 1})
+	for _, v := range []uint16{1, 0, 0xfffe, 2, 2} {
+		core.WriteUInt16LE(v, b)
+	}
+	b.Write([]byte{0xc0, 0x40, 0, 0})
+	// red text over a blue opaque rectangle
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_TYPE_CHANGE, pdu.ORDER_TYPE_TEXT2, 0x31, 0x3c, 0x38, 0})
+	b.Write([]byte{0xff, 0, 0, 0, 0, 0xff})
+	for _, v := range []uint16{10, 10, 20, 14, 10, 12} {
+		core.WriteUInt16LE(v, b)
+	}
+	// two glyphs kept as fragment 0, then the fragment again 8 pixels right
+	b.Write([]byte{10, 1, 0, 1, 4, pdu.GLYPH_FRAGMENT_ADD, 0, 4, pdu.GLYPH_FRAGMENT_USE, 0, 8})
+	o := &pdu.FastPathOrdersPDU{}
+	if err := o.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	g := gdi.New(32, 16, 24)
+	g.SetGlyphCache(gdi.NewGlyphCache(10))
+	g.Orders(o.OrderPdus)
+
+	img := g.Image()
+	red, blue := [3]uint8{0xff, 0, 0}, [3]uint8{0, 0, 0xff}
+	for _, c := range []struct {
+		x, y int
+		rgb  [3]uint8
+	}{
+		{10, 10, red},
+		{11, 11, red},
+		{10, 11, blue},
+		{14, 10, red},
+		{19, 13, blue},
+		{22, 10, red},
+		{23, 11, red},
+		{26, 10, red},
+		{22, 11, [3]uint8{}},
+		{24, 10, [3]uint8{}},
+	} {
+		if got := rgb(img, c.x, c.y); got != c.rgb {
+			t.Errorf("pixel (%d, %d) = %v, want %v", c.x, c.y, got, c.rgb)
+		}
+	}
+}
+
+func TestCachedBrush(t *testing.T) {
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(2, b)
+	// monochrome brush 2, top row set
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_SECONDARY, 7, 0, 0, 0, pdu.ORDER_TYPE_CACHE_BRUSH})
+	b.Write([]byte{2, pdu.BMF_1BPP, 8, 8, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0xff})
+	// compressed 32 bpp brush 1, top row red and the others blue
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_SECONDARY, 31, 0, 0, 0, pdu.ORDER_TYPE_CACHE_BRUSH})
+	b.Write([]byte{1, pdu.BMF_32BPP, 8, 8, 0, 32})
+	b.Write(make([]byte, 14))
+	b.Write([]byte{0x55, 0x55, 0xff, 0, 0, 0, 0, 0, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	o := &pdu.FastPathOrdersPDU{}
+	if err := o.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	g := gdi.New(16, 8, 32)
+	g.SetBrushCache(gdi.NewBrushCache(pdu.BRUSH_COLOR_8x8), gdi.NewColorTableCache(6))
+	g.Orders(o.OrderPdus)
+	g.Orders([]pdu.OrderPdu{
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Patblt{Cx: 8, Cy: 8, Opcode: 0xF0,
+			Fgcolour: [4]uint8{0, 0xff}, Bgcolour: [4]uint8{0xff, 0xff, 0xff},
+			Brush: pdu.Brush{Style: gdi.CACHED_BRUSH | pdu.BMF_1BPP, Hatch: 2}}}},
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Patblt{X: 8, Cx: 8, Cy: 8, Opcode: 0xF0,
+			Brush: pdu.Brush{Style: gdi.CACHED_BRUSH | pdu.BMF_32BPP, Hatch: 1}}}},
+	})
+
+	img := g.Image()
+	for _, c := range []struct {
+		x, y int
+		rgb  [3]uint8
+	}{
+		{0, 0, [3]uint8{0xff, 0xff, 0xff}},
+		{7, 1, [3]uint8{0, 0xff, 0}},
+		{8, 0, [3]uint8{0xff, 0, 0}},
+		{15, 7, [3]uint8{0, 0, 0xff}},
+	} {
+		if got := rgb(img, c.x, c.y); got != c.rgb {
+			t.Errorf("pixel (%d, %d) = %v, want %v", c.x, c.y, got, c.rgb)
+		}
+	}
+}
+
+func TestOffscreenBitmap(t *testing.T) {
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(3, b)
+	// create the 4x4 offscreen bitmap 3, deleting bitmap 1, and draw on it
+	b.Write([]byte{pdu.ORDER_TYPE_CREATE_OFFSCREEN_BITMAP<<2 | pdu.TS_SECONDARY})
+	for _, v := range []uint16{3 | 0x8000, 4, 4, 1, 1} {
+		core.WriteUInt16LE(v, b)
+	}
+	b.Write([]byte{pdu.ORDER_TYPE_SWITCH_SURFACE<<2 | pdu.TS_SECONDARY, 3, 0})
+	b.Write([]byte{pdu.TS_STANDARD | pdu.TS_TYPE_CHANGE, pdu.ORDER_TYPE_OPAQUERECT, 0x7f})
+	for _, v := range []uint16{1, 1, 10, 10} {
+		core.WriteUInt16LE(v, b)
+	}
+	b.Write([]byte{0xff, 0, 0})
+	o := &pdu.FastPathOrdersPDU{}
+	if err := o.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	g := gdi.New(16, 16, 24)
+	g.SetOffscreenCache(gdi.NewOffscreenCache(1, 10))
+	var damage []image.Rectangle
+	g.On("damage", func(r []image.Rectangle) {
+		damage = append(damage, r...)
+	})
+	g.Orders(o.OrderPdus)
+	if len(damage) != 0 || rgb(g.Image(), 1, 1) != [3]uint8{} {
+		t.Error("offscreen drawing reached the screen", damage)
+	}
+
+	g.Orders([]pdu.OrderPdu{
+		{Type: pdu.ORDER_ALTSEC, Altsec: &pdu.Altsec{Data: &pdu.SwitchSurfaceOrder{BitmapId: pdu.SCREEN_BITMAP_SURFACE}}},
+		{Type: pdu.ORDER_PRIMARY, Primary: &pdu.Primary{Data: &pdu.Memblt{CacheId: gdi.OFFSCREEN_CACHE_ID, CacheIdx: 3,
+			X: 8, Y: 8, Cx: 4, Cy: 4, Opcode: 0xCC}}},
+	})
+	img := g.Image()
+	if rgb(img, 8, 8) != [3]uint8{} || rgb(img, 9, 9) != [3]uint8{0xff, 0, 0} || rgb(img, 11, 11) != [3]uint8{0xff, 0, 0} {
+		t.Error("offscreen bitmap not copied")
+	}
+	if len(damage) != 1 || damage[0] != image.Rect(8, 8, 12, 12) {
+		t.Error("unexpected damage", damage)
+	}
+}
+
+func TestSurfaceBits(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(pdu.CMDTYPE_FRAME_MARKER, b)
+	core.WriteUInt16LE(pdu.SURFACECMD_FRAMEACTION_BEGIN, b)
+	core.WriteUInt32LE(7, b)
+	// a 2x2 uncompressed 32 bpp bitmap at (4, 2), a blue bottom row under a red one
+	core.WriteUInt16LE(pdu.CMDTYPE_STREAM_SURFACE_BITS, b)
+	for _, v := range []uint16{4, 2, 6, 4} {
+		core.WriteUInt16LE(v, b)
+	}
+	b.Write([]byte{32, 0, 0, pdu.CODEC_ID_NONE})
+	core.WriteUInt16LE(2, b)
+	core.WriteUInt16LE(2, b)
+	core.WriteUInt32LE(16, b)
+	b.Write([]byte{0xff, 0, 0, 0, 0xff, 0, 0, 0, 0, 0, 0xff, 0, 0, 0, 0xff, 0})
+	core.WriteUInt16LE(pdu.CMDTYPE_FRAME_MARKER, b)
+	core.WriteUInt16LE(pdu.SURFACECMD_FRAMEACTION_END, b)
+	core.WriteUInt32LE(7, b)
+
+	cmds := &pdu.FastPathSurfaceCmds{}
+	if err := cmds.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds.Cmds) != 3 {
+		t.Fatal("unexpected commands", cmds.Cmds)
+	}
+	if m, ok := cmds.Cmds[2].(*pdu.FrameMarker); !ok || m.FrameAction != pdu.SURFACECMD_FRAMEACTION_END || m.FrameId != 7 {
+		t.Error("unexpected frame marker", cmds.Cmds[2])
+	}
+
+	g := gdi.New(16, 16, 32)
+	var damage []image.Rectangle
+	g.On("damage", func(r []image.Rectangle) {
+		damage = r
+	})
+	g.SurfaceBits(cmds.Cmds[1].(*pdu.SurfaceBits))
+	img := g.Image()
+	if rgb(img, 4, 2) != [3]uint8{0xff, 0, 0} || rgb(img, 5, 3) != [3]uint8{0, 0, 0xff} {
+		t.Error("surface bits not drawn")
+	}
+	if len(damage) != 1 || damage[0] != image.Rect(4, 2, 6, 4) {
+		t.Error("unexpected damage", damage)
+	}
+}
+
+func TestPointerUpdate(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	b := &bytes.Buffer{}
+	// a 2x2 color pointer cached at 3 with its hotspot at (1, 0)
+	for _, v := range []uint16{pdu.TS_PTRMSGTYPE_COLOR, 0, 3, 1, 0, 2, 2, 4, 12} {
+		core.WriteUInt16LE(v, b)
+	}
+	// bottom-up BGR rows padded to 6 bytes, white and black then red and black
+	b.Write([]byte{0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0xff, 0, 0, 0})
+	// bottom-up AND rows, both pixels then the black one
+	b.Write([]byte{0xc0, 0, 0x40, 0})
+	d := &pdu.PointerDataPDU{}
+	if err := d.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	g := gdi.New(64, 32, 24)
+	g.SetPointerCache(gdi.NewPointerCache(4))
+	var ptr *gdi.Pointer
+	g.On("pointer", func(p *gdi.Pointer) {
+		ptr = p
+	})
+	g.PointerUpdate(d.Data)
+	if ptr == nil || ptr.Image == nil || ptr.Hotspot != image.Pt(1, 0) {
+		t.Fatalf("pointer %+v", ptr)
+	}
+	for _, c := range []struct {
+		x, y int
+		want [4]uint8
+	}{
+		{0, 0, [4]uint8{0xff, 0, 0, 0xff}},
+		// black under the AND mask is transparent
+		{1, 0, [4]uint8{}},
+		{1, 1, [4]uint8{}},
+		// inverted white is drawn black or white in turns
+		{0, 1, [4]uint8{0, 0, 0, 0xff}},
+	} {
+		p := ptr.Image.RGBAAt(c.x, c.y)
+		if got := [4]uint8{p.R, p.G, p.B, p.A}; got != c.want {
+			t.Errorf("pixel (%d, %d) %v, want %v", c.x, c.y, got, c.want)
+		}
+	}
+
+	cached := ptr
+	ptr = nil
+	g.PointerUpdate(&pdu.CachedPointer{CacheIndex: 3})
+	if ptr != cached {
+		t.Errorf("cached pointer %+v", ptr)
+	}
+
+	// a 1x1 pointer of 32 bpp without AND mask keeps its alpha
+	g.PointerUpdate(&pdu.NewPointer{ColorPointer: pdu.ColorPointer{XorBpp: 32, Width: 1, Height: 1,
+		XorMask: []byte{0, 0, 0xff, 0x80}}})
+	if p := ptr.Image.RGBAAt(0, 0); p.R != 0x80 || p.A != 0x80 {
+		t.Errorf("alpha pointer %v", p)
+	}
+
+	var x, y int
+	hidden := false
+	g.On("pointer-position", func(px, py int) {
+		x, y = px, py
+	}).On("pointer-hidden", func() {
+		hidden = true
+	})
+	g.PointerUpdate(&pdu.PointerPosition{X: 10, Y: 20})
+	g.PointerUpdate(&pdu.SystemPointer{Type: pdu.SYSPTR_NULL})
+	if x != 10 || y != 20 || !hidden {
+		t.Errorf("position (%d, %d), hidden %v", x, y, hidden)
+	}
+	g.PointerUpdate(&pdu.SystemPointer{Type: pdu.SYSPTR_DEFAULT})
+	if ptr.Image != nil {
+		t.Error("default pointer has an image")
+	}
+}
+
+func TestPaletteUpdate(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	b := &bytes.Buffer{}
+	// pad2Octets and numberColors, 0 is black and 1 is orange
+	core.WriteUInt16LE(0, b)
+	core.WriteUInt32LE(2, b)
+	b.Write([]byte{0, 0, 0, 0xff, 0x80, 0})
+	p := &pdu.PaletteUpdateData{}
+	if err := p.Unpack(b); err != nil {
+		t.Fatal(err)
+	}
+
+	g := gdi.New(8, 8, 8)
+	var pal color.Palette
+	g.On("palette", func(p color.Palette) {
+		pal = p
+	})
+	g.PaletteUpdate(p)
+	if len(pal) != 2 || pal[1] != (color.RGBA{0xff, 0x80, 0, 0xff}) {
+		t.Fatalf("palette %v", pal)
+	}
+
+	// a 4x1 uncompressed bitmap of indices and an orange rectangle
+	g.Bitmap([]pdu.BitmapData{{DestRight: 3, Width: 4, Height: 1, BitsPerPixel: 8,
+		BitmapDataStream: []byte{1, 0, 1, 1}}})
+	if rgb(g.Image(), 0, 0) != [3]uint8{0xff, 0x80, 0} || rgb(g.Image(), 1, 0) != [3]uint8{} {
+		t.Errorf("bitmap %v %v", rgb(g.Image(), 0, 0), rgb(g.Image(), 1, 0))
+	}
+	o := &bytes.Buffer{}
+	core.WriteUInt16LE(1, o)
+	o.Write([]byte{pdu.TS_STANDARD | pdu.TS_TYPE_CHANGE, pdu.ORDER_TYPE_OPAQUERECT, 0x1f})
+	for _, v := range []uint16{0, 2, 8, 6} {
+		core.WriteUInt16LE(v, o)
+	}
+	o.Write([]byte{1})
+	orders := &pdu.FastPathOrdersPDU{}
+	if err := orders.Unpack(o); err != nil {
+		t.Fatal(err)
+	}
+	g.Orders(orders.OrderPdus)
+	if rgb(g.Image(), 4, 4) != [3]uint8{0xff, 0x80, 0} {
+		t.Errorf("order color %v", rgb(g.Image(), 4, 4))
+	}
+}
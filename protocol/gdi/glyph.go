@@ -0,0 +1,264 @@
+// glyph.go
+package gdi
+
+import (
+	"image"
+
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+// GLYPH_FRAGMENTS is the number of entries of the fragment cache
+const GLYPH_FRAGMENTS = 256
+
+/**
+ * GlyphCache holds the glyphs of the Cache Glyph and FastGlyph orders
+ * and the fragments, runs of glyph indices, of the text orders.
+ */
+type GlyphCache struct {
+	caches    [][]*pdu.CacheGlyph
+	fragments [GLYPH_FRAGMENTS][]byte
+}
+
+// NewGlyphCache returns caches of cells entries
+func NewGlyphCache(cells ...int) *GlyphCache {
+	c := &GlyphCache{caches: make([][]*pdu.CacheGlyph, len(cells))}
+	for i, n := range cells {
+		c.caches[i] = make([]*pdu.CacheGlyph, n)
+	}
+	return c
+}
+
+func (c *GlyphCache) Put(id int, glyph *pdu.CacheGlyph) {
+	index := int(glyph.CacheIndex)
+	if id < 0 || id >= len(c.caches) || index >= len(c.caches[id]) {
+		glog.Warnf("glyph cache %d:%d out of range", id, index)
+		return
+	}
+	c.caches[id][index] = glyph
+}
+
+// Glyph returns the glyph at (id, index), nil if there is none
+func (c *GlyphCache) Glyph(id, index int) *pdu.CacheGlyph {
+	if id < 0 || id >= len(c.caches) || index < 0 || index >= len(c.caches[id]) {
+		return nil
+	}
+	return c.caches[id][index]
+}
+
+func (c *GlyphCache) PutFragment(index int, data []byte) {
+	c.fragments[index%GLYPH_FRAGMENTS] = append([]byte(nil), data...)
+}
+
+func (c *GlyphCache) Fragment(index int) []byte {
+	return c.fragments[index%GLYPH_FRAGMENTS]
+}
+
+// SetGlyphCache sets the cache of a new session, nil ignores text orders
+func (g *GDI) SetGlyphCache(c *GlyphCache) {
+	g.glyphs = c
+}
+
+func (g *GDI) cacheGlyph(o *pdu.CacheGlyphOrder) {
+	if g.glyphs == nil {
+		return
+	}
+	for i := range o.Glyphs {
+		g.glyphs.Put(int(o.CacheId), &o.Glyphs[i])
+	}
+}
+
+// glyphText draws the glyphs of a text order
+type glyphText struct {
+	g         *GDI
+	cacheId   int
+	flAccel   uint8
+	ulCharInc uint8
+	// FastGlyph draws the glyph at index alone
+	single bool
+	index  int
+	x, y   int
+	pat    *brush
+	clip   image.Rectangle
+	damage image.Rectangle
+}
+
+// inlineOffsets tells whether each glyph index is followed by its offset
+func (t *glyphText) inlineOffsets() bool {
+	return t.ulCharInc == 0 && t.flAccel&pdu.SO_CHAR_INC_EQUAL_BM_BASE == 0
+}
+
+// offset reads the offset at data[i], a byte or 0x80 followed
+// by 16 bits, and moves the pen. It returns the next index.
+func (t *glyphText) offset(data []byte, i int) int {
+	if i >= len(data) {
+		return i
+	}
+	v := int(data[i])
+	i++
+	if v&0x80 != 0 {
+		if i+1 >= len(data) {
+			return len(data)
+		}
+		v = int(int16(uint16(data[i]) | uint16(data[i+1])<<8))
+		i += 2
+	}
+	if t.flAccel&pdu.SO_VERTICAL != 0 {
+		t.y += v
+	} else {
+		t.x += v
+	}
+	return i
+}
+
+/**
+ * run draws the glyph indices of data, adding and replaying fragments:
+ * GLYPH_FRAGMENT_ADD keeps the bytes before it as a fragment,
+ * GLYPH_FRAGMENT_USE draws a fragment.
+ * @see MS-RDPEGDI GlyphIndex (GLYPHINDEX_ORDER)
+ */
+func (t *glyphText) run(data []byte, fragments bool) {
+	for i := 0; i < len(data); {
+		switch op := data[i]; {
+		case fragments && op == pdu.GLYPH_FRAGMENT_USE:
+			if i+1 >= len(data) {
+				return
+			}
+			frag := t.g.glyphs.Fragment(int(data[i+1]))
+			i += 2
+			if t.inlineOffsets() {
+				i = t.offset(data, i)
+			}
+			t.run(frag, false)
+
+		case fragments && op == pdu.GLYPH_FRAGMENT_ADD:
+			if i+2 >= len(data) {
+				return
+			}
+			size := int(data[i+2])
+			if size <= i {
+				t.g.glyphs.PutFragment(int(data[i+1]), data[i-size:i])
+			}
+			i += 3
+
+		default:
+			i++
+			if t.inlineOffsets() {
+				i = t.offset(data, i)
+			}
+			t.glyph(int(op))
+		}
+	}
+}
+
+// glyph draws a glyph at the pen position and advances it
+func (t *glyphText) glyph(index int) {
+	glyph := t.g.glyphs.Glyph(t.cacheId, index)
+	if glyph == nil {
+		glog.Debugf("gdi missing glyph %d:%d", t.cacheId, index)
+		return
+	}
+	x0, y0 := t.x+int(glyph.X), t.y+int(glyph.Y)
+	w, h := int(glyph.Width), int(glyph.Height)
+	stride := (w + 7) / 8
+	r := image.Rect(x0, y0, x0+w, y0+h).Intersect(t.clip)
+	if len(glyph.Data) < stride*h {
+		r = image.Rectangle{}
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		row := glyph.Data[(y-y0)*stride:]
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if row[(x-x0)/8]&(0x80>>uint((x-x0)%8)) != 0 {
+				t.g.setPixel(x, y, t.pat.at(x, y))
+			}
+		}
+	}
+	t.damage = t.damage.Union(r)
+
+	if t.flAccel&pdu.SO_CHAR_INC_EQUAL_BM_BASE != 0 {
+		t.advance(w)
+	} else if t.ulCharInc != 0 {
+		t.advance(int(t.ulCharInc))
+	}
+}
+
+func (t *glyphText) advance(v int) {
+	if t.flAccel&pdu.SO_VERTICAL != 0 {
+		t.y += v
+	} else {
+		t.x += v
+	}
+}
+
+// textRect is the rectangle of a text order, empty unless
+// right and bottom are past left and top
+func textRect(left, top, right, bottom int32) image.Rectangle {
+	if right <= left || bottom <= top {
+		return image.Rectangle{}
+	}
+	return image.Rect(int(left), int(top), int(right), int(bottom))
+}
+
+// text fills the opaque rectangle op and draws the glyphs of data over it
+func (g *GDI) text(t *glyphText, op image.Rectangle, opColour uint32, data []byte) {
+	if g.glyphs == nil {
+		return
+	}
+	t.g = g
+	g.blt(op.Intersect(t.clip), 0xF0, nil, solidBrush(opColour))
+	if t.single {
+		t.glyph(t.index)
+	} else {
+		t.run(data, true)
+	}
+	g.addDamage(t.damage)
+}
+
+func (g *GDI) glyphIndex(d *pdu.GlyphIndex, clip image.Rectangle) {
+	op := textRect(d.OpLeft, d.OpTop, d.OpRight, d.OpBottom)
+	if d.FOpRedundant != 0 {
+		op = textRect(d.BkLeft, d.BkTop, d.BkRight, d.BkBottom)
+	}
+	t := &glyphText{
+		cacheId:   int(d.CacheId),
+		flAccel:   d.FlAccel,
+		ulCharInc: d.UlCharInc,
+		x:         int(d.X),
+		y:         int(d.Y),
+		pat:       g.newBrush(&d.Brush, d.Bgcolour, d.Fgcolour, &g.palette),
+		clip:      clip,
+	}
+	g.text(t, op, g.color(d.Fgcolour), d.Data)
+}
+
+func (g *GDI) fastIndex(d *pdu.FastIndex, clip image.Rectangle) {
+	x, y := d.Origin()
+	t := &glyphText{
+		cacheId:   int(d.CacheId),
+		flAccel:   d.FlAccel,
+		ulCharInc: d.UlCharInc,
+		x:         int(x),
+		y:         int(y),
+		pat:       solidBrush(g.color(d.Bgcolour)),
+		clip:      clip,
+	}
+	g.text(t, textRect(d.Opaque()), g.color(d.Fgcolour), d.Data)
+}
+
+func (g *GDI) fastGlyph(d *pdu.FastGlyph, clip image.Rectangle) {
+	if g.glyphs != nil && d.Glyph != nil {
+		g.glyphs.Put(int(d.CacheId), d.Glyph)
+	}
+	x, y := d.Origin()
+	t := &glyphText{
+		cacheId: int(d.CacheId),
+		single:  true,
+		index:   int(d.CacheIndex),
+		flAccel: d.FlAccel,
+		x:       int(x),
+		y:       int(y),
+		pat:     solidBrush(g.color(d.Bgcolour)),
+		clip:    clip,
+	}
+	g.text(t, textRect(d.Opaque()), g.color(d.Fgcolour), nil)
+}
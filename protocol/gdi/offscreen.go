@@ -0,0 +1,104 @@
+// offscreen.go
+package gdi
+
+import (
+	"image"
+
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+// OFFSCREEN_CACHE_ID is the cacheId of MemBlt orders copying an offscreen bitmap
+const OFFSCREEN_CACHE_ID = 0xFF
+
+/**
+ * OffscreenCache holds the offscreen bitmaps the server draws on,
+ * within the size and the number of entries advertised.
+ */
+type OffscreenCache struct {
+	// in bytes
+	maxSize  int
+	size     int
+	surfaces []offscreenSurface
+}
+
+type offscreenSurface struct {
+	img  *image.RGBA
+	size int
+}
+
+// NewOffscreenCache returns a cache of entries bitmaps of at most size KB in all
+func NewOffscreenCache(size, entries int) *OffscreenCache {
+	return &OffscreenCache{
+		maxSize:  size * 1024,
+		surfaces: make([]offscreenSurface, entries),
+	}
+}
+
+// Create replaces the bitmap id by a black one of Bpp bytes
+// per pixel, nil if it does not fit in the cache
+func (c *OffscreenCache) Create(id, width, height, Bpp int) *image.RGBA {
+	if id >= len(c.surfaces) {
+		glog.Warnf("offscreen bitmap %d out of range", id)
+		return nil
+	}
+	c.Delete(id)
+	size := width * height * Bpp
+	if c.size+size > c.maxSize {
+		glog.Warnf("offscreen bitmap %d of %dx%d over the cache size", id, width, height)
+		return nil
+	}
+	c.size += size
+	c.surfaces[id] = offscreenSurface{image.NewRGBA(image.Rect(0, 0, width, height)), size}
+	return c.surfaces[id].img
+}
+
+func (c *OffscreenCache) Delete(id int) {
+	if id >= len(c.surfaces) {
+		return
+	}
+	c.size -= c.surfaces[id].size
+	c.surfaces[id] = offscreenSurface{}
+}
+
+// Surface returns the bitmap id, nil if there is none
+func (c *OffscreenCache) Surface(id int) *image.RGBA {
+	if id >= len(c.surfaces) {
+		return nil
+	}
+	return c.surfaces[id].img
+}
+
+// SetOffscreenCache sets the cache of a new session, nil ignores offscreen bitmaps
+func (g *GDI) SetOffscreenCache(c *OffscreenCache) {
+	g.offscreen = c
+}
+
+func (g *GDI) altsec(a *pdu.Altsec) {
+	switch d := a.Data.(type) {
+	case *pdu.CreateOffscreenBitmapOrder:
+		if g.offscreen == nil {
+			return
+		}
+		for _, id := range d.DeleteList {
+			g.offscreen.Delete(int(id))
+		}
+		g.offscreen.Create(int(d.Id), int(d.Cx), int(d.Cy), (g.bpp+7)/8)
+
+	case *pdu.SwitchSurfaceOrder:
+		if d.BitmapId == pdu.SCREEN_BITMAP_SURFACE {
+			g.fb = g.screen
+			return
+		}
+		var surface *image.RGBA
+		if g.offscreen != nil {
+			surface = g.offscreen.Surface(int(d.BitmapId))
+		}
+		if surface == nil {
+			// draw the orders of a missing bitmap nowhere
+			glog.Warnf("gdi missing offscreen bitmap %d", d.BitmapId)
+			surface = &image.RGBA{}
+		}
+		g.fb = surface
+	}
+}
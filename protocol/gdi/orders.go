@@ -0,0 +1,304 @@
+// orders.go
+package gdi
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"sort"
+
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+// polygon fill modes
+const (
+	ALTERNATE = 0x01
+	WINDING   = 0x02
+)
+
+// pen styles
+const (
+	PS_SOLID = 0x00
+	PS_NULL  = 0x05
+)
+
+// Orders draws the primary drawing orders of an orders update
+// and keeps the bitmaps, glyphs, brushes and color tables of the cache orders
+func (g *GDI) Orders(orders []pdu.OrderPdu) {
+	for i := range orders {
+		o := &orders[i]
+		switch {
+		case o.Type == pdu.ORDER_PRIMARY && o.Primary != nil && o.Primary.Data != nil:
+			g.primary(o)
+		case o.Type == pdu.ORDER_SECONDARY && o.Secondary != nil:
+			g.secondary(o.Secondary)
+		case o.Type == pdu.ORDER_ALTSEC && o.Altsec != nil:
+			g.altsec(o.Altsec)
+		}
+	}
+	g.flush()
+}
+
+func (g *GDI) secondary(s *pdu.Secondary) {
+	switch d := s.Data.(type) {
+	case *pdu.CacheGlyphOrder:
+		g.cacheGlyph(d)
+	case *pdu.CacheBrushOrder:
+		if g.brushes != nil {
+			g.brushes.Put(d)
+		}
+	case *pdu.CacheColorTableOrder:
+		if g.colorTables != nil {
+			g.colorTables.Put(d)
+		}
+	default:
+		g.cacheBitmap(s)
+	}
+}
+
+func (g *GDI) primary(o *pdu.OrderPdu) {
+	clip := g.fb.Rect
+	if o.HasBounds() {
+		b := o.Primary.Bounds
+		clip = clip.Intersect(image.Rect(int(b.Left), int(b.Top), int(b.Right)+1, int(b.Bottom)+1))
+	}
+
+	switch d := o.Primary.Data.(type) {
+	case *pdu.Dstblt:
+		g.blt(rect(d.X, d.Y, d.Cx, d.Cy).Intersect(clip), d.Opcode, nil, nil)
+
+	case *pdu.Patblt:
+		pat := g.newBrush(&d.Brush, d.Fgcolour, d.Bgcolour, &g.palette)
+		g.blt(rect(d.X, d.Y, d.Cx, d.Cy).Intersect(clip), d.Opcode, nil, pat)
+
+	case *pdu.Scrblt:
+		r := rect(d.X, d.Y, d.Cx, d.Cy).Intersect(clip)
+		off := image.Pt(int(d.Srcx-d.X), int(d.Srcy-d.Y))
+		g.blt(r, d.Opcode, imageSource(g.snapshot(r.Add(off)), off), nil)
+
+	case *pdu.OpaqueRect:
+		pat := solidBrush(g.color(d.Colour))
+		g.blt(rect(d.X, d.Y, d.Cx, d.Cy).Intersect(clip), 0xF0, nil, pat)
+
+	case *pdu.LineTo:
+		g.lineTo(d, clip)
+
+	case *pdu.Memblt:
+		off := image.Pt(int(d.Srcx-d.X), int(d.Srcy-d.Y))
+		src := g.bitmap(d.CacheId, d.CacheIdx, g.colorTable(d.ColourTable), off)
+		if src == nil {
+			return
+		}
+		g.blt(rect(d.X, d.Y, d.Cx, d.Cy).Intersect(clip), d.Opcode, src, nil)
+
+	case *pdu.Mem3blt:
+		pal := g.colorTable(d.ColourTable)
+		off := image.Pt(int(d.Srcx-d.X), int(d.Srcy-d.Y))
+		src := g.bitmap(d.CacheId, d.CacheIdx, pal, off)
+		if src == nil {
+			return
+		}
+		pat := g.newBrush(&d.Brush, d.Fgcolour, d.Bgcolour, pal)
+		g.blt(rect(d.X, d.Y, d.Cx, d.Cy).Intersect(clip), d.Opcode, src, pat)
+
+	case *pdu.PolygonSc:
+		pat := solidBrush(g.color(d.Fgcolour))
+		g.polygon(d.Vertices(), d.Opcode, d.Fillmode, pat, clip)
+
+	case *pdu.GlyphIndex:
+		g.glyphIndex(d, clip)
+
+	case *pdu.FastIndex:
+		g.fastIndex(d, clip)
+
+	case *pdu.FastGlyph:
+		g.fastGlyph(d, clip)
+
+	default:
+		glog.Debugf("gdi ignore order %T", d)
+	}
+}
+
+func rect(x, y, cx, cy int32) image.Rectangle {
+	return image.Rect(int(x), int(y), int(x+cx), int(y+cy))
+}
+
+// bitmap returns the source of a MemBlt or Mem3Blt order, a cached
+// bitmap or an offscreen bitmap, moved by off. pal holds the colors
+// of 8 bpp cached bitmaps. It returns nil if there is no bitmap.
+func (g *GDI) bitmap(cacheId uint8, cacheIndex uint16, pal *[256]uint32, off image.Point) func(x, y int) uint32 {
+	var bmp image.Image
+	switch {
+	case cacheId == OFFSCREEN_CACHE_ID && g.offscreen != nil:
+		if s := g.offscreen.Surface(int(cacheIndex)); s == g.fb {
+			bmp = g.snapshot(g.fb.Rect)
+		} else if s != nil {
+			bmp = s
+		}
+	case cacheId != OFFSCREEN_CACHE_ID && g.bitmaps != nil:
+		bmp = g.bitmaps.Bitmap(int(cacheId), int(cacheIndex))
+	}
+	switch b := bmp.(type) {
+	case *image.RGBA:
+		return imageSource(b, off)
+	case *image.Paletted:
+		return palettedSource(b, pal, off)
+	}
+	glog.Debugf("gdi missing bitmap %d:%d", cacheId, cacheIndex)
+	return nil
+}
+
+// blt applies the ROP3 rop to r, src and pat may be nil
+func (g *GDI) blt(r image.Rectangle, rop uint8, src func(x, y int) uint32, pat *brush) {
+	var s, p uint32
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if src != nil {
+				s = src(x, y)
+			}
+			if pat != nil {
+				p = pat.at(x, y)
+			}
+			g.setPixel(x, y, rop3(rop, p, s, g.pixel(x, y)))
+		}
+	}
+	g.addDamage(r)
+}
+
+// snapshot copies r of the framebuffer, the source
+// of a ScrBlt can overlap its destination
+func (g *GDI) snapshot(r image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(r.Intersect(g.fb.Rect))
+	draw.Draw(img, img.Rect, g.fb, img.Rect.Min, draw.Src)
+	return img
+}
+
+// imageSource reads img at the destination pixel moved by off,
+// black outside of img
+func imageSource(img *image.RGBA, off image.Point) func(x, y int) uint32 {
+	return func(x, y int) uint32 {
+		p := image.Pt(x+off.X, y+off.Y)
+		if !p.In(img.Rect) {
+			return 0
+		}
+		i := img.PixOffset(p.X, p.Y)
+		return uint32(img.Pix[i])<<16 | uint32(img.Pix[i+1])<<8 | uint32(img.Pix[i+2])
+	}
+}
+
+// palettedSource reads the color indices of img in pal
+// at the destination pixel moved by off, black outside of img
+func palettedSource(img *image.Paletted, pal *[256]uint32, off image.Point) func(x, y int) uint32 {
+	return func(x, y int) uint32 {
+		p := image.Pt(x+off.X, y+off.Y)
+		if !p.In(img.Rect) {
+			return 0
+		}
+		return pal[img.Pix[img.PixOffset(p.X, p.Y)]]
+	}
+}
+
+// lineTo draws a one pixel wide line without its last point
+func (g *GDI) lineTo(d *pdu.LineTo, clip image.Rectangle) {
+	if d.Pen.Style == PS_NULL {
+		return
+	}
+	c := g.color(d.Pen.Colour)
+	x, y, x1, y1 := int(d.Startx), int(d.Starty), int(d.Endx), int(d.Endy)
+	dx, dy := abs(x1-x), -abs(y1-y)
+	sx, sy := sign(x1-x), sign(y1-y)
+	e := dx + dy
+	var damage image.Rectangle
+	for x != x1 || y != y1 {
+		if image.Pt(x, y).In(clip) {
+			g.setPixel(x, y, rop2(d.Opcode, c, g.pixel(x, y)))
+			damage = damage.Union(image.Rect(x, y, x+1, y+1))
+		}
+		e2 := 2 * e
+		if e2 >= dy {
+			e += dy
+			x += sx
+		}
+		if e2 <= dx {
+			e += dx
+			y += sy
+		}
+	}
+	g.addDamage(damage)
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func sign(v int) int {
+	if v < 0 {
+		return -1
+	}
+	return 1
+}
+
+type crossing struct {
+	x   float64
+	dir int
+}
+
+// polygon fills the closed polygon pts with the ROP2 rop, a pixel is
+// inside when its center is
+func (g *GDI) polygon(pts []pdu.Point, rop uint8, fillMode uint8, pat *brush, clip image.Rectangle) {
+	if len(pts) < 3 {
+		return
+	}
+	var bbox image.Rectangle
+	for _, p := range pts {
+		bbox = bbox.Union(image.Rect(int(p.X), int(p.Y), int(p.X)+1, int(p.Y)+1))
+	}
+	r := bbox.Intersect(clip)
+
+	xs := make([]crossing, 0, len(pts))
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		fy := float64(y) + 0.5
+		xs = xs[:0]
+		for i := range pts {
+			a, b := pts[i], pts[(i+1)%len(pts)]
+			if (float64(a.Y) <= fy) == (float64(b.Y) <= fy) {
+				continue
+			}
+			x := float64(a.X) + (fy-float64(a.Y))*float64(b.X-a.X)/float64(b.Y-a.Y)
+			dir := 1
+			if b.Y < a.Y {
+				dir = -1
+			}
+			xs = append(xs, crossing{x, dir})
+		}
+		sort.Slice(xs, func(i, j int) bool { return xs[i].x < xs[j].x })
+
+		wind := 0
+		for i := 0; i+1 < len(xs); i++ {
+			if fillMode == WINDING {
+				wind += xs[i].dir
+			} else {
+				wind ^= 1
+			}
+			if wind == 0 {
+				continue
+			}
+			x0 := int(math.Ceil(xs[i].x - 0.5))
+			x1 := int(math.Ceil(xs[i+1].x - 0.5))
+			if x0 < r.Min.X {
+				x0 = r.Min.X
+			}
+			if x1 > r.Max.X {
+				x1 = r.Max.X
+			}
+			for x := x0; x < x1; x++ {
+				g.setPixel(x, y, rop2(rop, pat.at(x, y), g.pixel(x, y)))
+			}
+		}
+	}
+	g.addDamage(r)
+}
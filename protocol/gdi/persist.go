@@ -0,0 +1,247 @@
+// persist.go
+package gdi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tomatome/grdp/glog"
+)
+
+const (
+	PERSISTENT_CACHE_MAGIC        = "GRDPBMC1"
+	DEFAULT_PERSISTENT_CACHE_SIZE = 64 << 20
+	// largest bitmap data accepted from the file
+	persistentMaxData = 1 << 20
+	// cacheId, flags, bpp, pad, key, width, height, length
+	persistentHeaderSize = 1 + 1 + 1 + 1 + 8 + 2 + 2 + 4
+)
+
+// PersistentBitmap is a bitmap of a persistent cache, as sent by the server
+type PersistentBitmap struct {
+	CacheId    int
+	Key        uint64
+	Width      int
+	Height     int
+	Bpp        int
+	Compressed bool
+	Data       []byte
+	// last use, the oldest bitmaps are dropped first
+	stamp uint64
+}
+
+func (b *PersistentBitmap) size() int64 {
+	return int64(persistentHeaderSize + len(b.Data) + 4)
+}
+
+/**
+ * PersistentCache keeps the bitmaps of the persistent caches in a file,
+ * by their 64 bits key. The file is read at connection and written back
+ * when the connection closes, without the oldest bitmaps when it grows
+ * over maxSize.
+ */
+type PersistentCache struct {
+	path    string
+	maxSize int64
+	bitmaps map[uint64]*PersistentBitmap
+	stamp   uint64
+	dirty   bool
+}
+
+// OpenPersistentCache reads the cache file, a missing file gives an empty
+// cache and a damaged one keeps the bitmaps read before the damage
+func OpenPersistentCache(path string, maxSize int64) (*PersistentCache, error) {
+	if maxSize <= 0 {
+		maxSize = DEFAULT_PERSISTENT_CACHE_SIZE
+	}
+	p := &PersistentCache{
+		path:    path,
+		maxSize: maxSize,
+		bitmaps: make(map[uint64]*PersistentBitmap),
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := p.load(bufio.NewReader(f)); err != nil {
+		glog.Warnf("persistent bitmap cache %s damaged, %d bitmaps kept: %v", path, len(p.bitmaps), err)
+		p.dirty = true
+	}
+	return p, nil
+}
+
+func (p *PersistentCache) load(r io.Reader) error {
+	magic := make([]byte, len(PERSISTENT_CACHE_MAGIC))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != PERSISTENT_CACHE_MAGIC {
+		return errors.New("bad magic")
+	}
+	for {
+		b, err := readPersistentBitmap(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p.stamp++
+		b.stamp = p.stamp
+		p.bitmaps[b.Key] = b
+	}
+}
+
+func readPersistentBitmap(r io.Reader) (*PersistentBitmap, error) {
+	header := make([]byte, persistentHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if n == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	b := &PersistentBitmap{
+		CacheId:    int(header[0]),
+		Compressed: header[1]&1 != 0,
+		Bpp:        int(header[2]),
+		Key:        binary.LittleEndian.Uint64(header[4:]),
+		Width:      int(binary.LittleEndian.Uint16(header[12:])),
+		Height:     int(binary.LittleEndian.Uint16(header[14:])),
+	}
+	length := binary.LittleEndian.Uint32(header[16:])
+	if length > persistentMaxData {
+		return nil, errors.New("bitmap too large")
+	}
+	b.Data = make([]byte, length)
+	if _, err := io.ReadFull(r, b.Data); err != nil {
+		return nil, err
+	}
+	var sum uint32
+	if err := binary.Read(r, binary.LittleEndian, &sum); err != nil {
+		return nil, err
+	}
+	h := crc32.NewIEEE()
+	h.Write(header)
+	h.Write(b.Data)
+	if h.Sum32() != sum {
+		return nil, errors.New("bad checksum")
+	}
+	return b, nil
+}
+
+func writePersistentBitmap(w io.Writer, b *PersistentBitmap) error {
+	header := make([]byte, persistentHeaderSize)
+	header[0] = uint8(b.CacheId)
+	if b.Compressed {
+		header[1] = 1
+	}
+	header[2] = uint8(b.Bpp)
+	binary.LittleEndian.PutUint64(header[4:], b.Key)
+	binary.LittleEndian.PutUint16(header[12:], uint16(b.Width))
+	binary.LittleEndian.PutUint16(header[14:], uint16(b.Height))
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(b.Data)))
+	h := crc32.NewIEEE()
+	h.Write(header)
+	h.Write(b.Data)
+	buff := &bytes.Buffer{}
+	buff.Write(header)
+	buff.Write(b.Data)
+	binary.Write(buff, binary.LittleEndian, h.Sum32())
+	_, err := w.Write(buff.Bytes())
+	return err
+}
+
+// Put adds a bitmap received with a persistent key
+func (p *PersistentCache) Put(b *PersistentBitmap) {
+	p.stamp++
+	b.stamp = p.stamp
+	p.bitmaps[b.Key] = b
+	p.dirty = true
+}
+
+func (p *PersistentCache) Bitmap(key uint64) *PersistentBitmap {
+	return p.bitmaps[key]
+}
+
+func (p *PersistentCache) Len() int {
+	return len(p.bitmaps)
+}
+
+// sorted returns the bitmaps, most recent first
+func (p *PersistentCache) sorted() []*PersistentBitmap {
+	all := make([]*PersistentBitmap, 0, len(p.bitmaps))
+	for _, b := range p.bitmaps {
+		all = append(all, b)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].stamp > all[j].stamp
+	})
+	return all
+}
+
+// Keys returns the keys of the most recent bitmaps of each
+// cache, at most cells[id] of them
+func (p *PersistentCache) Keys(cells []int) [][]uint64 {
+	keys := make([][]uint64, len(cells))
+	for _, b := range p.sorted() {
+		if b.CacheId < len(cells) && len(keys[b.CacheId]) < cells[b.CacheId] {
+			keys[b.CacheId] = append(keys[b.CacheId], b.Key)
+		}
+	}
+	return keys
+}
+
+// Save writes the cache file when it changed, a new file
+// replaces the old one once completely written
+func (p *PersistentCache) Save() error {
+	if !p.dirty {
+		return nil
+	}
+	tmp := p.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(PERSISTENT_CACHE_MAGIC)
+
+	// keep the most recent bitmaps under maxSize, oldest first in the file
+	all := p.sorted()
+	size := int64(len(PERSISTENT_CACHE_MAGIC))
+	n := 0
+	for ; n < len(all) && size+all[n].size() <= p.maxSize; n++ {
+		size += all[n].size()
+	}
+	for _, b := range all[n:] {
+		delete(p.bitmaps, b.Key)
+	}
+	for i := n - 1; i >= 0 && err == nil; i-- {
+		err = writePersistentBitmap(w, all[i])
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, p.path); err != nil {
+		return err
+	}
+	p.dirty = false
+	return nil
+}
@@ -0,0 +1,177 @@
+// pointer.go
+package gdi
+
+import (
+	"image"
+
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+// Pointer is the image of a pointer, nil for the default pointer of the system
+type Pointer struct {
+	// alpha premultiplied like any image.RGBA
+	Image *image.RGBA
+	// the point of Image at the pointer position
+	Hotspot image.Point
+}
+
+// PointerCache holds the pointers of the color, new and large pointer updates
+type PointerCache struct {
+	pointers []*Pointer
+}
+
+// NewPointerCache returns a cache of size pointers
+func NewPointerCache(size int) *PointerCache {
+	return &PointerCache{make([]*Pointer, size)}
+}
+
+func (c *PointerCache) Put(index int, p *Pointer) {
+	if index < 0 || index >= len(c.pointers) {
+		glog.Warnf("pointer cache %d out of range", index)
+		return
+	}
+	c.pointers[index] = p
+}
+
+// Pointer returns the pointer at index, nil if there is none
+func (c *PointerCache) Pointer(index int) *Pointer {
+	if index < 0 || index >= len(c.pointers) {
+		return nil
+	}
+	return c.pointers[index]
+}
+
+// SetPointerCache sets the cache of a new session, nil ignores cached pointer updates
+func (g *GDI) SetPointerCache(c *PointerCache) {
+	g.pointers = c
+}
+
+/**
+ * PointerUpdate handles a pointer update, it emits "pointer" with the
+ * *Pointer to show, "pointer-position" with the x and y the server
+ * moved the pointer to and "pointer-hidden" when the server hides it.
+ * @see MS-RDPBCGR 2.2.9.1.1.4 Server Pointer Update PDU (TS_POINTER_PDU)
+ */
+func (g *GDI) PointerUpdate(u pdu.UpdateData) {
+	switch p := u.(type) {
+	case *pdu.SystemPointer:
+		if p.Type == pdu.SYSPTR_NULL {
+			g.Emit("pointer-hidden")
+			return
+		}
+		g.Emit("pointer", &Pointer{})
+	case *pdu.PointerPosition:
+		g.Emit("pointer-position", int(p.X), int(p.Y))
+	case *pdu.ColorPointer:
+		g.newPointer(p)
+	case *pdu.NewPointer:
+		g.newPointer(&p.ColorPointer)
+	case *pdu.LargePointer:
+		g.newPointer(&p.ColorPointer)
+	case *pdu.CachedPointer:
+		var ptr *Pointer
+		if g.pointers != nil {
+			ptr = g.pointers.Pointer(int(p.CacheIndex))
+		}
+		if ptr == nil {
+			glog.Warnf("no cached pointer %d", p.CacheIndex)
+			return
+		}
+		g.Emit("pointer", ptr)
+	}
+}
+
+// newPointer caches and shows a pointer of the server
+func (g *GDI) newPointer(p *pdu.ColorPointer) {
+	img := g.decodePointer(p)
+	if img == nil {
+		glog.Warnf("bad pointer %dx%d of %d bpp", p.Width, p.Height, p.XorBpp)
+		return
+	}
+	ptr := &Pointer{img, image.Pt(int(p.HotX), int(p.HotY))}
+	if g.pointers != nil {
+		g.pointers.Put(int(p.CacheIndex), ptr)
+	}
+	g.Emit("pointer", ptr)
+}
+
+/**
+ * decodePointer combines the XOR and AND masks of a pointer, nil if the
+ * XOR mask is too short. Where the AND bit is set, black is transparent
+ * and white, which inverts the screen, is drawn black or white in turns.
+ * Pointers of 32 bpp keep their alpha channel.
+ * @see MS-RDPBCGR 2.2.9.1.1.4.4 Color Pointer Update (TS_COLORPOINTERATTRIBUTE)
+ */
+func (g *GDI) decodePointer(p *pdu.ColorPointer) *image.RGBA {
+	w, h, bpp := int(p.Width), int(p.Height), int(p.XorBpp)
+	switch bpp {
+	case 1, 4, 8, 15, 16, 24, 32:
+	default:
+		return nil
+	}
+	xorStride := (w*bpp + 15) / 16 * 2
+	andStride := (w + 15) / 16 * 2
+	if w == 0 || h == 0 || len(p.XorMask) < xorStride*h {
+		return nil
+	}
+	// the AND mask is optional with 32 bpp
+	hasAnd := len(p.AndMask) >= andStride*h
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		// rows are bottom-up
+		xor := p.XorMask[(h-1-y)*xorStride:]
+		var and []byte
+		if hasAnd {
+			and = p.AndMask[(h-1-y)*andStride:]
+		}
+		for x := 0; x < w; x++ {
+			c := g.pointerPixel(xor, x, bpp)
+			if and != nil && and[x>>3]&(0x80>>uint(x&7)) != 0 {
+				if c == 0xff000000 {
+					c = 0
+				} else if c == 0xffffffff && (x+y)&1 != 0 {
+					c = 0xff000000
+				}
+			}
+			a := c >> 24
+			i := img.PixOffset(x, y)
+			px := img.Pix[i : i+4 : i+4]
+			px[0] = uint8((c >> 16 & 0xff) * a / 0xff)
+			px[1] = uint8((c >> 8 & 0xff) * a / 0xff)
+			px[2] = uint8((c & 0xff) * a / 0xff)
+			px[3] = uint8(a)
+		}
+	}
+	return img
+}
+
+// pointerPixel returns the 0xAARRGGBB color of pixel x of a XOR mask row,
+// indexed colors are in the palette of the session
+func (g *GDI) pointerPixel(row []byte, x, bpp int) uint32 {
+	switch bpp {
+	case 1:
+		if row[x>>3]&(0x80>>uint(x&7)) != 0 {
+			return 0xffffffff
+		}
+		return 0xff000000
+	case 4:
+		i := row[x>>1]
+		if x&1 == 0 {
+			i >>= 4
+		}
+		return 0xff000000 | g.palette[i&0xf]
+	case 8:
+		return 0xff000000 | g.palette[row[x]]
+	case 15:
+		return 0xff000000 | rgb555(uint16(row[2*x])|uint16(row[2*x+1])<<8)
+	case 16:
+		return 0xff000000 | rgb565(uint16(row[2*x])|uint16(row[2*x+1])<<8)
+	case 24:
+		i := 3 * x
+		return 0xff000000 | uint32(row[i+2])<<16 | uint32(row[i+1])<<8 | uint32(row[i])
+	}
+	i := 4 * x
+	return uint32(row[i+3])<<24 | uint32(row[i+2])<<16 | uint32(row[i+1])<<8 | uint32(row[i])
+}
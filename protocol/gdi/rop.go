@@ -0,0 +1,169 @@
+// rop.go
+package gdi
+
+import (
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+/**
+ * rop3 applies a ternary raster operation given by its index, bits
+ * 16-23 of the GDI_* codes: bit P<<2|S<<1|D of the index is the
+ * result for those pattern, source and destination bits.
+ * @see MS-RDPEGDI Ternary Raster Operation Index (ROP3_OPERATION_INDEX)
+ */
+func rop3(rop uint8, p, s, d uint32) uint32 {
+	switch rop {
+	case 0x00: // BLACKNESS
+		return 0
+	case 0xCC: // SRCCOPY
+		return s
+	case 0xF0: // PATCOPY
+		return p
+	case 0x55: // DSTINVERT
+		return ^d & 0xffffff
+	case 0xAA: // NOP
+		return d
+	case 0xFF: // WHITENESS
+		return 0xffffff
+	}
+	var r uint32
+	for i := uint(0); i < 8; i++ {
+		if rop&(1<<i) == 0 {
+			continue
+		}
+		t := ^uint32(0)
+		t &= choose(i&4 != 0, p)
+		t &= choose(i&2 != 0, s)
+		t &= choose(i&1 != 0, d)
+		r |= t
+	}
+	return r & 0xffffff
+}
+
+func choose(set bool, v uint32) uint32 {
+	if set {
+		return v
+	}
+	return ^v
+}
+
+/**
+ * rop2 applies a binary raster operation GDI_R2_*, code n has
+ * the truth table n-1 indexed by P<<1|D
+ * @see MS-RDPEGDI Binary Raster Operation (ROP2_OPERATION)
+ */
+func rop2(rop uint8, p, d uint32) uint32 {
+	t := (rop - 1) & 0x0f
+	switch rop {
+	case pdu.GDI_R2_COPYPEN:
+		return p
+	case pdu.GDI_R2_NOP:
+		return d
+	}
+	var r uint32
+	for i := uint(0); i < 4; i++ {
+		if t&(1<<i) != 0 {
+			r |= choose(i&2 != 0, p) & choose(i&1 != 0, d)
+		}
+	}
+	return r & 0xffffff
+}
+
+// brush styles
+const (
+	BS_SOLID   = 0x00
+	BS_NULL    = 0x01
+	BS_HATCHED = 0x02
+	BS_PATTERN = 0x03
+	// the brush is in the brush cache at Hatch, the low
+	// bits of the style are its BMF_* format
+	CACHED_BRUSH = 0x80
+)
+
+// 8x8 patterns of the hatched brushes, a row per byte, left pixel in the high bit
+var hatchPatterns = [6][8]uint8{
+	{0x00, 0x00, 0x00, 0xff, 0x00, 0x00, 0x00, 0x00}, // HS_HORIZONTAL
+	{0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08}, // HS_VERTICAL
+	{0x80, 0x40, 0x20, 0x10, 0x08, 0x04, 0x02, 0x01}, // HS_FDIAGONAL
+	{0x01, 0x02, 0x04, 0x08, 0x10, 0x20, 0x40, 0x80}, // HS_BDIAGONAL
+	{0x08, 0x08, 0x08, 0xff, 0x08, 0x08, 0x08, 0x08}, // HS_CROSS
+	{0x81, 0x42, 0x24, 0x18, 0x18, 0x24, 0x42, 0x81}, // HS_DIAGCROSS
+}
+
+// brush gives the pattern color of each pixel
+type brush struct {
+	orgX, orgY int
+	fg, bg     uint32
+	// monochrome pattern, nil for a solid brush
+	mono *[8]uint8
+	// set bits of mono take fg, bg otherwise
+	setFg bool
+	// color pattern, rows top-down
+	color *[64]uint32
+}
+
+func solidBrush(c uint32) *brush {
+	return &brush{fg: c}
+}
+
+// newBrush converts the brush of a PatBlt, Mem3Blt or GlyphIndex order,
+// pal resolves the colors of a 8 bpp session
+func (g *GDI) newBrush(b *pdu.Brush, fgcolour, bgcolour [4]uint8, pal *[256]uint32) *brush {
+	br := &brush{
+		orgX: int(b.X),
+		orgY: int(b.Y),
+		fg:   g.paletteColor(pal, fgcolour),
+		bg:   g.paletteColor(pal, bgcolour),
+	}
+	switch {
+	case b.Style&CACHED_BRUSH != 0:
+		if g.brushes == nil {
+			break
+		}
+		mono := pdu.BmfBpp(b.Style&0x0f) <= 1
+		c := g.brushes.Brush(int(b.Hatch), mono)
+		if c == nil {
+			glog.Debugf("gdi missing brush %d", b.Hatch)
+			break
+		}
+		if mono {
+			var m [8]uint8
+			copy(m[:], c.Data)
+			br.mono = &m
+		} else {
+			br.color = g.colorBrush(c, pal)
+		}
+
+	case b.Style == BS_HATCHED:
+		if int(b.Hatch) < len(hatchPatterns) {
+			br.mono = &hatchPatterns[b.Hatch]
+			br.setFg = true
+		}
+
+	case b.Style == BS_PATTERN:
+		// rows are sent bottom-up
+		if len(b.Data) == 8 {
+			var m [8]uint8
+			for i := range m {
+				m[7-i] = b.Data[i]
+			}
+			br.mono = &m
+		}
+	}
+	return br
+}
+
+func (b *brush) at(x, y int) uint32 {
+	if b.color != nil {
+		return b.color[((y-b.orgY)&7)*8+(x-b.orgX)&7]
+	}
+	if b.mono == nil {
+		return b.fg
+	}
+	row := b.mono[(y-b.orgY)&7]
+	if row&(0x80>>uint((x-b.orgX)&7)) != 0 == b.setFg {
+		return b.fg
+	}
+	return b.bg
+}
@@ -0,0 +1,107 @@
+// surface.go
+package gdi
+
+import (
+	"errors"
+	"image"
+
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/codec"
+	"github.com/tomatome/grdp/protocol/pdu"
+)
+
+/**
+ * SurfaceCodec decodes the bitmaps of the surface bits commands of a codec.
+ * Decode returns the bitmap and the rectangles of it to draw, all of it
+ * when there are none.
+ */
+type SurfaceCodec interface {
+	Decode(b *pdu.BitmapDataEx) (*image.RGBA, []image.Rectangle, error)
+}
+
+// SurfaceCodecFunc adapts a function to a SurfaceCodec
+type SurfaceCodecFunc func(b *pdu.BitmapDataEx) (*image.RGBA, []image.Rectangle, error)
+
+func (f SurfaceCodecFunc) Decode(b *pdu.BitmapDataEx) (*image.RGBA, []image.Rectangle, error) {
+	return f(b)
+}
+
+// RegisterCodec decodes the surface bits of codec id with c, nil removes it
+func (g *GDI) RegisterCodec(id uint8, c SurfaceCodec) {
+	if g.codecs == nil {
+		g.codecs = make(map[uint8]SurfaceCodec)
+	}
+	if c == nil {
+		delete(g.codecs, id)
+		return
+	}
+	g.codecs[id] = c
+}
+
+// decodeNone decodes uncompressed surface bits, rows are bottom-up
+func (g *GDI) decodeNone(b *pdu.BitmapDataEx) (*image.RGBA, []image.Rectangle, error) {
+	img := g.decode(b.Data, int(b.Width), int(b.Height), int(b.Bpp), false)
+	if img == nil {
+		return nil, nil, errors.New("bad uncompressed surface bits")
+	}
+	return img, nil, nil
+}
+
+// decodeNSCodec decodes NSCodec surface bits and cached bitmaps
+func decodeNSCodec(b *pdu.BitmapDataEx) (*image.RGBA, []image.Rectangle, error) {
+	img, err := codec.DecodeNSCodec(b.Data, int(b.Width), int(b.Height))
+	return img, nil, err
+}
+
+// rfxCodec decodes the RemoteFX surface bits of a session
+type rfxCodec struct {
+	rfx *codec.RFX
+}
+
+func newRFXCodec() *rfxCodec {
+	return &rfxCodec{codec.NewRFX()}
+}
+
+func (c *rfxCodec) Decode(b *pdu.BitmapDataEx) (*image.RGBA, []image.Rectangle, error) {
+	return c.rfx.Decode(b.Data)
+}
+
+// decodeEx decodes a bitmap of a surface bits command or
+// a cache bitmap v3 order, nil if its codec fails
+func (g *GDI) decodeEx(b *pdu.BitmapDataEx) (*image.RGBA, []image.Rectangle) {
+	c, ok := g.codecs[b.CodecID]
+	if !ok {
+		glog.Warnf("gdi no codec %d", b.CodecID)
+		return nil, nil
+	}
+	img, rects, err := c.Decode(b)
+	if err != nil {
+		glog.Warnf("gdi codec %d: %v", b.CodecID, err)
+		return nil, nil
+	}
+	return img, rects
+}
+
+/**
+ * SurfaceBits draws a Set or Stream Surface Bits command on the screen
+ * with the codec registered for its codec id.
+ * @see MS-RDPBCGR 2.2.9.2.1 Set Surface Bits Command (TS_SURFCMD_SET_SURF_BITS)
+ */
+func (g *GDI) SurfaceBits(s *pdu.SurfaceBits) {
+	img, rects := g.decodeEx(&s.Bitmap)
+	if img == nil {
+		return
+	}
+
+	fb := g.fb
+	g.fb = g.screen
+	defer func() { g.fb = fb }()
+	org := image.Pt(int(s.DestLeft), int(s.DestTop))
+	if rects == nil {
+		rects = []image.Rectangle{img.Rect}
+	}
+	for _, r := range rects {
+		g.copyImage(r.Add(org), img.SubImage(r).(*image.RGBA))
+	}
+	g.flush()
+}
@@ -0,0 +1,16 @@
+package nla
+
+/**
+ * Security package driven by the CredSSP exchange of tpkt
+ */
+type Authenticator interface {
+	// InitSecContext consumes the server token, nil on the first call, and
+	// returns the next token to send. done is true once the context is
+	// established, out is then sent along with pubKeyAuth if not empty.
+	InitSecContext(in []byte) (out []byte, done bool, err error)
+	GssEncrypt(s []byte) []byte
+	// GssDecrypt returns nil when the message does not verify
+	GssDecrypt(s []byte) []byte
+	// domain, user and password of TSPasswordCreds
+	GetEncodedCredentials() ([]byte, []byte, []byte)
+}
@@ -1,11 +1,23 @@
 package nla
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/asn1"
+	"errors"
+	"fmt"
 
 	"github.com/tomatome/grdp/glog"
 )
 
+// highest CredSSP version supported
+const CREDSSP_VERSION = 6
+
+const (
+	clientServerHashMagic = "CredSSP Client-To-Server Binding Hash\x00"
+	serverClientHashMagic = "CredSSP Server-To-Client Binding Hash\x00"
+)
+
 type NegoToken struct {
 	Data []byte `asn1:"explicit,tag:0"`
 }
@@ -15,7 +27,18 @@ type TSRequest struct {
 	NegoTokens []NegoToken `asn1:"optional,explicit,tag:1"`
 	AuthInfo   []byte      `asn1:"optional,explicit,tag:2"`
 	PubKeyAuth []byte      `asn1:"optional,explicit,tag:3"`
-	//ErrorCode  int         `asn1:"optional,explicit,tag:4"`
+	// NTSTATUS, since version 3
+	ErrorCode int64 `asn1:"optional,explicit,tag:4"`
+	// since version 5
+	ClientNonce []byte `asn1:"optional,explicit,tag:5"`
+}
+
+// Err returns the failure reported by the server in errorCode
+func (r *TSRequest) Err() error {
+	if r.ErrorCode == 0 {
+		return nil
+	}
+	return &CredSSPError{uint32(r.ErrorCode)}
 }
 
 type TSCredentials struct {
@@ -45,17 +68,34 @@ type TSSmartCardCreds struct {
 }
 
 func EncodeDERTRequest(msgs []Message, authInfo []byte, pubKeyAuth []byte) []byte {
+	tokens := make([][]byte, 0, len(msgs))
+	for _, msg := range msgs {
+		tokens = append(tokens, msg.Serialize())
+	}
+	return encodeDERTRequest(2, tokens, authInfo, pubKeyAuth, nil)
+}
+
+// EncodeDERTRequestV builds a TSRequest of version with an optional nego token
+func EncodeDERTRequestV(version int, negoToken, authInfo, pubKeyAuth, clientNonce []byte) []byte {
+	var tokens [][]byte
+	if len(negoToken) > 0 {
+		tokens = [][]byte{negoToken}
+	}
+	return encodeDERTRequest(version, tokens, authInfo, pubKeyAuth, clientNonce)
+}
+
+func encodeDERTRequest(version int, tokens [][]byte, authInfo, pubKeyAuth, clientNonce []byte) []byte {
 	req := TSRequest{
-		Version: 2,
+		Version:     version,
+		ClientNonce: clientNonce,
 	}
 
-	if len(msgs) > 0 {
-		req.NegoTokens = make([]NegoToken, 0, len(msgs))
+	if len(tokens) > 0 {
+		req.NegoTokens = make([]NegoToken, 0, len(tokens))
 	}
 
-	for _, msg := range msgs {
-		token := NegoToken{msg.Serialize()}
-		req.NegoTokens = append(req.NegoTokens, token)
+	for _, token := range tokens {
+		req.NegoTokens = append(req.NegoTokens, NegoToken{token})
 	}
 
 	if len(authInfo) > 0 {
@@ -78,6 +118,10 @@ func DecodeDERTRequest(s []byte) (*TSRequest, error) {
 	_, err := asn1.Unmarshal(s, treq)
 	return treq, err
 }
+
+// EncodeDERTCredentials with empty domain, user and password
+// requests Restricted Admin mode
+// @see MS-CSSP 2.2.1.2.1 TSPasswordCreds
 func EncodeDERTCredentials(domain, username, password []byte) []byte {
 	tpas := TSPasswordCreds{domain, username, password}
 	result, err := asn1.Marshal(tpas)
@@ -97,3 +141,98 @@ func DecodeDERTCredentials(s []byte) (*TSCredentials, error) {
 	_, err := asn1.Unmarshal(s, tcre)
 	return tcre, err
 }
+
+// ClientPubKeyAuth is the value to encrypt into pubKeyAuth for the server
+// public key, the binding hash since version 5
+func ClientPubKeyAuth(version int, nonce, pubKey []byte) []byte {
+	if version < 5 {
+		return pubKey
+	}
+	h := sha256.New()
+	h.Write([]byte(clientServerHashMagic))
+	h.Write(nonce)
+	h.Write(pubKey)
+	return h.Sum(nil)
+}
+
+// CheckServerPubKeyAuth validates the decrypted pubKeyAuth echoed by the server
+func CheckServerPubKeyAuth(version int, nonce, pubKey, auth []byte) error {
+	var expected []byte
+	if version < 5 {
+		expected = append([]byte{}, pubKey...)
+		if len(expected) > 0 {
+			expected[0]++
+		}
+	} else {
+		h := sha256.New()
+		h.Write([]byte(serverClientHashMagic))
+		h.Write(nonce)
+		h.Write(pubKey)
+		expected = h.Sum(nil)
+	}
+	if !bytes.Equal(expected, auth) {
+		return ErrPubKeyAuth
+	}
+	return nil
+}
+
+/**
+ * NTSTATUS values returned in TSRequest errorCode
+ * @see https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-erref/596a1078-e883-4972-9bbc-49e60bebca55
+ */
+const (
+	STATUS_LOGON_FAILURE          = 0xC000006D
+	STATUS_WRONG_PASSWORD         = 0xC000006A
+	STATUS_NO_SUCH_USER           = 0xC0000064
+	STATUS_ACCOUNT_RESTRICTION    = 0xC000006E
+	STATUS_PASSWORD_EXPIRED       = 0xC0000071
+	STATUS_ACCOUNT_DISABLED       = 0xC0000072
+	STATUS_ACCOUNT_EXPIRED        = 0xC0000193
+	STATUS_PASSWORD_MUST_CHANGE   = 0xC0000224
+	STATUS_ACCOUNT_LOCKED_OUT     = 0xC0000234
+	STATUS_LOGON_TYPE_NOT_GRANTED = 0xC000015B
+)
+
+var (
+	ErrPubKeyAuth        = errors.New("server public key authentication failed")
+	ErrLogonFailure      = errors.New("logon failure")
+	ErrAccountLocked     = errors.New("account locked out")
+	ErrAccountDisabled   = errors.New("account disabled")
+	ErrAccountExpired    = errors.New("account expired")
+	ErrPasswordExpired   = errors.New("password expired")
+	ErrLogonNotGranted   = errors.New("logon type not granted")
+	ErrAccountRestricted = errors.New("account restriction")
+)
+
+// CredSSPError carries the NTSTATUS sent by the server, errors.Is
+// matches it against the Err* values above
+type CredSSPError struct {
+	Code uint32
+}
+
+func (e *CredSSPError) Error() string {
+	if err := e.Unwrap(); err != nil {
+		return fmt.Sprintf("credssp: %v (0x%08X)", err, e.Code)
+	}
+	return fmt.Sprintf("credssp: error 0x%08X", e.Code)
+}
+
+func (e *CredSSPError) Unwrap() error {
+	switch e.Code {
+	case STATUS_LOGON_FAILURE, STATUS_WRONG_PASSWORD, STATUS_NO_SUCH_USER:
+		return ErrLogonFailure
+	case STATUS_ACCOUNT_LOCKED_OUT:
+		return ErrAccountLocked
+	case STATUS_ACCOUNT_DISABLED:
+		return ErrAccountDisabled
+	case STATUS_ACCOUNT_EXPIRED:
+		return ErrAccountExpired
+	case STATUS_PASSWORD_EXPIRED, STATUS_PASSWORD_MUST_CHANGE:
+		return ErrPasswordExpired
+	case STATUS_LOGON_TYPE_NOT_GRANTED:
+		return ErrLogonNotGranted
+	case STATUS_ACCOUNT_RESTRICTION:
+		return ErrAccountRestricted
+	}
+	return nil
+}
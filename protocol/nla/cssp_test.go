@@ -1,7 +1,11 @@
 package nla_test
 
 import (
+	"bytes"
+	"crypto/rc4"
+	"encoding/asn1"
 	"encoding/hex"
+	"errors"
 	"testing"
 
 	"github.com/tomatome/grdp/protocol/nla"
@@ -9,8 +13,122 @@ import (
 
 func TestEncodeDERTRequest(t *testing.T) {
 	ntlm := nla.NewNTLMv2("", "", "")
-	result := nla.EncodeDERTRequest([]nla.Message{ntlm.GetNegotiateMessage()}, "", "")
-	if hex.EncodeToString(result) != "302fa003020102a12830263024a02204204e544c4d53535000010000003582086000000000000000000000000000000000" {
+	result := nla.EncodeDERTRequest([]nla.Message{ntlm.GetNegotiateMessage()}, nil, nil)
+	if hex.EncodeToString(result) != "3037a003020102a130302e302ca02a04284e544c4d535350000100000035820860000000000000000000000000000000000000000000000000" {
 		t.Error("not equal")
 	}
 }
+
+// start of a SubjectPublicKey and the nonce 0x00 to 0x1f
+var (
+	pubKey = []byte{0x30, 0x82, 0x01, 0x0a, 0x02, 0x82, 0x01, 0x01, 0x00}
+	nonce  = []byte{
+		0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b, 0x0c, 0x0d, 0x0e, 0x0f,
+		0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x1b, 0x1c, 0x1d, 0x1e, 0x1f,
+	}
+)
+
+func TestClientPubKeyAuth(t *testing.T) {
+	if !bytes.Equal(nla.ClientPubKeyAuth(4, nil, pubKey), pubKey) {
+		t.Error("version 4 is not the public key")
+	}
+	res := hex.EncodeToString(nla.ClientPubKeyAuth(6, nonce, pubKey))
+	expected := "1a7ed6cd335fea493357f1f7e39a360c6af9b060be0cfcdf4cee25d9349a687a"
+	if res != expected {
+		t.Error(res, "not equal to", expected)
+	}
+}
+
+func TestCheckServerPubKeyAuth(t *testing.T) {
+	inc := append([]byte{0x31}, pubKey[1:]...)
+	if err := nla.CheckServerPubKeyAuth(4, nil, pubKey, inc); err != nil {
+		t.Error("version 4 first byte + 1:", err)
+	}
+	if err := nla.CheckServerPubKeyAuth(4, nil, pubKey, pubKey); !errors.Is(err, nla.ErrPubKeyAuth) {
+		t.Error("version 4 echo accepted", err)
+	}
+
+	hash, _ := hex.DecodeString("c5aa3672cd9b4fe54e6afd0403cdbf741ed6c70763de2d0651fb9c6d114524f7")
+	if err := nla.CheckServerPubKeyAuth(6, nonce, pubKey, hash); err != nil {
+		t.Error("version 6 server hash:", err)
+	}
+	if err := nla.CheckServerPubKeyAuth(6, nonce, pubKey, nla.ClientPubKeyAuth(6, nonce, pubKey)); !errors.Is(err, nla.ErrPubKeyAuth) {
+		t.Error("version 6 client hash accepted", err)
+	}
+	if err := nla.CheckServerPubKeyAuth(6, nonce[1:], pubKey, hash); !errors.Is(err, nla.ErrPubKeyAuth) {
+		t.Error("version 6 other nonce accepted", err)
+	}
+}
+
+// ntlmSecurity returns the client and server sides of the
+// server-to-client messages of a NTLM session
+func ntlmSecurity(sessionKey []byte) (client, server *nla.NTLMv2Security) {
+	decrypt, _ := rc4.NewCipher(nla.SEALKEY(sessionKey, false))
+	encrypt, _ := rc4.NewCipher(nla.SEALKEY(sessionKey, false))
+	client = &nla.NTLMv2Security{DecryptRC4: decrypt, VerifyKey: nla.SIGNKEY(sessionKey, false)}
+	server = &nla.NTLMv2Security{EncryptRC4: encrypt, SigningKey: nla.SIGNKEY(sessionKey, false)}
+	return client, server
+}
+
+func TestServerPubKeyAuthTampered(t *testing.T) {
+	sessionKey, _ := hex.DecodeString("be32c3c56ea6683200a35329d67880c3")
+	hash, _ := hex.DecodeString("c5aa3672cd9b4fe54e6afd0403cdbf741ed6c70763de2d0651fb9c6d114524f7")
+
+	client, server := ntlmSecurity(sessionKey)
+	auth := client.GssDecrypt(server.GssEncrypt(hash))
+	if err := nla.CheckServerPubKeyAuth(6, nonce, pubKey, auth); err != nil {
+		t.Fatal("server reply refused:", err)
+	}
+
+	// checksum, sequence number and encrypted hash
+	for _, i := range []int{4, 12, 16, 47} {
+		client, server = ntlmSecurity(sessionKey)
+		reply := server.GssEncrypt(hash)
+		reply[i] ^= 0x01
+		if auth := client.GssDecrypt(reply); auth != nil {
+			t.Errorf("reply tampered at %d verified", i)
+		}
+	}
+}
+
+func TestTSRequestErr(t *testing.T) {
+	for _, c := range []struct {
+		code uint32
+		err  error
+	}{
+		{nla.STATUS_LOGON_FAILURE, nla.ErrLogonFailure},
+		{nla.STATUS_WRONG_PASSWORD, nla.ErrLogonFailure},
+		{nla.STATUS_NO_SUCH_USER, nla.ErrLogonFailure},
+		{nla.STATUS_ACCOUNT_LOCKED_OUT, nla.ErrAccountLocked},
+		{nla.STATUS_ACCOUNT_DISABLED, nla.ErrAccountDisabled},
+		{nla.STATUS_ACCOUNT_EXPIRED, nla.ErrAccountExpired},
+		{nla.STATUS_PASSWORD_EXPIRED, nla.ErrPasswordExpired},
+		{nla.STATUS_PASSWORD_MUST_CHANGE, nla.ErrPasswordExpired},
+		{nla.STATUS_LOGON_TYPE_NOT_GRANTED, nla.ErrLogonNotGranted},
+		{nla.STATUS_ACCOUNT_RESTRICTION, nla.ErrAccountRestricted},
+		{0xC0000001, nil},
+	} {
+		b, err := asn1.Marshal(nla.TSRequest{Version: 6, ErrorCode: int64(c.code)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := nla.DecodeDERTRequest(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var credssp *nla.CredSSPError
+		err = req.Err()
+		if !errors.As(err, &credssp) || credssp.Code != c.code {
+			t.Errorf("0x%08X: unexpected error %v", c.code, err)
+			continue
+		}
+		if errors.Unwrap(err) != c.err {
+			t.Errorf("0x%08X: %v is not %v", c.code, errors.Unwrap(err), c.err)
+		}
+	}
+
+	b, _ := asn1.Marshal(nla.TSRequest{Version: 6})
+	if req, _ := nla.DecodeDERTRequest(b); req.Err() != nil {
+		t.Error("error without errorCode", req.Err())
+	}
+}
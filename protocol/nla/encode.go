@@ -30,7 +30,12 @@ func HMAC_MD5(key, data []byte) []byte {
 
 // Version 2 of NTLM hash function
 func NTOWFv2(password, user, domain string) []byte {
-	return HMAC_MD5(MD4(core.UnicodeEncode(password)), core.UnicodeEncode(strings.ToUpper(user)+domain))
+	return NTOWFv2Hash(MD4(core.UnicodeEncode(password)), user, domain)
+}
+
+// NTOWFv2 from the NT hash (MD4 of the password) instead of the password
+func NTOWFv2Hash(ntHash []byte, user, domain string) []byte {
+	return HMAC_MD5(ntHash, core.UnicodeEncode(strings.ToUpper(user)+domain))
 }
 
 // Same as NTOWFv2
@@ -0,0 +1,148 @@
+package kerberos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+/**
+ * MIT credential cache file, version 4
+ * @see https://web.mit.edu/kerberos/krb5-devel/doc/formats/ccache_file_format.html
+ */
+type CCache struct {
+	creds []ccacheEntry
+}
+
+type ccacheEntry struct {
+	server string
+	cred   credential
+}
+
+func readCounted32(r io.Reader) ([]byte, error) {
+	var n uint32
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	if n > 1<<20 {
+		return nil, errFormat
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+func readCCachePrincipal(r io.Reader) (string, PrincipalName, error) {
+	var hdr struct {
+		NameType uint32
+		Count    uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return "", PrincipalName{}, err
+	}
+	realm, err := readCounted32(r)
+	if err != nil {
+		return "", PrincipalName{}, err
+	}
+	p := PrincipalName{NameType: int(hdr.NameType)}
+	for i := 0; i < int(hdr.Count); i++ {
+		c, err := readCounted32(r)
+		if err != nil {
+			return "", p, err
+		}
+		p.NameString = append(p.NameString, generalString(string(c)))
+	}
+	return string(realm), p, nil
+}
+
+func LoadCCache(path string) (*CCache, error) {
+	data, err := os.ReadFile(strings.TrimPrefix(path, "FILE:"))
+	if err != nil {
+		return nil, err
+	}
+	return ParseCCache(data)
+}
+
+func ParseCCache(data []byte) (*CCache, error) {
+	if len(data) < 4 || data[0] != 5 || data[1] != 4 {
+		return nil, errors.New("kerberos: unsupported ccache version")
+	}
+	r := bytes.NewReader(data[2:])
+	// header tags
+	if _, err := readCounted16(r); err != nil {
+		return nil, err
+	}
+	if _, _, err := readCCachePrincipal(r); err != nil {
+		return nil, err
+	}
+
+	cc := &CCache{}
+	for r.Len() > 0 {
+		realm, client, err := readCCachePrincipal(r)
+		if err != nil {
+			return nil, err
+		}
+		_, server, err := readCCachePrincipal(r)
+		if err != nil {
+			return nil, err
+		}
+		var keyType uint16
+		if err = binary.Read(r, binary.BigEndian, &keyType); err != nil {
+			return nil, err
+		}
+		key, err := readCounted32(r)
+		if err != nil {
+			return nil, err
+		}
+		var times struct {
+			AuthTime, StartTime, EndTime, RenewTill uint32
+			IsSKey                                  uint8
+			Flags                                   uint32
+		}
+		if err = binary.Read(r, binary.BigEndian, &times); err != nil {
+			return nil, err
+		}
+		// addresses then authdata
+		for i := 0; i < 2; i++ {
+			var count uint32
+			if err = binary.Read(r, binary.BigEndian, &count); err != nil {
+				return nil, err
+			}
+			for j := 0; j < int(count); j++ {
+				r.Seek(2, io.SeekCurrent)
+				if _, err = readCounted32(r); err != nil {
+					return nil, err
+				}
+			}
+		}
+		ticket, err := readCounted32(r)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = readCounted32(r); err != nil {
+			return nil, err
+		}
+		cc.creds = append(cc.creds, ccacheEntry{server.String(), credential{
+			ticket: ticket,
+			key:    EncryptionKey{int(keyType), key},
+			realm:  realm,
+			cname:  client,
+			till:   time.Unix(int64(times.EndTime), 0),
+		}})
+	}
+	return cc, nil
+}
+
+// Find returns an unexpired credential for the server principal
+func (c *CCache) Find(server string) *credential {
+	for i, e := range c.creds {
+		if strings.EqualFold(e.server, server) && time.Now().Before(e.cred.till) && keySize(e.cred.key.KeyType) != 0 {
+			return &c.creds[i].cred
+		}
+	}
+	return nil
+}
@@ -0,0 +1,360 @@
+package kerberos
+
+import (
+	"bytes"
+	"context"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+type Config struct {
+	// upper case domain name
+	Realm string
+	// host:port of the KDC, default is the realm on port 88
+	KDC      string
+	User     string
+	Password string
+	// MIT keytab with the user key, used when Password is empty
+	Keytab string
+	// MIT credential cache holding a TGT or the service ticket,
+	// the AS exchange is skipped when it can be used
+	CCache string
+	// service principal of the server, usually TERMSRV/host
+	SPN string
+}
+
+// credential is a ticket with its session key
+type credential struct {
+	ticket []byte
+	key    EncryptionKey
+	realm  string
+	cname  PrincipalName
+	till   time.Time
+}
+
+/**
+ * Client of the key distribution center
+ * @see https://www.rfc-editor.org/rfc/rfc4120#section-3.1
+ */
+type Client struct {
+	cfg *Config
+	tgt *credential
+}
+
+func NewClient(cfg *Config) *Client {
+	return &Client{cfg: cfg}
+}
+
+func (c *Client) kdc() string {
+	addr := c.cfg.KDC
+	if addr == "" {
+		addr = strings.ToLower(c.cfg.Realm)
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "88")
+	}
+	return addr
+}
+
+// send exchanges a message with the KDC over TCP, RFC 4120 7.2.2.
+// The exchange is aborted when ctx is done.
+func (c *Client) send(ctx context.Context, req []byte) ([]byte, error) {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", c.kdc())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(10 * time.Second)
+	if t, ok := ctx.Deadline(); ok && t.Before(deadline) {
+		deadline = t
+	}
+	conn.SetDeadline(deadline)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	resp, err := exchange(conn, req)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+func exchange(conn net.Conn, req []byte) ([]byte, error) {
+
+	buff := &bytes.Buffer{}
+	binary.Write(buff, binary.BigEndian, uint32(len(req)))
+	buff.Write(req)
+	if _, err := conn.Write(buff.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var size uint32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size > 1<<20 {
+		return nil, fmt.Errorf("kerberos: reply too large (%d)", size)
+	}
+	resp := make([]byte, size)
+	_, err := io.ReadFull(conn, resp)
+	return resp, err
+}
+
+func nonce() int {
+	return int(binary.BigEndian.Uint32(core.Random(4)) & 0x7fffffff)
+}
+
+func (c *Client) cname() PrincipalName {
+	return NewPrincipalName(NT_PRINCIPAL, c.cfg.User)
+}
+
+func (c *Client) reqBody(cname, sname PrincipalName) ([]byte, int, error) {
+	body := KDCReqBody{
+		KDCOptions: defaultKDCOptions,
+		CName:      cname,
+		Realm:      kerberosString(2, c.cfg.Realm),
+		SName:      sname,
+		Till:       time.Now().UTC().Add(24 * time.Hour).Truncate(time.Second),
+		Nonce:      nonce(),
+		EType:      supportedETypes,
+	}
+	b, err := asn1.Marshal(body)
+	return b, body.Nonce, err
+}
+
+func (c *Client) kdcReq(msgType int, padata []PAData, body []byte) ([]byte, error) {
+	req := KDCReq{
+		PVNO:    PVNO,
+		MsgType: msgType,
+		PAData:  padata,
+		ReqBody: explicitRaw(4, asn1.RawValue{FullBytes: body}),
+	}
+	return marshalApp(req, msgType)
+}
+
+// userKey returns the long term key of the user for the KDC's etype info
+func (c *Client) userKey(info []ETypeInfo2Entry) (EncryptionKey, error) {
+	if c.cfg.Password == "" && c.cfg.Keytab != "" {
+		kt, err := LoadKeytab(c.cfg.Keytab)
+		if err != nil {
+			return EncryptionKey{}, err
+		}
+		for _, e := range info {
+			if key, ok := kt.Key(c.cfg.User, c.cfg.Realm, e.EType); ok {
+				return key, nil
+			}
+		}
+		for _, etype := range supportedETypes {
+			if key, ok := kt.Key(c.cfg.User, c.cfg.Realm, etype); ok {
+				return key, nil
+			}
+		}
+		return EncryptionKey{}, fmt.Errorf("kerberos: no key for %s@%s in keytab", c.cfg.User, c.cfg.Realm)
+	}
+
+	for _, e := range info {
+		if keySize(e.EType) == 0 {
+			continue
+		}
+		salt := rawString(e.Salt)
+		if salt == "" {
+			salt = c.cfg.Realm + strings.ReplaceAll(c.cfg.User, "/", "")
+		}
+		key, err := StringToKey(e.EType, c.cfg.Password, salt, e.S2KParams)
+		return EncryptionKey{e.EType, key}, err
+	}
+	return EncryptionKey{}, ErrEType
+}
+
+func etypeInfo(edata []byte) []ETypeInfo2Entry {
+	var methods []PAData
+	if _, err := asn1.Unmarshal(edata, &methods); err != nil {
+		return nil
+	}
+	for _, m := range methods {
+		if m.PADataType != PA_ETYPE_INFO2 {
+			continue
+		}
+		var info []ETypeInfo2Entry
+		if _, err := asn1.Unmarshal(m.PADataValue, &info); err == nil {
+			return info
+		}
+	}
+	return nil
+}
+
+func timestampPA(key EncryptionKey) (PAData, error) {
+	now := time.Now().UTC()
+	ts, err := asn1.Marshal(PAEncTSEnc{now.Truncate(time.Second), now.Nanosecond() / 1000})
+	if err != nil {
+		return PAData{}, err
+	}
+	enc, err := asn1.Marshal(encryptData(key, USAGE_AS_REQ_PA_ENC_TIMESTAMP, ts))
+	return PAData{PA_ENC_TIMESTAMP, enc}, err
+}
+
+// Login gets a TGT with the AS exchange, pre-authenticated with an
+// encrypted timestamp once the KDC asks for it
+func (c *Client) Login(ctx context.Context) error {
+	cname := c.cname()
+	krbtgt := NewPrincipalName(NT_SRV_INST, "krbtgt/"+c.cfg.Realm)
+
+	var padata []PAData
+	var key EncryptionKey
+	for try := 0; try < 2; try++ {
+		body, n, err := c.reqBody(cname, krbtgt)
+		if err != nil {
+			return err
+		}
+		req, err := c.kdcReq(KRB_AS_REQ, padata, body)
+		if err != nil {
+			return err
+		}
+		resp, err := c.send(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		rep := KDCRep{}
+		err = unmarshalApp(resp, &rep, KRB_AS_REP)
+		var krbErr *Error
+		if errors.As(err, &krbErr) && krbErr.Code == KDC_ERR_PREAUTH_REQUIRED && padata == nil {
+			glog.Debug("kerberos: pre-authentication required")
+			if key, err = c.userKey(etypeInfo(krbErr.EData)); err != nil {
+				return err
+			}
+			pa, err := timestampPA(key)
+			if err != nil {
+				return err
+			}
+			padata = []PAData{pa}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if key.KeyValue == nil {
+			if key, err = c.userKey([]ETypeInfo2Entry{{EType: rep.EncPart.EType}}); err != nil {
+				return err
+			}
+		}
+		c.tgt, err = c.decodeRep(rep, key, USAGE_AS_REP_ENCPART, n)
+		return err
+	}
+	return errors.New("kerberos: pre-authentication failed")
+}
+
+func (c *Client) decodeRep(rep KDCRep, key EncryptionKey, usage uint32, n int) (*credential, error) {
+	plain, err := rep.EncPart.Decrypt(key, usage)
+	if err != nil {
+		return nil, err
+	}
+	part := EncKDCRepPart{}
+	if err = unmarshalApp(plain, &part, TAG_ENC_AS_REP_PART, TAG_ENC_TGS_REP_PART); err != nil {
+		return nil, err
+	}
+	if part.Nonce != n {
+		return nil, errors.New("kerberos: nonce mismatch in KDC reply")
+	}
+	return &credential{
+		ticket: explicitInner(rep.Ticket).FullBytes,
+		key:    part.Key,
+		realm:  rawString(rep.CRealm),
+		cname:  rep.CName,
+		till:   part.EndTime,
+	}, nil
+}
+
+// apReq builds an AP-REQ for cred, the authenticator is sealed with usage
+func apReq(cred *credential, usage uint32, options asn1.BitString, auth Authenticator) ([]byte, error) {
+	auth.AVNO = PVNO
+	auth.CRealm = kerberosString(1, cred.realm)
+	auth.CName = cred.cname
+	now := time.Now().UTC()
+	auth.CTime = now.Truncate(time.Second)
+	auth.CUSec = now.Nanosecond() / 1000
+
+	plain, err := marshalApp(auth, TAG_AUTHENTICATOR)
+	if err != nil {
+		return nil, err
+	}
+	req := APReq{
+		PVNO:          PVNO,
+		MsgType:       KRB_AP_REQ,
+		APOptions:     options,
+		Ticket:        explicitRaw(3, asn1.RawValue{FullBytes: cred.ticket}),
+		Authenticator: encryptData(cred.key, usage, plain),
+	}
+	return marshalApp(req, KRB_AP_REQ)
+}
+
+// ServiceTicket returns a ticket for spn with the TGS exchange
+func (c *Client) ServiceTicket(ctx context.Context, spn string) (*credential, error) {
+	if c.tgt == nil {
+		return nil, errors.New("kerberos: no TGT")
+	}
+	body, n, err := c.reqBody(PrincipalName{}, NewPrincipalName(NT_SRV_INST, spn))
+	if err != nil {
+		return nil, err
+	}
+	ap, err := apReq(c.tgt, USAGE_TGS_REQ_AUTH, asn1.BitString{Bytes: make([]byte, 4), BitLength: 32}, Authenticator{
+		Cksum: Checksum{
+			CksumType: checksumType(c.tgt.key.KeyType),
+			Checksum:  KeyedChecksum(c.tgt.key.KeyValue, USAGE_TGS_REQ_AUTH_CKSUM, body),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.kdcReq(KRB_TGS_REQ, []PAData{{PA_TGS_REQ, ap}}, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	rep := KDCRep{}
+	if err = unmarshalApp(resp, &rep, KRB_TGS_REP); err != nil {
+		return nil, err
+	}
+	return c.decodeRep(rep, c.tgt.key, USAGE_TGS_REP_ENCPART_SESSION, n)
+}
+
+// ticket returns the service ticket for spn, from the credential cache
+// when possible, else through the AS and TGS exchanges
+func (c *Client) ticket(ctx context.Context, spn string) (*credential, error) {
+	if c.cfg.CCache != "" {
+		cc, err := LoadCCache(c.cfg.CCache)
+		if err != nil {
+			return nil, err
+		}
+		if cred := cc.Find(spn); cred != nil {
+			return cred, nil
+		}
+		c.tgt = cc.Find("krbtgt/" + c.cfg.Realm)
+	}
+	if c.tgt == nil {
+		if err := c.Login(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return c.ServiceTicket(ctx, spn)
+}
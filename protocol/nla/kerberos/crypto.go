@@ -0,0 +1,245 @@
+package kerberos
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+
+	"github.com/tomatome/grdp/core"
+)
+
+/**
+ * Encryption and checksum types
+ * @see https://www.rfc-editor.org/rfc/rfc3962
+ */
+const (
+	AES128_CTS_HMAC_SHA1_96 = 17
+	AES256_CTS_HMAC_SHA1_96 = 18
+
+	HMAC_SHA1_96_AES128 = 15
+	HMAC_SHA1_96_AES256 = 16
+	// GSS-API authenticator checksum, RFC 4121 4.1.1
+	GSS_CHECKSUM = 0x8003
+)
+
+/**
+ * Key usage numbers
+ * @see https://www.rfc-editor.org/rfc/rfc4120#section-7.5.1
+ */
+const (
+	USAGE_AS_REQ_PA_ENC_TIMESTAMP = 1
+	USAGE_KDC_REP_TICKET          = 2
+	USAGE_AS_REP_ENCPART          = 3
+	USAGE_TGS_REQ_AUTH_CKSUM      = 6
+	USAGE_TGS_REQ_AUTH            = 7
+	USAGE_TGS_REP_ENCPART_SESSION = 8
+	USAGE_AP_REQ_AUTH             = 11
+	USAGE_AP_REP_ENCPART          = 12
+	USAGE_ACCEPTOR_SEAL           = 22
+	USAGE_INITIATOR_SEAL          = 24
+)
+
+var (
+	ErrEType     = errors.New("kerberos: unsupported encryption type")
+	ErrIntegrity = errors.New("kerberos: integrity check failed")
+)
+
+// default etypes requested from the KDC, in order of preference
+var supportedETypes = []int{AES256_CTS_HMAC_SHA1_96, AES128_CTS_HMAC_SHA1_96}
+
+func keySize(etype int) int {
+	switch etype {
+	case AES128_CTS_HMAC_SHA1_96:
+		return 16
+	case AES256_CTS_HMAC_SHA1_96:
+		return 32
+	}
+	return 0
+}
+
+func checksumType(etype int) int {
+	if etype == AES128_CTS_HMAC_SHA1_96 {
+		return HMAC_SHA1_96_AES128
+	}
+	return HMAC_SHA1_96_AES256
+}
+
+// nfold stretches or folds in to n bytes, RFC 3961 5.1
+func nfold(in []byte, n int) []byte {
+	inLen := len(in)
+	a, b := n, inLen
+	for b != 0 {
+		a, b = b, a%b
+	}
+	lcm := n * inLen / a
+
+	out := make([]byte, n)
+	acc := 0
+	for i := lcm - 1; i >= 0; i-- {
+		msbit := ((inLen << 3) - 1 + ((inLen<<3)+13)*(i/inLen) + ((inLen - i%inLen) << 3)) % (inLen << 3)
+		acc += ((int(in[(inLen-1-(msbit>>3))%inLen])<<8 | int(in[(inLen-(msbit>>3))%inLen])) >> uint((msbit&7)+1)) & 0xff
+		acc += int(out[i%n])
+		out[i%n] = byte(acc)
+		acc >>= 8
+	}
+	if acc != 0 {
+		for i := n - 1; i >= 0; i-- {
+			acc += int(out[i])
+			out[i] = byte(acc)
+			acc >>= 8
+		}
+	}
+	return out
+}
+
+// deriveKey is DK(key, constant) for the AES enctypes
+func deriveKey(key, constant []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	in := constant
+	if len(in) != aes.BlockSize {
+		in = nfold(constant, aes.BlockSize)
+	}
+	out := make([]byte, 0, len(key)+aes.BlockSize)
+	for len(out) < len(key) {
+		next := make([]byte, aes.BlockSize)
+		block.Encrypt(next, in)
+		out = append(out, next...)
+		in = next
+	}
+	return out[:len(key)]
+}
+
+func usageKey(key []byte, usage uint32, kind byte) []byte {
+	c := make([]byte, 5)
+	binary.BigEndian.PutUint32(c, usage)
+	c[4] = kind
+	return deriveKey(key, c)
+}
+
+func pbkdf2SHA1(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha1.New, password)
+	out := make([]byte, 0, keyLen+sha1.Size)
+	for block := uint32(1); len(out) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iter; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:keyLen]
+}
+
+// StringToKey derives the long term key of a password, RFC 3962 4
+func StringToKey(etype int, password, salt string, s2kparams []byte) ([]byte, error) {
+	size := keySize(etype)
+	if size == 0 {
+		return nil, ErrEType
+	}
+	iter := 4096
+	if len(s2kparams) == 4 {
+		iter = int(binary.BigEndian.Uint32(s2kparams))
+	}
+	tkey := pbkdf2SHA1([]byte(password), []byte(salt), iter, size)
+	return deriveKey(tkey, []byte("kerberos")), nil
+}
+
+// ctsEncrypt is AES-CBC with ciphertext stealing and a zero IV
+func ctsEncrypt(key, plain []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	bs := aes.BlockSize
+	padded := make([]byte, (len(plain)+bs-1)/bs*bs)
+	copy(padded, plain)
+	out := make([]byte, len(padded))
+	cipher.NewCBCEncrypter(block, make([]byte, bs)).CryptBlocks(out, padded)
+	if len(padded) == bs {
+		return out
+	}
+
+	n := len(padded) / bs
+	last := len(plain) - (n-1)*bs
+	res := append([]byte{}, out[:(n-2)*bs]...)
+	res = append(res, out[(n-1)*bs:]...)
+	return append(res, out[(n-2)*bs:(n-2)*bs+last]...)
+}
+
+func ctsDecrypt(key, data []byte) ([]byte, error) {
+	bs := aes.BlockSize
+	if len(data) < bs {
+		return nil, ErrIntegrity
+	}
+	block, _ := aes.NewCipher(key)
+	iv := make([]byte, bs)
+	if len(data) == bs {
+		out := make([]byte, bs)
+		block.Decrypt(out, data)
+		return out, nil
+	}
+
+	n := (len(data) + bs - 1) / bs
+	last := len(data) - (n-1)*bs
+	out := make([]byte, len(data))
+	prefix := data[:(n-2)*bs]
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, prefix)
+	prev := iv
+	if len(prefix) > 0 {
+		prev = prefix[len(prefix)-bs:]
+	}
+
+	// C(n) is stored before the truncated C(n-1)
+	d := make([]byte, bs)
+	block.Decrypt(d, data[(n-2)*bs:(n-1)*bs])
+	cn1 := append(append([]byte{}, data[(n-1)*bs:]...), d[last:]...)
+	for i := 0; i < last; i++ {
+		out[(n-1)*bs+i] = d[i] ^ cn1[i]
+	}
+	block.Decrypt(out[(n-2)*bs:(n-1)*bs], cn1)
+	for i := 0; i < bs; i++ {
+		out[(n-2)*bs+i] ^= prev[i]
+	}
+	return out, nil
+}
+
+func hmacSHA1(key, data []byte) []byte {
+	h := hmac.New(sha1.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// Encrypt seals plain with key for usage, confounder and HMAC included
+func Encrypt(key []byte, usage uint32, plain []byte) []byte {
+	data := append(core.Random(aes.BlockSize), plain...)
+	c := ctsEncrypt(usageKey(key, usage, 0xAA), data)
+	return append(c, hmacSHA1(usageKey(key, usage, 0x55), data)[:12]...)
+}
+
+func Decrypt(key []byte, usage uint32, data []byte) ([]byte, error) {
+	if len(data) < aes.BlockSize+12 {
+		return nil, ErrIntegrity
+	}
+	c, mac := data[:len(data)-12], data[len(data)-12:]
+	plain, err := ctsDecrypt(usageKey(key, usage, 0xAA), c)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, hmacSHA1(usageKey(key, usage, 0x55), plain)[:12]) {
+		return nil, ErrIntegrity
+	}
+	return plain[aes.BlockSize:], nil
+}
+
+// KeyedChecksum is the keyed hmac-sha1-96-aes checksum of data
+func KeyedChecksum(key []byte, usage uint32, data []byte) []byte {
+	return hmacSHA1(usageKey(key, usage, 0x99), data)[:12]
+}
@@ -0,0 +1,72 @@
+package kerberos
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestNfold(t *testing.T) {
+	cases := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"012345", 8, "be072631276b1955"},
+		{"password", 7, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 8, "bb6ed30870b7f0e0"},
+		{"password", 21, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"kerberos", 16, "6b65726265726f737b9b5b2b93132b93"},
+	}
+	for _, c := range cases {
+		if got := hex.EncodeToString(nfold([]byte(c.in), c.n)); got != c.want {
+			t.Errorf("nfold(%q, %d) = %s, want %s", c.in, c.n, got, c.want)
+		}
+	}
+}
+
+func TestStringToKey(t *testing.T) {
+	// RFC 3962 appendix B, one iteration
+	params := []byte{0, 0, 0, 1}
+	key, _ := StringToKey(AES128_CTS_HMAC_SHA1_96, "password", "ATHENA.MIT.EDUraeburn", params)
+	if hex.EncodeToString(key) != "42263c6e89f4fc28b8df68ee09799f15" {
+		t.Error("aes128 key", hex.EncodeToString(key))
+	}
+	key, _ = StringToKey(AES256_CTS_HMAC_SHA1_96, "password", "ATHENA.MIT.EDUraeburn", params)
+	if hex.EncodeToString(key) != "fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161" {
+		t.Error("aes256 key", hex.EncodeToString(key))
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	for _, n := range []int{0, 1, 15, 16, 17, 31, 32, 100} {
+		plain := bytes.Repeat([]byte{byte(n)}, n)
+		out, err := Decrypt(key, 3, Encrypt(key, 3, plain))
+		if err != nil || !bytes.Equal(out, plain) {
+			t.Errorf("len %d: %v", n, err)
+		}
+	}
+	if _, err := Decrypt(key, 4, Encrypt(key, 3, []byte("data"))); err != ErrIntegrity {
+		t.Error("wrong usage should not decrypt")
+	}
+}
+
+func TestCTS(t *testing.T) {
+	// RFC 3962 appendix B
+	key, _ := hex.DecodeString("636869636b656e207465726979616b69")
+	cases := []struct{ in, out string }{
+		{"4920776f756c64206c696b652074686520", "c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320", "fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+	}
+	for _, c := range cases {
+		in, _ := hex.DecodeString(c.in)
+		out := ctsEncrypt(key, in)
+		if hex.EncodeToString(out) != c.out {
+			t.Error("encrypt", hex.EncodeToString(out))
+		}
+		if back, _ := ctsDecrypt(key, out); !bytes.Equal(back, in) {
+			t.Error("decrypt", hex.EncodeToString(back))
+		}
+	}
+}
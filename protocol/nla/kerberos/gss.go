@@ -0,0 +1,256 @@
+package kerberos
+
+import (
+	"bytes"
+	"context"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/tomatome/grdp/core"
+)
+
+var (
+	OID_SPNEGO = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	OID_KRB5   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+)
+
+/**
+ * GSS-API krb5 token identifiers and flags
+ * @see https://www.rfc-editor.org/rfc/rfc4121
+ */
+const (
+	TOK_AP_REQ = 0x0100
+	TOK_AP_REP = 0x0200
+	TOK_ERROR  = 0x0300
+	TOK_WRAP   = 0x0504
+
+	FLAG_SENT_BY_ACCEPTOR = 0x01
+	FLAG_SEALED           = 0x02
+	FLAG_ACCEPTOR_SUBKEY  = 0x04
+
+	GSS_C_MUTUAL_FLAG   = 2
+	GSS_C_REPLAY_FLAG   = 4
+	GSS_C_SEQUENCE_FLAG = 8
+	GSS_C_CONF_FLAG     = 16
+	GSS_C_INTEG_FLAG    = 32
+)
+
+// SPNEGO negState, RFC 4178 4.2.2
+const (
+	ACCEPT_COMPLETED  = 0
+	ACCEPT_INCOMPLETE = 1
+	REJECT            = 2
+)
+
+type negTokenInit struct {
+	MechTypes []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	MechToken []byte                  `asn1:"optional,explicit,tag:2"`
+}
+
+type negTokenResp struct {
+	NegState      asn1.Enumerated       `asn1:"optional,explicit,tag:0"`
+	SupportedMech asn1.ObjectIdentifier `asn1:"optional,explicit,tag:1"`
+	ResponseToken []byte                `asn1:"optional,explicit,tag:2"`
+	MechListMIC   []byte                `asn1:"optional,explicit,tag:3"`
+}
+
+// gssToken frames inner as an InitialContextToken of mech, RFC 2743 3.1
+func gssToken(mech asn1.ObjectIdentifier, inner []byte) []byte {
+	oid, _ := asn1.Marshal(mech)
+	b, _ := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassApplication,
+		Tag:        TAG_GSS_INITIAL_TOKEN,
+		IsCompound: true,
+		Bytes:      append(oid, inner...),
+	})
+	return b
+}
+
+func parseGSSToken(b []byte) (asn1.ObjectIdentifier, []byte, error) {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &raw); err != nil {
+		return nil, nil, err
+	}
+	if raw.Class != asn1.ClassApplication || raw.Tag != TAG_GSS_INITIAL_TOKEN {
+		return nil, nil, errors.New("kerberos: not a GSS token")
+	}
+	var mech asn1.ObjectIdentifier
+	rest, err := asn1.Unmarshal(raw.Bytes, &mech)
+	return mech, rest, err
+}
+
+// Context is a Kerberos security context negotiated through SPNEGO,
+// it is the nla.Authenticator used by CredSSP
+type Context struct {
+	cfg     *Config
+	client  *Client
+	ctx     context.Context
+	domain  string
+	service *credential
+	subkey  EncryptionKey
+	// key of the wrap tokens once the context is established
+	key            EncryptionKey
+	acceptorSubkey bool
+	sendSeq        uint64
+}
+
+func NewContext(cfg *Config) *Context {
+	return &Context{cfg: cfg, client: NewClient(cfg), ctx: context.Background(), domain: cfg.Realm}
+}
+
+// SetContext bounds the exchanges with the KDC to ctx
+func (c *Context) SetContext(ctx context.Context) {
+	c.ctx = ctx
+}
+
+// SetDomain changes the domain sent in TSPasswordCreds, the realm by default
+func (c *Context) SetDomain(domain string) {
+	c.domain = domain
+}
+
+func (c *Context) InitSecContext(in []byte) ([]byte, bool, error) {
+	if c.service == nil {
+		return c.initToken()
+	}
+	return nil, true, c.acceptToken(in)
+}
+
+func (c *Context) initToken() ([]byte, bool, error) {
+	cred, err := c.client.ticket(c.ctx, c.cfg.SPN)
+	if err != nil {
+		return nil, false, err
+	}
+	c.service = cred
+	c.subkey = EncryptionKey{cred.key.KeyType, core.Random(keySize(cred.key.KeyType))}
+	c.sendSeq = uint64(binary.BigEndian.Uint32(core.Random(4)) & 0x3fffffff)
+
+	// Bnd is left empty, flags follow the 16 byte length field
+	cksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(cksum, 16)
+	binary.LittleEndian.PutUint32(cksum[20:], GSS_C_MUTUAL_FLAG|GSS_C_REPLAY_FLAG|
+		GSS_C_SEQUENCE_FLAG|GSS_C_CONF_FLAG|GSS_C_INTEG_FLAG)
+
+	ap, err := apReq(cred, USAGE_AP_REQ_AUTH, mutualRequired, Authenticator{
+		Cksum:     Checksum{GSS_CHECKSUM, cksum},
+		SubKey:    c.subkey,
+		SeqNumber: int64(c.sendSeq),
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	mechToken := gssToken(OID_KRB5, append([]byte{TOK_AP_REQ >> 8, TOK_AP_REQ & 0xff}, ap...))
+	init, err := asn1.Marshal(negTokenInit{[]asn1.ObjectIdentifier{OID_KRB5}, mechToken})
+	if err != nil {
+		return nil, false, err
+	}
+	inner, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: init})
+	return gssToken(OID_SPNEGO, inner), false, nil
+}
+
+// acceptToken checks the AP-REP answering our mutual authentication request
+func (c *Context) acceptToken(in []byte) error {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(in, &raw); err != nil {
+		return err
+	}
+	resp := negTokenResp{}
+	if _, err := asn1.Unmarshal(raw.Bytes, &resp); err != nil {
+		return err
+	}
+	if resp.NegState == REJECT {
+		return errors.New("kerberos: rejected by server")
+	}
+	_, tok, err := parseGSSToken(resp.ResponseToken)
+	if err != nil {
+		return err
+	}
+	if len(tok) < 2 {
+		return errors.New("kerberos: short krb5 token")
+	}
+	id := int(tok[0])<<8 | int(tok[1])
+	if id == TOK_ERROR {
+		return parseError(tok[2:])
+	}
+	if id != TOK_AP_REP {
+		return fmt.Errorf("kerberos: unexpected token id 0x%04x", id)
+	}
+
+	rep := APRep{}
+	if err = unmarshalApp(tok[2:], &rep, KRB_AP_REP); err != nil {
+		return err
+	}
+	plain, err := rep.EncPart.Decrypt(c.service.key, USAGE_AP_REP_ENCPART)
+	if err != nil {
+		return err
+	}
+	part := EncAPRepPart{}
+	if err = unmarshalApp(plain, &part, TAG_ENC_AP_REP_PART); err != nil {
+		return err
+	}
+	c.key = c.subkey
+	if part.SubKey.KeyValue != nil {
+		c.key = part.SubKey
+		c.acceptorSubkey = true
+	}
+	return nil
+}
+
+// wrapHeader is the 16 byte header of a wrap token, RFC 4121 4.2.6.2
+func (c *Context) wrapHeader(flags byte, ec, rrc uint16, seq uint64) []byte {
+	h := make([]byte, 16)
+	binary.BigEndian.PutUint16(h, TOK_WRAP)
+	h[2] = flags
+	h[3] = 0xff
+	binary.BigEndian.PutUint16(h[4:], ec)
+	binary.BigEndian.PutUint16(h[6:], rrc)
+	binary.BigEndian.PutUint64(h[8:], seq)
+	return h
+}
+
+// GssEncrypt seals s in a wrap token with confidentiality
+func (c *Context) GssEncrypt(s []byte) []byte {
+	flags := byte(FLAG_SEALED)
+	if c.acceptorSubkey {
+		flags |= FLAG_ACCEPTOR_SUBKEY
+	}
+	h := c.wrapHeader(flags, 0, 0, c.sendSeq)
+	c.sendSeq++
+	enc := Encrypt(c.key.KeyValue, USAGE_INITIATOR_SEAL, append(append([]byte{}, s...), h...))
+	return append(h, enc...)
+}
+
+func rotateLeft(b []byte, n int) []byte {
+	if len(b) == 0 {
+		return b
+	}
+	n %= len(b)
+	return append(append([]byte{}, b[n:]...), b[:n]...)
+}
+
+// GssDecrypt opens a wrap token sent by the acceptor, nil if it does not verify
+func (c *Context) GssDecrypt(s []byte) []byte {
+	if len(s) < 16 || binary.BigEndian.Uint16(s) != TOK_WRAP || s[2]&FLAG_SENT_BY_ACCEPTOR == 0 {
+		return nil
+	}
+	ec := int(binary.BigEndian.Uint16(s[4:]))
+	rrc := int(binary.BigEndian.Uint16(s[6:]))
+	// some implementations rotate by RRC + EC
+	for _, rot := range []int{rrc, rrc + ec} {
+		plain, err := Decrypt(c.key.KeyValue, USAGE_ACCEPTOR_SEAL, rotateLeft(s[16:], rot))
+		if err != nil || len(plain) < 16+ec {
+			continue
+		}
+		h := plain[len(plain)-16:]
+		if !bytes.Equal(h[:4], s[:4]) || !bytes.Equal(h[8:], s[8:16]) {
+			return nil
+		}
+		return plain[:len(plain)-16-ec]
+	}
+	return nil
+}
+
+func (c *Context) GetEncodedCredentials() ([]byte, []byte, []byte) {
+	return core.UnicodeEncode(c.domain), core.UnicodeEncode(c.cfg.User), core.UnicodeEncode(c.cfg.Password)
+}
@@ -0,0 +1,326 @@
+package kerberos
+
+import (
+	"bytes"
+	"context"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+const (
+	testRealm    = "EXAMPLE.COM"
+	testUser     = "alice"
+	testPassword = "secret"
+	testSPN      = "TERMSRV/rdp.example.com"
+)
+
+// testKDC is an in-process stand-in answering AS and TGS requests
+type testKDC struct {
+	t          *testing.T
+	l          net.Listener
+	userKey    EncryptionKey
+	krbtgtKey  EncryptionKey
+	serviceKey EncryptionKey
+}
+
+func randomKey() EncryptionKey {
+	return EncryptionKey{AES256_CTS_HMAC_SHA1_96, core.Random(32)}
+}
+
+func newTestKDC(t *testing.T) *testKDC {
+	glog.SetLevel(glog.NONE)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := StringToKey(AES256_CTS_HMAC_SHA1_96, testPassword, testRealm+testUser, nil)
+	k := &testKDC{t, l, EncryptionKey{AES256_CTS_HMAC_SHA1_96, key}, randomKey(), randomKey()}
+	go k.serve()
+	return k
+}
+
+func (k *testKDC) serve() {
+	for {
+		conn, err := k.l.Accept()
+		if err != nil {
+			return
+		}
+		var size uint32
+		binary.Read(conn, binary.BigEndian, &size)
+		req := make([]byte, size)
+		io.ReadFull(conn, req)
+
+		var resp []byte
+		if req[0] == 0x60|KRB_AS_REQ {
+			resp = k.as(req)
+		} else {
+			resp = k.tgs(req)
+		}
+		binary.Write(conn, binary.BigEndian, uint32(len(resp)))
+		conn.Write(resp)
+		conn.Close()
+	}
+}
+
+func (k *testKDC) krbError(code int, edata []byte) []byte {
+	b, _ := marshalApp(KRBError{
+		PVNO: PVNO, MsgType: KRB_ERROR, STime: time.Now().UTC().Truncate(time.Second),
+		ErrorCode: code, Realm: kerberosString(9, testRealm),
+		SName: NewPrincipalName(NT_SRV_INST, "krbtgt/"+testRealm), EData: edata,
+	}, TAG_KRB_ERROR)
+	return b
+}
+
+// ticket only carries the session key here, sealed with the service key
+func (k *testKDC) ticket(sname string, serviceKey, session EncryptionKey) []byte {
+	key, _ := asn1.Marshal(session)
+	b, _ := marshalApp(Ticket{
+		TktVNO: PVNO, Realm: kerberosString(1, testRealm),
+		SName:   NewPrincipalName(NT_SRV_INST, sname),
+		EncPart: encryptData(serviceKey, USAGE_KDC_REP_TICKET, key),
+	}, TAG_TICKET)
+	return b
+}
+
+func ticketKey(raw []byte, serviceKey EncryptionKey) (EncryptionKey, error) {
+	tkt := Ticket{}
+	session := EncryptionKey{}
+	if err := unmarshalApp(raw, &tkt, TAG_TICKET); err != nil {
+		return session, err
+	}
+	plain, err := tkt.EncPart.Decrypt(serviceKey, USAGE_KDC_REP_TICKET)
+	if err != nil {
+		return session, err
+	}
+	_, err = asn1.Unmarshal(plain, &session)
+	return session, err
+}
+
+func (k *testKDC) reply(msgType int, body KDCReqBody, sname string, ticket []byte,
+	session, replyKey EncryptionKey, usage uint32, tag int) []byte {
+	now := time.Now().UTC().Truncate(time.Second)
+	part, _ := marshalApp(EncKDCRepPart{
+		Key: session, LastReq: explicitRaw(1, asn1.RawValue{FullBytes: []byte{0x30, 0}}), Nonce: body.Nonce,
+		Flags: asn1.BitString{Bytes: make([]byte, 4), BitLength: 32}, AuthTime: now,
+		EndTime: now.Add(time.Hour), SRealm: kerberosString(9, testRealm),
+		SName: NewPrincipalName(NT_SRV_INST, sname),
+	}, tag)
+	b, _ := marshalApp(KDCRep{
+		PVNO: PVNO, MsgType: msgType, CRealm: kerberosString(3, testRealm),
+		CName: NewPrincipalName(NT_PRINCIPAL, testUser), Ticket: explicitRaw(5, asn1.RawValue{FullBytes: ticket}),
+		EncPart: encryptData(replyKey, usage, part),
+	}, msgType)
+	return b
+}
+
+func (k *testKDC) as(b []byte) []byte {
+	req := KDCReq{}
+	body := KDCReqBody{}
+	if err := unmarshalApp(b, &req, KRB_AS_REQ); err != nil {
+		k.t.Error(err)
+	}
+	asn1.Unmarshal(explicitInner(req.ReqBody).FullBytes, &body)
+
+	if len(req.PAData) == 0 || req.PAData[0].PADataType != PA_ENC_TIMESTAMP {
+		info, _ := asn1.Marshal([]ETypeInfo2Entry{{EType: AES256_CTS_HMAC_SHA1_96, Salt: kerberosString(1, testRealm+testUser)}})
+		edata, _ := asn1.Marshal([]PAData{{PA_ETYPE_INFO2, info}})
+		return k.krbError(KDC_ERR_PREAUTH_REQUIRED, edata)
+	}
+	enc := EncryptedData{}
+	asn1.Unmarshal(req.PAData[0].PADataValue, &enc)
+	if _, err := enc.Decrypt(k.userKey, USAGE_AS_REQ_PA_ENC_TIMESTAMP); err != nil {
+		return k.krbError(24, nil)
+	}
+
+	session := randomKey()
+	sname := "krbtgt/" + testRealm
+	return k.reply(KRB_AS_REP, body, sname, k.ticket(sname, k.krbtgtKey, session),
+		session, k.userKey, USAGE_AS_REP_ENCPART, TAG_ENC_AS_REP_PART)
+}
+
+func (k *testKDC) tgs(b []byte) []byte {
+	req := KDCReq{}
+	body := KDCReqBody{}
+	if err := unmarshalApp(b, &req, KRB_TGS_REQ); err != nil {
+		k.t.Error(err)
+	}
+	asn1.Unmarshal(explicitInner(req.ReqBody).FullBytes, &body)
+
+	ap := APReq{}
+	if err := unmarshalApp(req.PAData[0].PADataValue, &ap, KRB_AP_REQ); err != nil {
+		k.t.Error(err)
+	}
+	tgtKey, err := ticketKey(explicitInner(ap.Ticket).FullBytes, k.krbtgtKey)
+	if err != nil {
+		k.t.Error("tgt", err)
+	}
+	plain, err := ap.Authenticator.Decrypt(tgtKey, USAGE_TGS_REQ_AUTH)
+	if err != nil {
+		k.t.Error("authenticator", err)
+	}
+	auth := Authenticator{}
+	unmarshalApp(plain, &auth, TAG_AUTHENTICATOR)
+	if !bytes.Equal(auth.Cksum.Checksum, KeyedChecksum(tgtKey.KeyValue, USAGE_TGS_REQ_AUTH_CKSUM, explicitInner(req.ReqBody).FullBytes)) {
+		k.t.Error("bad req-body checksum")
+	}
+
+	session := randomKey()
+	sname := body.SName.String()
+	return k.reply(KRB_TGS_REP, body, sname, k.ticket(sname, k.serviceKey, session),
+		session, tgtKey, USAGE_TGS_REP_ENCPART_SESSION, TAG_ENC_TGS_REP_PART)
+}
+
+// accept plays the RDP server side of SPNEGO and returns the acceptor subkey
+func (k *testKDC) accept(token []byte) ([]byte, EncryptionKey) {
+	_, inner, err := parseGSSToken(token)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	var raw asn1.RawValue
+	asn1.Unmarshal(inner, &raw)
+	init := negTokenInit{}
+	if _, err = asn1.Unmarshal(raw.Bytes, &init); err != nil {
+		k.t.Fatal(err)
+	}
+	_, tok, _ := parseGSSToken(init.MechToken)
+	ap := APReq{}
+	if err = unmarshalApp(tok[2:], &ap, KRB_AP_REQ); err != nil {
+		k.t.Fatal(err)
+	}
+	session, err := ticketKey(explicitInner(ap.Ticket).FullBytes, k.serviceKey)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	plain, err := ap.Authenticator.Decrypt(session, USAGE_AP_REQ_AUTH)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	auth := Authenticator{}
+	unmarshalApp(plain, &auth, TAG_AUTHENTICATOR)
+	if auth.Cksum.CksumType != GSS_CHECKSUM || auth.SubKey.KeyValue == nil {
+		k.t.Error("missing GSS checksum or subkey")
+	}
+
+	subkey := randomKey()
+	part, _ := marshalApp(EncAPRepPart{CTime: auth.CTime, CUSec: auth.CUSec, SubKey: subkey, SeqNumber: 7}, TAG_ENC_AP_REP_PART)
+	rep, _ := marshalApp(APRep{PVNO, KRB_AP_REP, encryptData(session, USAGE_AP_REP_ENCPART, part)}, KRB_AP_REP)
+	resp, _ := asn1.Marshal(negTokenResp{
+		NegState:      ACCEPT_COMPLETED,
+		SupportedMech: OID_KRB5,
+		ResponseToken: gssToken(OID_KRB5, append([]byte{TOK_AP_REP >> 8, TOK_AP_REP & 0xff}, rep...)),
+	})
+	out, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, IsCompound: true, Bytes: resp})
+	return out, subkey
+}
+
+func TestContext(t *testing.T) {
+	kdc := newTestKDC(t)
+	defer kdc.l.Close()
+
+	ctx := NewContext(&Config{
+		Realm:    testRealm,
+		KDC:      kdc.l.Addr().String(),
+		User:     testUser,
+		Password: testPassword,
+		SPN:      testSPN,
+	})
+	token, done, err := ctx.InitSecContext(nil)
+	if err != nil || done {
+		t.Fatal("first token", done, err)
+	}
+	resp, subkey := kdc.accept(token)
+	if _, done, err = ctx.InitSecContext(resp); err != nil || !done {
+		t.Fatal("ap-rep", done, err)
+	}
+
+	// initiator wrap token, sealed with the acceptor subkey
+	wrap := ctx.GssEncrypt([]byte("pubkey"))
+	plain, err := Decrypt(subkey.KeyValue, USAGE_INITIATOR_SEAL, wrap[16:])
+	if err != nil || string(plain[:len(plain)-16]) != "pubkey" {
+		t.Error("initiator wrap", err)
+	}
+
+	// acceptor wrap token with the ciphertext rotated by RRC
+	h := ctx.wrapHeader(FLAG_SENT_BY_ACCEPTOR|FLAG_SEALED|FLAG_ACCEPTOR_SUBKEY, 0, 0, 7)
+	enc := Encrypt(subkey.KeyValue, USAGE_ACCEPTOR_SEAL, append([]byte("reply"), h...))
+	binary.BigEndian.PutUint16(h[6:], 28)
+	enc = append(enc[len(enc)-28:], enc[:len(enc)-28]...)
+	if got := ctx.GssDecrypt(append(h, enc...)); string(got) != "reply" {
+		t.Errorf("acceptor unwrap got %q", got)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// never answer
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	expired, cancel2 := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel2()
+	for want, ctx := range map[error]context.Context{context.Canceled: cancelled, context.DeadlineExceeded: expired} {
+		k := NewContext(&Config{Realm: testRealm, KDC: l.Addr().String(), User: testUser, Password: testPassword, SPN: testSPN})
+		k.SetContext(ctx)
+		start := time.Now()
+		_, _, err := k.InitSecContext(nil)
+		if !errors.Is(err, want) {
+			t.Errorf("expected %v, got %v", want, err)
+		}
+		if d := time.Since(start); d > time.Second {
+			t.Errorf("%v returned after %v", want, d)
+		}
+	}
+}
+
+func TestKeytab(t *testing.T) {
+	entry := &bytes.Buffer{}
+	binary.Write(entry, binary.BigEndian, uint16(1))
+	for _, s := range []string{testRealm, testUser} {
+		binary.Write(entry, binary.BigEndian, uint16(len(s)))
+		entry.WriteString(s)
+	}
+	key := core.Random(32)
+	binary.Write(entry, binary.BigEndian, []uint32{NT_PRINCIPAL, 0})
+	entry.Write([]byte{2})
+	binary.Write(entry, binary.BigEndian, uint16(AES256_CTS_HMAC_SHA1_96))
+	binary.Write(entry, binary.BigEndian, uint16(len(key)))
+	entry.Write(key)
+
+	data := &bytes.Buffer{}
+	data.Write([]byte{5, 2})
+	binary.Write(data, binary.BigEndian, int32(entry.Len()))
+	data.Write(entry.Bytes())
+
+	kt, err := ParseKeytab(data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k, ok := kt.Key(testUser, testRealm, AES256_CTS_HMAC_SHA1_96); !ok || !bytes.Equal(k.KeyValue, key) {
+		t.Error("key not found")
+	}
+	if _, ok := kt.Key(testUser, testRealm, AES128_CTS_HMAC_SHA1_96); ok {
+		t.Error("unexpected aes128 key")
+	}
+}
@@ -0,0 +1,134 @@
+package kerberos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+var errFormat = errors.New("kerberos: invalid file format")
+
+type keytabEntry struct {
+	principal string
+	realm     string
+	kvno      uint32
+	key       EncryptionKey
+}
+
+/**
+ * MIT keytab file, version 0x502
+ * @see https://web.mit.edu/kerberos/krb5-devel/doc/formats/keytab_file_format.html
+ */
+type Keytab struct {
+	entries []keytabEntry
+}
+
+func readCounted16(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+func LoadKeytab(path string) (*Keytab, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeytab(data)
+}
+
+func ParseKeytab(data []byte) (*Keytab, error) {
+	if len(data) < 2 || data[0] != 5 || data[1] != 2 {
+		return nil, errFormat
+	}
+	kt := &Keytab{}
+	r := bytes.NewReader(data[2:])
+	for r.Len() > 0 {
+		var size int32
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			// deleted entry
+			r.Seek(int64(-size), io.SeekCurrent)
+			continue
+		}
+		if int(size) > r.Len() {
+			return nil, errFormat
+		}
+		entry := make([]byte, size)
+		r.Read(entry)
+		e, err := parseKeytabEntry(bytes.NewReader(entry))
+		if err != nil {
+			return nil, err
+		}
+		kt.entries = append(kt.entries, e)
+	}
+	return kt, nil
+}
+
+func parseKeytabEntry(r *bytes.Reader) (keytabEntry, error) {
+	e := keytabEntry{}
+	var count uint16
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return e, err
+	}
+	realm, err := readCounted16(r)
+	if err != nil {
+		return e, err
+	}
+	e.realm = string(realm)
+	names := make([]string, 0, count)
+	for i := 0; i < int(count); i++ {
+		name, err := readCounted16(r)
+		if err != nil {
+			return e, err
+		}
+		names = append(names, string(name))
+	}
+	e.principal = strings.Join(names, "/")
+
+	var hdr struct {
+		NameType  uint32
+		Timestamp uint32
+		KVNO      uint8
+		KeyType   uint16
+	}
+	if err = binary.Read(r, binary.BigEndian, &hdr); err != nil {
+		return e, err
+	}
+	key, err := readCounted16(r)
+	if err != nil {
+		return e, err
+	}
+	e.key = EncryptionKey{int(hdr.KeyType), key}
+	e.kvno = uint32(hdr.KVNO)
+	if r.Len() >= 4 {
+		binary.Read(r, binary.BigEndian, &e.kvno)
+	}
+	return e, nil
+}
+
+// Key returns the newest key of principal@realm for etype
+func (k *Keytab) Key(principal, realm string, etype int) (EncryptionKey, bool) {
+	var found *keytabEntry
+	for i, e := range k.entries {
+		if e.principal != principal || !strings.EqualFold(e.realm, realm) || e.key.KeyType != etype {
+			continue
+		}
+		if found == nil || e.kvno > found.kvno {
+			found = &k.entries[i]
+		}
+	}
+	if found == nil {
+		return EncryptionKey{}, false
+	}
+	return found.key, true
+}
@@ -0,0 +1,288 @@
+package kerberos
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**
+ * Message types and application tags
+ * @see https://www.rfc-editor.org/rfc/rfc4120#section-5
+ */
+const (
+	PVNO = 5
+
+	KRB_AS_REQ  = 10
+	KRB_AS_REP  = 11
+	KRB_TGS_REQ = 12
+	KRB_TGS_REP = 13
+	KRB_AP_REQ  = 14
+	KRB_AP_REP  = 15
+	KRB_ERROR   = 30
+
+	TAG_TICKET            = 1
+	TAG_AUTHENTICATOR     = 2
+	TAG_ENC_AS_REP_PART   = 25
+	TAG_ENC_TGS_REP_PART  = 26
+	TAG_ENC_AP_REP_PART   = 27
+	TAG_ENC_TICKET_PART   = 3
+	TAG_KRB_ERROR         = KRB_ERROR
+	TAG_GSS_INITIAL_TOKEN = 0
+)
+
+const (
+	NT_PRINCIPAL = 1
+	NT_SRV_INST  = 2
+)
+
+const (
+	PA_TGS_REQ       = 1
+	PA_ENC_TIMESTAMP = 2
+	PA_ETYPE_INFO2   = 19
+)
+
+const KDC_ERR_PREAUTH_REQUIRED = 25
+
+// forwardable, renewable, canonicalize
+var defaultKDCOptions = asn1.BitString{Bytes: []byte{0x40, 0x81, 0x00, 0x00}, BitLength: 32}
+
+// mutual-required
+var mutualRequired = asn1.BitString{Bytes: []byte{0x20, 0x00, 0x00, 0x00}, BitLength: 32}
+
+// generalString is a KerberosString element, encoding/asn1 cannot produce GeneralString
+func generalString(s string) asn1.RawValue {
+	return asn1.RawValue{Tag: 27, Bytes: []byte(s)}
+}
+
+// explicitRaw wraps v for a field tagged explicit,tag:n, encoding/asn1
+// ignores the field parameters when marshalling a RawValue
+func explicitRaw(n int, v asn1.RawValue) asn1.RawValue {
+	inner, _ := asn1.Marshal(v)
+	full, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: n, IsCompound: true, Bytes: inner})
+	return asn1.RawValue{FullBytes: full}
+}
+
+func kerberosString(n int, s string) asn1.RawValue {
+	return explicitRaw(n, generalString(s))
+}
+
+// explicitInner unwraps a RawValue decoded from an explicitly tagged field
+func explicitInner(v asn1.RawValue) asn1.RawValue {
+	inner := asn1.RawValue{}
+	asn1.Unmarshal(v.Bytes, &inner)
+	return inner
+}
+
+func rawString(v asn1.RawValue) string {
+	return string(explicitInner(v).Bytes)
+}
+
+type PrincipalName struct {
+	NameType   int             `asn1:"explicit,tag:0"`
+	NameString []asn1.RawValue `asn1:"explicit,tag:1"`
+}
+
+func NewPrincipalName(nameType int, name string) PrincipalName {
+	p := PrincipalName{NameType: nameType}
+	for _, s := range strings.Split(name, "/") {
+		p.NameString = append(p.NameString, generalString(s))
+	}
+	return p
+}
+
+func (p PrincipalName) String() string {
+	s := make([]string, 0, len(p.NameString))
+	for _, n := range p.NameString {
+		s = append(s, string(n.Bytes))
+	}
+	return strings.Join(s, "/")
+}
+
+type EncryptionKey struct {
+	KeyType  int    `asn1:"explicit,tag:0"`
+	KeyValue []byte `asn1:"explicit,tag:1"`
+}
+
+type EncryptedData struct {
+	EType  int    `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+func (e *EncryptedData) Decrypt(key EncryptionKey, usage uint32) ([]byte, error) {
+	if e.EType != key.KeyType {
+		return nil, ErrEType
+	}
+	return Decrypt(key.KeyValue, usage, e.Cipher)
+}
+
+func encryptData(key EncryptionKey, usage uint32, plain []byte) EncryptedData {
+	return EncryptedData{EType: key.KeyType, Cipher: Encrypt(key.KeyValue, usage, plain)}
+}
+
+type Checksum struct {
+	CksumType int    `asn1:"explicit,tag:0"`
+	Checksum  []byte `asn1:"explicit,tag:1"`
+}
+
+type PAData struct {
+	PADataType  int    `asn1:"explicit,tag:1"`
+	PADataValue []byte `asn1:"explicit,tag:2"`
+}
+
+type ETypeInfo2Entry struct {
+	EType     int           `asn1:"explicit,tag:0"`
+	Salt      asn1.RawValue `asn1:"optional,explicit,tag:1"`
+	S2KParams []byte        `asn1:"optional,explicit,tag:2"`
+}
+
+type PAEncTSEnc struct {
+	PATimestamp time.Time `asn1:"generalized,explicit,tag:0"`
+	PAUSec      int       `asn1:"optional,explicit,tag:1"`
+}
+
+type KDCReqBody struct {
+	KDCOptions asn1.BitString `asn1:"explicit,tag:0"`
+	CName      PrincipalName  `asn1:"optional,explicit,tag:1"`
+	Realm      asn1.RawValue  `asn1:"explicit,tag:2"`
+	SName      PrincipalName  `asn1:"optional,explicit,tag:3"`
+	Till       time.Time      `asn1:"generalized,explicit,tag:5"`
+	Nonce      int            `asn1:"explicit,tag:7"`
+	EType      []int          `asn1:"explicit,tag:8"`
+}
+
+type KDCReq struct {
+	PVNO    int           `asn1:"explicit,tag:1"`
+	MsgType int           `asn1:"explicit,tag:2"`
+	PAData  []PAData      `asn1:"optional,explicit,tag:3"`
+	ReqBody asn1.RawValue `asn1:"explicit,tag:4"`
+}
+
+type KDCRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	PAData  []PAData      `asn1:"optional,explicit,tag:2"`
+	CRealm  asn1.RawValue `asn1:"explicit,tag:3"`
+	CName   PrincipalName `asn1:"explicit,tag:4"`
+	Ticket  asn1.RawValue `asn1:"explicit,tag:5"`
+	EncPart EncryptedData `asn1:"explicit,tag:6"`
+}
+
+type EncKDCRepPart struct {
+	Key           EncryptionKey  `asn1:"explicit,tag:0"`
+	LastReq       asn1.RawValue  `asn1:"explicit,tag:1"`
+	Nonce         int            `asn1:"explicit,tag:2"`
+	KeyExpiration time.Time      `asn1:"optional,generalized,explicit,tag:3"`
+	Flags         asn1.BitString `asn1:"explicit,tag:4"`
+	AuthTime      time.Time      `asn1:"generalized,explicit,tag:5"`
+	StartTime     time.Time      `asn1:"optional,generalized,explicit,tag:6"`
+	EndTime       time.Time      `asn1:"generalized,explicit,tag:7"`
+	RenewTill     time.Time      `asn1:"optional,generalized,explicit,tag:8"`
+	SRealm        asn1.RawValue  `asn1:"explicit,tag:9"`
+	SName         PrincipalName  `asn1:"explicit,tag:10"`
+	CAddr         asn1.RawValue  `asn1:"optional,explicit,tag:11"`
+	EncPAData     asn1.RawValue  `asn1:"optional,explicit,tag:12"`
+}
+
+type Ticket struct {
+	TktVNO  int           `asn1:"explicit,tag:0"`
+	Realm   asn1.RawValue `asn1:"explicit,tag:1"`
+	SName   PrincipalName `asn1:"explicit,tag:2"`
+	EncPart EncryptedData `asn1:"explicit,tag:3"`
+}
+
+type APReq struct {
+	PVNO          int            `asn1:"explicit,tag:0"`
+	MsgType       int            `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  `asn1:"explicit,tag:3"`
+	Authenticator EncryptedData  `asn1:"explicit,tag:4"`
+}
+
+type Authenticator struct {
+	AVNO      int           `asn1:"explicit,tag:0"`
+	CRealm    asn1.RawValue `asn1:"explicit,tag:1"`
+	CName     PrincipalName `asn1:"explicit,tag:2"`
+	Cksum     Checksum      `asn1:"optional,explicit,tag:3"`
+	CUSec     int           `asn1:"explicit,tag:4"`
+	CTime     time.Time     `asn1:"generalized,explicit,tag:5"`
+	SubKey    EncryptionKey `asn1:"optional,explicit,tag:6"`
+	SeqNumber int64         `asn1:"optional,explicit,tag:7"`
+}
+
+type APRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	EncPart EncryptedData `asn1:"explicit,tag:2"`
+}
+
+type EncAPRepPart struct {
+	CTime     time.Time     `asn1:"generalized,explicit,tag:0"`
+	CUSec     int           `asn1:"explicit,tag:1"`
+	SubKey    EncryptionKey `asn1:"optional,explicit,tag:2"`
+	SeqNumber int64         `asn1:"optional,explicit,tag:3"`
+}
+
+type KRBError struct {
+	PVNO      int           `asn1:"explicit,tag:0"`
+	MsgType   int           `asn1:"explicit,tag:1"`
+	CTime     time.Time     `asn1:"optional,generalized,explicit,tag:2"`
+	CUSec     int           `asn1:"optional,explicit,tag:3"`
+	STime     time.Time     `asn1:"generalized,explicit,tag:4"`
+	SUSec     int           `asn1:"explicit,tag:5"`
+	ErrorCode int           `asn1:"explicit,tag:6"`
+	CRealm    asn1.RawValue `asn1:"optional,explicit,tag:7"`
+	CName     PrincipalName `asn1:"optional,explicit,tag:8"`
+	Realm     asn1.RawValue `asn1:"explicit,tag:9"`
+	SName     PrincipalName `asn1:"explicit,tag:10"`
+	EText     asn1.RawValue `asn1:"optional,explicit,tag:11"`
+	EData     []byte        `asn1:"optional,explicit,tag:12"`
+}
+
+// Error is a KRB-ERROR returned by the KDC or the server
+type Error struct {
+	Code  int
+	Text  string
+	EData []byte
+}
+
+func (e *Error) Error() string {
+	if e.Text != "" {
+		return fmt.Sprintf("kerberos: error %d (%s)", e.Code, e.Text)
+	}
+	return fmt.Sprintf("kerberos: error %d", e.Code)
+}
+
+func marshalApp(v interface{}, tag int) ([]byte, error) {
+	return asn1.MarshalWithParams(v, fmt.Sprintf("application,explicit,tag:%d", tag))
+}
+
+// unmarshalApp decodes an [APPLICATION tag] message, any of tags is accepted
+func unmarshalApp(b []byte, v interface{}, tags ...int) error {
+	var raw asn1.RawValue
+	if _, err := asn1.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if raw.Class == asn1.ClassApplication {
+		if raw.Tag == TAG_KRB_ERROR && tags[0] != TAG_KRB_ERROR {
+			return parseError(b)
+		}
+		for _, t := range tags {
+			if raw.Tag == t {
+				_, err := asn1.Unmarshal(raw.Bytes, v)
+				return err
+			}
+		}
+	}
+	return fmt.Errorf("kerberos: unexpected message tag %d", raw.Tag)
+}
+
+func parseError(b []byte) error {
+	e := KRBError{}
+	if err := unmarshalApp(b, &e, TAG_KRB_ERROR); err != nil {
+		return err
+	}
+	return &Error{e.ErrorCode, rawString(e.EText), e.EData}
+}
@@ -2,10 +2,10 @@ package nla
 
 import (
 	"bytes"
-	"crypto/md5"
 	"crypto/rc4"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"time"
 
 	"github.com/lunixbochs/struc"
@@ -285,6 +285,7 @@ type NTLMv2 struct {
 	challengeMessage    *ChallengeMessage
 	authenticateMessage *AuthenticateMessage
 	enableUnicode       bool
+	sec                 *NTLMv2Security
 }
 
 func NewNTLMv2(domain, user, password string) *NTLMv2 {
@@ -297,6 +298,18 @@ func NewNTLMv2(domain, user, password string) *NTLMv2 {
 	}
 }
 
+// NewNTLMv2Hash authenticates with the NT hash of the password, used by
+// Restricted Admin mode where the password is never sent to the server
+func NewNTLMv2Hash(domain, user string, ntHash []byte) *NTLMv2 {
+	key := NTOWFv2Hash(ntHash, user, domain)
+	return &NTLMv2{
+		domain:    domain,
+		user:      user,
+		respKeyNT: key,
+		respKeyLM: key,
+	}
+}
+
 // generate first handshake messgae
 func (n *NTLMv2) GetNegotiateMessage() *NegotiateMessage {
 	negoMsg := NewNegotiateMessage()
@@ -362,6 +375,28 @@ var (
 	serverSealing = concat([]byte("session key to server-to-client sealing key magic constant"), []byte{0x00})
 )
 
+/**
+ * SIGNKEY returns the client or server signing key of a 128-bit session
+ * @see MS-NLMP 3.4.5.2 SIGNKEY
+ */
+func SIGNKEY(exportedSessionKey []byte, client bool) []byte {
+	if client {
+		return MD5(concat(exportedSessionKey, clientSigning))
+	}
+	return MD5(concat(exportedSessionKey, serverSigning))
+}
+
+/**
+ * SEALKEY returns the client or server sealing key of a 128-bit session
+ * @see MS-NLMP 3.4.5.3 SEALKEY
+ */
+func SEALKEY(exportedSessionKey []byte, client bool) []byte {
+	if client {
+		return MD5(concat(exportedSessionKey, clientSealing))
+	}
+	return MD5(concat(exportedSessionKey, serverSealing))
+}
+
 func (n *NTLMv2) GetAuthenticateMessage(s []byte) (*AuthenticateMessage, *NTLMv2Security) {
 	challengeMsg := &ChallengeMessage{}
 	r := bytes.NewReader(s)
@@ -420,26 +455,10 @@ func (n *NTLMv2) GetAuthenticateMessage(s []byte) (*AuthenticateMessage, *NTLMv2
 		copy(n.authenticateMessage.MIC[:], MIC(exportedSessionKey, n.negotiateMessage, n.challengeMessage, n.authenticateMessage)[:16])
 	}
 
-	md := md5.New()
-	//ClientSigningKey
-	a := concat(exportedSessionKey, clientSigning)
-	md.Write(a)
-	ClientSigningKey := md.Sum(nil)
-	//ServerSigningKey
-	md.Reset()
-	a = concat(exportedSessionKey, serverSigning)
-	md.Write(a)
-	ServerSigningKey := md.Sum(nil)
-	//ClientSealingKey
-	md.Reset()
-	a = concat(exportedSessionKey, clientSealing)
-	md.Write(a)
-	ClientSealingKey := md.Sum(nil)
-	//ServerSealingKey
-	md.Reset()
-	a = concat(exportedSessionKey, serverSealing)
-	md.Write(a)
-	ServerSealingKey := md.Sum(nil)
+	ClientSigningKey := SIGNKEY(exportedSessionKey, true)
+	ServerSigningKey := SIGNKEY(exportedSessionKey, false)
+	ClientSealingKey := SEALKEY(exportedSessionKey, true)
+	ServerSealingKey := SEALKEY(exportedSessionKey, false)
 
 	glog.Debugf("ClientSigningKey:%s", hex.EncodeToString(ClientSigningKey))
 	glog.Debugf("ServerSigningKey:%s", hex.EncodeToString(ServerSigningKey))
@@ -454,6 +473,28 @@ func (n *NTLMv2) GetAuthenticateMessage(s []byte) (*AuthenticateMessage, *NTLMv2
 	return n.authenticateMessage, ntlmSec
 }
 
+// InitSecContext sends the negotiate message, then answers the server
+// challenge with the authenticate message
+func (n *NTLMv2) InitSecContext(in []byte) ([]byte, bool, error) {
+	if in == nil {
+		return n.GetNegotiateMessage().Serialize(), false, nil
+	}
+	authMsg, sec := n.GetAuthenticateMessage(in)
+	if authMsg == nil {
+		return nil, false, errors.New("invalid NTLM challenge message")
+	}
+	n.sec = sec
+	return authMsg.Serialize(), true, nil
+}
+
+func (n *NTLMv2) GssEncrypt(s []byte) []byte {
+	return n.sec.GssEncrypt(s)
+}
+
+func (n *NTLMv2) GssDecrypt(s []byte) []byte {
+	return n.sec.GssDecrypt(s)
+}
+
 func (n *NTLMv2) GetEncodedCredentials() ([]byte, []byte, []byte) {
 	if n.enableUnicode {
 		return core.UnicodeEncode(n.domain), core.UnicodeEncode(n.user), core.UnicodeEncode(n.password)
@@ -508,7 +549,7 @@ func (n *NTLMv2Security) GssDecrypt(s []byte) []byte {
 	core.WriteUInt32LE(seqNum, b)
 	core.WriteBytes(p, b)
 	verify := HMAC_MD5(n.VerifyKey, b.Bytes())
-	if string(verify) != string(check) {
+	if string(verify[:8]) != string(check) {
 		return nil
 	}
 	return p
@@ -453,6 +453,15 @@ func (*GlyphCapability) Type() CapsType {
 	return CAPSTYPE_GLYPHCACHE
 }
 
+// Cells returns the number of entries of each glyph cache
+func (c *GlyphCapability) Cells() []int {
+	cells := make([]int, len(c.GlyphCache))
+	for i, e := range c.GlyphCache {
+		cells[i] = int(e.Entries)
+	}
+	return cells
+}
+
 type OffscreenBitmapCacheCapability struct {
 	// 11000c000000000000000000
 	SupportLevel OffscreenSupportLevel `struc:"little"`
@@ -464,6 +473,15 @@ func (*OffscreenBitmapCacheCapability) Type() CapsType {
 	return CAPSTYPE_OFFSCREENCACHE
 }
 
+// BitmapCachePersist flags
+const (
+	PERSISTENT_KEYS_EXPECTED_FLAG = 0x0001
+	ALLOW_CACHE_WAITING_LIST_FLAG = 0x0002
+)
+
+// high bit of the BmpC*Cells, the cache is kept on disk
+const CELL_PERSISTENT = 0x80000000
+
 type BitmapCache2Capability struct {
 	BitmapCachePersist uint16   `struc:"little"`
 	Pad2octets         uint8    `struc:"little"`
@@ -480,6 +498,20 @@ func (*BitmapCache2Capability) Type() CapsType {
 	return CAPSTYPE_BITMAPCACHE_REV2
 }
 
+// Cells returns the number of entries of each cache
+func (c *BitmapCache2Capability) Cells() []int {
+	all := []uint32{c.BmpC0Cells, c.BmpC1Cells, c.BmpC2Cells, c.BmpC3Cells, c.BmpC4Cells}
+	n := int(c.CachesNum)
+	if n > len(all) {
+		n = len(all)
+	}
+	cells := make([]int, n)
+	for i := range cells {
+		cells[i] = int(all[i] &^ CELL_PERSISTENT)
+	}
+	return cells
+}
+
 type VirtualChannelCapability struct {
 	// 14000c000000000000000000
 	Flags       VirtualChannelCompressionFlag `struc:"little"`
@@ -581,6 +613,64 @@ type BitmapCodec struct {
 	Properties       []byte
 }
 
+// ids the client gives to the codecs it advertises
+const (
+	CODEC_ID_NONE     = 0x00
+	CODEC_ID_NSCODEC  = 0x01
+	CODEC_ID_REMOTEFX = 0x03
+)
+
+// CA8D1BB9-000F-154F-589F-AE2D1A87E2D6
+var CODEC_GUID_NSCODEC = [16]byte{
+	0xb9, 0x1b, 0x8d, 0xca, 0x0f, 0x00, 0x4f, 0x15,
+	0x58, 0x9f, 0xae, 0x2d, 0x1a, 0x87, 0xe2, 0xd6,
+}
+
+// 76772F12-BD72-4463-AFB3-B73C9C6F7886
+var CODEC_GUID_REMOTEFX = [16]byte{
+	0x12, 0x2f, 0x77, 0x76, 0x72, 0xbd, 0x63, 0x44,
+	0xaf, 0xb3, 0xb7, 0x3c, 0x9c, 0x6f, 0x78, 0x86,
+}
+
+/**
+ * NSCodecProperties allows dynamic fidelity, chroma sub-sampling
+ * and a color loss level of 3.
+ * @see MS-RDPNSC 2.2.1 NSCodec Capability Set (TS_NSCODEC_CAPABILITYSET)
+ */
+func NSCodecProperties() []byte {
+	return []byte{0x01, 0x01, 0x03}
+}
+
+/**
+ * RemoteFXProperties advertises 64x64 tiles, the ICT color conversion
+ * and the 5/3 DWT with RLGR1 or RLGR3 entropy in video mode.
+ * @see MS-RDPRFX 2.2.1.1 TS_RFX_CLNT_CAPS_CONTAINER
+ */
+func RemoteFXProperties() []byte {
+	b := &bytes.Buffer{}
+	// length, captureFlags CARDP_CAPS_CAPTURE_NON_CAC and capsLength
+	core.WriteUInt32LE(49, b)
+	core.WriteUInt32LE(0x01, b)
+	core.WriteUInt32LE(37, b)
+	// TS_RFX_CAPS of a TS_RFX_CAPSET
+	core.WriteUInt16LE(0xCBC0, b)
+	core.WriteUInt32LE(8, b)
+	core.WriteUInt16LE(1, b)
+	core.WriteUInt16LE(0xCBC1, b)
+	core.WriteUInt32LE(29, b)
+	core.WriteUInt8(0x01, b)
+	core.WriteUInt16LE(0xCFC0, b)
+	core.WriteUInt16LE(2, b)
+	core.WriteUInt16LE(8, b)
+	// TS_RFX_ICAP of each entropy
+	for _, entropy := range []uint8{0x01, 0x04} {
+		core.WriteUInt16LE(0x0100, b)
+		core.WriteUInt16LE(64, b)
+		b.Write([]byte{0x00, 0x01, 0x01, entropy})
+	}
+	return b.Bytes()
+}
+
 // see https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/408b1878-9f6e-4106-8329-1af42219ba6a
 type BitmapCodecS struct {
 	Count uint8 `struc:"sizeof=Array"`
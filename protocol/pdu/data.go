@@ -2,6 +2,7 @@ package pdu
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +10,7 @@ import (
 	"github.com/lunixbochs/struc"
 	"github.com/tomatome/grdp/core"
 	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/sec"
 )
 
 const (
@@ -46,6 +48,7 @@ const (
 	PDUTYPE2_ARC_STATUS_PDU              = 0x32
 	PDUTYPE2_STATUS_INFO_PDU             = 0x36
 	PDUTYPE2_MONITOR_LAYOUT_PDU          = 0x37
+	PDUTYPE2_FRAME_ACKNOWLEDGE           = 0x38
 )
 
 func (p PduType2) String() string {
@@ -98,6 +101,8 @@ func (p PduType2) String() string {
 		return "PDUTYPE2_STATUS_INFO_PDU"
 	case PDUTYPE2_MONITOR_LAYOUT_PDU:
 		return "PDUTYPE2_MONITOR_LAYOUT_PDU"
+	case PDUTYPE2_FRAME_ACKNOWLEDGE:
+		return "PDUTYPE2_FRAME_ACKNOWLEDGE"
 	}
 
 	return "Unknown"
@@ -398,6 +403,31 @@ func readDeactiveAllPDU(r io.Reader) (*DeactiveAllPDU, error) {
 	return p, err
 }
 
+/**
+ * Enhanced Security Server Redirection PDU
+ * @see MS-RDPBCGR 2.2.13.3.1 Enhanced Security Server Redirection (TS_ENHANCED_SECURITY_SERVER_REDIRECTION)
+ */
+type ServerRedirectionPDU struct {
+	Redirection *sec.ServerRedirection
+}
+
+func (*ServerRedirectionPDU) Type() uint16 {
+	return PDUTYPE_SERVER_REDIR_PKT
+}
+
+func (d *ServerRedirectionPDU) Serialize() []byte {
+	return nil
+}
+
+func readServerRedirectionPDU(r io.Reader) (*ServerRedirectionPDU, error) {
+	// pad2Octets
+	if _, err := core.ReadBytes(2, r); err != nil {
+		return nil, err
+	}
+	rd, err := sec.ReadServerRedirection(r)
+	return &ServerRedirectionPDU{rd}, err
+}
+
 type DataPDU struct {
 	Header *ShareDataHeader
 	Data   DataPDUData
@@ -454,6 +484,9 @@ func readDataPDU(r io.Reader) (*DataPDU, error) {
 	case PDUTYPE2_SAVE_SESSION_INFO:
 		d = &SaveSessionInfo{}
 
+	case PDUTYPE2_POINTER:
+		d = &PointerDataPDU{}
+
 	default:
 		err = errors.New(fmt.Sprintf("Unknown data pdu type2 0x%02x", header.PDUType2))
 		glog.Error(err)
@@ -496,6 +529,7 @@ func (d *UpdateDataPDU) Unpack(r io.Reader) (err error) {
 	case FASTPATH_UPDATETYPE_BITMAP:
 		p = &BitmapUpdateDataPDU{}
 	case FASTPATH_UPDATETYPE_PALETTE:
+		p = &PaletteUpdateData{}
 	case FASTPATH_UPDATETYPE_SYNCHRONIZE:
 	}
 	if p != nil {
@@ -552,6 +586,44 @@ func (f *BitmapUpdateDataPDU) Unpack(r io.Reader) error {
 	return err
 }
 
+// PaletteEntry is a color of a palette update
+type PaletteEntry struct {
+	Red   uint8
+	Green uint8
+	Blue  uint8
+}
+
+/**
+ * PaletteUpdateData replaces the palette of a 8 bpp session,
+ * Unpack reads what follows the updateType field.
+ * @see MS-RDPBCGR 2.2.9.1.1.3.1.1.1 Palette Update Data (TS_UPDATE_PALETTE_DATA)
+ */
+type PaletteUpdateData struct {
+	NumberColors uint32
+	Entries      []PaletteEntry
+}
+
+func (*PaletteUpdateData) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_PALETTE
+}
+func (d *PaletteUpdateData) Unpack(r io.Reader) error {
+	// pad2Octets
+	core.ReadUint16LE(r)
+	d.NumberColors, _ = core.ReadUInt32LE(r)
+	if d.NumberColors > 256 {
+		return fmt.Errorf("palette of %d colors", d.NumberColors)
+	}
+	b, err := core.ReadBytes(3*int(d.NumberColors), r)
+	if err != nil {
+		return err
+	}
+	d.Entries = make([]PaletteEntry, d.NumberColors)
+	for i := range d.Entries {
+		d.Entries[i] = PaletteEntry{b[3*i], b[3*i+1], b[3*i+2]}
+	}
+	return nil
+}
+
 type SynchronizeDataPDU struct {
 	MessageType uint16 `struc:"little"`
 	TargetUser  uint16 `struc:"little"`
@@ -736,6 +808,20 @@ func (*SaveSessionInfo) Type2() uint8 {
 	return PDUTYPE2_SAVE_SESSION_INFO
 }
 
+// BBitMask of the Persistent Key List PDU
+const (
+	PERSIST_FIRST_PDU = 0x01
+	PERSIST_LAST_PDU  = 0x02
+)
+
+// at most 169 keys per Persistent Key List PDU
+const PERSIST_MAX_KEYS = 169
+
+/**
+ * PersistKeyPDU lists the keys of the bitmaps the client already
+ * has, the server then assumes they fill the persistent caches.
+ * @see MS-RDPBCGR 2.2.1.17.1 Persistent Key List PDU Data
+ */
 type PersistKeyPDU struct {
 	NumEntriesCache0   uint16 `struc:"little"`
 	NumEntriesCache1   uint16 `struc:"little"`
@@ -750,11 +836,87 @@ type PersistKeyPDU struct {
 	BBitMask           uint8  `struc:"little"`
 	Pad1               uint8  `struc:"little"`
 	Ppad3              uint16 `struc:"little"`
+	Entries            PersistentListEntries
 }
 
 func (*PersistKeyPDU) Type2() uint8 {
 	return PDUTYPE2_BITMAPCACHE_PERSISTENT_LIST
 }
+func (d *PersistKeyPDU) Unpack(r io.Reader) error {
+	return struc.Unpack(r, d)
+}
+
+// PersistentListEntries are TS_BITMAPCACHE_PERSISTENT_LIST_ENTRY,
+// key1 is the low 32 bits of a key
+type PersistentListEntries struct {
+	Keys []uint64
+}
+
+func (e *PersistentListEntries) Pack(p []byte, opt *struc.Options) (int, error) {
+	for i, k := range e.Keys {
+		binary.LittleEndian.PutUint64(p[i*8:], k)
+	}
+	return len(e.Keys) * 8, nil
+}
+func (e *PersistentListEntries) Unpack(r io.Reader, length int, opt *struc.Options) error {
+	e.Keys = e.Keys[:0]
+	for {
+		var k uint64
+		if err := binary.Read(r, binary.LittleEndian, &k); err != nil {
+			return nil
+		}
+		e.Keys = append(e.Keys, k)
+	}
+}
+func (e *PersistentListEntries) Size(opt *struc.Options) int {
+	return len(e.Keys) * 8
+}
+func (e *PersistentListEntries) String() string {
+	return fmt.Sprintf("%d keys", len(e.Keys))
+}
+
+// NewPersistKeyPDUs splits the keys of each cache in Persistent Key List PDUs
+func NewPersistKeyPDUs(keys [][]uint64) []*PersistKeyPDU {
+	var total [5]uint16
+	type entry struct {
+		cache int
+		key   uint64
+	}
+	all := make([]entry, 0)
+	for i := 0; i < len(keys) && i < len(total); i++ {
+		total[i] = uint16(len(keys[i]))
+		for _, k := range keys[i] {
+			all = append(all, entry{i, k})
+		}
+	}
+
+	pdus := make([]*PersistKeyPDU, 0, len(all)/PERSIST_MAX_KEYS+1)
+	for len(all) > 0 {
+		n := len(all)
+		if n > PERSIST_MAX_KEYS {
+			n = PERSIST_MAX_KEYS
+		}
+		var num [5]uint16
+		p := &PersistKeyPDU{}
+		for _, e := range all[:n] {
+			num[e.cache]++
+			p.Entries.Keys = append(p.Entries.Keys, e.key)
+		}
+		all = all[n:]
+		p.NumEntriesCache0, p.NumEntriesCache1, p.NumEntriesCache2, p.NumEntriesCache3, p.NumEntriesCache4 =
+			num[0], num[1], num[2], num[3], num[4]
+		p.TotalEntriesCache0, p.TotalEntriesCache1, p.TotalEntriesCache2, p.TotalEntriesCache3, p.TotalEntriesCache4 =
+			total[0], total[1], total[2], total[3], total[4]
+		if len(pdus) == 0 {
+			p.BBitMask |= PERSIST_FIRST_PDU
+		}
+		if len(all) == 0 {
+			p.BBitMask |= PERSIST_LAST_PDU
+		}
+		pdus = append(pdus, p)
+	}
+	return pdus
+}
 
 type UpdateData interface {
 	FastPathUpdateType() uint8
@@ -828,38 +990,94 @@ func (*FastPathBitmapUpdateDataPDU) FastPathUpdateType() uint8 {
 	return FASTPATH_UPDATETYPE_BITMAP
 }
 
-type FastPathColorPdu struct {
-	CacheIdx uint16
-	X        uint16
-	Y        uint16
-	Width    uint16
-	Height   uint16
-	MaskLen  uint16 `struc:"little,sizeof=Mask"`
-	DataLen  uint16 `struc:"little,sizeof=Data"`
-	Mask     []byte
-	Data     []byte
-}
+const (
+	CMDTYPE_SET_SURFACE_BITS    = 0x0001
+	CMDTYPE_FRAME_MARKER        = 0x0004
+	CMDTYPE_STREAM_SURFACE_BITS = 0x0006
+)
 
-func (*FastPathColorPdu) FastPathUpdateType() uint8 {
-	return FASTPATH_UPDATETYPE_COLOR
-}
-func (f *FastPathColorPdu) Unpack(r io.Reader) error {
-	return struc.Unpack(r, f)
-}
+const (
+	SURFACECMD_FRAMEACTION_BEGIN = 0x0000
+	SURFACECMD_FRAMEACTION_END   = 0x0001
+)
 
+// FastPathSurfaceCmds holds the surface commands of an update
 type FastPathSurfaceCmds struct {
+	// *SurfaceBits or *FrameMarker
+	Cmds []interface{}
 }
 
 func (*FastPathSurfaceCmds) FastPathUpdateType() uint8 {
 	return FASTPATH_UPDATETYPE_SURFCMDS
 }
 func (f *FastPathSurfaceCmds) Unpack(r io.Reader) error {
-	cmdType, _ := core.ReadUint16LE(r)
-	switch cmdType {
-
+	for {
+		// ReadUint16LE hides the end of the update
+		b, err := core.ReadBytes(2, r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch cmdType := binary.LittleEndian.Uint16(b); cmdType {
+		case CMDTYPE_SET_SURFACE_BITS, CMDTYPE_STREAM_SURFACE_BITS:
+			c := &SurfaceBits{CmdType: cmdType}
+			if err := c.Unpack(r); err != nil {
+				return err
+			}
+			f.Cmds = append(f.Cmds, c)
+		case CMDTYPE_FRAME_MARKER:
+			c := &FrameMarker{}
+			if err := struc.Unpack(r, c); err != nil {
+				return err
+			}
+			f.Cmds = append(f.Cmds, c)
+		default:
+			// the length of an unknown command is unknown too
+			return fmt.Errorf("unknown surface command 0x%x", cmdType)
+		}
 	}
+}
 
-	return nil
+/**
+ * SurfaceBits draws a bitmap encoded by a codec at (DestLeft, DestTop),
+ * Stream Surface Bits only differ by their name.
+ * @see MS-RDPBCGR 2.2.9.2.1 Set Surface Bits Command (TS_SURFCMD_SET_SURF_BITS)
+ */
+type SurfaceBits struct {
+	CmdType    uint16
+	DestLeft   uint16
+	DestTop    uint16
+	DestRight  uint16
+	DestBottom uint16
+	Bitmap     BitmapDataEx
+}
+
+func (c *SurfaceBits) Unpack(r io.Reader) error {
+	c.DestLeft, _ = core.ReadUint16LE(r)
+	c.DestTop, _ = core.ReadUint16LE(r)
+	c.DestRight, _ = core.ReadUint16LE(r)
+	c.DestBottom, _ = core.ReadUint16LE(r)
+	return c.Bitmap.Unpack(r)
+}
+
+// FrameMarker begins or ends a frame of surface commands
+type FrameMarker struct {
+	FrameAction uint16 `struc:"little"`
+	FrameId     uint32 `struc:"little"`
+}
+
+// FrameAcknowledgePDU tells the server a frame was drawn
+type FrameAcknowledgePDU struct {
+	FrameId uint32 `struc:"little"`
+}
+
+func (*FrameAcknowledgePDU) Type2() uint8 {
+	return PDUTYPE2_FRAME_ACKNOWLEDGE
+}
+func (d *FrameAcknowledgePDU) Unpack(r io.Reader) error {
+	return struc.Unpack(r, d)
 }
 
 type FastPathUpdatePDU struct {
@@ -881,28 +1099,41 @@ const (
 	FASTPATH_FRAGMENT_NEXT   = (0x3 << 4)
 )
 
-func readFastPathUpdatePDU(r io.Reader, code uint8) (*FastPathUpdatePDU, error) {
+// readFastPathUpdatePDU reads an update, orders with the history of orders
+func readFastPathUpdatePDU(r io.Reader, code uint8, orders *OrderState) (*FastPathUpdatePDU, error) {
 	f := &FastPathUpdatePDU{}
 	var err error
 	var d UpdateData
 	//glog.Debugf("FastPathPDU type %s(0x%x)", FastPathUpdateType(code), code)
 	switch code {
 	case FASTPATH_UPDATETYPE_ORDERS:
-		d = &FastPathOrdersPDU{}
+		d = &FastPathOrdersPDU{State: orders}
 	case FASTPATH_UPDATETYPE_BITMAP:
 		d = &FastPathBitmapUpdateDataPDU{}
 	case FASTPATH_UPDATETYPE_PALETTE:
+		// the updateType of the slow-path update comes first
+		core.ReadUint16LE(r)
+		d = &PaletteUpdateData{}
 	case FASTPATH_UPDATETYPE_SYNCHRONIZE:
 	case FASTPATH_UPDATETYPE_SURFCMDS:
-		//d = &FastPathSurfaceCmds{}
+		d = &FastPathSurfaceCmds{}
 	case FASTPATH_UPDATETYPE_PTR_NULL:
+		// no body, the code is the system pointer
+		f.Data = &SystemPointer{SYSPTR_NULL}
+		return f, nil
 	case FASTPATH_UPDATETYPE_PTR_DEFAULT:
+		f.Data = &SystemPointer{SYSPTR_DEFAULT}
+		return f, nil
 	case FASTPATH_UPDATETYPE_PTR_POSITION:
+		d = &PointerPosition{}
 	case FASTPATH_UPDATETYPE_COLOR:
-		//d = &FastPathColorPdu{}
+		d = &ColorPointer{}
 	case FASTPATH_UPDATETYPE_CACHED:
+		d = &CachedPointer{}
 	case FASTPATH_UPDATETYPE_POINTER:
+		d = &NewPointer{}
 	case FASTPATH_UPDATETYPE_LARGE_POINTER:
+		d = &LargePointer{}
 	default:
 		glog.Debugf("Unknown FastPathPDU type 0x%x", code)
 		return f, errors.New(fmt.Sprintf("Unknown FastPathPDU type 0x%x", code))
@@ -968,6 +1199,9 @@ func readPDU(r io.Reader) (*PDU, error) {
 	case PDUTYPE_DEACTIVATEALLPDU:
 		glog.Debug("PDUTYPE_DEACTIVATEALLPDU")
 		d, err = readDeactiveAllPDU(r)
+	case PDUTYPE_SERVER_REDIR_PKT:
+		glog.Debug("PDUTYPE_SERVER_REDIR_PKT")
+		d, err = readServerRedirectionPDU(r)
 	default:
 		glog.Errorf("PDU invalid pdu type: 0x%02x", pdu.ShareCtrlHeader.PDUType)
 	}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"reflect"
 
 	"github.com/tomatome/grdp/glog"
 
@@ -41,11 +42,11 @@ const (
 	//ORDER_TYPE_MULTIPATBLT        = 0x10 //16
 	//ORDER_TYPE_MULTISCRBLT        = 0x11 //17
 	//ORDER_TYPE_MULTIOPAQUERECT    = 0x12 //18
-	//ORDER_TYPE_FAST_INDEX         = 0x13 //19
+	ORDER_TYPE_FAST_INDEX = 0x13 //19
 	ORDER_TYPE_POLYGON_SC = 0x14 //20
 	ORDER_TYPE_POLYGON_CB = 0x15 //21
 	ORDER_TYPE_POLYLINE   = 0x16 //22
-	//ORDER_TYPE_FAST_GLYPH         = 0x18 //24
+	ORDER_TYPE_FAST_GLYPH = 0x18 //24
 	ORDER_TYPE_ELLIPSE_SC = 0x19 //25
 	ORDER_TYPE_ELLIPSE_CB = 0x1A //26
 	ORDER_TYPE_TEXT2      = 0x1B //27
@@ -110,10 +111,24 @@ const (
 	GLYPH_FRAGMENT_USE = 0xFE
 	GLYPH_FRAGMENT_ADD = 0xFF
 
+	SO_FLAG_DEFAULT_PLACEMENT = 0x01
+	SO_HORIZONTAL             = 0x02
+	SO_VERTICAL               = 0x04
+	SO_REVERSED               = 0x08
+	SO_ZERO_BEARINGS          = 0x10
+	SO_CHAR_INC_EQUAL_BM_BASE = 0x20
+	SO_MAXEXT_EQUAL_BM_SIDE   = 0x40
+
+	// extraFlags of the revision 1 and 2 cache glyph orders
+	CG_GLYPH_UNICODE_PRESENT      = 0x0100
+	CG_GLYPH_UNICODE_PRESENT_REV2 = 0x0010
+
 	CBR2_HEIGHT_SAME_AS_WIDTH      = 0x01
 	CBR2_PERSISTENT_KEY_PRESENT    = 0x02
 	CBR2_NO_BITMAP_COMPRESSION_HDR = 0x08
 	CBR2_DO_NOT_CACHE              = 0x10
+
+	BITMAPCACHE_WAITING_LIST_INDEX = 0x7FFF
 )
 
 const (
@@ -135,9 +150,16 @@ func (o *OrderPdu) HasBounds() bool {
 }
 
 type Altsec struct {
+	OrderType uint8
+	// *SwitchSurfaceOrder or *CreateOffscreenBitmapOrder, nil for the others
+	Data interface{}
 }
 
 type Secondary struct {
+	OrderType uint8
+	// *CacheBitmapOrder, *CacheBitmapV2Order, *CacheBitmapV3Order, *CacheGlyphOrder,
+	// *CacheBrushOrder or *CacheColorTableOrder
+	Data interface{}
 }
 
 type Primary struct {
@@ -148,6 +170,8 @@ type Primary struct {
 type FastPathOrdersPDU struct {
 	NumberOrders uint16
 	OrderPdus    []OrderPdu
+	// primary order history of the connection, a new one when nil
+	State *OrderState
 }
 
 func (*FastPathOrdersPDU) FastPathUpdateType() uint8 {
@@ -155,6 +179,9 @@ func (*FastPathOrdersPDU) FastPathUpdateType() uint8 {
 }
 
 func (f *FastPathOrdersPDU) Unpack(r io.Reader) error {
+	if f.State == nil {
+		f.State = NewOrderState()
+	}
 	f.NumberOrders, _ = core.ReadUint16LE(r)
 	//glog.Info("NumberOrders:", f.NumberOrders)
 	for i := 0; i < int(f.NumberOrders); i++ {
@@ -167,11 +194,11 @@ func (f *FastPathOrdersPDU) Unpack(r io.Reader) error {
 			//return errors.New("Not support")
 		} else if o.ControlFlags&TS_SECONDARY != 0 {
 			//glog.Info("Secondary order")
-			o.processSecondaryOrder(r)
+			o.processSecondaryOrder(r, f.State)
 			o.Type = ORDER_SECONDARY
 		} else {
 			//glog.Info("Primary order")
-			o.processPrimaryOrder(r)
+			o.processPrimaryOrder(r, f.State)
 			o.Type = ORDER_PRIMARY
 		}
 
@@ -184,10 +211,14 @@ func (f *FastPathOrdersPDU) Unpack(r io.Reader) error {
 }
 func (o *OrderPdu) processAltsecOrder(r io.Reader) error {
 	orderType := o.ControlFlags >> 2
+	alt := &Altsec{OrderType: orderType}
+	o.Altsec = alt
 	//glog.Info("Altsec:", orderType)
 	switch orderType {
 	case ORDER_TYPE_SWITCH_SURFACE:
+		alt.updateSwitchSurfaceOrder(r)
 	case ORDER_TYPE_CREATE_OFFSCREEN_BITMAP:
+		alt.updateCreateOffscreenBitmapOrder(r)
 	case ORDER_TYPE_STREAM_BITMAP_FIRST:
 	case ORDER_TYPE_STREAM_BITMAP_NEXT:
 	case ORDER_TYPE_CREATE_NINE_GRID_BITMAP:
@@ -205,13 +236,14 @@ func (o *OrderPdu) processAltsecOrder(r io.Reader) error {
 
 	return nil
 }
-func (o *OrderPdu) processSecondaryOrder(r io.Reader) error {
-	var sec Secondary
+func (o *OrderPdu) processSecondaryOrder(r io.Reader, state *OrderState) error {
 	length, _ := core.ReadUint16LE(r)
 	flags, _ := core.ReadUint16LE(r)
 	orderType, _ := core.ReadUInt8(r)
+	sec := &Secondary{OrderType: orderType}
+	o.Secondary = sec
 
-	glog.Info("Secondary:", SecondaryOrderType(orderType))
+	glog.Debug("Secondary:", SecondaryOrderType(orderType))
 
 	b, _ := core.ReadBytes(int(length)+13-6, r)
 	r0 := bytes.NewReader(b)
@@ -232,7 +264,7 @@ func (o *OrderPdu) processSecondaryOrder(r io.Reader) error {
 	case ORDER_TYPE_CACHE_COLOR_TABLE:
 		sec.updateCacheColorTableOrder(r0, flags)
 	case ORDER_TYPE_CACHE_GLYPH:
-		sec.updateCacheGlyphOrder(r0, flags)
+		sec.updateCacheGlyphOrder(r0, flags, state.glyphRev2)
 	case ORDER_TYPE_CACHE_BRUSH:
 		sec.updateCacheBrushOrder(r0, flags)
 	default:
@@ -245,26 +277,26 @@ func (b *Bounds) updateBounds(r io.Reader) {
 	present, _ := core.ReadUInt8(r)
 
 	if present&1 != 0 {
-		readOrderCoord(r, &b.left, false)
+		readOrderCoord(r, &b.Left, false)
 	} else if present&16 != 0 {
-		readOrderCoord(r, &b.left, true)
+		readOrderCoord(r, &b.Left, true)
 	}
 
 	if present&2 != 0 {
-		readOrderCoord(r, &b.top, false)
+		readOrderCoord(r, &b.Top, false)
 	} else if present&32 != 0 {
-		readOrderCoord(r, &b.top, true)
+		readOrderCoord(r, &b.Top, true)
 	}
 
 	if present&4 != 0 {
-		readOrderCoord(r, &b.right, false)
+		readOrderCoord(r, &b.Right, false)
 	} else if present&64 != 0 {
-		readOrderCoord(r, &b.right, true)
+		readOrderCoord(r, &b.Right, true)
 	}
 	if present&8 != 0 {
-		readOrderCoord(r, &b.bottom, false)
+		readOrderCoord(r, &b.Bottom, false)
 	} else if present&128 != 0 {
-		readOrderCoord(r, &b.bottom, true)
+		readOrderCoord(r, &b.Bottom, true)
 	}
 }
 
@@ -273,22 +305,59 @@ type PrimaryOrder interface {
 	Unpack(io.Reader, uint32, bool) error
 }
 
-var (
+/**
+ * OrderState is the primary order history of a connection: primary orders
+ * only carry the fields that changed since the last order of the same type,
+ * the type and bounds of the last order.
+ * @see MS-RDPEGDI Primary Drawing Order History
+ */
+type OrderState struct {
 	orderType uint8
 	bounds    Bounds
-)
+	orders    map[uint8]PrimaryOrder
+	// cache glyph orders are revision 2
+	glyphRev2 bool
+}
+
+func NewOrderState() *OrderState {
+	s := &OrderState{}
+	s.Reset()
+	return s
+}
 
-func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
+// SetGlyphSupport sets the glyph support level advertised to the server,
+// GLYPH_SUPPORT_ENCODE servers send revision 2 cache glyph orders
+func (s *OrderState) SetGlyphSupport(level GlyphSupport) {
+	s.glyphRev2 = level == GLYPH_SUPPORT_ENCODE
+}
+
+// Reset drops the history, the server starts again from
+// scratch after each Demand Active PDU
+func (s *OrderState) Reset() {
+	s.orderType = ORDER_TYPE_PATBLT
+	s.bounds = Bounds{}
+	s.orders = make(map[uint8]PrimaryOrder)
+}
+
+func copyOrder(p PrimaryOrder) PrimaryOrder {
+	v := reflect.New(reflect.TypeOf(p).Elem())
+	v.Elem().Set(reflect.ValueOf(p).Elem())
+	return v.Interface().(PrimaryOrder)
+}
+
+func (o *OrderPdu) processPrimaryOrder(r io.Reader, s *OrderState) error {
 	o.Primary = &Primary{}
 	if o.ControlFlags&TS_TYPE_CHANGE != 0 {
-		orderType, _ = core.ReadUInt8(r)
+		s.orderType, _ = core.ReadUInt8(r)
 	}
+	orderType := s.orderType
 	size := 1
 	switch orderType {
 	case ORDER_TYPE_MEM3BLT, ORDER_TYPE_TEXT2:
 		size = 3
 
-	case ORDER_TYPE_PATBLT, ORDER_TYPE_MEMBLT, ORDER_TYPE_LINETO, ORDER_TYPE_POLYGON_CB, ORDER_TYPE_ELLIPSE_CB:
+	case ORDER_TYPE_PATBLT, ORDER_TYPE_MEMBLT, ORDER_TYPE_LINETO, ORDER_TYPE_POLYGON_CB, ORDER_TYPE_ELLIPSE_CB,
+		ORDER_TYPE_FAST_INDEX, ORDER_TYPE_FAST_GLYPH:
 		size = 2
 	}
 
@@ -310,10 +379,10 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 
 	if o.ControlFlags&TS_BOUNDS != 0 {
 		if o.ControlFlags&TS_ZERO_BOUNDS_DELTAS == 0 {
-			bounds.updateBounds(r)
+			s.bounds.updateBounds(r)
 		}
 		//glog.Infof("updateBounds")
-		o.Primary.Bounds = bounds
+		o.Primary.Bounds = s.bounds
 	}
 
 	delta := o.ControlFlags&TS_DELTA_COORDINATES != 0
@@ -358,7 +427,8 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 
 	//case ORDER_TYPE_MULTIOPAQUERECT:
 
-	//case ORDER_TYPE_FAST_INDEX:
+	case ORDER_TYPE_FAST_INDEX:
+		p = &FastIndex{}
 
 	case ORDER_TYPE_POLYGON_SC:
 		p = &PolygonSc{}
@@ -369,7 +439,8 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 	case ORDER_TYPE_POLYLINE:
 		p = &Polyline{}
 
-	//case ORDER_TYPE_FAST_GLYPH:
+	case ORDER_TYPE_FAST_GLYPH:
+		p = &FastGlyph{}
 
 	case ORDER_TYPE_ELLIPSE_SC:
 		p = &EllipeSc{}
@@ -378,16 +449,18 @@ func (o *OrderPdu) processPrimaryOrder(r io.Reader) error {
 		p = &EllipeCb{}
 
 	case ORDER_TYPE_TEXT2:
-		p = &GlayphIndex{}
+		p = &GlyphIndex{}
 	default:
 		glog.Error("Not Support order type:", orderType)
 		return errors.New("Not Support order type")
 	}
-	if p != nil {
-		if err := p.Unpack(r, present, delta); err != nil {
-			return err
-		}
+	if last, ok := s.orders[orderType]; ok {
+		p = copyOrder(last)
 	}
+	if err := p.Unpack(r, present, delta); err != nil {
+		return err
+	}
+	s.orders[orderType] = p
 
 	o.Primary.Data = p
 	return nil
@@ -403,76 +476,74 @@ func readOrderCoord(r io.Reader, coord *int32, delta bool) {
 }
 
 type Dstblt struct {
-	x      int32
-	y      int32
-	cx     int32
-	cy     int32
-	opcode uint8
+	X      int32
+	Y      int32
+	Cx     int32
+	Cy     int32
+	Opcode uint8
 }
 
 func (d *Dstblt) Type() int {
 	return ORDER_TYPE_DSTBLT
 }
 func (d *Dstblt) Unpack(r io.Reader, present uint32, delta bool) error {
-	glog.Infof("Dstblt Order")
 	if present&0x01 != 0 {
-		readOrderCoord(r, &d.x, delta)
+		readOrderCoord(r, &d.X, delta)
 	}
 	if present&0x02 != 0 {
-		readOrderCoord(r, &d.y, delta)
+		readOrderCoord(r, &d.Y, delta)
 	}
 	if present&0x04 != 0 {
-		readOrderCoord(r, &d.cx, delta)
+		readOrderCoord(r, &d.Cx, delta)
 	}
 	if present&0x08 != 0 {
-		readOrderCoord(r, &d.cy, delta)
+		readOrderCoord(r, &d.Cy, delta)
 	}
 	if present&0x10 != 0 {
-		d.opcode, _ = core.ReadUInt8(r)
+		d.Opcode, _ = core.ReadUInt8(r)
 	}
 	return nil
 }
 
 type Patblt struct {
-	x        int32
-	y        int32
-	cx       int32
-	cy       int32
-	opcode   uint8
-	bgcolour [4]uint8
-	fgcolour [4]uint8
-	brush    Brush
+	X        int32
+	Y        int32
+	Cx       int32
+	Cy       int32
+	Opcode   uint8
+	Bgcolour [4]uint8
+	Fgcolour [4]uint8
+	Brush    Brush
 }
 
 func (d *Patblt) Type() int {
 	return ORDER_TYPE_PATBLT
 }
 func (d *Patblt) Unpack(r io.Reader, present uint32, delta bool) error {
-	glog.Infof("Patblt Order")
 	if present&0x01 != 0 {
-		readOrderCoord(r, &d.x, delta)
+		readOrderCoord(r, &d.X, delta)
 	}
 	if present&0x02 != 0 {
-		readOrderCoord(r, &d.y, delta)
+		readOrderCoord(r, &d.Y, delta)
 	}
 	if present&0x04 != 0 {
-		readOrderCoord(r, &d.cx, delta)
+		readOrderCoord(r, &d.Cx, delta)
 	}
 	if present&0x08 != 0 {
-		readOrderCoord(r, &d.cy, delta)
+		readOrderCoord(r, &d.Cy, delta)
 	}
 	if present&0x10 != 0 {
-		d.opcode, _ = core.ReadUInt8(r)
+		d.Opcode, _ = core.ReadUInt8(r)
 	}
 	if present&0x0020 != 0 {
 		b, g, r, a := updateReadColorRef(r)
-		d.bgcolour[0], d.bgcolour[1], d.bgcolour[2], d.bgcolour[3] = b, g, r, a
+		d.Bgcolour[0], d.Bgcolour[1], d.Bgcolour[2], d.Bgcolour[3] = b, g, r, a
 	}
 	if present&0x0040 != 0 {
 		b, g, r, a := updateReadColorRef(r)
-		d.fgcolour[0], d.fgcolour[1], d.fgcolour[2], d.fgcolour[3] = b, g, r, a
+		d.Fgcolour[0], d.Fgcolour[1], d.Fgcolour[2], d.Fgcolour[3] = b, g, r, a
 	}
-	d.brush.updateBrush(r, present>>7)
+	d.Brush.updateBrush(r, present>>7)
 
 	return nil
 }
@@ -524,10 +595,7 @@ func (d *Scrblt) Type() int {
 	return ORDER_TYPE_SCRBLT
 }
 
-var d Scrblt
-
-func (d1 *Scrblt) Unpack(r io.Reader, present uint32, delta bool) error {
-	glog.Infof("Scrblt Order")
+func (d *Scrblt) Unpack(r io.Reader, present uint32, delta bool) error {
 	if present&0x0001 != 0 {
 		readOrderCoord(r, &d.X, delta)
 	}
@@ -549,7 +617,6 @@ func (d1 *Scrblt) Unpack(r io.Reader, present uint32, delta bool) error {
 	if present&0x0040 != 0 {
 		readOrderCoord(r, &d.Srcy, delta)
 	}
-	*d1 = d
 	return nil
 }
 
@@ -568,7 +635,6 @@ func (d *LineTo) Type() int {
 	return ORDER_TYPE_LINETO
 }
 func (d *LineTo) Unpack(r io.Reader, present uint32, delta bool) error {
-	glog.Infof("LineTo Order")
 	if present&0x0001 != 0 {
 		d.Mixmode, _ = core.ReadUint16LE(r)
 	}
@@ -630,7 +696,6 @@ func (d *OpaqueRect) Type() int {
 	return ORDER_TYPE_OPAQUERECT
 }
 func (d *OpaqueRect) Unpack(r io.Reader, present uint32, delta bool) error {
-	glog.Infof("OpaqueRect Order")
 	if present&0x0001 != 0 {
 		readOrderCoord(r, &d.X, delta)
 	}
@@ -811,7 +876,8 @@ type PolygonSc struct {
 	Fillmode uint8
 	Fgcolour [4]uint8
 	Npoints  uint8
-	Points   []Point
+	// offsets of each vertex from the previous one
+	Points []Point
 }
 
 type Point struct {
@@ -841,32 +907,52 @@ func (d *PolygonSc) Unpack(r io.Reader, present uint32, delta bool) error {
 	}
 	if present&0x0020 != 0 {
 		d.Npoints, _ = core.ReadUInt8(r)
-		d.Points = make([]Point, 0, d.Npoints+1)
 	}
 	if present&0x0040 != 0 {
 		size, _ := core.ReadUInt8(r)
-		data, _ := core.ReadBytes(int(size), r)
-		d.Points = append(d.Points, Point{d.X, d.Y})
-		var flags uint8
-		r = bytes.NewReader(data)
-		for i := 1; i <= int(d.Npoints); i++ {
-			var p Point
-			if (i-1)%4 == 0 {
-				flags, _ = core.ReadUInt8(r)
-			}
-			if (^flags)&0x80 != 0 {
-				p.X = parseDelta(r)
-			}
-			if (^flags)&0x40 != 0 {
-				p.Y = parseDelta(r)
-			}
-			flags <<= 2
+		data, err := core.ReadBytes(int(size), r)
+		if err != nil {
+			return err
 		}
+		d.Points = readDeltaPoints(bytes.NewReader(data), int(d.Npoints))
 	}
 
 	return nil
 }
 
+// Vertices returns the absolute polygon vertices, starting at (X, Y)
+func (d *PolygonSc) Vertices() []Point {
+	pts := make([]Point, 0, len(d.Points)+1)
+	p := Point{d.X, d.Y}
+	pts = append(pts, p)
+	for _, v := range d.Points {
+		p.X += v.X
+		p.Y += v.Y
+		pts = append(pts, p)
+	}
+	return pts
+}
+
+/**
+ * DELTA_PTS_FIELD: the zero bits of all points come first,
+ * two bits per point, then the non zero deltas
+ * @see MS-RDPEGDI Delta-Encoded Points (DELTA_PTS_FIELD)
+ */
+func readDeltaPoints(r *bytes.Reader, n int) []Point {
+	zeroBits, _ := core.ReadBytes((n+3)/4, r)
+	pts := make([]Point, n)
+	for i := 0; i < n && i/4 < len(zeroBits); i++ {
+		flags := zeroBits[i/4] << uint(i%4*2)
+		if flags&0x80 == 0 {
+			pts[i].X = parseDelta(r)
+		}
+		if flags&0x40 == 0 {
+			pts[i].Y = parseDelta(r)
+		}
+	}
+	return pts
+}
+
 func parseDelta(r io.Reader) (v int32) {
 	b, _ := core.ReadUInt8(r)
 	if b&0x40 != 0 {
@@ -921,48 +1007,313 @@ func (d *EllipeCb) Unpack(r io.Reader, present uint32, delta bool) error {
 	return nil
 }
 
-type GlayphIndex struct {
+/**
+ * GlyphIndex draws a line of cached glyphs. Bgcolour is the text color
+ * and Fgcolour the color of the opaque rectangle.
+ * @see MS-RDPEGDI GlyphIndex (GLYPHINDEX_ORDER)
+ */
+type GlyphIndex struct {
+	CacheId      uint8
+	FlAccel      uint8
+	UlCharInc    uint8
+	FOpRedundant uint8
+	Bgcolour     [4]uint8
+	Fgcolour     [4]uint8
+	BkLeft       int32
+	BkTop        int32
+	BkRight      int32
+	BkBottom     int32
+	OpLeft       int32
+	OpTop        int32
+	OpRight      int32
+	OpBottom     int32
+	Brush        Brush
+	X            int32
+	Y            int32
+	// glyph indices, offsets and fragment operations
+	Data []byte
+}
+
+func (d *GlyphIndex) Type() int {
+	return ORDER_TYPE_TEXT2
+}
+func (d *GlyphIndex) Unpack(r io.Reader, present uint32, delta bool) error {
+	if present&0x000001 != 0 {
+		d.CacheId, _ = core.ReadUInt8(r)
+	}
+	if present&0x000002 != 0 {
+		d.FlAccel, _ = core.ReadUInt8(r)
+	}
+	if present&0x000004 != 0 {
+		d.UlCharInc, _ = core.ReadUInt8(r)
+	}
+	if present&0x000008 != 0 {
+		d.FOpRedundant, _ = core.ReadUInt8(r)
+	}
+	if present&0x000010 != 0 {
+		b, g, r, a := updateReadColorRef(r)
+		d.Bgcolour[0], d.Bgcolour[1], d.Bgcolour[2], d.Bgcolour[3] = b, g, r, a
+	}
+	if present&0x000020 != 0 {
+		b, g, r, a := updateReadColorRef(r)
+		d.Fgcolour[0], d.Fgcolour[1], d.Fgcolour[2], d.Fgcolour[3] = b, g, r, a
+	}
+	if present&0x000040 != 0 {
+		readOrderCoord(r, &d.BkLeft, delta)
+	}
+	if present&0x000080 != 0 {
+		readOrderCoord(r, &d.BkTop, delta)
+	}
+	if present&0x000100 != 0 {
+		readOrderCoord(r, &d.BkRight, delta)
+	}
+	if present&0x000200 != 0 {
+		readOrderCoord(r, &d.BkBottom, delta)
+	}
+	if present&0x000400 != 0 {
+		readOrderCoord(r, &d.OpLeft, delta)
+	}
+	if present&0x000800 != 0 {
+		readOrderCoord(r, &d.OpTop, delta)
+	}
+	if present&0x001000 != 0 {
+		readOrderCoord(r, &d.OpRight, delta)
+	}
+	if present&0x002000 != 0 {
+		readOrderCoord(r, &d.OpBottom, delta)
+	}
+	d.Brush.updateBrush(r, present>>14)
+	if present&0x080000 != 0 {
+		readOrderCoord(r, &d.X, delta)
+	}
+	if present&0x100000 != 0 {
+		readOrderCoord(r, &d.Y, delta)
+	}
+	if present&0x200000 != 0 {
+		size, _ := core.ReadUInt8(r)
+		data, err := core.ReadBytes(int(size), r)
+		if err != nil {
+			return err
+		}
+		d.Data = data
+	}
+	return nil
 }
 
-func (d *GlayphIndex) Type() int {
-	return ORDER_TYPE_TEXT2
+// fastText holds the fields shared by FastIndex and FastGlyph
+type fastText struct {
+	CacheId   uint8
+	FlAccel   uint8
+	UlCharInc uint8
+	Bgcolour  [4]uint8
+	Fgcolour  [4]uint8
+	BkLeft    int32
+	BkTop     int32
+	BkRight   int32
+	BkBottom  int32
+	OpLeft    int32
+	OpTop     int32
+	OpRight   int32
+	OpBottom  int32
+	X         int32
+	Y         int32
+}
+
+func (d *fastText) unpack(r io.Reader, present uint32, delta bool) {
+	if present&0x0001 != 0 {
+		d.CacheId, _ = core.ReadUInt8(r)
+	}
+	if present&0x0002 != 0 {
+		d.FlAccel, _ = core.ReadUInt8(r)
+		d.UlCharInc, _ = core.ReadUInt8(r)
+	}
+	if present&0x0004 != 0 {
+		b, g, r, a := updateReadColorRef(r)
+		d.Bgcolour[0], d.Bgcolour[1], d.Bgcolour[2], d.Bgcolour[3] = b, g, r, a
+	}
+	if present&0x0008 != 0 {
+		b, g, r, a := updateReadColorRef(r)
+		d.Fgcolour[0], d.Fgcolour[1], d.Fgcolour[2], d.Fgcolour[3] = b, g, r, a
+	}
+	if present&0x0010 != 0 {
+		readOrderCoord(r, &d.BkLeft, delta)
+	}
+	if present&0x0020 != 0 {
+		readOrderCoord(r, &d.BkTop, delta)
+	}
+	if present&0x0040 != 0 {
+		readOrderCoord(r, &d.BkRight, delta)
+	}
+	if present&0x0080 != 0 {
+		readOrderCoord(r, &d.BkBottom, delta)
+	}
+	if present&0x0100 != 0 {
+		readOrderCoord(r, &d.OpLeft, delta)
+	}
+	if present&0x0200 != 0 {
+		readOrderCoord(r, &d.OpTop, delta)
+	}
+	if present&0x0400 != 0 {
+		readOrderCoord(r, &d.OpRight, delta)
+	}
+	if present&0x0800 != 0 {
+		readOrderCoord(r, &d.OpBottom, delta)
+	}
+	if present&0x1000 != 0 {
+		readOrderCoord(r, &d.X, delta)
+	}
+	if present&0x2000 != 0 {
+		readOrderCoord(r, &d.Y, delta)
+	}
 }
-func (d *GlayphIndex) Unpack(r io.Reader, present uint32, delta bool) error {
+
+/**
+ * Opaque returns the opaque rectangle, bottom and right exclusive.
+ * An OpBottom of -32768 marks OpTop as flags telling which sides are
+ * those of the background rectangle, as does a zero OpLeft or OpRight.
+ * @see MS-RDPEGDI FastIndex (FASTINDEX_ORDER)
+ */
+func (d *fastText) Opaque() (left, top, right, bottom int32) {
+	left, top, right, bottom = d.OpLeft, d.OpTop, d.OpRight, d.OpBottom
+	if bottom == -32768 {
+		flags := d.OpTop & 0x0f
+		if flags&0x01 != 0 {
+			bottom = d.BkBottom
+		}
+		if flags&0x02 != 0 {
+			right = d.BkRight
+		}
+		if flags&0x04 != 0 {
+			top = d.BkTop
+		}
+		if flags&0x08 != 0 {
+			left = d.BkLeft
+		}
+	}
+	if left == 0 {
+		left = d.BkLeft
+	}
+	if right == 0 {
+		right = d.BkRight
+	}
+	return
+}
+
+// Origin returns the position of the text, -32768 stands for
+// the corner of the background rectangle
+func (d *fastText) Origin() (x, y int32) {
+	x, y = d.X, d.Y
+	if x == -32768 {
+		x = d.BkLeft
+	}
+	if y == -32768 {
+		y = d.BkTop
+	}
+	return
+}
+
+// FastIndex is a GlyphIndex with a solid brush, Bgcolour is the text color
+type FastIndex struct {
+	fastText
+	Data []byte
+}
+
+func (d *FastIndex) Type() int {
+	return ORDER_TYPE_FAST_INDEX
+}
+func (d *FastIndex) Unpack(r io.Reader, present uint32, delta bool) error {
+	d.unpack(r, present, delta)
+	if present&0x4000 != 0 {
+		size, _ := core.ReadUInt8(r)
+		data, err := core.ReadBytes(int(size), r)
+		if err != nil {
+			return err
+		}
+		d.Data = data
+	}
+	return nil
+}
+
+/**
+ * FastGlyph draws a single glyph, sent along when
+ * it is not already in the glyph cache
+ * @see MS-RDPEGDI FastGlyph (FASTGLYPH_ORDER)
+ */
+type FastGlyph struct {
+	fastText
+	CacheIndex uint8
+	// nil when the glyph is cached
+	Glyph *CacheGlyph
+}
+
+func (d *FastGlyph) Type() int {
+	return ORDER_TYPE_FAST_GLYPH
+}
+func (d *FastGlyph) Unpack(r io.Reader, present uint32, delta bool) error {
+	d.unpack(r, present, delta)
+	if present&0x4000 == 0 {
+		return nil
+	}
+	size, _ := core.ReadUInt8(r)
+	data, err := core.ReadBytes(int(size), r)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("empty fast glyph data")
+	}
+	d.CacheIndex = data[0]
+	d.Glyph = nil
+	if len(data) == 1 {
+		return nil
+	}
+	r0 := bytes.NewReader(data[1:])
+	g := &CacheGlyph{CacheIndex: uint16(d.CacheIndex)}
+	g.X = readTwoByteSigned(r0)
+	g.Y = readTwoByteSigned(r0)
+	g.Width = readTwoByteUnsigned(r0)
+	g.Height = readTwoByteUnsigned(r0)
+	// unlike the cache glyph orders the bitmap is not padded
+	g.Data, err = core.ReadBytes(int((g.Width+7)/8*g.Height), r0)
+	if err != nil {
+		return err
+	}
+	if r0.Len() >= 2 {
+		g.Unicode, _ = core.ReadUint16LE(r0)
+	}
+	d.Glyph = g
 	return nil
 }
 
 /*Secondary*/
+
+// CacheBitmapOrder is a Cache Bitmap (Revision 1) order
+type CacheBitmapOrder struct {
+	CacheId          uint8
+	BitmapBpp        uint8
+	BitmapWidth      uint8
+	BitmapHeight     uint8
+	CacheIndex       uint16
+	Compressed       bool
+	BitmapDataStream []byte
+}
+
 func (s *Secondary) updateCacheBitmapOrder(r io.Reader, compressed bool, flags uint16) {
 	var cb CacheBitmapOrder
-	cb.cacheId, _ = core.ReadUInt8(r)
+	cb.CacheId, _ = core.ReadUInt8(r)
 	core.ReadUInt8(r)
-	cb.bitmapWidth, _ = core.ReadUInt8(r)
-	cb.bitmapHeight, _ = core.ReadUInt8(r)
-	cb.bitmapBpp, _ = core.ReadUInt8(r)
+	cb.BitmapWidth, _ = core.ReadUInt8(r)
+	cb.BitmapHeight, _ = core.ReadUInt8(r)
+	cb.BitmapBpp, _ = core.ReadUInt8(r)
 	bitmapLength, _ := core.ReadUint16LE(r)
-	cb.cacheIndex, _ = core.ReadUint16LE(r)
-	var bitmapComprHdr []byte
-	if compressed {
-		if (flags & NO_BITMAP_COMPRESSION_HDR) == 0 {
-			bitmapComprHdr, _ = core.ReadBytes(8, r)
-			bitmapLength -= 8
-		}
+	cb.CacheIndex, _ = core.ReadUint16LE(r)
+	if compressed && flags&NO_BITMAP_COMPRESSION_HDR == 0 {
+		core.ReadBytes(8, r)
+		bitmapLength -= 8
 	}
-	cb.bitmapComprHdr = bitmapComprHdr
-	cb.bitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
-	cb.bitmapLength = bitmapLength
-
-}
-
-type CacheBitmapOrder struct {
-	cacheId          uint8
-	bitmapBpp        uint8
-	bitmapWidth      uint8
-	bitmapHeight     uint8
-	bitmapLength     uint16
-	cacheIndex       uint16
-	bitmapComprHdr   []byte
-	bitmapDataStream []byte
+	cb.Compressed = compressed
+	cb.BitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
+	s.Data = &cb
 }
 
 func getCbV2Bpp(bpp uint32) (b uint32) {
@@ -981,217 +1332,360 @@ func getCbV2Bpp(bpp uint32) (b uint32) {
 	return
 }
 
+// TWO_BYTE_UNSIGNED_ENCODING
+func readTwoByteUnsigned(r io.Reader) uint16 {
+	b, _ := core.ReadUInt8(r)
+	v := uint16(b & 0x7f)
+	if b&0x80 != 0 {
+		b, _ = core.ReadUInt8(r)
+		v = v<<8 | uint16(b)
+	}
+	return v
+}
+
+// TWO_BYTE_SIGNED_ENCODING
+func readTwoByteSigned(r io.Reader) int16 {
+	b, _ := core.ReadUInt8(r)
+	v := int16(b & 0x3f)
+	if b&0x80 != 0 {
+		c, _ := core.ReadUInt8(r)
+		v = v<<8 | int16(c)
+	}
+	if b&0x40 != 0 {
+		v = -v
+	}
+	return v
+}
+
+// FOUR_BYTE_UNSIGNED_ENCODING
+func readFourByteUnsigned(r io.Reader) uint32 {
+	b, _ := core.ReadUInt8(r)
+	v := uint32(b & 0x3f)
+	for i := 0; i < int(b>>6); i++ {
+		c, _ := core.ReadUInt8(r)
+		v = v<<8 | uint32(c)
+	}
+	return v
+}
+
+// CacheBitmapV2Order is a Cache Bitmap (Revision 2) order
 type CacheBitmapV2Order struct {
-	cacheId            uint32
-	flags              uint32
-	key1               uint32
-	key2               uint32
-	bitmapBpp          uint32
-	bitmapWidth        uint8
-	bitmapHeight       uint8
-	bitmapLength       uint16
-	cacheIndex         uint32
-	compressed         bool
-	cbCompFirstRowSize uint16
-	cbCompMainBodySize uint16
-	cbScanWidth        uint16
-	cbUncompressedSize uint16
-	bitmapDataStream   []byte
+	CacheId      uint32
+	Flags        uint32
+	Key1         uint32
+	Key2         uint32
+	BitmapBpp    uint32
+	BitmapWidth  uint16
+	BitmapHeight uint16
+	// BITMAPCACHE_WAITING_LIST_INDEX when CBR2_DO_NOT_CACHE is set
+	CacheIndex       uint16
+	Compressed       bool
+	BitmapDataStream []byte
 }
 
 func (s *Secondary) updateCacheBitmapV2Order(r io.Reader, compressed bool, flags uint16) {
 	var cb CacheBitmapV2Order
-	cb.cacheId = uint32(flags) & 0x0003
-	cb.flags = (uint32(flags) & 0xFF80) >> 7
+	cb.CacheId = uint32(flags) & 0x0003
+	cb.Flags = (uint32(flags) & 0xFF80) >> 7
 	bitsPerPixelId := (uint32(flags) & 0x0078) >> 3
-	cb.bitmapBpp = getCbV2Bpp(bitsPerPixelId)
+	cb.BitmapBpp = getCbV2Bpp(bitsPerPixelId)
 
-	if cb.flags&CBR2_PERSISTENT_KEY_PRESENT != 0 {
-		cb.key1, _ = core.ReadUInt32LE(r)
-		cb.key2, _ = core.ReadUInt32LE(r)
+	if cb.Flags&CBR2_PERSISTENT_KEY_PRESENT != 0 {
+		cb.Key1, _ = core.ReadUInt32LE(r)
+		cb.Key2, _ = core.ReadUInt32LE(r)
 	}
 
-	if cb.flags&CBR2_HEIGHT_SAME_AS_WIDTH != 0 {
-		cb.bitmapWidth, _ = core.ReadUInt8(r)
-		cb.bitmapHeight = cb.bitmapWidth
-	} else {
-		cb.bitmapWidth, _ = core.ReadUInt8(r)
-		cb.bitmapHeight, _ = core.ReadUInt8(r)
+	cb.BitmapWidth = readTwoByteUnsigned(r)
+	cb.BitmapHeight = cb.BitmapWidth
+	if cb.Flags&CBR2_HEIGHT_SAME_AS_WIDTH == 0 {
+		cb.BitmapHeight = readTwoByteUnsigned(r)
 	}
 
-	bitmapLength, _ := core.ReadUint16LE(r)
-	cacheIndex, _ := core.ReadUInt8(r)
-
-	if cb.flags&CBR2_DO_NOT_CACHE != 0 {
-		cb.cacheIndex = 0x7FFF
-	} else {
-		cb.cacheIndex = uint32(cacheIndex)
+	bitmapLength := readFourByteUnsigned(r)
+	cb.CacheIndex = readTwoByteUnsigned(r)
+	if cb.Flags&CBR2_DO_NOT_CACHE != 0 {
+		cb.CacheIndex = BITMAPCACHE_WAITING_LIST_INDEX
 	}
 
-	if compressed {
-		if cb.flags&CBR2_NO_BITMAP_COMPRESSION_HDR == 0 {
-			cb.cbCompFirstRowSize, _ = core.ReadUint16LE(r)
-			cb.cbCompMainBodySize, _ = core.ReadUint16LE(r)
-			cb.cbScanWidth, _ = core.ReadUint16LE(r)
-			cb.cbUncompressedSize, _ = core.ReadUint16LE(r)
-			bitmapLength = cb.cbCompMainBodySize
-		}
+	if compressed && cb.Flags&CBR2_NO_BITMAP_COMPRESSION_HDR == 0 {
+		// cbCompFirstRowSize, cbCompMainBodySize, cbScanWidth, cbUncompressedSize
+		core.ReadUint16LE(r)
+		mainBodySize, _ := core.ReadUint16LE(r)
+		core.ReadUint16LE(r)
+		core.ReadUint16LE(r)
+		bitmapLength = uint32(mainBodySize)
 	}
 
-	cb.bitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
-	cb.bitmapLength = bitmapLength
-	cb.compressed = compressed
-
+	cb.Compressed = compressed
+	cb.BitmapDataStream, _ = core.ReadBytes(int(bitmapLength), r)
+	s.Data = &cb
 }
 
+// CacheBitmapV3Order is a Cache Bitmap (Revision 3) order
 type CacheBitmapV3Order struct {
-	cacheId    uint32
-	bpp        uint32
-	flags      uint32
-	cacheIndex uint16
-	key1       uint32
-	key2       uint32
-	bitmapData BitmapDataEx
+	CacheId    uint32
+	Bpp        uint32
+	Flags      uint32
+	CacheIndex uint16
+	Key1       uint32
+	Key2       uint32
+	BitmapData BitmapDataEx
 }
+
+// BitmapDataEx is a TS_BITMAP_DATA_EX
 type BitmapDataEx struct {
-	bpp     uint8
-	codecID uint8
-	width   uint16
-	height  uint16
-	length  uint32
-	data    []byte
+	Bpp     uint8
+	Flags   uint8
+	CodecID uint8
+	Width   uint16
+	Height  uint16
+	Data    []byte
+}
+
+// the optional TS_COMPRESSED_BITMAP_HEADER_EX is present
+const EX_COMPRESSED_BITMAP_HEADER_PRESENT = 0x01
+
+func (b *BitmapDataEx) Unpack(r io.Reader) error {
+	b.Bpp, _ = core.ReadUInt8(r)
+	b.Flags, _ = core.ReadUInt8(r)
+	core.ReadUInt8(r)
+	b.CodecID, _ = core.ReadUInt8(r)
+	b.Width, _ = core.ReadUint16LE(r)
+	b.Height, _ = core.ReadUint16LE(r)
+	length, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return err
+	}
+	if b.Flags&EX_COMPRESSED_BITMAP_HEADER_PRESENT != 0 {
+		// highUniqueId, lowUniqueId, tmMilliseconds, tmSeconds
+		if _, err := core.ReadBytes(24, r); err != nil {
+			return err
+		}
+	}
+	b.Data, err = core.ReadBytes(int(length), r)
+	return err
 }
 
 func (s *Secondary) updateCacheBitmapV3Order(r io.Reader, flags uint16) {
 	var cb CacheBitmapV3Order
 
-	cb.cacheId = uint32(flags) & 0x00000003
-	cb.flags = (uint32(flags) & 0x0000FF80) >> 7
+	cb.CacheId = uint32(flags) & 0x00000003
+	cb.Flags = (uint32(flags) & 0x0000FF80) >> 7
 	bitsPerPixelId := (uint32(flags) & 0x00000078) >> 3
-	cb.bpp = getCbV2Bpp(bitsPerPixelId)
+	cb.Bpp = getCbV2Bpp(bitsPerPixelId)
 
-	cacheIndex, _ := core.ReadUint16LE(r)
-	cb.cacheIndex = cacheIndex
-	cb.key1, _ = core.ReadUInt32LE(r)
-	cb.key2, _ = core.ReadUInt32LE(r)
-
-	bitmapData := &cb.bitmapData
-	bitmapData.bpp, _ = core.ReadUInt8(r)
-	core.ReadUInt8(r)
-	core.ReadUInt8(r)
-	bitmapData.codecID, _ = core.ReadUInt8(r)
-	bitmapData.width, _ = core.ReadUint16LE(r)
-	bitmapData.height, _ = core.ReadUint16LE(r)
-	new_len, _ := core.ReadUInt32LE(r)
-
-	bitmapData.data, _ = core.ReadBytes(int(new_len), r)
-	bitmapData.length = new_len
+	cb.CacheIndex, _ = core.ReadUint16LE(r)
+	cb.Key1, _ = core.ReadUInt32LE(r)
+	cb.Key2, _ = core.ReadUInt32LE(r)
 
+	cb.BitmapData.Unpack(r)
+	s.Data = &cb
 }
 
+// CacheColorTableOrder is a palette of 8 bpp sessions, referenced by
+// the colorIndex of MemBlt and Mem3Blt orders
 type CacheColorTableOrder struct {
-	cacheIndex   uint8
-	numberColors uint16
-	colorTable   [256 * 4]uint8
+	CacheIndex   uint8
+	NumberColors uint16
+	// TS_COLOR_QUAD entries
+	ColorTable [256 * 4]uint8
 }
 
 func (s *Secondary) updateCacheColorTableOrder(r io.Reader, flags uint16) {
 	var cb CacheColorTableOrder
-	cb.cacheIndex, _ = core.ReadUInt8(r)
-	cb.numberColors, _ = core.ReadUint16LE(r)
+	cb.CacheIndex, _ = core.ReadUInt8(r)
+	cb.NumberColors, _ = core.ReadUint16LE(r)
 
-	if cb.numberColors != 256 {
+	if cb.NumberColors != 256 {
 		/* This field MUST be set to 256 */
 		return
 	}
 
-	for i := 0; i < int(cb.numberColors)*4; i++ {
-		cb.colorTable[i], cb.colorTable[i+1], cb.colorTable[i+2], cb.colorTable[i+3] = updateReadColorRef(r)
+	for i := 0; i < int(cb.NumberColors)*4; i += 4 {
+		cb.ColorTable[i], cb.ColorTable[i+1], cb.ColorTable[i+2], cb.ColorTable[i+3] = updateReadColorQuad(r)
 	}
+	s.Data = &cb
 }
+
+// updateReadColorRef reads a TS_COLOR, the bytes as sent
 func updateReadColorRef(r io.Reader) (uint8, uint8, uint8, uint8) {
 	blue, _ := core.ReadUInt8(r)
 	green, _ := core.ReadUInt8(r)
 	red, _ := core.ReadUInt8(r)
-	core.ReadUInt8(r)
 
 	return blue, green, red, 255
 }
 
-type CacheGlyphOrder struct {
-	cacheId uint8
-	nglyphs uint8
-	glyphs  []CacheGlyph
+// updateReadColorQuad reads a TS_COLOR_QUAD
+func updateReadColorQuad(r io.Reader) (uint8, uint8, uint8, uint8) {
+	blue, green, red, a := updateReadColorRef(r)
+	core.ReadUInt8(r)
+
+	return blue, green, red, a
 }
-type CacheGlyph struct {
-	character uint16
-	offset    uint16
-	baseline  uint16
-	width     uint16
-	height    uint16
-	datasize  int
-	data      []uint8
+
+// CacheGlyphOrder is a Cache Glyph order of revision 1 or 2
+type CacheGlyphOrder struct {
+	CacheId uint8
+	Glyphs  []CacheGlyph
 }
 
-func (s *Secondary) updateCacheGlyphOrder(r io.Reader, flags uint16) {
+// CacheGlyph is a 1 bpp glyph, rows are padded to a byte
+// and the leftmost pixel is the high bit
+type CacheGlyph struct {
+	CacheIndex uint16
+	// origin of the glyph bitmap relative to the text position
+	X       int16
+	Y       int16
+	Width   uint16
+	Height  uint16
+	Data    []uint8
+	Unicode uint16
+}
+
+/**
+ * The revision 2 order packs cacheId, its flags and the number of glyphs
+ * in extraFlags, servers send it to GLYPH_SUPPORT_ENCODE clients only.
+ * @see MS-RDPEGDI Cache Glyph - Revision 1 (CACHE_GLYPH_ORDER)
+ * @see MS-RDPEGDI Cache Glyph - Revision 2 (CACHE_GLYPH_REV2_ORDER)
+ */
+func (s *Secondary) updateCacheGlyphOrder(r io.Reader, flags uint16, rev2 bool) {
 	var cb CacheGlyphOrder
+	var nglyphs int
+	if rev2 {
+		cb.CacheId = uint8(flags & 0x0f)
+		nglyphs = int(flags >> 8)
+	} else {
+		cb.CacheId, _ = core.ReadUInt8(r)
+		n, _ := core.ReadUInt8(r)
+		nglyphs = int(n)
+	}
+	cb.Glyphs = make([]CacheGlyph, 0, nglyphs)
 
-	cb.cacheId, _ = core.ReadUInt8(r)
-	cb.nglyphs, _ = core.ReadUInt8(r)
-	cb.glyphs = make([]CacheGlyph, 0, cb.nglyphs)
-
-	for i := 0; i < int(cb.nglyphs); i++ {
+	for i := 0; i < nglyphs; i++ {
 		var c CacheGlyph
-		c.character, _ = core.ReadUint16LE(r)
-		c.offset, _ = core.ReadUint16LE(r)
-		c.baseline, _ = core.ReadUint16LE(r)
-		c.width, _ = core.ReadUint16LE(r)
-		c.height, _ = core.ReadUint16LE(r)
+		if rev2 {
+			index, _ := core.ReadUInt8(r)
+			c.CacheIndex = uint16(index)
+			c.X = readTwoByteSigned(r)
+			c.Y = readTwoByteSigned(r)
+			c.Width = readTwoByteUnsigned(r)
+			c.Height = readTwoByteUnsigned(r)
+		} else {
+			var x, y uint16
+			c.CacheIndex, _ = core.ReadUint16LE(r)
+			x, _ = core.ReadUint16LE(r)
+			y, _ = core.ReadUint16LE(r)
+			c.X, c.Y = int16(x), int16(y)
+			c.Width, _ = core.ReadUint16LE(r)
+			c.Height, _ = core.ReadUint16LE(r)
+		}
 
-		c.datasize = int(c.height*((c.width+7)/8)+3) & ^3
-		c.data, _ = core.ReadBytes(c.datasize, r)
+		size := (int((c.Width+7)/8)*int(c.Height) + 3) & ^3
+		data, err := core.ReadBytes(size, r)
+		if err != nil {
+			glog.Debug("cache glyph order too short")
+			break
+		}
+		c.Data = data
+		cb.Glyphs = append(cb.Glyphs, c)
+	}
 
-		cb.glyphs = append(cb.glyphs, c)
+	unicode := flags&CG_GLYPH_UNICODE_PRESENT != 0
+	if rev2 {
+		unicode = flags&CG_GLYPH_UNICODE_PRESENT_REV2 != 0
 	}
+	if unicode {
+		for i := range cb.Glyphs {
+			cb.Glyphs[i].Unicode, _ = core.ReadUint16LE(r)
+		}
+	}
+	s.Data = &cb
 }
 
+// brush bitmap formats
+const (
+	BMF_1BPP  = 0x1
+	BMF_8BPP  = 0x3
+	BMF_16BPP = 0x4
+	BMF_24BPP = 0x5
+	BMF_32BPP = 0x6
+)
+
+// BmfBpp returns the bits per pixel of a BMF_* format, 0 if unknown
+func BmfBpp(bmf uint8) int {
+	switch bmf {
+	case BMF_1BPP:
+		return 1
+	case BMF_8BPP:
+		return 8
+	case BMF_16BPP:
+		return 16
+	case BMF_24BPP:
+		return 24
+	case BMF_32BPP:
+		return 32
+	}
+	return 0
+}
+
+/**
+ * CacheBrushOrder is an 8x8 brush referenced by the cached brush style
+ * of the orders. Data rows are top-down: one byte per row at 1 bpp,
+ * pixels of Bpp bytes otherwise.
+ * @see MS-RDPEGDI Cache Brush (CACHE_BRUSH_ORDER)
+ */
 type CacheBrushOrder struct {
-	index  uint8
-	bpp    uint8
-	cx     uint8
-	cy     uint8
-	style  uint8
-	length uint8
-	data   []uint8
+	CacheIndex uint8
+	Bpp        int
+	Width      uint8
+	Height     uint8
+	Data       []uint8
 }
 
 func (s *Secondary) updateCacheBrushOrder(r io.Reader, flags uint16) {
 	var cb CacheBrushOrder
-	cb.index, _ = core.ReadUInt8(r)
-	cb.bpp, _ = core.ReadUInt8(r)
-	cb.cx, _ = core.ReadUInt8(r)
-	cb.cy, _ = core.ReadUInt8(r)
-	cb.style, _ = core.ReadUInt8(r)
-	cb.length, _ = core.ReadUInt8(r)
-	if cb.cx == 8 && cb.cy == 8 {
-		if cb.bpp == 1 {
-			for i := 7; i >= 0; i-- {
-				cb.data[i], _ = core.ReadUInt8(r)
+	cb.CacheIndex, _ = core.ReadUInt8(r)
+	bmf, _ := core.ReadUInt8(r)
+	cb.Bpp = BmfBpp(bmf)
+	cb.Width, _ = core.ReadUInt8(r)
+	cb.Height, _ = core.ReadUInt8(r)
+	core.ReadUInt8(r)
+	length, _ := core.ReadUInt8(r)
+	if cb.Width != 8 || cb.Height != 8 || cb.Bpp == 0 {
+		glog.Debugf("unsupported brush %dx%d format %d", cb.Width, cb.Height, bmf)
+		return
+	}
+	data, err := core.ReadBytes(int(length), r)
+	if err != nil {
+		return
+	}
+	if cb.Bpp == 1 {
+		if len(data) != 8 {
+			return
+		}
+		cb.Data = make([]uint8, 8)
+		for i := range cb.Data {
+			cb.Data[7-i] = data[i]
+		}
+	} else {
+		bpp := cb.Bpp / 8
+		if len(data) == 16+4*bpp {
+			/* compressed brush */
+			cb.Data = update_decompress_brush(data, bpp)
+		} else if len(data) == 8*8*bpp {
+			/* uncompressed brush, rows are bottom-up */
+			cb.Data = make([]uint8, 0, len(data))
+			for y := 7; y >= 0; y-- {
+				cb.Data = append(cb.Data, data[y*8*bpp:(y+1)*8*bpp]...)
 			}
 		} else {
-			bpp := int(cb.bpp) - 2
-			if int(cb.length) == 16+4*bpp {
-				/* compressed brush */
-				data, _ := core.ReadBytes(int(cb.length), r)
-				cb.data = update_decompress_brush(data, bpp)
-			} else {
-				/* uncompressed brush */
-				scanline := 8 * 8 * bpp
-				cb.data, _ = core.ReadBytes(scanline, r)
-			}
+			return
 		}
 	}
+	s.Data = &cb
 }
+
 func update_decompress_brush(in []uint8, bpp int) []uint8 {
 	var pal_index, in_index, shift int
 
@@ -1220,12 +1714,60 @@ func update_decompress_brush(in []uint8, bpp int) []uint8 {
 	return out
 }
 
+/*Altsec*/
+
+// SCREEN_BITMAP_SURFACE is the bitmapId of the primary drawing surface
+const SCREEN_BITMAP_SURFACE = 0xFFFF
+
+// SwitchSurfaceOrder makes an offscreen bitmap or the screen the target of the drawing orders
+type SwitchSurfaceOrder struct {
+	BitmapId uint16
+}
+
+func (a *Altsec) updateSwitchSurfaceOrder(r io.Reader) {
+	var o SwitchSurfaceOrder
+	o.BitmapId, _ = core.ReadUint16LE(r)
+	a.Data = &o
+}
+
+/**
+ * CreateOffscreenBitmapOrder creates the offscreen bitmap Id, after
+ * deleting those of DeleteList
+ * @see MS-RDPEGDI Create Offscreen Bitmap (CREATE_OFFSCREEN_BITMAP_ORDER)
+ */
+type CreateOffscreenBitmapOrder struct {
+	Id         uint16
+	Cx         uint16
+	Cy         uint16
+	DeleteList []uint16
+}
+
+func (a *Altsec) updateCreateOffscreenBitmapOrder(r io.Reader) {
+	var o CreateOffscreenBitmapOrder
+	flags, _ := core.ReadUint16LE(r)
+	o.Id = flags & 0x7FFF
+	o.Cx, _ = core.ReadUint16LE(r)
+	o.Cy, _ = core.ReadUint16LE(r)
+	if flags&0x8000 != 0 {
+		n, _ := core.ReadUint16LE(r)
+		o.DeleteList = make([]uint16, 0, n)
+		for i := 0; i < int(n); i++ {
+			id, err := core.ReadUint16LE(r)
+			if err != nil {
+				break
+			}
+			o.DeleteList = append(o.DeleteList, id)
+		}
+	}
+	a.Data = &o
+}
+
 /*Primary*/
 type Bounds struct {
-	left   int32
-	top    int32
-	right  int32
-	bottom int32
+	Left   int32
+	Top    int32
+	Right  int32
+	Bottom int32
 }
 type OrderInfo struct {
 	controlFlags     uint32
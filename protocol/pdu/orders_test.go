@@ -0,0 +1,119 @@
+package pdu
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+)
+
+// opaqueRect returns an orders update of an OpaqueRect at x,
+// only y when x is negative
+func opaqueRect(x, y int) []byte {
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(1, b)
+	if x < 0 {
+		b.Write([]byte{TS_STANDARD, 0x02})
+	} else {
+		b.Write([]byte{TS_STANDARD | TS_TYPE_CHANGE, ORDER_TYPE_OPAQUERECT, 0x03})
+		core.WriteUInt16LE(uint16(x), b)
+	}
+	core.WriteUInt16LE(uint16(y), b)
+	return b.Bytes()
+}
+
+func readOpaqueRect(t *testing.T, data []byte, s *OrderState) *OpaqueRect {
+	p, err := readFastPathUpdatePDU(bytes.NewReader(data), FASTPATH_UPDATETYPE_ORDERS, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := p.Data.(*FastPathOrdersPDU).OrderPdus[0]
+	r, ok := o.Primary.Data.(*OpaqueRect)
+	if !ok {
+		t.Fatalf("%T", o.Primary.Data)
+	}
+	return r
+}
+
+func TestOrderStatePerSession(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	a, b := NewOrderState(), NewOrderState()
+	readOpaqueRect(t, opaqueRect(5, 1), a)
+	readOpaqueRect(t, opaqueRect(50, 2), b)
+
+	// the orders that only carry y keep the x of their own session
+	if r := readOpaqueRect(t, opaqueRect(-1, 3), a); r.X != 5 || r.Y != 3 {
+		t.Errorf("session a %+v", r)
+	}
+	if r := readOpaqueRect(t, opaqueRect(-1, 4), b); r.X != 50 || r.Y != 4 {
+		t.Errorf("session b %+v", r)
+	}
+
+	// a Demand Active on a leaves b as it is
+	a.Reset()
+	if r := readOpaqueRect(t, opaqueRect(-1, 5), b); r.X != 50 {
+		t.Errorf("session b after reset of a %+v", r)
+	}
+
+	// concurrent sessions, go test -race
+	done := make(chan bool)
+	for _, s := range []*OrderState{a, b} {
+		go func(s *OrderState) {
+			for i := 0; i < 100; i++ {
+				if _, err := readFastPathUpdatePDU(bytes.NewReader(opaqueRect(i, i)), FASTPATH_UPDATETYPE_ORDERS, s); err != nil {
+					t.Error(err)
+				}
+			}
+			done <- true
+		}(s)
+	}
+	<-done
+	<-done
+}
+
+// cacheGlyph returns an orders update of a cache glyph order
+func cacheGlyph(flags uint16, body []byte) []byte {
+	b := &bytes.Buffer{}
+	core.WriteUInt16LE(1, b)
+	b.WriteByte(TS_STANDARD | TS_SECONDARY)
+	core.WriteUInt16LE(uint16(len(body)-7), b)
+	core.WriteUInt16LE(flags, b)
+	b.WriteByte(ORDER_TYPE_CACHE_GLYPH)
+	b.Write(body)
+	return b.Bytes()
+}
+
+func TestCacheGlyphRevision(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	glyph := []byte{0xc0, 0x40, 0, 0, 'A', 0}
+	for _, c := range []struct {
+		name  string
+		level GlyphSupport
+		flags uint16
+		body  []byte
+	}{
+		// cacheId, cGlyphs, then cacheIndex, x, y, cx and cy of 2 bytes
+		{"revision 1", GLYPH_SUPPORT_FULL, CG_GLYPH_UNICODE_PRESENT,
+			append([]byte{3, 1, 7, 0, 0, 0, 0xfe, 0xff, 2, 0, 2, 0}, glyph...)},
+		// cacheId, flags and cGlyphs in extraFlags, then packed fields
+		{"revision 2", GLYPH_SUPPORT_ENCODE, 3 | CG_GLYPH_UNICODE_PRESENT_REV2 | 1<<8,
+			append([]byte{7, 0, 0x42, 2, 2}, glyph...)},
+	} {
+		s := NewOrderState()
+		s.SetGlyphSupport(c.level)
+		p, err := readFastPathUpdatePDU(bytes.NewReader(cacheGlyph(c.flags, c.body)), FASTPATH_UPDATETYPE_ORDERS, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cb, ok := p.Data.(*FastPathOrdersPDU).OrderPdus[0].Secondary.Data.(*CacheGlyphOrder)
+		if !ok || cb.CacheId != 3 || len(cb.Glyphs) != 1 {
+			t.Fatalf("%s: %+v", c.name, cb)
+		}
+		g := cb.Glyphs[0]
+		if g.CacheIndex != 7 || g.Y != -2 || g.Width != 2 || g.Height != 2 ||
+			!bytes.Equal(g.Data, glyph[:4]) || g.Unicode != 'A' {
+			t.Errorf("%s: %+v", c.name, g)
+		}
+	}
+}
@@ -2,11 +2,13 @@ package pdu
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 
 	"github.com/tomatome/grdp/core"
 	"github.com/tomatome/grdp/emission"
 	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/sec"
 	"github.com/tomatome/grdp/protocol/t125/gcc"
 )
 
@@ -80,10 +82,24 @@ func NewPDULayer(t core.Transport) *PDULayer {
 			CAPSTYPE_INPUT:           &InputCapability{},
 			CAPSTYPE_FONT:            &FontCapability{0x0001, 0},
 			CAPSTYPE_BRUSH:           &BrushCapability{BRUSH_COLOR_8x8},
-			CAPSTYPE_GLYPHCACHE:      &GlyphCapability{},
 			CAPSETTYPE_BITMAP_CODECS: &BitmapCodecsCapability{},
+			CAPSTYPE_GLYPHCACHE: &GlyphCapability{
+				GlyphCache: [10]cacheEntry{
+					{254, 4}, {254, 4}, {254, 8}, {254, 8}, {254, 16},
+					{254, 32}, {254, 64}, {254, 128}, {254, 256}, {64, 2048},
+				},
+				// 256 fragments of at most 256 bytes
+				FragCache:    0x01000100,
+				SupportLevel: GLYPH_SUPPORT_FULL,
+			},
+			CAPSTYPE_OFFSCREENCACHE: &OffscreenBitmapCacheCapability{
+				SupportLevel: OSL_TRUE,
+				// the largest values allowed, in KB and entries
+				CacheSize:    7680,
+				CacheEntries: 500,
+			},
 			CAPSTYPE_BITMAPCACHE_REV2: &BitmapCache2Capability{
-				BitmapCachePersist: 2,
+				BitmapCachePersist: ALLOW_CACHE_WAITING_LIST_FLAG,
 				CachesNum:          5,
 				BmpC0Cells:         0x258,
 				BmpC1Cells:         0x258,
@@ -137,17 +153,93 @@ type Client struct {
 	*PDULayer
 	clientCoreData *gcc.ClientCoreData
 	buff           *bytes.Buffer
+	// keys of the bitmaps preloaded in each cache
+	persistentKeys [][]uint64
+	// history of the compressed slow-path and fast-path updates
+	bulk *core.BulkDecompressor
+	// history of the primary orders
+	orders *OrderState
 }
 
 func NewClient(t core.Transport) *Client {
 	c := &Client{
 		PDULayer: NewPDULayer(t),
 		buff:     &bytes.Buffer{},
+		bulk:     core.NewBulkDecompressor(),
+		orders:   NewOrderState(),
 	}
 	c.transport.Once("connect", c.connect)
+	c.transport.On("redirect", c.redirect)
 	return c
 }
 
+// redirect forwards a Server Redirection PDU, the connection
+// has to be closed and opened again to the new target
+func (c *Client) redirect(rd *sec.ServerRedirection) {
+	c.Emit("redirect", rd)
+}
+
+// Desktop returns the size and color depth of the session,
+// as accepted by the server in its Demand Active PDU
+func (c *Client) Desktop() (width, height, bpp int) {
+	b := c.serverCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability)
+	return int(b.DesktopWidth), int(b.DesktopHeight), int(b.PreferredBitsPerPixel)
+}
+
+// BitmapCacheCells returns the number of entries of each
+// bitmap cache advertised to the server
+func (c *Client) BitmapCacheCells() []int {
+	return c.clientCapabilities[CAPSTYPE_BITMAPCACHE_REV2].(*BitmapCache2Capability).Cells()
+}
+
+// GlyphCacheCells returns the number of entries of each
+// glyph cache advertised to the server
+func (c *Client) GlyphCacheCells() []int {
+	return c.clientCapabilities[CAPSTYPE_GLYPHCACHE].(*GlyphCapability).Cells()
+}
+
+// BrushSupport returns the brush support level advertised to the server
+func (c *Client) BrushSupport() BrushSupport {
+	return c.clientCapabilities[CAPSTYPE_BRUSH].(*BrushCapability).SupportLevel
+}
+
+// ColorTableCacheSize returns the number of color tables advertised to the server
+func (c *Client) ColorTableCacheSize() int {
+	return int(c.clientCapabilities[CAPSTYPE_COLORCACHE].(*ColorCacheCapability).CacheSize)
+}
+
+// OffscreenCache returns the size in KB and the number of
+// entries of the offscreen bitmap cache advertised to the server
+func (c *Client) OffscreenCache() (size, entries int) {
+	o := c.clientCapabilities[CAPSTYPE_OFFSCREENCACHE].(*OffscreenBitmapCacheCapability)
+	if o.SupportLevel == OSL_FALSE {
+		return 0, 0
+	}
+	return int(o.CacheSize), int(o.CacheEntries)
+}
+
+// PointerCacheSize returns the number of pointers advertised to the server
+func (c *Client) PointerCacheSize() int {
+	p := c.clientCapabilities[CAPSTYPE_POINTER].(*PointerCapability)
+	if p.PointerCacheSize > p.ColorPointerCacheSize {
+		return int(p.PointerCacheSize)
+	}
+	return int(p.ColorPointerCacheSize)
+}
+
+// SetPersistentKeys marks the bitmap caches persistent, keys are sent
+// in the Persistent Key List PDUs of the first connection sequence
+func (c *Client) SetPersistentKeys(keys [][]uint64) {
+	b := c.clientCapabilities[CAPSTYPE_BITMAPCACHE_REV2].(*BitmapCache2Capability)
+	b.BitmapCachePersist |= PERSISTENT_KEYS_EXPECTED_FLAG
+	b.BmpC0Cells |= CELL_PERSISTENT
+	b.BmpC1Cells |= CELL_PERSISTENT
+	b.BmpC2Cells |= CELL_PERSISTENT
+	b.BmpC3Cells |= CELL_PERSISTENT
+	b.BmpC4Cells |= CELL_PERSISTENT
+	c.persistentKeys = keys
+}
+
 func (c *Client) connect(data *gcc.ClientCoreData, userId uint16, channelId uint16) {
 	glog.Debug("pdu connect:", userId, ",", channelId)
 	c.clientCoreData = data
@@ -158,12 +250,16 @@ func (c *Client) connect(data *gcc.ClientCoreData, userId uint16, channelId uint
 
 func (c *Client) recvDemandActivePDU(s []byte) {
 	glog.Trace("PDU recvDemandActivePDU", hex.EncodeToString(s))
-	r := bytes.NewReader(s)
+	r := bytes.NewReader(c.decompressPDU(s))
 	pdu, err := readPDU(r)
 	if err != nil {
 		glog.Error(err)
 		return
 	}
+	if pdu.ShareCtrlHeader.PDUType == PDUTYPE_SERVER_REDIR_PKT {
+		c.redirect(pdu.Message.(*ServerRedirectionPDU).Redirection)
+		return
+	}
 	if pdu.ShareCtrlHeader.PDUType != PDUTYPE_DEMANDACTIVEPDU {
 		glog.Info("PDU ignore message during connection sequence, type is", pdu.ShareCtrlHeader.PDUType)
 		c.transport.Once("data", c.recvDemandActivePDU)
@@ -171,6 +267,8 @@ func (c *Client) recvDemandActivePDU(s []byte) {
 	}
 	c.sharedId = pdu.Message.(*DemandActivePDU).SharedId
 	c.demandActivePDU = pdu.Message.(*DemandActivePDU)
+	c.orders.Reset()
+	c.orders.SetGlyphSupport(c.clientCapabilities[CAPSTYPE_GLYPHCACHE].(*GlyphCapability).SupportLevel)
 	for _, caps := range c.demandActivePDU.CapabilitySets {
 		glog.Debugf("serverCapabilities<%s>: %+v", caps.Type(), caps)
 		c.serverCapabilities[caps.Type()] = caps
@@ -195,6 +293,9 @@ func (c *Client) sendConfirmActivePDU() {
 
 	bitmapCapa := c.clientCapabilities[CAPSTYPE_BITMAP].(*BitmapCapability)
 	bitmapCapa.PreferredBitsPerPixel = c.clientCoreData.HighColorDepth
+	if c.clientCoreData.EarlyCapabilityFlags&gcc.RNS_UD_CS_WANT_32BPP_SESSION != 0 {
+		bitmapCapa.PreferredBitsPerPixel = 32
+	}
 	bitmapCapa.DesktopWidth = c.clientCoreData.DesktopWidth
 	bitmapCapa.DesktopHeight = c.clientCoreData.DesktopHeight
 	bitmapCapa.DesktopResizeFlag = 0x0001
@@ -202,23 +303,25 @@ func (c *Client) sendConfirmActivePDU() {
 	orderCapa := c.clientCapabilities[CAPSTYPE_ORDER].(*OrderCapability)
 	orderCapa.OrderFlags = NEGOTIATEORDERSUPPORT | ZEROBOUNDSDELTASSUPPORT | COLORINDEXSUPPORT | ORDERFLAGS_EXTRA_FLAGS
 	orderCapa.OrderSupportExFlags |= ORDERFLAGS_EX_ALTSEC_FRAME_MARKER_SUPPORT
+	// the orders drawn by gdi.GDI, PATBLT also covers OpaqueRect
 	orderCapa.OrderSupport[TS_NEG_DSTBLT_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_PATBLT_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_SCRBLT_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_LINETO_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_MEMBLT_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_MEM3BLT_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_POLYLINE_INDEX] = 1
-	/*orderCapa.OrderSupport[TS_NEG_MULTIOPAQUERECT_INDEX] = 1
-	orderCapa.OrderSupport[TS_NEG_GLYPH_INDEX_INDEX] = 1
-	//orderCapa.OrderSupport[TS_NEG_DRAWNINEGRID_INDEX] = 1
-	orderCapa.OrderSupport[TS_NEG_SAVEBITMAP_INDEX] = 1
+	orderCapa.OrderSupport[TS_NEG_MEMBLT_INDEX] = 1
+	orderCapa.OrderSupport[TS_NEG_MEM3BLT_INDEX] = 1
+	orderCapa.OrderSupport[TS_NEG_LINETO_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_POLYGON_SC_INDEX] = 1
-	orderCapa.OrderSupport[TS_NEG_POLYGON_CB_INDEX] = 1
-	orderCapa.OrderSupport[TS_NEG_ELLIPSE_SC_INDEX] = 1
-	orderCapa.OrderSupport[TS_NEG_ELLIPSE_CB_INDEX] = 1*/
+	orderCapa.OrderSupport[TS_NEG_GLYPH_INDEX_INDEX] = 1
+	orderCapa.OrderSupport[TS_NEG_FAST_INDEX_INDEX] = 1
 	orderCapa.OrderSupport[TS_NEG_FAST_GLYPH_INDEX] = 1
 
+	// the codecs decoded by gdi.GDI
+	codecsCapa := c.clientCapabilities[CAPSETTYPE_BITMAP_CODECS].(*BitmapCodecsCapability)
+	codecsCapa.SupportedBitmapCodecs.Array = []BitmapCodec{
+		{GUID: CODEC_GUID_NSCODEC, ID: CODEC_ID_NSCODEC, Properties: NSCodecProperties()},
+		{GUID: CODEC_GUID_REMOTEFX, ID: CODEC_ID_REMOTEFX, Properties: RemoteFXProperties()},
+	}
+
 	inputCapa := c.clientCapabilities[CAPSTYPE_INPUT].(*InputCapability)
 	inputCapa.Flags = INPUT_FLAG_SCANCODES | INPUT_FLAG_MOUSEX | INPUT_FLAG_UNICODE
 	inputCapa.KeyboardLayout = c.clientCoreData.KbdLayout
@@ -227,20 +330,6 @@ func (c *Client) sendConfirmActivePDU() {
 	inputCapa.KeyboardFunctionKey = c.clientCoreData.KeyboardFnKeys
 	inputCapa.ImeFileName = c.clientCoreData.ImeFileName
 
-	glyphCapa := c.clientCapabilities[CAPSTYPE_GLYPHCACHE].(*GlyphCapability)
-	/*glyphCapa.GlyphCache[0] = cacheEntry{254, 4}
-	glyphCapa.GlyphCache[1] = cacheEntry{254, 4}
-	glyphCapa.GlyphCache[2] = cacheEntry{254, 8}
-	glyphCapa.GlyphCache[3] = cacheEntry{254, 8}
-	glyphCapa.GlyphCache[4] = cacheEntry{254, 16}
-	glyphCapa.GlyphCache[5] = cacheEntry{254, 32}
-	glyphCapa.GlyphCache[6] = cacheEntry{254, 64}
-	glyphCapa.GlyphCache[7] = cacheEntry{254, 128}
-	glyphCapa.GlyphCache[8] = cacheEntry{254, 256}
-	glyphCapa.GlyphCache[9] = cacheEntry{64, 2048}
-	glyphCapa.FragCache = 0x01000100*/
-	glyphCapa.SupportLevel = GLYPH_SUPPORT_NONE
-
 	pdu.SharedId = c.sharedId
 	for _, v := range c.clientCapabilities {
 		glog.Debugf("clientCapabilities<%s>: %+v", v.Type(), v)
@@ -259,13 +348,16 @@ func (c *Client) sendClientFinalizeSynchronizePDU() {
 	c.sendDataPDU(NewSynchronizeDataPDU(c.channelId))
 	c.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_COOPERATE})
 	c.sendDataPDU(&ControlDataPDU{Action: CTRLACTION_REQUEST_CONTROL})
-	//c.sendDataPDU(&PersistKeyPDU{BBitMask: 0x03})
+	for _, p := range NewPersistKeyPDUs(c.persistentKeys) {
+		c.sendDataPDU(p)
+	}
+	c.persistentKeys = nil
 	c.sendDataPDU(&FontListDataPDU{ListFlags: 0x0003, EntrySize: 0x0032})
 }
 
 func (c *Client) recvServerSynchronizePDU(s []byte) {
 	glog.Debug("PDU recvServerSynchronizePDU")
-	r := bytes.NewReader(s)
+	r := bytes.NewReader(c.decompressPDU(s))
 	pdu, err := readPDU(r)
 	if err != nil {
 		glog.Error(err)
@@ -287,7 +379,7 @@ func (c *Client) recvServerSynchronizePDU(s []byte) {
 
 func (c *Client) recvServerControlCooperatePDU(s []byte) {
 	glog.Debug("PDU recvServerControlCooperatePDU")
-	r := bytes.NewReader(s)
+	r := bytes.NewReader(c.decompressPDU(s))
 	pdu, err := readPDU(r)
 	if err != nil {
 		glog.Error(err)
@@ -313,7 +405,7 @@ func (c *Client) recvServerControlCooperatePDU(s []byte) {
 
 func (c *Client) recvServerControlGrantedPDU(s []byte) {
 	glog.Debug("PDU recvServerControlGrantedPDU")
-	r := bytes.NewReader(s)
+	r := bytes.NewReader(c.decompressPDU(s))
 	pdu, err := readPDU(r)
 	if err != nil {
 		glog.Error(err)
@@ -339,7 +431,7 @@ func (c *Client) recvServerControlGrantedPDU(s []byte) {
 
 func (c *Client) recvServerFontMapPDU(s []byte) {
 	glog.Debug("PDU recvServerFontMapPDU")
-	r := bytes.NewReader(s)
+	r := bytes.NewReader(c.decompressPDU(s))
 	pdu, err := readPDU(r)
 	if err != nil {
 		glog.Error(err)
@@ -360,7 +452,7 @@ func (c *Client) recvServerFontMapPDU(s []byte) {
 
 func (c *Client) recvPDU(s []byte) {
 	glog.Trace("PDU recvPDU", hex.EncodeToString(s))
-	r := bytes.NewReader(s)
+	r := bytes.NewReader(c.decompressPDU(s))
 	if r.Len() > 0 {
 		p, err := readPDU(r)
 		if err != nil {
@@ -369,6 +461,8 @@ func (c *Client) recvPDU(s []byte) {
 		}
 		if p.ShareCtrlHeader.PDUType == PDUTYPE_DEACTIVATEALLPDU {
 			c.transport.Once("data", c.recvDemandActivePDU)
+		} else if p.ShareCtrlHeader.PDUType == PDUTYPE_SERVER_REDIR_PKT {
+			c.redirect(p.Message.(*ServerRedirectionPDU).Redirection)
 		} else if p.ShareCtrlHeader.PDUType == PDUTYPE_DATAPDU {
 			d := p.Message.(*DataPDU)
 			if d.Header.PDUType2 == PDUTYPE2_UPDATE {
@@ -378,12 +472,36 @@ func (c *Client) recvPDU(s []byte) {
 					c.Emit("bitmap", p.(*BitmapUpdateDataPDU).Rectangles)
 				} else if up.UpdateType == FASTPATH_UPDATETYPE_ORDERS {
 					c.Emit("orders", p.(*FastPathOrdersPDU).OrderPdus)
+				} else if up.UpdateType == FASTPATH_UPDATETYPE_PALETTE {
+					c.Emit("paletteupdate", p.(*PaletteUpdateData))
 				}
+			} else if d.Header.PDUType2 == PDUTYPE2_POINTER {
+				c.Emit("pointerupdate", d.Data.(*PointerDataPDU).Data)
 			}
 		}
 	}
 }
 
+// decompressPDU returns a slow-path PDU with the data of its
+// Data PDU decompressed, nil if it does not decompress
+func (c *Client) decompressPDU(s []byte) []byte {
+	// the share control header and the share data header up to compressedType
+	const header = 18
+	if len(s) < header || binary.LittleEndian.Uint16(s[2:]) != PDUTYPE_DATAPDU || s[15] == 0 {
+		return s
+	}
+	data, err := c.bulk.Decompress(s[header:], s[15])
+	if err != nil {
+		glog.Error("decompress data pdu:", err)
+		return nil
+	}
+	p := make([]byte, header+len(data))
+	copy(p, s[:header])
+	p[15] = 0
+	copy(p[header:], data)
+	return p
+}
+
 func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 	glog.Trace("PDU RecvFastPath", hex.EncodeToString(s))
 	r := bytes.NewReader(s)
@@ -394,10 +512,10 @@ func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 		}
 		updateCode := updateHeader & 0x0f
 		fragmentation := updateHeader & 0x30
-		compression := updateHeader & 0xC0
+		compression := updateHeader >> 6
 
 		var compressionFlags uint8 = 0
-		if compression == FASTPATH_OUTPUT_COMPRESSION_USED {
+		if compression&FASTPATH_OUTPUT_COMPRESSION_USED != 0 {
 			compressionFlags, err = core.ReadUInt8(r)
 		}
 
@@ -410,33 +528,64 @@ func (c *Client) RecvFastPath(secFlag byte, s []byte) {
 			"compressionFlags:", compressionFlags,
 			"fragmentation:", fragmentation,
 			"size:", size, "len:", r.Len())
-		if compressionFlags&RDP_MPPC_COMPRESSED != 0 {
-			glog.Info("RDP_MPPC_COMPRESSED")
+		b, err := core.ReadBytes(int(size), r)
+		if err != nil {
+			return
+		}
+		if compression&FASTPATH_OUTPUT_COMPRESSION_USED != 0 {
+			// fragments are compressed one by one
+			b, err = c.bulk.Decompress(b, compressionFlags)
+			if err != nil {
+				glog.Error("decompress fast-path update:", err)
+				continue
+			}
 		}
 		if fragmentation != FASTPATH_FRAGMENT_SINGLE {
 			if fragmentation == FASTPATH_FRAGMENT_FIRST {
 				c.buff.Reset()
 			}
-			b, _ := core.ReadBytes(r.Len(), r)
 			c.buff.Write(b)
 			if fragmentation != FASTPATH_FRAGMENT_LAST {
-				return
+				continue
 			}
-			r = bytes.NewReader(c.buff.Bytes())
+			b = c.buff.Bytes()
 		}
 
-		p, err := readFastPathUpdatePDU(r, updateCode)
+		p, err := readFastPathUpdatePDU(bytes.NewReader(b), updateCode, c.orders)
 		if err != nil || p == nil || p.Data == nil {
 			glog.Debug("readFastPathUpdatePDU:", err)
-			return
+			continue
 		}
 
-		if updateCode == FASTPATH_UPDATETYPE_BITMAP {
+		switch updateCode {
+		case FASTPATH_UPDATETYPE_BITMAP:
 			c.Emit("bitmap", p.Data.(*FastPathBitmapUpdateDataPDU).Rectangles)
-		} else if updateCode == FASTPATH_UPDATETYPE_COLOR {
-			c.Emit("color", p.Data.(*FastPathColorPdu))
-		} else if updateCode == FASTPATH_UPDATETYPE_ORDERS {
+		case FASTPATH_UPDATETYPE_ORDERS:
 			c.Emit("orders", p.Data.(*FastPathOrdersPDU).OrderPdus)
+		case FASTPATH_UPDATETYPE_SURFCMDS:
+			c.recvSurfaceCmds(p.Data.(*FastPathSurfaceCmds))
+		case FASTPATH_UPDATETYPE_PALETTE:
+			c.Emit("paletteupdate", p.Data.(*PaletteUpdateData))
+		case FASTPATH_UPDATETYPE_PTR_NULL, FASTPATH_UPDATETYPE_PTR_DEFAULT,
+			FASTPATH_UPDATETYPE_PTR_POSITION, FASTPATH_UPDATETYPE_COLOR,
+			FASTPATH_UPDATETYPE_CACHED, FASTPATH_UPDATETYPE_POINTER,
+			FASTPATH_UPDATETYPE_LARGE_POINTER:
+			c.Emit("pointerupdate", p.Data)
+		}
+	}
+}
+
+// recvSurfaceCmds emits the surface commands and acknowledges the frames drawn
+func (c *Client) recvSurfaceCmds(cmds *FastPathSurfaceCmds) {
+	for _, cmd := range cmds.Cmds {
+		switch d := cmd.(type) {
+		case *SurfaceBits:
+			c.Emit("surfacebits", d)
+		case *FrameMarker:
+			c.Emit("frame", d)
+			if d.FrameAction == SURFACECMD_FRAMEACTION_END {
+				c.sendDataPDU(&FrameAcknowledgePDU{FrameId: d.FrameId})
+			}
 		}
 	}
 }
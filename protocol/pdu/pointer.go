@@ -0,0 +1,202 @@
+// pointer.go
+package pdu
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/tomatome/grdp/core"
+)
+
+// message types of the slow-path pointer updates
+const (
+	TS_PTRMSGTYPE_SYSTEM   = 0x0001
+	TS_PTRMSGTYPE_POSITION = 0x0003
+	TS_PTRMSGTYPE_COLOR    = 0x0006
+	TS_PTRMSGTYPE_CACHED   = 0x0007
+	TS_PTRMSGTYPE_POINTER  = 0x0008
+	TS_PTRMSGTYPE_LARGE    = 0x0009
+)
+
+const (
+	SYSPTR_NULL    = 0x00000000
+	SYSPTR_DEFAULT = 0x00007F00
+)
+
+const (
+	LARGE_POINTER_FLAG_96x96   = 0x0001
+	LARGE_POINTER_FLAG_384x384 = 0x0002
+)
+
+/**
+ * PointerDataPDU is a slow-path pointer update, Data holds
+ * the same update data as the fast-path pointer updates.
+ * @see MS-RDPBCGR 2.2.9.1.1.4 Server Pointer Update PDU (TS_POINTER_PDU)
+ */
+type PointerDataPDU struct {
+	MessageType uint16
+	Data        UpdateData
+}
+
+func (*PointerDataPDU) Type2() uint8 {
+	return PDUTYPE2_POINTER
+}
+func (d *PointerDataPDU) Unpack(r io.Reader) error {
+	d.MessageType, _ = core.ReadUint16LE(r)
+	// pad2Octets
+	core.ReadUint16LE(r)
+	switch d.MessageType {
+	case TS_PTRMSGTYPE_SYSTEM:
+		d.Data = &SystemPointer{}
+	case TS_PTRMSGTYPE_POSITION:
+		d.Data = &PointerPosition{}
+	case TS_PTRMSGTYPE_COLOR:
+		d.Data = &ColorPointer{}
+	case TS_PTRMSGTYPE_CACHED:
+		d.Data = &CachedPointer{}
+	case TS_PTRMSGTYPE_POINTER:
+		d.Data = &NewPointer{}
+	case TS_PTRMSGTYPE_LARGE:
+		d.Data = &LargePointer{}
+	default:
+		return fmt.Errorf("unknown pointer message type 0x%x", d.MessageType)
+	}
+	return d.Data.Unpack(r)
+}
+
+/**
+ * SystemPointer hides the pointer or shows the default one,
+ * fast-path updates carry the type in their update code.
+ * @see MS-RDPBCGR 2.2.9.1.1.4.3 System Pointer Update (TS_SYSTEMPOINTERATTRIBUTE)
+ */
+type SystemPointer struct {
+	Type uint32
+}
+
+func (p *SystemPointer) FastPathUpdateType() uint8 {
+	if p.Type == SYSPTR_NULL {
+		return FASTPATH_UPDATETYPE_PTR_NULL
+	}
+	return FASTPATH_UPDATETYPE_PTR_DEFAULT
+}
+func (p *SystemPointer) Unpack(r io.Reader) (err error) {
+	p.Type, err = core.ReadUInt32LE(r)
+	return err
+}
+
+/**
+ * PointerPosition moves the pointer
+ * @see MS-RDPBCGR 2.2.9.1.1.4.2 Pointer Position Update (TS_POINTERPOSATTRIBUTE)
+ */
+type PointerPosition struct {
+	X uint16
+	Y uint16
+}
+
+func (*PointerPosition) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_PTR_POSITION
+}
+func (p *PointerPosition) Unpack(r io.Reader) error {
+	p.X, _ = core.ReadUint16LE(r)
+	p.Y, _ = core.ReadUint16LE(r)
+	return nil
+}
+
+/**
+ * ColorPointer is a pointer of 24 bpp to cache at CacheIndex and show,
+ * the rows of both masks are bottom-up and padded to 2 bytes.
+ * @see MS-RDPBCGR 2.2.9.1.1.4.4 Color Pointer Update (TS_COLORPOINTERATTRIBUTE)
+ */
+type ColorPointer struct {
+	XorBpp     uint16
+	CacheIndex uint16
+	HotX       uint16
+	HotY       uint16
+	Width      uint16
+	Height     uint16
+	// XorBpp bits per pixel
+	XorMask []byte
+	// 1 bit per pixel
+	AndMask []byte
+}
+
+func (*ColorPointer) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_COLOR
+}
+func (p *ColorPointer) Unpack(r io.Reader) error {
+	p.XorBpp = 24
+	return p.unpack(r, false)
+}
+
+// unpack reads the attribute after xorBpp, the mask lengths are 32 bits when long
+func (p *ColorPointer) unpack(r io.Reader, long bool) (err error) {
+	p.CacheIndex, _ = core.ReadUint16LE(r)
+	p.HotX, _ = core.ReadUint16LE(r)
+	p.HotY, _ = core.ReadUint16LE(r)
+	p.Width, _ = core.ReadUint16LE(r)
+	p.Height, _ = core.ReadUint16LE(r)
+	var andLen, xorLen int
+	if long {
+		a, _ := core.ReadUInt32LE(r)
+		x, _ := core.ReadUInt32LE(r)
+		andLen, xorLen = int(a), int(x)
+	} else {
+		a, _ := core.ReadUint16LE(r)
+		x, _ := core.ReadUint16LE(r)
+		andLen, xorLen = int(a), int(x)
+	}
+	if p.XorMask, err = core.ReadBytes(xorLen, r); err != nil {
+		return err
+	}
+	p.AndMask, err = core.ReadBytes(andLen, r)
+	return err
+}
+
+/**
+ * NewPointer is a color pointer of XorBpp bits per pixel,
+ * 32 bpp pointers have an alpha channel.
+ * @see MS-RDPBCGR 2.2.9.1.1.4.5 New Pointer Update (TS_POINTERATTRIBUTE)
+ */
+type NewPointer struct {
+	ColorPointer
+}
+
+func (*NewPointer) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_POINTER
+}
+func (p *NewPointer) Unpack(r io.Reader) error {
+	p.XorBpp, _ = core.ReadUint16LE(r)
+	return p.unpack(r, false)
+}
+
+/**
+ * LargePointer is a new pointer larger than 96x96
+ * @see MS-RDPBCGR 2.2.9.1.1.4.7 Large Pointer Update (TS_LARGEPOINTERATTRIBUTE)
+ */
+type LargePointer struct {
+	ColorPointer
+}
+
+func (*LargePointer) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_LARGE_POINTER
+}
+func (p *LargePointer) Unpack(r io.Reader) error {
+	p.XorBpp, _ = core.ReadUint16LE(r)
+	return p.unpack(r, true)
+}
+
+/**
+ * CachedPointer shows the pointer cached at CacheIndex
+ * @see MS-RDPBCGR 2.2.9.1.1.4.6 Cached Pointer Update (TS_CACHEDPOINTERATTRIBUTE)
+ */
+type CachedPointer struct {
+	CacheIndex uint16
+}
+
+func (*CachedPointer) FastPathUpdateType() uint8 {
+	return FASTPATH_UPDATETYPE_CACHED
+}
+func (p *CachedPointer) Unpack(r io.Reader) error {
+	p.CacheIndex, _ = core.ReadUint16LE(r)
+	return nil
+}
@@ -0,0 +1,183 @@
+package sec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/tomatome/grdp/core"
+)
+
+/**
+ * RedirFlags of the server redirection packet
+ * @see MS-RDPBCGR 2.2.13.1 Server Redirection Packet (RDP_SERVER_REDIRECTION_PACKET)
+ */
+const (
+	LB_TARGET_NET_ADDRESS       uint32 = 0x00000001
+	LB_LOAD_BALANCE_INFO               = 0x00000002
+	LB_USERNAME                        = 0x00000004
+	LB_DOMAIN                          = 0x00000008
+	LB_PASSWORD                        = 0x00000010
+	LB_DONTSTOREUSERNAME               = 0x00000020
+	LB_SMARTCARD_LOGON                 = 0x00000040
+	LB_NOREDIRECT                      = 0x00000080
+	LB_TARGET_FQDN                     = 0x00000100
+	LB_TARGET_NETBIOS_NAME             = 0x00000200
+	LB_TARGET_NET_ADDRESSES            = 0x00000800
+	LB_CLIENT_TSV_URL                  = 0x00001000
+	LB_SERVER_TSV_CAPABLE              = 0x00002000
+	LB_PASSWORD_IS_PK_ENCRYPTED        = 0x00004000
+	LB_REDIRECTION_GUID                = 0x00008000
+	LB_TARGET_CERTIFICATE              = 0x00010000
+)
+
+// ServerRedirection asks the client to reconnect, usually to another
+// server of the farm chosen by a connection broker
+type ServerRedirection struct {
+	SessionId  uint32
+	RedirFlags uint32
+	// IP address of the target
+	TargetNetAddress string
+	// routing token to send back in the X.224 connection request
+	LoadBalanceInfo []byte
+	UserName        string
+	Domain          string
+	// password or password cookie, opaque to the client
+	Password           []byte
+	TargetFQDN         string
+	TargetNetBiosName  string
+	TsvUrl             []byte
+	RedirectionGuid    []byte
+	TargetCertificate  []byte
+	TargetNetAddresses []string
+}
+
+func readBlob(r io.Reader) ([]byte, error) {
+	n, err := core.ReadUInt32LE(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > 0x10000 {
+		return nil, fmt.Errorf("redirection field too long (%d)", n)
+	}
+	return core.ReadBytes(int(n), r)
+}
+
+func readUnicode(r io.Reader) (string, error) {
+	b, err := readBlob(r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(core.UnicodeDecode(b), "\x00"), nil
+}
+
+// ReadServerRedirection reads a RDP_SERVER_REDIRECTION_PACKET
+func ReadServerRedirection(r io.Reader) (*ServerRedirection, error) {
+	flags, _ := core.ReadUint16LE(r)
+	length, err := core.ReadUint16LE(r)
+	if err != nil {
+		return nil, err
+	}
+	if flags != REDIRECTION_PKT {
+		return nil, errors.New("NODE_RDP_PROTOCOL_SEC_BAD_REDIRECTION_PACKET")
+	}
+	if length < 12 {
+		return nil, fmt.Errorf("redirection packet too short (%d)", length)
+	}
+	body, err := core.ReadBytes(int(length)-4, r)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bytes.NewReader(body)
+	rd := &ServerRedirection{}
+	rd.SessionId, _ = core.ReadUInt32LE(br)
+	rd.RedirFlags, err = core.ReadUInt32LE(br)
+	if err != nil {
+		return nil, err
+	}
+	has := func(flag uint32) bool {
+		return err == nil && rd.RedirFlags&flag != 0
+	}
+	if has(LB_TARGET_NET_ADDRESS) {
+		rd.TargetNetAddress, err = readUnicode(br)
+	}
+	if has(LB_LOAD_BALANCE_INFO) {
+		rd.LoadBalanceInfo, err = readBlob(br)
+	}
+	if has(LB_USERNAME) {
+		rd.UserName, err = readUnicode(br)
+	}
+	if has(LB_DOMAIN) {
+		rd.Domain, err = readUnicode(br)
+	}
+	if has(LB_PASSWORD) {
+		rd.Password, err = readBlob(br)
+	}
+	if has(LB_TARGET_FQDN) {
+		rd.TargetFQDN, err = readUnicode(br)
+	}
+	if has(LB_TARGET_NETBIOS_NAME) {
+		rd.TargetNetBiosName, err = readUnicode(br)
+	}
+	if has(LB_CLIENT_TSV_URL) {
+		rd.TsvUrl, err = readBlob(br)
+	}
+	if has(LB_REDIRECTION_GUID) {
+		rd.RedirectionGuid, err = readBlob(br)
+	}
+	if has(LB_TARGET_CERTIFICATE) {
+		rd.TargetCertificate, err = readBlob(br)
+	}
+	if has(LB_TARGET_NET_ADDRESSES) {
+		rd.TargetNetAddresses, err = readNetAddresses(br)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read redirection packet %v", err)
+	}
+	return rd, nil
+}
+
+// readNetAddresses reads TARGET_NET_ADDRESSES
+func readNetAddresses(r io.Reader) ([]string, error) {
+	b, err := readBlob(r)
+	if err != nil {
+		return nil, err
+	}
+	br := bytes.NewReader(b)
+	count, err := core.ReadUInt32LE(br)
+	if err != nil {
+		return nil, err
+	}
+	if int(count) > br.Len()/4 {
+		return nil, fmt.Errorf("bad target address count %d", count)
+	}
+	addrs := make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		a, err := readUnicode(br)
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs, nil
+}
+
+// Target returns the server to reconnect to, empty when the client
+// must reconnect to the same server (LB_NOREDIRECT)
+func (rd *ServerRedirection) Target() string {
+	if rd.RedirFlags&LB_NOREDIRECT != 0 {
+		return ""
+	}
+	for _, t := range []string{rd.TargetNetAddress, rd.TargetFQDN, rd.TargetNetBiosName} {
+		if t != "" {
+			return t
+		}
+	}
+	if len(rd.TargetNetAddresses) > 0 {
+		return rd.TargetNetAddresses[0]
+	}
+	return ""
+}
@@ -0,0 +1,57 @@
+package sec_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/protocol/sec"
+)
+
+func blob(buff *bytes.Buffer, b []byte) {
+	core.WriteUInt32LE(uint32(len(b)), buff)
+	buff.Write(b)
+}
+
+func TestReadServerRedirection(t *testing.T) {
+	body := &bytes.Buffer{}
+	core.WriteUInt32LE(7, body)
+	core.WriteUInt32LE(sec.LB_TARGET_NET_ADDRESS|sec.LB_LOAD_BALANCE_INFO|sec.LB_USERNAME|
+		sec.LB_DOMAIN|sec.LB_PASSWORD|sec.LB_TARGET_NET_ADDRESSES, body)
+	blob(body, core.UnicodeEncode("10.0.0.2\x00"))
+	blob(body, []byte("Cookie: msts=123\r\n"))
+	blob(body, core.UnicodeEncode("alice\x00"))
+	blob(body, core.UnicodeEncode("CORP\x00"))
+	blob(body, []byte{1, 2, 3, 4})
+	addrs := &bytes.Buffer{}
+	core.WriteUInt32LE(2, addrs)
+	blob(addrs, core.UnicodeEncode("10.0.0.2\x00"))
+	blob(addrs, core.UnicodeEncode("fe80::2\x00"))
+	blob(body, addrs.Bytes())
+
+	pkt := &bytes.Buffer{}
+	core.WriteUInt16LE(sec.REDIRECTION_PKT, pkt)
+	core.WriteUInt16LE(uint16(body.Len()+4), pkt)
+	pkt.Write(body.Bytes())
+
+	rd, err := sec.ReadServerRedirection(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rd.SessionId != 7 || rd.TargetNetAddress != "10.0.0.2" || rd.UserName != "alice" || rd.Domain != "CORP" {
+		t.Errorf("unexpected redirection %+v", rd)
+	}
+	if string(rd.LoadBalanceInfo) != "Cookie: msts=123\r\n" || !bytes.Equal(rd.Password, []byte{1, 2, 3, 4}) {
+		t.Errorf("unexpected blobs %+v", rd)
+	}
+	if len(rd.TargetNetAddresses) != 2 || rd.TargetNetAddresses[1] != "fe80::2" {
+		t.Errorf("unexpected addresses %q", rd.TargetNetAddresses)
+	}
+	if rd.Target() != "10.0.0.2" {
+		t.Error("unexpected target", rd.Target())
+	}
+	rd.RedirFlags |= sec.LB_NOREDIRECT
+	if rd.Target() != "" {
+		t.Error("LB_NOREDIRECT must keep the server")
+	}
+}
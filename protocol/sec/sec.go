@@ -7,6 +7,7 @@ import (
 	"crypto/rc4"
 	"crypto/rsa"
 	"crypto/sha1"
+	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"io"
@@ -173,7 +174,8 @@ func NewRDPInfo() *RDPInfo {
 	info := &RDPInfo{
 		Flag: INFO_MOUSE | INFO_UNICODE | INFO_MAXIMIZESHELL |
 			INFO_ENABLEWINDOWSKEY | INFO_DISABLECTRLALTDEL | INFO_MOUSE_HAS_WHEEL |
-			INFO_FORCE_ENCRYPTED_CS_PDU | INFO_AUTOLOGON,
+			INFO_FORCE_ENCRYPTED_CS_PDU | INFO_AUTOLOGON |
+			INFO_COMPRESSION | core.PACKET_COMPR_TYPE_64K<<9,
 		Domain:         []byte{0, 0},
 		UserName:       []byte{0, 0},
 		Password:       []byte{0, 0},
@@ -437,41 +439,68 @@ func (c *Client) SetClientAutoReconnect(id uint32, random []byte) {
 	c.info.SetClientAutoReconnect(auto)
 }
 
-func (c *Client) SetAlternateShell(shell string) {
+func unicodeString(s string) []byte {
 	buff := &bytes.Buffer{}
-	for _, ch := range utf16.Encode([]rune(shell)) {
+	for _, ch := range utf16.Encode([]rune(s)) {
 		core.WriteUInt16LE(ch, buff)
 	}
 	core.WriteUInt16LE(0, buff)
-	c.info.AlternateShell = buff.Bytes()
+	return buff.Bytes()
+}
+
+// SetAlternateShell sets the program started instead of the desktop
+// shell, and marks the session as a remote application (RAIL) one
+func (c *Client) SetAlternateShell(shell string) {
+	c.SetShell(shell)
 	c.info.Flag |= INFO_RAIL
 }
 
+// SetShell sets the program started instead of the desktop shell
+func (c *Client) SetShell(shell string) {
+	c.info.AlternateShell = unicodeString(shell)
+}
+
+func (c *Client) SetWorkingDir(dir string) {
+	c.info.WorkingDir = unicodeString(dir)
+}
+
 func (c *Client) SetUser(user string) {
-	buff := &bytes.Buffer{}
-	for _, ch := range utf16.Encode([]rune(user)) {
-		core.WriteUInt16LE(ch, buff)
-	}
-	core.WriteUInt16LE(0, buff)
-	c.info.UserName = buff.Bytes()
+	c.info.UserName = unicodeString(user)
 }
 
 func (c *Client) SetPwd(pwd string) {
-	buff := &bytes.Buffer{}
-	for _, ch := range utf16.Encode([]rune(pwd)) {
-		core.WriteUInt16LE(ch, buff)
-	}
-	core.WriteUInt16LE(0, buff)
-	c.info.Password = buff.Bytes()
+	c.info.Password = unicodeString(pwd)
+}
+
+// SetPasswordCookie sends the password cookie of a server redirection
+// in place of the password
+func (c *Client) SetPasswordCookie(cookie []byte) {
+	c.info.Password = append(append([]byte{}, cookie...), 0, 0)
 }
 
 func (c *Client) SetDomain(domain string) {
-	buff := &bytes.Buffer{}
-	for _, ch := range utf16.Encode([]rune(domain)) {
-		core.WriteUInt16LE(ch, buff)
+	c.info.Domain = unicodeString(domain)
+}
+
+func (c *Client) SetPerformanceFlags(flags uint32) {
+	c.info.ExtendedInfo.PerformanceFlags = flags
+}
+
+// SetCompression offers the bulk compression type t, core.PACKET_COMPR_TYPE_*,
+// a negative t disables compression
+func (c *Client) SetCompression(t int) {
+	c.info.Flag &^= INFO_COMPRESSION | INFO_CompressionTypeMask
+	if t >= 0 {
+		c.info.Flag |= INFO_COMPRESSION | uint32(t)<<9&INFO_CompressionTypeMask
+	}
+}
+
+func (c *Client) SetAutoLogon(auto bool) {
+	if auto {
+		c.info.Flag |= INFO_AUTOLOGON
+	} else {
+		c.info.Flag &^= INFO_AUTOLOGON
 	}
-	core.WriteUInt16LE(0, buff)
-	c.info.Domain = buff.Bytes()
 }
 
 func (c *Client) connect(clientData []interface{}, serverData []interface{}, userId uint16, channels []t125.MCSChannelInfo) {
@@ -857,12 +886,29 @@ func (c *Client) recvData(channel string, s []byte) {
 	glog.Trace("sec recvData", hex.EncodeToString(s))
 	glog.Debugf("channel<%s> data len: %d", channel, len(s))
 	data := c.decrytData(s)
+	if c.enableEncryption && len(s) >= 2 && binary.LittleEndian.Uint16(s)&REDIRECTION_PKT != 0 {
+		c.recvRedirection(data)
+		return
+	}
 	if channel != t125.GLOBAL_CHANNEL_NAME {
 		c.Emit("channel", channel, data)
 		return
 	}
 	c.Emit("data", data)
 }
+
+// recvRedirection reads the Standard Security Server Redirection PDU
+func (c *Client) recvRedirection(s []byte) {
+	rd, err := ReadServerRedirection(bytes.NewReader(s))
+	if err != nil {
+		glog.Error("sec recvRedirection", err)
+		c.Emit("error", err)
+		return
+	}
+	glog.Infof("sec server redirection to %q", rd.Target())
+	c.Emit("redirect", rd)
+}
+
 func (c *Client) SetFastPathListener(f core.FastPathListener) {
 	c.fastPathListener = f
 }
@@ -340,6 +340,36 @@ func (d *ClientSecurityData) Pack() []byte {
 	return buff.Bytes()
 }
 
+/**
+ * Client cluster data, tells the server the client follows redirections
+ * @see MS-RDPBCGR 2.2.1.3.5 Client Cluster Data (TS_UD_CS_CLUSTER)
+ */
+const (
+	REDIRECTION_SUPPORTED            uint32 = 0x00000001
+	REDIRECTED_SESSIONID_FIELD_VALID        = 0x00000002
+	REDIRECTED_SMARTCARD                    = 0x00000040
+	// ServerSessionRedirectionVersionMask
+	REDIRECTION_VERSION4 = 0x03 << 2
+)
+
+type ClientClusterData struct {
+	Flags               uint32
+	RedirectedSessionID uint32
+}
+
+func NewClientClusterData() *ClientClusterData {
+	return &ClientClusterData{REDIRECTION_SUPPORTED | REDIRECTION_VERSION4, 0}
+}
+
+func (d *ClientClusterData) Pack() []byte {
+	buff := &bytes.Buffer{}
+	core.WriteUInt16LE(CS_CLUSTER, buff) // type
+	core.WriteUInt16LE(0x0c, buff)       // len 12
+	core.WriteUInt32LE(d.Flags, buff)
+	core.WriteUInt32LE(d.RedirectedSessionID, buff)
+	return buff.Bytes()
+}
+
 type RSAPublicKey struct {
 	Magic   uint32 `struc:"little"` //0x31415352
 	Keylen  uint32 `struc:"little,sizeof=Modulus"`
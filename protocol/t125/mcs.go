@@ -255,6 +255,7 @@ type MCSClient struct {
 	clientCoreData     *gcc.ClientCoreData
 	clientNetworkData  *gcc.ClientNetworkData
 	clientSecurityData *gcc.ClientSecurityData
+	clientClusterData  *gcc.ClientClusterData
 
 	serverCoreData     *gcc.ServerCoreData
 	serverNetworkData  *gcc.ServerNetworkData
@@ -271,6 +272,7 @@ func NewMCSClient(t core.Transport) *MCSClient {
 		clientCoreData:     gcc.NewClientCoreData(),
 		clientNetworkData:  gcc.NewClientNetworkData(),
 		clientSecurityData: gcc.NewClientSecurityData(),
+		clientClusterData:  gcc.NewClientClusterData(),
 		userId:             1 + MCS_USERCHANNEL_BASE,
 	}
 	c.transport.On("connect", c.connect)
@@ -282,8 +284,54 @@ func (c *MCSClient) SetClientDesktop(width, height uint16) {
 	c.clientCoreData.DesktopHeight = height
 }
 
+func (c *MCSClient) SetClientColorDepth(bpp int) {
+	switch bpp {
+	case 8:
+		c.clientCoreData.HighColorDepth = gcc.HIGH_COLOR_8BPP
+	case 15:
+		c.clientCoreData.HighColorDepth = gcc.HIGH_COLOR_15BPP
+	case 16:
+		c.clientCoreData.HighColorDepth = gcc.HIGH_COLOR_16BPP
+	default:
+		c.clientCoreData.HighColorDepth = gcc.HIGH_COLOR_24BPP
+	}
+	if bpp == 32 {
+		c.clientCoreData.EarlyCapabilityFlags |= gcc.RNS_UD_CS_WANT_32BPP_SESSION
+	} else {
+		c.clientCoreData.EarlyCapabilityFlags &^= gcc.RNS_UD_CS_WANT_32BPP_SESSION
+	}
+}
+
+func (c *MCSClient) SetClientKeyboard(layout, kbType, subType, fnKeys uint32) {
+	c.clientCoreData.KbdLayout = gcc.KeyboardLayout(layout)
+	c.clientCoreData.KeyboardType = kbType
+	c.clientCoreData.KeyboardSubType = subType
+	c.clientCoreData.KeyboardFnKeys = fnKeys
+}
+
+// SetClientName sets the NetBIOS name of the client, at most 15 characters
+func (c *MCSClient) SetClientName(name string) {
+	r := []rune(name)
+	if len(r) > 15 {
+		r = r[:15]
+	}
+	c.clientCoreData.ClientName = [32]byte{}
+	copy(c.clientCoreData.ClientName[:], core.UnicodeEncode(string(r)))
+}
+
+func (c *MCSClient) SetClientBuild(build uint32) {
+	c.clientCoreData.ClientBuild = build
+}
+
+// SetClientRedirectedSession asks the server to reconnect to the
+// session named by a Server Redirection PDU
+func (c *MCSClient) SetClientRedirectedSession(id uint32) {
+	c.clientClusterData.Flags |= gcc.REDIRECTED_SESSIONID_FIELD_VALID
+	c.clientClusterData.RedirectedSessionID = id
+}
+
 func (c *MCSClient) SetClientDynvcProtocol() {
-	c.clientCoreData.EarlyCapabilityFlags = gcc.RNS_UD_CS_SUPPORT_DYNVC_GFX_PROTOCOL
+	c.clientCoreData.EarlyCapabilityFlags |= gcc.RNS_UD_CS_SUPPORT_DYNVC_GFX_PROTOCOL
 	c.clientNetworkData.AddVirtualChannel(drdynvc.ChannelName, drdynvc.ChannelOption)
 }
 
@@ -307,6 +355,7 @@ func (c *MCSClient) connect(selectedProtocol uint32) {
 	userDataBuff.Write(c.clientCoreData.Pack())
 	userDataBuff.Write(c.clientNetworkData.Pack())
 	userDataBuff.Write(c.clientSecurityData.Pack())
+	userDataBuff.Write(c.clientClusterData.Pack())
 
 	ccReq := gcc.MakeConferenceCreateRequest(userDataBuff.Bytes())
 	connectInitial := NewConnectInitial(ccReq)
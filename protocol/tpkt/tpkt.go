@@ -2,13 +2,18 @@ package tpkt
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/tomatome/grdp/core"
 	"github.com/tomatome/grdp/emission"
 	"github.com/tomatome/grdp/glog"
 	"github.com/tomatome/grdp/protocol/nla"
+	"github.com/tomatome/grdp/protocol/t125/ber"
 )
 
 // take idea from https://github.com/Madnikulin50/gordp
@@ -24,31 +29,59 @@ const (
 	FASTPATH_ACTION_X224     = 0x3
 )
 
+/**
+ * Early User Authorization Result PDU, sent by the server after
+ * CredSSP when PROTOCOL_HYBRID_EX is selected
+ * @see MS-RDPBCGR 2.2.10.2 Early User Authorization Result PDU
+ */
+const (
+	AUTHZ_SUCCESS       uint32 = 0x00000000
+	AUTHZ_ACCESS_DENIED        = 0x00000005
+)
+
+// ErrAccessDenied is returned when the user is authenticated but not
+// allowed to log on the server
+var ErrAccessDenied = errors.New("NODE_RDP_PROTOCOL_TPKT_ACCESS_DENIED")
+
 /**
  * TPKT layer of rdp stack
  */
 type TPKT struct {
 	emission.Emitter
 	Conn             *core.SocketLayer
-	ntlm             *nla.NTLMv2
+	auth             nla.Authenticator
 	secFlag          byte
 	lastShortLength  int
 	fastPathListener core.FastPathListener
-	ntlmSec          *nla.NTLMv2Security
+	credsspVersion   int
+	clientNonce      []byte
+	pubKey           []byte
+	restrictedAdmin  bool
 }
 
-func New(s *core.SocketLayer, ntlm *nla.NTLMv2) *TPKT {
+func New(s *core.SocketLayer, auth nla.Authenticator) *TPKT {
 	t := &TPKT{
 		Emitter: *emission.NewEmitter(),
 		Conn:    s,
 		secFlag: 0,
-		ntlm:    ntlm}
+		auth:    auth}
 	core.StartReadBytes(2, s, t.recvHeader)
 	return t
 }
 
+// SetRestrictedAdmin sends empty credentials at the end of CredSSP
+// so that the user password is not delegated to the server
+func (t *TPKT) SetRestrictedAdmin(b bool) {
+	t.restrictedAdmin = b
+}
+
 func (t *TPKT) StartTLS() error {
-	return t.Conn.StartTLS()
+	err := t.Conn.StartTLS()
+	if err != nil {
+		return err
+	}
+	t.Emit("tls")
+	return nil
 }
 
 func (t *TPKT) StartNLA() error {
@@ -57,79 +90,141 @@ func (t *TPKT) StartNLA() error {
 		glog.Info("start tls failed", err)
 		return err
 	}
-	req := nla.EncodeDERTRequest([]nla.Message{t.ntlm.GetNegotiateMessage()}, nil, nil)
-	_, err = t.Conn.Write(req)
+	// get pubkey
+	t.pubKey, err = t.Conn.TlsPubKey()
 	if err != nil {
-		glog.Info("send NegotiateMessage", err)
 		return err
 	}
+	glog.Debugf("pubkey=%+v", t.pubKey)
+	t.credsspVersion = nla.CREDSSP_VERSION
 
-	resp := make([]byte, 1024)
-	n, err := t.Conn.Read(resp)
-	if err != nil {
-		return fmt.Errorf("read %s", err)
-	} else {
-		glog.Debug("StartNLA Read success")
+	var token []byte
+	for {
+		out, done, err := t.auth.InitSecContext(token)
+		if err != nil {
+			return err
+		}
+		if done {
+			return t.sendPubKeyAuth(out)
+		}
+		req := nla.EncodeDERTRequestV(t.credsspVersion, out, nil, nil, nil)
+		_, err = t.Conn.Write(req)
+		if err != nil {
+			glog.Info("send nego token", err)
+			return err
+		}
+		token, err = t.recvNegoToken()
+		if err != nil {
+			return err
+		}
 	}
-	return t.recvChallenge(resp[:n])
 }
 
-func (t *TPKT) recvChallenge(data []byte) error {
-	glog.Trace("recvChallenge", hex.EncodeToString(data))
-	tsreq, err := nla.DecodeDERTRequest(data)
+// readTSRequest reads a whole TSRequest, which may span several TLS
+// records, with the length of its DER header
+func (t *TPKT) readTSRequest() (*nla.TSRequest, error) {
+	buff := &bytes.Buffer{}
+	r := io.TeeReader(t.Conn, buff)
+	if _, err := core.ReadUInt8(r); err != nil {
+		return nil, fmt.Errorf("read %s", err)
+	}
+	size, err := ber.ReadLength(r)
+	if err != nil {
+		return nil, fmt.Errorf("read %s", err)
+	}
+	if _, err = io.CopyN(buff, t.Conn, int64(size)); err != nil {
+		return nil, fmt.Errorf("read %s", err)
+	}
+	resp := buff.Bytes()
+	glog.Trace("readTSRequest", hex.EncodeToString(resp))
+	tsreq, err := nla.DecodeDERTRequest(resp)
 	if err != nil {
 		glog.Info("DecodeDERTRequest", err)
-		return err
+		return nil, err
 	}
 	glog.Debugf("tsreq:%+v", tsreq)
-	// get pubkey
-	pubkey, err := t.Conn.TlsPubKey()
-	glog.Debugf("pubkey=%+v", pubkey)
+	return tsreq, tsreq.Err()
+}
 
-	authMsg, ntlmSec := t.ntlm.GetAuthenticateMessage(tsreq.NegoTokens[0].Data)
-	t.ntlmSec = ntlmSec
+func (t *TPKT) recvNegoToken() ([]byte, error) {
+	tsreq, err := t.readTSRequest()
+	if err != nil {
+		return nil, err
+	}
+	if len(tsreq.NegoTokens) == 0 {
+		return nil, errors.New("credssp: no nego token from server")
+	}
+	if tsreq.Version < t.credsspVersion {
+		t.credsspVersion = tsreq.Version
+	}
+	return tsreq.NegoTokens[0].Data, nil
+}
+
+func (t *TPKT) sendPubKeyAuth(token []byte) error {
+	if t.credsspVersion >= 5 {
+		t.clientNonce = make([]byte, 32)
+		if _, err := rand.Read(t.clientNonce); err != nil {
+			return err
+		}
+	}
 
-	encryptPubkey := ntlmSec.GssEncrypt(pubkey)
-	req := nla.EncodeDERTRequest([]nla.Message{authMsg}, nil, encryptPubkey)
-	_, err = t.Conn.Write(req)
+	encryptPubkey := t.auth.GssEncrypt(nla.ClientPubKeyAuth(t.credsspVersion, t.clientNonce, t.pubKey))
+	req := nla.EncodeDERTRequestV(t.credsspVersion, token, nil, encryptPubkey, t.clientNonce)
+	_, err := t.Conn.Write(req)
 	if err != nil {
 		glog.Info("send AuthenticateMessage", err)
 		return err
 	}
-	resp := make([]byte, 1024)
-	n, err := t.Conn.Read(resp)
+	tsreq, err := t.readTSRequest()
 	if err != nil {
-		glog.Error("Read:", err)
-		return fmt.Errorf("read %s", err)
-	} else {
-		glog.Debug("recvChallenge Read success")
+		return err
 	}
-	return t.recvPubKeyInc(resp[:n])
+	return t.recvPubKeyInc(tsreq)
 }
 
-func (t *TPKT) recvPubKeyInc(data []byte) error {
-	glog.Trace("recvPubKeyInc", hex.EncodeToString(data))
-	tsreq, err := nla.DecodeDERTRequest(data)
-	if err != nil {
-		glog.Info("DecodeDERTRequest", err)
+func (t *TPKT) recvPubKeyInc(tsreq *nla.TSRequest) error {
+	glog.Trace("PubKeyAuth:", tsreq.PubKeyAuth)
+	auth := t.auth.GssDecrypt(tsreq.PubKeyAuth)
+	if auth == nil {
+		return nla.ErrPubKeyAuth
+	}
+	if err := nla.CheckServerPubKeyAuth(t.credsspVersion, t.clientNonce, t.pubKey, auth); err != nil {
 		return err
 	}
-	glog.Trace("PubKeyAuth:", tsreq.PubKeyAuth)
-	//ignore
-	//pubkey := t.ntlmSec.GssDecrypt([]byte(tsreq.PubKeyAuth))
-	domain, username, password := t.ntlm.GetEncodedCredentials()
+	var domain, username, password []byte
+	if !t.restrictedAdmin {
+		domain, username, password = t.auth.GetEncodedCredentials()
+	}
 	credentials := nla.EncodeDERTCredentials(domain, username, password)
-	authInfo := t.ntlmSec.GssEncrypt(credentials)
-	req := nla.EncodeDERTRequest(nil, authInfo, nil)
-	_, err = t.Conn.Write(req)
+	authInfo := t.auth.GssEncrypt(credentials)
+	req := nla.EncodeDERTRequestV(t.credsspVersion, nil, authInfo, nil, nil)
+	_, err := t.Conn.Write(req)
 	if err != nil {
-		glog.Info("send AuthenticateMessage", err)
+		glog.Info("send TSCredentials", err)
 		return err
 	}
 
 	return nil
 }
 
+// RecvEarlyUserAuthResult reads the authorization result following
+// StartNLA when PROTOCOL_HYBRID_EX is selected
+func (t *TPKT) RecvEarlyUserAuthResult() error {
+	b, err := core.ReadBytes(4, t.Conn)
+	if err != nil {
+		return fmt.Errorf("read early user authorization result %s", err)
+	}
+	result := binary.LittleEndian.Uint32(b)
+	glog.Debug("early user authorization result:", result)
+	switch result {
+	case AUTHZ_SUCCESS:
+		return nil
+	case AUTHZ_ACCESS_DENIED:
+		return ErrAccessDenied
+	}
+	return fmt.Errorf("unknown early user authorization result 0x%08x", result)
+}
+
 func (t *TPKT) Read(b []byte) (n int, err error) {
 	return t.Conn.Read(b)
 }
@@ -187,6 +282,7 @@ func (t *TPKT) recvHeader(s []byte, err error) {
 func (t *TPKT) recvExtendedHeader(s []byte, err error) {
 	glog.Trace("tpkt recvExtendedHeader", hex.EncodeToString(s), err)
 	if err != nil {
+		t.Emit("error", err)
 		return
 	}
 	r := bytes.NewReader(s)
@@ -198,6 +294,7 @@ func (t *TPKT) recvExtendedHeader(s []byte, err error) {
 func (t *TPKT) recvData(s []byte, err error) {
 	glog.Trace("tpkt recvData", hex.EncodeToString(s), err)
 	if err != nil {
+		t.Emit("error", err)
 		return
 	}
 	t.Emit("data", s)
@@ -205,13 +302,13 @@ func (t *TPKT) recvData(s []byte, err error) {
 }
 
 func (t *TPKT) recvExtendedFastPathHeader(s []byte, err error) {
-	glog.Trace("tpkt recvExtendedFastPathHeader", hex.EncodeToString(s))
-	r := bytes.NewReader(s)
-	rightPart, err := core.ReadUInt8(r)
+	glog.Trace("tpkt recvExtendedFastPathHeader", hex.EncodeToString(s), err)
 	if err != nil {
-		glog.Error("TPTK recvExtendedFastPathHeader", err)
+		t.Emit("error", err)
 		return
 	}
+	r := bytes.NewReader(s)
+	rightPart, _ := core.ReadUInt8(r)
 
 	leftPart := t.lastShortLength & ^0x80
 	packetSize := (leftPart << 8) + int(rightPart)
@@ -221,6 +318,7 @@ func (t *TPKT) recvExtendedFastPathHeader(s []byte, err error) {
 func (t *TPKT) recvFastPath(s []byte, err error) {
 	glog.Trace("tpkt recvFastPath")
 	if err != nil {
+		t.Emit("error", err)
 		return
 	}
 
@@ -0,0 +1,105 @@
+// tpkt_test.go
+package tpkt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tomatome/grdp/core"
+	"github.com/tomatome/grdp/glog"
+	"github.com/tomatome/grdp/protocol/nla"
+)
+
+// pipe returns a TPKT layer reading from the server end of a pipe
+func pipe() (*TPKT, net.Conn) {
+	glog.SetLevel(glog.NONE)
+	client, server := net.Pipe()
+	return New(core.NewSocketLayer(client), nil), server
+}
+
+func TestRecvTruncated(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"extended header": {FASTPATH_ACTION_X224, 0, 0},
+		"x224 data":       {FASTPATH_ACTION_X224, 0, 0, 8, 1, 2},
+		"fast-path":       {FASTPATH_ACTION_FASTPATH, 8, 1, 2},
+		"fast-path size":  {FASTPATH_ACTION_FASTPATH, 0x81},
+	} {
+		tp, server := pipe()
+		errc := make(chan error, 1)
+		tp.On("error", func(err error) {
+			errc <- err
+		})
+		go func() {
+			server.Write(data)
+			server.Close()
+		}()
+		select {
+		case err := <-errc:
+			if err == nil {
+				t.Errorf("%s: nil error", name)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestReadTSRequest(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	client, server := net.Pipe()
+	defer server.Close()
+	tp := &TPKT{Conn: core.NewSocketLayer(client), credsspVersion: nla.CREDSSP_VERSION}
+
+	// larger than a read and written in several parts
+	token := bytes.Repeat([]byte{0x5a}, 2000)
+	req := nla.EncodeDERTRequestV(nla.CREDSSP_VERSION, token, nil, nil, nil)
+	go func() {
+		b := req
+		for len(b) > 100 {
+			server.Write(b[:100])
+			b = b[100:]
+		}
+		server.Write(b)
+	}()
+	got, err := tp.recvNegoToken()
+	if err != nil || !bytes.Equal(got, token) {
+		t.Fatalf("%d bytes, %v", len(got), err)
+	}
+
+	go func() {
+		server.Write(req[:len(req)-1])
+		server.Close()
+	}()
+	if _, err = tp.recvNegoToken(); err == nil {
+		t.Error("truncated request")
+	}
+}
+
+func TestRecvEarlyUserAuthResult(t *testing.T) {
+	glog.SetLevel(glog.NONE)
+	for _, c := range []struct {
+		result     uint32
+		ok, denied bool
+	}{
+		{AUTHZ_SUCCESS, true, false},
+		{AUTHZ_ACCESS_DENIED, false, true},
+		{0x1234, false, false},
+	} {
+		client, server := net.Pipe()
+		tp := &TPKT{Conn: core.NewSocketLayer(client)}
+		go func(result uint32) {
+			b := make([]byte, 4)
+			binary.LittleEndian.PutUint32(b, result)
+			server.Write(b)
+		}(c.result)
+		err := tp.RecvEarlyUserAuthResult()
+		if (err == nil) != c.ok || errors.Is(err, ErrAccessDenied) != c.denied {
+			t.Errorf("result 0x%x: %v", c.result, err)
+		}
+		server.Close()
+	}
+}
@@ -51,6 +51,56 @@ const (
 	PROTOCOL_HYBRID_EX        = 0x00000008
 )
 
+/**
+ * Preconnection PDU, sent on the raw socket before the connection
+ * request to name the target of a Hyper-V host or a broker
+ * @see MS-RDPBCGR 2.2.14 Preconnection PDU
+ */
+const (
+	PRECONNECTION_PDU_V1 uint32 = 0x00000001
+	PRECONNECTION_PDU_V2        = 0x00000002
+)
+
+type PreconnectionPDU struct {
+	Id uint32
+	// wide-string blob of version 2, a VM id for Hyper-V
+	Blob string
+}
+
+func (p *PreconnectionPDU) Serialize() []byte {
+	version := PRECONNECTION_PDU_V1
+	var blob []byte
+	if p.Blob != "" {
+		version = PRECONNECTION_PDU_V2
+		blob = core.UnicodeEncode(p.Blob + "\x00")
+	}
+	size := 16
+	if version == PRECONNECTION_PDU_V2 {
+		size += 2 + len(blob)
+	}
+
+	buff := &bytes.Buffer{}
+	core.WriteUInt32LE(uint32(size), buff)
+	core.WriteUInt32LE(0, buff) // flags
+	core.WriteUInt32LE(version, buff)
+	core.WriteUInt32LE(p.Id, buff)
+	if version == PRECONNECTION_PDU_V2 {
+		core.WriteUInt16LE(uint16(len(blob)/2), buff) // cchPCB
+		buff.Write(blob)
+	}
+	return buff.Bytes()
+}
+
+/**
+ * Flags of the RDP_NEG_REQ
+ * @see https://learn.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/902b090b-9cb3-4efc-92bf-ee13373371e3
+ */
+const (
+	RESTRICTED_ADMIN_MODE_REQUIRED          = 0x01
+	REDIRECTED_AUTHENTICATION_MODE_REQUIRED = 0x02
+	CORRELATION_INFO_PRESENT                = 0x08
+)
+
 /**
  * Use to negotiate security layer of RDP stack
  * In node-rdpjs only ssl is available
@@ -92,6 +142,54 @@ const (
 	SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER = 0x00000006
 )
 
+/**
+ * Reported through the error event when the server answers with TYPE_RDP_NEG_FAILURE
+ * @see http://msdn.microsoft.com/en-us/library/cc240507.aspx
+ */
+type NegotiationError struct {
+	RequestedProtocol uint32
+	Code              uint32
+}
+
+func (e *NegotiationError) Error() string {
+	return fmt.Sprintf("NODE_RDP_PROTOCOL_X224_NEG_FAILURE with code: %d", e.Code)
+}
+
+// acceptable tells if requesting protocol may succeed where the
+// server answered with the failure code
+func acceptable(protocol uint32, code uint32) bool {
+	switch code {
+	case SSL_REQUIRED_BY_SERVER:
+		return protocol&PROTOCOL_SSL != 0
+	case SSL_NOT_ALLOWED_BY_SERVER, SSL_CERT_NOT_ON_SERVER:
+		return protocol == PROTOCOL_RDP
+	case HYBRID_REQUIRED_BY_SERVER:
+		return protocol&(PROTOCOL_HYBRID|PROTOCOL_HYBRID_EX) != 0
+	case INCONSISTENT_FLAGS:
+		return true
+	}
+	// SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER, no client certificate support
+	return false
+}
+
+// NextProtocol walks the fallback policy in order and returns the first
+// protocol set not tried yet that can satisfy the failure code
+func NextProtocol(policy []uint32, tried []uint32, code uint32) (uint32, bool) {
+	for _, p := range policy {
+		done := false
+		for _, t := range tried {
+			if t == p {
+				done = true
+				break
+			}
+		}
+		if !done && acceptable(p, code) {
+			return p, true
+		}
+	}
+	return 0, false
+}
+
 /**
  * X224 client connection request
  * @param opt {object} component type options
@@ -181,6 +279,9 @@ type X224 struct {
 	transport         core.Transport
 	requestedProtocol uint32
 	selectedProtocol  uint32
+	negFlags          uint8
+	cookie            []byte
+	preconnection     *PreconnectionPDU
 	dataHeader        *DataHeader
 }
 
@@ -188,8 +289,11 @@ func New(t core.Transport) *X224 {
 	x := &X224{
 		*emission.NewEmitter(),
 		t,
-		PROTOCOL_RDP | PROTOCOL_SSL | PROTOCOL_HYBRID,
+		PROTOCOL_RDP | PROTOCOL_SSL | PROTOCOL_HYBRID | PROTOCOL_HYBRID_EX,
 		PROTOCOL_SSL,
+		0,
+		[]byte("Cookie: mstshash=test"),
+		nil,
 		NewDataHeader(),
 	}
 
@@ -226,13 +330,53 @@ func (x *X224) SetRequestedProtocol(p uint32) {
 	x.requestedProtocol = p
 }
 
+// SetCookie sets the user name of the mstshash cookie, used by
+// load balancers to route the connection
+func (x *X224) SetCookie(user string) {
+	x.cookie = []byte("Cookie: mstshash=" + user)
+}
+
+// SetRoutingToken sends token instead of the cookie, it is the load
+// balance info of a server redirection or of a connection broker
+func (x *X224) SetRoutingToken(token []byte) {
+	x.cookie = bytes.TrimRight(token, "\r\n")
+}
+
+// SetPreconnection sends p before the connection request, nil disables it
+func (x *X224) SetPreconnection(p *PreconnectionPDU) {
+	x.preconnection = p
+}
+
+// SetRestrictedAdmin asks the server for Restricted Admin mode,
+// the server refuses the connection if it does not support it
+func (x *X224) SetRestrictedAdmin(b bool) {
+	if b {
+		x.negFlags |= RESTRICTED_ADMIN_MODE_REQUIRED
+	} else {
+		x.negFlags &^= RESTRICTED_ADMIN_MODE_REQUIRED
+	}
+}
+
+func (x *X224) SelectedProtocol() uint32 {
+	return x.selectedProtocol
+}
+
 func (x *X224) Connect() error {
 	if x.transport == nil {
 		return errors.New("no transport")
 	}
-	cookie := "Cookie: mstshash=test"
-	message := NewClientConnectionRequestPDU([]byte(cookie), x.requestedProtocol)
+	// the whole TPDU length must fit in one byte
+	if len(x.cookie) > 255-6-2-8 {
+		return errors.New("x224 cookie or routing token too long")
+	}
+	if x.preconnection != nil {
+		if err := x.sendPreconnection(); err != nil {
+			return err
+		}
+	}
+	message := NewClientConnectionRequestPDU(x.cookie, x.requestedProtocol)
 	message.ProtocolNeg.Type = TYPE_RDP_NEG_REQ
+	message.ProtocolNeg.Flag = x.negFlags
 	message.ProtocolNeg.Result = uint32(x.requestedProtocol)
 
 	glog.Debug("x224 sendConnectionRequest", hex.EncodeToString(message.Serialize()))
@@ -241,6 +385,18 @@ func (x *X224) Connect() error {
 	return err
 }
 
+// sendPreconnection writes the Preconnection PDU without TPKT header
+func (x *X224) sendPreconnection() error {
+	t, ok := x.transport.(*tpkt.TPKT)
+	if !ok {
+		return errors.New("preconnection PDU needs a tpkt transport")
+	}
+	b := x.preconnection.Serialize()
+	glog.Debug("x224 sendPreconnectionPDU", hex.EncodeToString(b))
+	_, err := t.Conn.Write(b)
+	return err
+}
+
 func (x *X224) recvConnectionConfirm(s []byte) {
 	glog.Debug("x224 recvConnectionConfirm ", hex.EncodeToString(s))
 	r := bytes.NewReader(s)
@@ -249,6 +405,7 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		message := &ServerConnectionConfirm{}
 		if err := struc.Unpack(bytes.NewReader(s), message); err != nil {
 			glog.Error("ReadServerConnectionConfirm err", err)
+			x.Emit("error", fmt.Errorf("ReadServerConnectionConfirm %v", err))
 			return
 		}
 		glog.Debugf("message: %+v", *message.ProtocolNeg)
@@ -259,6 +416,7 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 			if message.ProtocolNeg.Result == 2 {
 				glog.Info("Only use Standard RDP Security mechanisms, Reconnect with Standard RDP")
 			}
+			x.Emit("error", &NegotiationError{x.requestedProtocol, message.ProtocolNeg.Result})
 			x.Close()
 			return
 		}
@@ -271,11 +429,7 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		x.selectedProtocol = PROTOCOL_RDP
 	}
 
-	if x.selectedProtocol == PROTOCOL_HYBRID_EX {
-		glog.Error("NODE_RDP_PROTOCOL_HYBRID_EX_NOT_SUPPORTED")
-		return
-	}
-
+	x.Emit("negotiate", x.selectedProtocol)
 	x.transport.On("data", x.recvData)
 
 	if x.selectedProtocol == PROTOCOL_RDP {
@@ -289,6 +443,7 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		err := x.transport.(*tpkt.TPKT).StartTLS()
 		if err != nil {
 			glog.Error("start tls failed:", err)
+			x.Emit("error", err)
 			return
 		}
 		x.Emit("connect", x.selectedProtocol)
@@ -300,6 +455,23 @@ func (x *X224) recvConnectionConfirm(s []byte) {
 		err := x.transport.(*tpkt.TPKT).StartNLA()
 		if err != nil {
 			glog.Error("start NLA failed:", err)
+			x.Emit("error", err)
+			return
+		}
+		x.Emit("connect", x.selectedProtocol)
+		return
+	}
+
+	if x.selectedProtocol == PROTOCOL_HYBRID_EX {
+		glog.Info("*** NLA Security with Early User Authorization selected ***")
+		t := x.transport.(*tpkt.TPKT)
+		err := t.StartNLA()
+		if err == nil {
+			err = t.RecvEarlyUserAuthResult()
+		}
+		if err != nil {
+			glog.Error("start NLA failed:", err)
+			x.Emit("error", err)
 			return
 		}
 		x.Emit("connect", x.selectedProtocol)
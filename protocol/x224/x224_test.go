@@ -0,0 +1,39 @@
+package x224_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tomatome/grdp/protocol/x224"
+)
+
+func TestNextProtocol(t *testing.T) {
+	policy := []uint32{x224.PROTOCOL_HYBRID, x224.PROTOCOL_SSL, x224.PROTOCOL_RDP}
+	tried := []uint32{x224.PROTOCOL_SSL | x224.PROTOCOL_HYBRID}
+
+	if p, ok := x224.NextProtocol(policy, tried, x224.SSL_NOT_ALLOWED_BY_SERVER); !ok || p != x224.PROTOCOL_RDP {
+		t.Errorf("SSL_NOT_ALLOWED_BY_SERVER: got %d %v", p, ok)
+	}
+	if p, ok := x224.NextProtocol(policy, tried, x224.HYBRID_REQUIRED_BY_SERVER); !ok || p != x224.PROTOCOL_HYBRID {
+		t.Errorf("HYBRID_REQUIRED_BY_SERVER: got %d %v", p, ok)
+	}
+	tried = append(tried, x224.PROTOCOL_HYBRID)
+	if p, ok := x224.NextProtocol(policy, tried, x224.SSL_REQUIRED_BY_SERVER); !ok || p != x224.PROTOCOL_SSL {
+		t.Errorf("SSL_REQUIRED_BY_SERVER: got %d %v", p, ok)
+	}
+	if _, ok := x224.NextProtocol(policy, tried, x224.SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER); ok {
+		t.Error("SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER should not fall back")
+	}
+}
+
+func TestPreconnectionPDU(t *testing.T) {
+	v1 := (&x224.PreconnectionPDU{Id: 0x1234}).Serialize()
+	if !bytes.Equal(v1, []byte{16, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0x34, 0x12, 0, 0}) {
+		t.Errorf("unexpected v1 PDU % x", v1)
+	}
+	v2 := (&x224.PreconnectionPDU{Blob: "vm"}).Serialize()
+	want := []byte{24, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 3, 0, 'v', 0, 'm', 0, 0, 0}
+	if !bytes.Equal(v2, want) {
+		t.Errorf("unexpected v2 PDU % x", v2)
+	}
+}